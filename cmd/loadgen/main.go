@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/felixhao/overlord/loadgen"
+	"github.com/felixhao/overlord/proto"
+)
+
+var c = &loadgen.Config{}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of Overlord loadgen:\n")
+	flag.PrintDefaults()
+}
+
+func init() {
+	flag.Usage = usage
+	flag.StringVar(&c.Addr, "addr", "127.0.0.1:21211", "the proxy or server addr driven.")
+	flag.StringVar((*string)(&c.CacheType), "cache-type", string(proto.CacheTypeMemcache), "the cache type, memcache only now.")
+	flag.IntVar(&c.Concurrency, "c", 16, "the concurrent connections.")
+	flag.Int64Var(&c.Requests, "n", 100000, "the total requests, 0 means no limit until duration.")
+	flag.DurationVar(&c.Duration, "d", 0, "the duration, 0 means no limit until requests.")
+	flag.IntVar(&c.Keys, "keys", 10000, "the key space.")
+	flag.StringVar(&c.Dist, "dist", loadgen.DistUniform, "the key distribution, uniform or zipfian.")
+	flag.Float64Var(&c.ZipfS, "zipf-s", 1.1, "the zipfian skew, greater than 1.")
+	flag.IntVar(&c.ValueSize, "value-size", 100, "the value bytes of set.")
+	flag.Float64Var(&c.ReadRatio, "read-ratio", 0.9, "the share of get, the others are set.")
+	flag.DurationVar(&c.Timeout, "timeout", time.Second, "the dial, read and write timeout.")
+}
+
+func main() {
+	flag.Parse()
+	r, err := loadgen.Run(context.Background(), c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loadgen run error:%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("requests:%d errors:%d hits:%d misses:%d elapsed:%v throughput:%.0f/s\n",
+		r.Requests, r.Errors, r.Hits, r.Misses, r.Elapsed, r.Throughput())
+	for _, p := range loadgen.Percentiles {
+		fmt.Printf("p%v:%v\n", p, r.Latencies[p])
+	}
+}
@@ -28,6 +28,7 @@ var (
 	debug    bool
 	pprof    string
 	metrics  bool
+	admin    bool
 	config   string
 	clusters clustersFlag
 )
@@ -57,6 +58,7 @@ func init() {
 	flag.IntVar(&logVl, "log-vl", 0, "log verbose level. high priority than conf.log_vl.")
 	flag.StringVar(&pprof, "pprof", "", "pprof listen addr. high priority than conf.pprof.")
 	flag.BoolVar(&metrics, "metrics", false, "proxy support prometheus metrics and reuse pprof port.")
+	flag.BoolVar(&admin, "admin", false, "proxy support admin API and reuse pprof port.")
 	flag.StringVar(&config, "conf", "", "run with the specific configuration.")
 	flag.Var(&clusters, "cluster", "specify cache cluster configuration.")
 }
@@ -84,6 +86,9 @@ func main() {
 		panic(err)
 	}
 	defer p.Close()
+	if c.Pprof != "" && c.Proxy.UseAdmin {
+		p.Admin(http.DefaultServeMux)
+	}
 	go p.Serve(ccs)
 	// hanlde signal
 	signalHandler()
@@ -121,6 +126,9 @@ func parseConfig() (c *proxy.Config, ccs []*proxy.ClusterConfig) {
 	if metrics {
 		c.Proxy.UseMetrics = metrics
 	}
+	if admin {
+		c.Proxy.UseAdmin = admin
+	}
 	if debug {
 		c.Debug = debug
 	}
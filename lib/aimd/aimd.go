@@ -0,0 +1,180 @@
+package aimd
+
+import (
+	"sync"
+	"time"
+)
+
+const backoffRatio = 0.9
+
+// Limiter limits the concurrent requests by an adaptive limit, like: of one backend. The limit is
+// increased additively when the requests are healthy and use at least half of it, and decreased
+// multiplicatively when any request is dropped or slower than the latency threshold.
+type Limiter struct {
+	min, max  int
+	threshold time.Duration
+	change    func(limit int)
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+
+	size    int
+	depth   func(n int)
+	waiters []*waiter // NOTE: FIFO
+	waiting int       // NOTE: the requests of waiters
+}
+
+// waiter waits for n requests granted at once, ch is closed when granted.
+type waiter struct {
+	n  int
+	ch chan struct{}
+}
+
+// New new a limiter starts with max limit, which is adapted in [min, max]. The change func
+// is called with the limit when changed, can be nil.
+func New(min, max int, threshold time.Duration, change func(limit int)) *Limiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	l := &Limiter{min: min, max: max, threshold: threshold, change: change, limit: float64(max)}
+	if change != nil {
+		change(max)
+	}
+	return l
+}
+
+// Queue sets the size of FIFO queue of the requests waiting for the limit, the depth func
+// is called with the queue depth when changed, can be nil.
+func (l *Limiter) Queue(size int, depth func(n int)) {
+	l.mu.Lock()
+	l.size, l.depth = size, depth
+	l.mu.Unlock()
+}
+
+// Acquire acquires one request, returns false when the in-flight requests reach the limit.
+func (l *Limiter) Acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) || len(l.waiters) > 0 {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// Wait acquires one request like Acquire, but waits in the queue for the released one when the
+// in-flight requests reach the limit. It returns false when the queue is full or timeout.
+func (l *Limiter) Wait(timeout time.Duration) bool {
+	return l.WaitN(1, timeout)
+}
+
+// WaitN acquires n requests at once like Wait, they are granted all or none, so a batch never
+// holds some of the limit while waiting for the rest. The batch over the limit is granted alone
+// when nothing in-flight. The queue not empty is full when the n requests exceed its size.
+func (l *Limiter) WaitN(n int, timeout time.Duration) bool {
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.fits(n) {
+		l.inflight += n
+		l.mu.Unlock()
+		return true
+	}
+	if l.size <= 0 || (l.waiting > 0 && l.waiting+n > l.size) || timeout <= 0 {
+		l.mu.Unlock()
+		return false
+	}
+	w := &waiter{n: n, ch: make(chan struct{})}
+	l.waiters = append(l.waiters, w)
+	l.waiting += n
+	l.queued()
+	l.mu.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ch:
+		return true
+	case <-timer.C:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ww := range l.waiters {
+		if ww == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			l.waiting -= n
+			l.queued()
+			l.grant() // NOTE: the smaller ones behind may fit now
+			return false
+		}
+	}
+	return true // NOTE: granted while timeout
+}
+
+// fits returns whether n requests fit in the limit. The caller must hold l.mu during the call.
+func (l *Limiter) fits(n int) bool {
+	return l.inflight+n <= int(l.limit) || l.inflight == 0
+}
+
+// grant grants the waiters in order under the limit. The caller must hold l.mu during the call.
+func (l *Limiter) grant() {
+	n := 0
+	for n < len(l.waiters) && l.fits(l.waiters[n].n) {
+		w := l.waiters[n]
+		l.inflight += w.n
+		l.waiting -= w.n
+		close(w.ch)
+		n++
+	}
+	if n > 0 {
+		l.waiters = append(l.waiters[:0], l.waiters[n:]...)
+		l.queued()
+	}
+}
+
+// queued reports the queue depth. The caller must hold l.mu during the call.
+func (l *Limiter) queued() {
+	if l.depth != nil {
+		l.depth(l.waiting)
+	}
+}
+
+// Release releases the acquired request with its latency, dropped means failed like: timeout.
+func (l *Limiter) Release(rtt time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inflight := l.inflight
+	l.inflight--
+	limit := l.limit
+	if dropped || rtt > l.threshold {
+		limit *= backoffRatio
+		if limit < float64(l.min) {
+			limit = float64(l.min)
+		}
+	} else if inflight*2 >= int(limit) { // NOTE: probe up only when the limit is in use
+		limit++
+		if limit > float64(l.max) {
+			limit = float64(l.max)
+		}
+	}
+	if int(limit) != int(l.limit) && l.change != nil {
+		l.change(int(limit))
+	}
+	l.limit = limit
+	l.grant()
+}
+
+// Depth returns the requests waiting in queue.
+func (l *Limiter) Depth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
@@ -0,0 +1,189 @@
+package aimd_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/lib/aimd"
+)
+
+func TestLimiterAcquire(t *testing.T) {
+	l := aimd.New(1, 2, time.Second, nil)
+	if !l.Acquire() || !l.Acquire() {
+		t.Fatal("acquire under limit should be ok")
+	}
+	if l.Acquire() {
+		t.Error("acquire over limit should fail")
+	}
+	l.Release(time.Millisecond, false)
+	if !l.Acquire() {
+		t.Error("acquire after released should be ok")
+	}
+}
+
+func TestLimiterAdapt(t *testing.T) {
+	var gauge int
+	l := aimd.New(2, 20, 10*time.Millisecond, func(limit int) { gauge = limit })
+	if gauge != 20 {
+		t.Fatalf("initial gauge(%d) want max", gauge)
+	}
+	// NOTE: rising latency shrinks the limit to min
+	last := l.Limit()
+	for i := 0; i < 40; i++ {
+		l.Acquire()
+		l.Release(time.Duration(i+11)*time.Millisecond, false)
+		if limit := l.Limit(); limit > last {
+			t.Fatalf("limit(%d) grown from(%d) while latency rising", limit, last)
+		}
+		last = l.Limit()
+	}
+	if last != 2 || gauge != 2 {
+		t.Fatalf("limit(%d) gauge(%d) want shrunk to min", last, gauge)
+	}
+	l.Acquire()
+	l.Release(time.Millisecond, true)
+	if l.Limit() != 2 {
+		t.Errorf("dropped limit(%d) want kept min", l.Limit())
+	}
+	// NOTE: healthy requests using the limit probe it up to max
+	for i := 0; i < 40; i++ {
+		n := 0
+		for l.Acquire() {
+			n++
+		}
+		for ; n > 0; n-- {
+			l.Release(time.Millisecond, false)
+		}
+	}
+	if l.Limit() != 20 || gauge != 20 {
+		t.Errorf("limit(%d) gauge(%d) want grown to max", l.Limit(), gauge)
+	}
+	// NOTE: the limit not in use is not probed up
+	l = aimd.New(1, 20, 10*time.Millisecond, nil)
+	l.Acquire()
+	l.Release(time.Second, false)
+	for i := 0; i < 10; i++ {
+		l.Acquire()
+		l.Release(time.Millisecond, false)
+	}
+	if l.Limit() != 18 {
+		t.Errorf("idle limit(%d) want not probed up", l.Limit())
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+		gauge int32
+	)
+	l := aimd.New(1, 1, time.Second, nil)
+	l.Queue(3, func(n int) { atomic.StoreInt32(&gauge, int32(n)) })
+	if !l.Acquire() {
+		t.Fatal("acquire under limit should be ok")
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if !l.Wait(time.Second) {
+				t.Errorf("waiter(%d) not granted", i)
+				return
+			}
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+			l.Release(time.Millisecond, false)
+		}(i)
+		for l.Depth() != i+1 { // NOTE: queued in order
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if l.Wait(time.Second) {
+		t.Error("wait on full queue should fail")
+	}
+	if n := atomic.LoadInt32(&gauge); n != 3 {
+		t.Errorf("depth gauge(%d) want 3", n)
+	}
+	if l.Acquire() {
+		t.Error("acquire should not jump the queue")
+	}
+	l.Release(time.Millisecond, false)
+	wg.Wait()
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("drained order(%v) want FIFO", order)
+	}
+	if l.Depth() != 0 || atomic.LoadInt32(&gauge) != 0 {
+		t.Errorf("depth(%d) gauge(%d) want drained", l.Depth(), atomic.LoadInt32(&gauge))
+	}
+	if !l.Acquire() {
+		t.Fatal("acquire after drained should be ok")
+	}
+	start := time.Now()
+	if l.Wait(20 * time.Millisecond) {
+		t.Error("wait over limit should timeout")
+	}
+	if time.Since(start) < 20*time.Millisecond || l.Depth() != 0 {
+		t.Errorf("wait timeout too early or still queued depth(%d)", l.Depth())
+	}
+}
+
+func TestLimiterWaitN(t *testing.T) {
+	l := aimd.New(1, 3, time.Second, nil)
+	l.Queue(4, nil)
+	if !l.WaitN(2, time.Second) {
+		t.Fatal("wait batch under limit should be ok")
+	}
+	granted := make(chan bool, 2)
+	go func() { granted <- l.WaitN(2, time.Second) }()
+	for l.Depth() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { granted <- l.Wait(time.Second) }()
+	for l.Depth() != 3 { // NOTE: queued behind the batch, though one is free
+		time.Sleep(time.Millisecond)
+	}
+	if l.WaitN(2, time.Second) {
+		t.Error("wait batch over the queue size should fail")
+	}
+	l.Release(time.Millisecond, false)
+	if !<-granted {
+		t.Fatal("batch not granted once fits")
+	}
+	if l.Depth() != 1 {
+		t.Errorf("depth(%d) want the single one queued", l.Depth())
+	}
+	l.Release(time.Millisecond, false)
+	if !<-granted {
+		t.Fatal("single not granted after the batch")
+	}
+	for i := 0; i < 3; i++ {
+		l.Release(time.Millisecond, false)
+	}
+	// NOTE: the batch over the limit is granted alone
+	if !l.WaitN(5, time.Second) {
+		t.Error("wait batch over limit should be granted when idle")
+	}
+	if l.Acquire() {
+		t.Error("acquire should fail while the large batch in-flight")
+	}
+	// NOTE: the batch timeout grants the smaller ones behind it
+	for i := 0; i < 4; i++ {
+		l.Release(time.Millisecond, false)
+	}
+	go func() { granted <- l.WaitN(3, 20*time.Millisecond) }()
+	for l.Depth() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { granted <- l.Wait(time.Second) }()
+	for l.Depth() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	got1, got2 := <-granted, <-granted
+	if got1 || !got2 || l.Depth() != 0 {
+		t.Errorf("batch granted(%v) single granted(%v) depth(%d) want batch timeout then single", got1, got2, l.Depth())
+	}
+}
@@ -35,6 +35,26 @@ func NewReaderSize(rd io.Reader, size int) *Reader {
 	return &Reader{rd: rd, buf: make([]byte, size)}
 }
 
+// Reset discards any buffered data and error, and rebinds the buffer to read from rd,
+// like: the buffer of a closed connection reused by a new one.
+func (b *Reader) Reset(rd io.Reader) {
+	b.rd = rd
+	b.err = nil
+	b.rpos, b.wpos = 0, 0
+	b.slice = SliceAlloc{} // NOTE: the sliced bytes may be still held by the read results
+}
+
+// ResetErr clears the read error, the buffered bytes are kept. Like: the read timeout
+// tolerated, the reader can read again.
+func (b *Reader) ResetErr() {
+	b.err = nil
+}
+
+// Size returns the size of the underlying buffer in bytes.
+func (b *Reader) Size() int {
+	return len(b.buf)
+}
+
 func (b *Reader) fill() error {
 	if b.err != nil {
 		return b.err
@@ -45,12 +65,11 @@ func (b *Reader) fill() error {
 		b.wpos = n
 	}
 	n, err := b.rd.Read(b.buf[b.wpos:])
+	b.wpos += n // NOTE: the bytes read along with error are still buffered
 	if err != nil {
 		b.err = err
 	} else if n == 0 {
 		b.err = io.ErrNoProgress
-	} else {
-		b.wpos += n
 	}
 	return b.err
 }
@@ -59,16 +78,24 @@ func (b *Reader) buffered() int {
 	return b.wpos - b.rpos
 }
 
+// Buffered returns the number of bytes that can be read from the current buffer.
+func (b *Reader) Buffered() int {
+	return b.buffered()
+}
+
 // Read reads data into p.
 // It returns the number of bytes read into p.
 // The bytes are taken from at most one Read on the underlying Reader,
 // hence n may be less than len(p).
 // At EOF, the count will be zero and err will be io.EOF.
 func (b *Reader) Read(p []byte) (int, error) {
-	if b.err != nil || len(p) == 0 {
+	if len(p) == 0 {
 		return 0, b.err
 	}
 	if b.buffered() == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
 		if len(p) >= len(b.buf) {
 			n, err := b.rd.Read(p)
 			if err != nil {
@@ -76,7 +103,7 @@ func (b *Reader) Read(p []byte) (int, error) {
 			}
 			return n, b.err
 		}
-		if b.fill() != nil {
+		if b.fill(); b.buffered() == 0 {
 			return 0, b.err
 		}
 	}
@@ -88,11 +115,8 @@ func (b *Reader) Read(p []byte) (int, error) {
 // ReadByte reads and returns a single byte.
 // If no byte is available, returns an error.
 func (b *Reader) ReadByte() (byte, error) {
-	if b.err != nil {
-		return 0, b.err
-	}
 	if b.buffered() == 0 {
-		if b.fill() != nil {
+		if b.fill(); b.buffered() == 0 {
 			return 0, b.err
 		}
 	}
@@ -111,9 +135,6 @@ func (b *Reader) ReadByte() (byte, error) {
 // by the next I/O operation, most clients should use ReadBytes instead.
 // ReadSlice returns err != nil if and only if line does not end in delim.
 func (b *Reader) ReadSlice(delim byte) ([]byte, error) {
-	if b.err != nil {
-		return nil, b.err
-	}
 	for {
 		var index = bytes.IndexByte(b.buf[b.rpos:b.wpos], delim)
 		if index >= 0 {
@@ -126,9 +147,10 @@ func (b *Reader) ReadSlice(delim byte) ([]byte, error) {
 			b.rpos = b.wpos
 			return b.buf, bufio.ErrBufferFull
 		}
-		if b.fill() != nil {
+		if b.err != nil {
 			return nil, b.err
 		}
+		b.fill() // NOTE: the bytes read along with error are searched before it returned
 	}
 }
 
@@ -171,9 +193,10 @@ func (b *Reader) ReadBytes(delim byte) ([]byte, error) {
 // The error is EOF only if no bytes were read.
 // If an EOF happens after reading some but not all the bytes,
 // ReadFull returns ErrUnexpectedEOF.
-// On return, n == len(buf) if and only if err == nil.
+// On return, n == len(buf) if and only if err == nil, the partial bytes of
+// a short read are never returned.
 func (b *Reader) ReadFull(n int) ([]byte, error) {
-	if b.err != nil || n == 0 {
+	if n == 0 {
 		return nil, b.err
 	}
 	var buf = b.slice.Make(n)
@@ -212,6 +235,18 @@ func NewWriterSize(wr io.Writer, size int) *Writer {
 	return &Writer{wr: wr, buf: make([]byte, size)}
 }
 
+// Reset discards any unflushed data and error, and rebinds the buffer to write to wr.
+func (b *Writer) Reset(wr io.Writer) {
+	b.wr = wr
+	b.err = nil
+	b.wpos = 0
+}
+
+// Size returns the size of the underlying buffer in bytes.
+func (b *Writer) Size() int {
+	return len(b.buf)
+}
+
 // Flush writes any buffered data to the underlying io.Writer.
 func (b *Writer) Flush() error {
 	return b.flush()
@@ -6,6 +6,7 @@ import (
 	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/felixhao/overlord/lib/bufio"
 )
@@ -94,6 +95,69 @@ func TestReadFull(t *testing.T) {
 	}
 }
 
+// chunkReader returns the input by chunks of at most size, the last chunk along with io.EOF.
+type chunkReader struct {
+	input []byte
+	size  int
+	reads int
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	r.reads++
+	if len(r.input) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > r.size {
+		p = p[:r.size]
+	}
+	n = copy(p, r.input)
+	if r.input = r.input[n:]; len(r.input) == 0 {
+		err = io.EOF
+	}
+	return
+}
+
+func TestReadFullAcrossFills(t *testing.T) {
+	input := bytes.Repeat([]byte("0123456789"), 100)
+	for _, size := range []int{1, 7, 64, 1000} {
+		// NOTE: the header line is buffered first, the value spans many fills
+		cr := &chunkReader{input: append([]byte("VALUE a 0 1000\r\n"), input...), size: size}
+		r := bufio.NewReaderSize(cr, 16)
+		if line, err := r.ReadSlice('\n'); err != nil || string(line) != "VALUE a 0 1000\r\n" {
+			t.Fatalf("size(%d) read line(%q) error:%v", size, line, err)
+		}
+		b, err := r.ReadFull(len(input))
+		if err != nil {
+			t.Fatalf("size(%d) read full error:%v", size, err)
+		}
+		if !bytes.Equal(b, input) {
+			t.Fatalf("size(%d) read full(%q) not integral", size, b)
+		}
+		if size < len(input) && cr.reads < 2 {
+			t.Errorf("size(%d) reads(%d) want multiple reads", size, cr.reads)
+		}
+		if _, err = r.ReadByte(); err != io.EOF {
+			t.Errorf("size(%d) read after full error(%v) want EOF", size, err)
+		}
+	}
+	r := bufio.NewReaderSize(iotest.DataErrReader(iotest.OneByteReader(bytes.NewReader(input))), 16)
+	if b, err := r.ReadFull(len(input)); err != nil || !bytes.Equal(b, input) {
+		t.Errorf("data along with EOF read full(%q) error:%v", b, err)
+	}
+}
+
+func TestReadFullShort(t *testing.T) {
+	cr := &chunkReader{input: []byte("0123456789"), size: 3}
+	r := bufio.NewReaderSize(cr, 4)
+	b, err := r.ReadFull(12)
+	if err != io.ErrUnexpectedEOF || b != nil {
+		t.Fatalf("short read full(%q) error(%v) want nil and unexpected EOF", b, err)
+	}
+	if b, err = r.ReadFull(1); err != io.EOF || b != nil {
+		t.Errorf("read full after short(%q) error(%v) want EOF", b, err)
+	}
+}
+
 func newWriter(n int, b *bytes.Buffer) *bufio.Writer {
 	return bufio.NewWriterSize(b, n)
 }
@@ -161,3 +225,31 @@ func TestWriteString(t *testing.T) {
 		}
 	}
 }
+
+func TestReset(t *testing.T) {
+	r := newReader(8, "hello\r\nworld")
+	if _, err := r.ReadBytes('\n'); err != nil {
+		t.Fatalf("read bytes error:%v", err)
+	}
+	if _, err := r.ReadBytes('\n'); err != io.EOF {
+		t.Fatalf("read bytes error(%v) want EOF", err)
+	}
+	r.Reset(strings.NewReader("again\r\n"))
+	if bs, err := r.ReadBytes('\n'); err != nil || string(bs) != "again\r\n" {
+		t.Fatalf("read bytes(%q) error(%v) after reset, want the new reader", bs, err)
+	}
+	var b1, b2 bytes.Buffer
+	w := newWriter(16, &b1)
+	w.WriteString("discarded")
+	w.Reset(&b2)
+	w.WriteString("flushed")
+	if err := w.Flush(); err != nil {
+		t.Fatalf("write flush error:%v", err)
+	}
+	if b1.Len() != 0 || b2.String() != "flushed" {
+		t.Fatalf("writes(%q) (%q) after reset, want only the new writer", b1.String(), b2.String())
+	}
+	if r.Size() != 8 || w.Size() != 16 {
+		t.Fatalf("size(%d) (%d) want the buffer kept", r.Size(), w.Size())
+	}
+}
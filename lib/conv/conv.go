@@ -2,7 +2,16 @@ package conv
 
 import (
 	"bytes"
+	errs "errors"
 	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// errors
+var (
+	ErrBadLength      = errs.New("length is not a valid integer")
+	ErrNegativeLength = errs.New("length is negative")
 )
 
 const (
@@ -34,8 +43,8 @@ func init() {
 		switch {
 		case c >= 'A' && c <= 'Z':
 			charmap[i] = c + 'a' - 'A'
-		case c >= 'a' && c <= 'z':
-			charmap[i] = c
+		default:
+			charmap[i] = c // NOTE: keep others, like: '_' of 'overlord_compress'
 		}
 	}
 }
@@ -84,13 +93,28 @@ func Btoi(b []byte) (int64, error) {
 	return n, nil
 }
 
+// ParseLen returns the length value of b, surrounding whitespace and CR are trimmed.
+// The error contains the offending bytes, and a negative length returns ErrNegativeLength.
+func ParseLen(b []byte) (int64, error) {
+	tb := bytes.TrimSpace(b)
+	if len(tb) == 0 {
+		return 0, errors.Wrapf(ErrBadLength, "parse length(%q)", b)
+	}
+	n, err := Btoi(tb)
+	if err != nil {
+		return 0, errors.Wrapf(ErrBadLength, "parse length(%q)", b)
+	}
+	if n < 0 {
+		return 0, errors.Wrapf(ErrNegativeLength, "parse length(%q)", b)
+	}
+	return n, nil
+}
+
 // ToLower returns a copy of the string s with all Unicode letters mapped to their lower case.
 func ToLower(src []byte) []byte {
 	var lower [maxCmdLen]byte
 	for i := range src {
-		if c := charmap[src[i]]; c != 0 {
-			lower[i] = c
-		}
+		lower[i] = charmap[src[i]]
 	}
 	return lower[:len(src)]
 }
@@ -0,0 +1,38 @@
+package conv_test
+
+import (
+	"testing"
+
+	"github.com/felixhao/overlord/lib/conv"
+	"github.com/pkg/errors"
+)
+
+func TestParseLen(t *testing.T) {
+	n, err := conv.ParseLen([]byte(" 3\r"))
+	if err != nil || n != 3 {
+		t.Errorf("parse length got(%d) err(%v) want 3", n, err)
+	}
+	if _, err = conv.ParseLen([]byte("-1")); errors.Cause(err) != conv.ErrNegativeLength {
+		t.Errorf("parse negative length err(%v) want ErrNegativeLength", err)
+	}
+	if _, err = conv.ParseLen([]byte("")); errors.Cause(err) != conv.ErrBadLength {
+		t.Errorf("parse empty length err(%v) want ErrBadLength", err)
+	}
+	if _, err = conv.ParseLen([]byte("1x")); errors.Cause(err) != conv.ErrBadLength {
+		t.Errorf("parse bad length err(%v) want ErrBadLength", err)
+	} else if err.Error() != `parse length("1x"): length is not a valid integer` {
+		t.Errorf("parse bad length err(%v) not contains offending bytes", err)
+	}
+}
+
+func TestToLower(t *testing.T) {
+	for in, want := range map[string]string{
+		"GET":               "get",
+		"Overlord_Compress": "overlord_compress",
+		"cache_memlimit2":   "cache_memlimit2",
+	} {
+		if got := string(conv.ToLower([]byte(in))); got != want {
+			t.Errorf("ToLower(%q) got(%q) want(%q)", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package dialer
+
+import (
+	"net"
+	"time"
+
+	"github.com/felixhao/overlord/lib/resolver"
+	"github.com/pkg/errors"
+)
+
+// DialFunc dials the tcp address 'ip:port' within timeout.
+type DialFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+// Dialer dials the host resolved into both IPv4 and IPv6 addresses by racing them
+// in RFC 8305 (happy eyeballs) style, the first connected one wins and the losers are closed.
+type Dialer struct {
+	timeout time.Duration
+	delay   time.Duration
+	lookup  resolver.LookupFunc
+	dial    DialFunc
+}
+
+// New new a dialer starts the next attempt after delay or the failure of previous one,
+// lookup is net.LookupHost and dial is net.DialTimeout when nil.
+func New(timeout, delay time.Duration, lookup resolver.LookupFunc, dial DialFunc) *Dialer {
+	if lookup == nil {
+		lookup = net.LookupHost
+	}
+	if dial == nil {
+		dial = func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		}
+	}
+	return &Dialer{timeout: timeout, delay: delay, lookup: lookup, dial: dial}
+}
+
+type attempt struct {
+	conn net.Conn
+	err  error
+}
+
+// Dial dials 'host:port', the ip address is dialed directly.
+func (d *Dialer) Dial(addr string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		err = errors.Wrapf(err, "Dialer dial addr(%s)", addr)
+		return
+	}
+	if net.ParseIP(host) != nil {
+		return d.dial(addr, d.timeout)
+	}
+	ips, err := d.lookup(host)
+	if err != nil {
+		err = errors.Wrapf(err, "Dialer lookup host(%s)", host)
+		return
+	}
+	ips = interleave(ips)
+	if len(ips) == 0 {
+		err = errors.Wrapf(&net.DNSError{Err: "no such host", Name: host}, "Dialer lookup host(%s)", host)
+		return
+	}
+	ch := make(chan attempt, len(ips)) // NOTE: buffered, the losers never block
+	next, pending := 0, 0
+	start := func() {
+		raddr := net.JoinHostPort(ips[next], port)
+		next++
+		pending++
+		go func() {
+			c, err := d.dial(raddr, d.timeout)
+			ch <- attempt{conn: c, err: err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(d.delay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case a := <-ch:
+			pending--
+			if a.err == nil {
+				go closeLosers(ch, pending)
+				return a.conn, nil
+			}
+			err = a.err
+			if next < len(ips) {
+				start() // NOTE: failed, start the next one without waiting
+				resetTimer(timer, d.delay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(d.delay)
+			}
+		}
+	}
+	err = errors.Wrapf(err, "Dialer dial addr(%s)", addr)
+	return
+}
+
+// closeLosers closes the connections of pending attempts after the winner returned.
+func closeLosers(ch chan attempt, pending int) {
+	for ; pending > 0; pending-- {
+		if a := <-ch; a.err == nil {
+			a.conn.Close()
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// interleave orders the addresses alternating IPv6 and IPv4 with IPv6 first,
+// so a broken family delays at most one attempt of the other.
+func interleave(ips []string) []string {
+	var v6, v4 []string
+	for _, ip := range ips {
+		p := net.ParseIP(ip)
+		if p == nil {
+			continue
+		}
+		if p.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	res := make([]string, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			res = append(res, v6[i])
+		}
+		if i < len(v4) {
+			res = append(res, v4[i])
+		}
+	}
+	return res
+}
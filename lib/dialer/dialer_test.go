@@ -0,0 +1,109 @@
+package dialer_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/lib/dialer"
+)
+
+// mockConn is the fake connection records whether closed.
+type mockConn struct {
+	net.Conn
+	addr   string
+	closed int32
+}
+
+func (c *mockConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+// mockNet dials every address after its delay, fails when the error set.
+type mockNet struct {
+	lock   sync.Mutex
+	delays map[string]time.Duration
+	errs   map[string]error
+	dialed []string
+	conns  []*mockConn
+}
+
+func (m *mockNet) lookup(host string) ([]string, error) {
+	return []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, nil
+}
+
+func (m *mockNet) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	m.lock.Lock()
+	m.dialed = append(m.dialed, addr)
+	delay, err := m.delays[addr], m.errs[addr]
+	m.lock.Unlock()
+	time.Sleep(delay)
+	if err != nil {
+		return nil, err
+	}
+	c := &mockConn{addr: addr}
+	m.lock.Lock()
+	m.conns = append(m.conns, c)
+	m.lock.Unlock()
+	return c, nil
+}
+
+func TestDialerRace(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	for _, c := range []struct {
+		name   string
+		delays map[string]time.Duration
+		errs   map[string]error
+		want   string
+		dialed int
+		max    time.Duration
+	}{
+		{"ipv6 first", nil, nil, "[fd00::1]:11211", 1, delay},
+		{"ipv6 slow", map[string]time.Duration{"[fd00::1]:11211": 300 * time.Millisecond}, nil, "10.0.0.1:11211", 2, 2 * delay},
+		{"ipv6 broken", nil, map[string]error{"[fd00::1]:11211": errors.New("network unreachable")}, "10.0.0.1:11211", 2, delay / 2},
+	} {
+		m := &mockNet{delays: c.delays, errs: c.errs}
+		d := dialer.New(time.Second, delay, m.lookup, m.dial)
+		now := time.Now()
+		conn, err := d.Dial("cache.local:11211")
+		if err != nil {
+			t.Fatalf("%s dial error:%v", c.name, err)
+		}
+		if took := time.Since(now); took > c.max {
+			t.Errorf("%s dial took(%v) more than(%v)", c.name, took, c.max)
+		}
+		if addr := conn.(*mockConn).addr; addr != c.want {
+			t.Errorf("%s dial addr(%s) want(%s)", c.name, addr, c.want)
+		}
+		time.Sleep(400 * time.Millisecond) // NOTE: wait the losers connected
+		m.lock.Lock()
+		if len(m.dialed) != c.dialed {
+			t.Errorf("%s dialed(%v) want %d attempts", c.name, m.dialed, c.dialed)
+		}
+		for _, mc := range m.conns {
+			if closed := atomic.LoadInt32(&mc.closed) == 1; closed == (mc == conn) {
+				t.Errorf("%s conn(%s) closed(%v), only the losers should be closed", c.name, mc.addr, closed)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func TestDialerAllFailed(t *testing.T) {
+	m := &mockNet{errs: map[string]error{
+		"[fd00::1]:11211": errors.New("network unreachable"),
+		"10.0.0.1:11211":  errors.New("connection refused"),
+		"10.0.0.2:11211":  errors.New("connection refused"),
+	}}
+	d := dialer.New(time.Second, time.Second, m.lookup, m.dial)
+	if _, err := d.Dial("cache.local:11211"); err == nil {
+		t.Error("dial should fail when all addresses failed")
+	}
+	if len(m.dialed) != 3 {
+		t.Errorf("dialed(%v) want all 3 addresses", m.dialed)
+	}
+}
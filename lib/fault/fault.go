@@ -0,0 +1,101 @@
+package fault
+
+import (
+	errs "errors"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// errors
+var (
+	ErrDial = errs.New("fault: injected dial failure")
+)
+
+// Faults are the probabilities of the injected faults in [0, 1], 0 means never and 1 means always.
+type Faults struct {
+	Dial      float64 `json:"dial"`      // NOTE: the dial fails
+	Timeout   float64 `json:"timeout"`   // NOTE: the read times out
+	Malformed float64 `json:"malformed"` // NOTE: the bytes read are corrupted
+}
+
+// Injector injects the faults into the dials and connections of one backend when enabled,
+// like: chaos testing the retry and ejection. The zero value is disabled.
+type Injector struct {
+	lock    sync.RWMutex
+	enabled bool
+	faults  Faults
+}
+
+// New new a disabled injector.
+func New() *Injector {
+	return &Injector{}
+}
+
+// Enable enables the injector by the faults.
+func (i *Injector) Enable(f Faults) {
+	i.lock.Lock()
+	i.enabled, i.faults = true, f
+	i.lock.Unlock()
+}
+
+// Disable disables the injector, the faults are kept.
+func (i *Injector) Disable() {
+	i.lock.Lock()
+	i.enabled = false
+	i.lock.Unlock()
+}
+
+// Faults returns the faults and whether the injector is enabled.
+func (i *Injector) Faults() (f Faults, enabled bool) {
+	i.lock.RLock()
+	f, enabled = i.faults, i.enabled
+	i.lock.RUnlock()
+	return
+}
+
+// hit returns whether the fault of probability p injected now.
+func (i *Injector) hit(p func(f *Faults) float64) bool {
+	i.lock.RLock()
+	enabled, prob := i.enabled, p(&i.faults)
+	i.lock.RUnlock()
+	return enabled && prob > 0 && rand.Float64() < prob
+}
+
+// Dial returns ErrDial when the dial failure injected, the dial must not proceed.
+func (i *Injector) Dial() error {
+	if i.hit(func(f *Faults) float64 { return f.Dial }) {
+		return ErrDial
+	}
+	return nil
+}
+
+// Conn returns a conn the read faults injected into.
+func (i *Injector) Conn(c net.Conn) net.Conn {
+	return &conn{Conn: c, i: i}
+}
+
+type conn struct {
+	net.Conn
+	i *Injector
+}
+
+// Read returns the timeout error without reading when the timeout injected, and corrupts
+// the first byte read when the malformed injected.
+func (c *conn) Read(p []byte) (n int, err error) {
+	if c.i.hit(func(f *Faults) float64 { return f.Timeout }) {
+		return 0, timeoutError{}
+	}
+	n, err = c.Conn.Read(p)
+	if n > 0 && c.i.hit(func(f *Faults) float64 { return f.Malformed }) {
+		p[0] = '?'
+	}
+	return
+}
+
+// timeoutError is the net.Error of the injected read timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "fault: injected read timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,43 @@
+package fault_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/felixhao/overlord/lib/fault"
+)
+
+func TestInjector(t *testing.T) {
+	i := fault.New()
+	if err := i.Dial(); err != nil {
+		t.Fatalf("dial error(%v) want nil when disabled", err)
+	}
+	i.Enable(fault.Faults{Dial: 1, Timeout: 1})
+	if err := i.Dial(); err != fault.ErrDial {
+		t.Fatalf("dial error(%v) want ErrDial", err)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := i.Conn(c1)
+	if _, err := conn.Read(make([]byte, 8)); err == nil {
+		t.Fatal("read want timeout error")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read error(%v) want timeout net.Error", err)
+	}
+	i.Enable(fault.Faults{Malformed: 1})
+	go c2.Write([]byte("END\r\n"))
+	bs := make([]byte, 8)
+	n, err := conn.Read(bs)
+	if err != nil || string(bs[:n]) != "?ND\r\n" {
+		t.Fatalf("read(%q) error(%v) want corrupted", bs[:n], err)
+	}
+	i.Disable()
+	if f, ok := i.Faults(); ok || f.Malformed != 1 {
+		t.Fatalf("faults(%+v) enabled(%v) want kept and disabled", f, ok)
+	}
+	go c2.Write([]byte("END\r\n"))
+	if n, err = conn.Read(bs); err != nil || string(bs[:n]) != "END\r\n" {
+		t.Fatalf("read(%q) error(%v) want intact", bs[:n], err)
+	}
+}
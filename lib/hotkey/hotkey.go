@@ -0,0 +1,179 @@
+package hotkey
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 256 // NOTE: of one shard
+	shards      = 16
+)
+
+// Key is the hot key and its approximate count in window.
+type Key struct {
+	Key   string
+	Count uint32
+}
+
+// Detector detects the hot keys by a count-min sketch, the key counted not less than
+// threshold in one window is hot. At most k hot keys of the window are reported.
+// The hot keys of the last window are still hot in the current window.
+// NOTE: sharded by the key hash, so the concurrent adds of different keys rarely contend.
+// Each shard keeps at most k hot keys, the reported ones are the top k of all shards.
+type Detector struct {
+	threshold uint32
+	k         int
+	window    time.Duration
+	report    func([]Key)
+
+	start  int64 // NOTE: atomic, the unix nano of window started
+	shards [shards]shard
+}
+
+type shard struct {
+	lock   sync.Mutex
+	sketch [sketchDepth][sketchWidth]uint32
+	hot    map[string]uint32
+	last   map[string]uint32
+}
+
+// New new a detector, the report func is called with the hot keys of every window ended, can be nil.
+func New(threshold uint32, k int, window time.Duration, report func([]Key)) *Detector {
+	d := &Detector{
+		threshold: threshold,
+		k:         k,
+		window:    window,
+		report:    report,
+		start:     time.Now().UnixNano(),
+	}
+	for i := range d.shards {
+		d.shards[i].hot = map[string]uint32{}
+	}
+	return d
+}
+
+// Add counts the key, and returns whether the key is hot.
+func (d *Detector) Add(key []byte) bool {
+	h1, h2 := sum(key)
+	d.tick(time.Now())
+	s := &d.shards[(h1>>24)%shards] // NOTE: the high bits, the columns use the low ones
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// NOTE: conservative update, only the min counters are incremented
+	var idx [sketchDepth]uint32
+	min := ^uint32(0)
+	for i := 0; i < sketchDepth; i++ {
+		idx[i] = (h1 + uint32(i)*h2) % sketchWidth
+		if c := s.sketch[i][idx[i]]; c < min {
+			min = c
+		}
+	}
+	min++
+	for i := 0; i < sketchDepth; i++ {
+		if s.sketch[i][idx[i]] < min {
+			s.sketch[i][idx[i]] = min
+		}
+	}
+	if min >= d.threshold {
+		s.promote(string(key), min, d.k)
+		return true
+	}
+	_, ok := s.last[string(key)]
+	return ok
+}
+
+// Hot returns the hot keys of the last window, ordered by count desc.
+func (d *Detector) Hot() []Key {
+	d.tick(time.Now())
+	last := map[string]uint32{}
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.lock.Lock()
+		for k, c := range s.last {
+			last[k] = c
+		}
+		s.lock.Unlock()
+	}
+	return d.top(last)
+}
+
+// tick rotates the window when ended, only one of the concurrent callers rotates.
+func (d *Detector) tick(now time.Time) {
+	start := atomic.LoadInt64(&d.start)
+	if now.UnixNano()-start < int64(d.window) || !atomic.CompareAndSwapInt64(&d.start, start, now.UnixNano()) {
+		return
+	}
+	last := map[string]uint32{}
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.lock.Lock()
+		s.last, s.hot = s.hot, map[string]uint32{}
+		s.sketch = [sketchDepth][sketchWidth]uint32{}
+		for k, c := range s.last {
+			last[k] = c
+		}
+		s.lock.Unlock()
+	}
+	if d.report != nil {
+		d.report(d.top(last))
+	}
+}
+
+// promote keeps the key as hot, evicts the coldest when more than k.
+func (s *shard) promote(key string, count uint32, k int) {
+	if _, ok := s.hot[key]; ok || len(s.hot) < k {
+		s.hot[key] = count
+		return
+	}
+	coldest, cc := "", count
+	for k, c := range s.hot {
+		if c < cc {
+			coldest, cc = k, c
+		}
+	}
+	if coldest != "" {
+		delete(s.hot, coldest)
+		s.hot[key] = count
+	}
+}
+
+// top returns the top k keys ordered by count desc.
+func (d *Detector) top(m map[string]uint32) []Key {
+	ks := sorted(m)
+	if len(ks) > d.k {
+		ks = ks[:d.k]
+	}
+	return ks
+}
+
+func sorted(m map[string]uint32) []Key {
+	ks := make([]Key, 0, len(m))
+	for k, c := range m {
+		ks = append(ks, Key{Key: k, Count: c})
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if ks[i].Count != ks[j].Count {
+			return ks[i].Count > ks[j].Count
+		}
+		return ks[i].Key < ks[j].Key
+	})
+	return ks
+}
+
+// sum returns the two independent hashes of key by fnv-1a, the rows use h1+i*h2.
+func sum(key []byte) (h1, h2 uint32) {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= prime64
+	}
+	return uint32(h), uint32(h>>32) | 1
+}
@@ -0,0 +1,93 @@
+package hotkey_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/lib/hotkey"
+)
+
+func TestDetector(t *testing.T) {
+	var reported []hotkey.Key
+	d := hotkey.New(100, 2, 50*time.Millisecond, func(ks []hotkey.Key) { reported = ks })
+	hot := []byte("a_hot")
+	for i := 0; i < 10000; i++ {
+		if i%10 == 0 {
+			if isHot := d.Add(hot); isHot != (i/10+1 >= 100) {
+				t.Fatalf("hot key added(%d) hot(%v)", i/10+1, isHot)
+			}
+			continue
+		}
+		if d.Add([]byte("a_cold_" + strconv.Itoa(i))) {
+			t.Fatalf("cold key(%d) flagged hot", i)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	ks := d.Hot()
+	if len(ks) != 1 || ks[0].Key != "a_hot" || ks[0].Count < 1000 {
+		t.Fatalf("hot keys(%v) want a_hot counted 1000", ks)
+	}
+	if len(reported) != 1 || reported[0] != ks[0] {
+		t.Errorf("reported hot keys(%v) want(%v)", reported, ks)
+	}
+	if !d.Add(hot) {
+		t.Error("the hot key of last window should be still hot")
+	}
+	if d.Add([]byte("a_cold_1")) {
+		t.Error("the cold key should not be hot")
+	}
+}
+
+func TestDetectorTopK(t *testing.T) {
+	d := hotkey.New(10, 2, 50*time.Millisecond, nil)
+	for n, key := range []string{"a_top_1", "a_top_2", "a_top_3"} {
+		for i := 0; i < 10*(n+1); i++ {
+			d.Add([]byte(key))
+		}
+	}
+	d.Add([]byte("a_top_1")) // NOTE: colder than the kept, not promoted
+	time.Sleep(60 * time.Millisecond)
+	ks := d.Hot()
+	if len(ks) != 2 || ks[0].Key != "a_top_3" || ks[1].Key != "a_top_2" {
+		t.Errorf("hot keys(%v) want top 2 a_top_3 a_top_2", ks)
+	}
+}
+
+func TestDetectorConcurrent(t *testing.T) {
+	d := hotkey.New(100, 4, time.Hour, nil)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				d.Add([]byte("a_hot"))
+				d.Add([]byte("a_cold_" + strconv.Itoa(g) + "_" + strconv.Itoa(i)))
+			}
+		}(g)
+	}
+	wg.Wait()
+	if !d.Add([]byte("a_hot")) {
+		t.Error("the key added 8000 times should be hot")
+	}
+	if d.Add([]byte("a_cold_0_1")) {
+		t.Error("the cold key should not be hot")
+	}
+}
+
+func BenchmarkDetectorAdd(b *testing.B) {
+	d := hotkey.New(1000, 16, time.Second, nil)
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte("a_bench_" + strconv.Itoa(i))
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			d.Add(keys[i%len(keys)])
+			i++
+		}
+	})
+}
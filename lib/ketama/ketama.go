@@ -29,6 +29,7 @@ type HashRing struct {
 	spots int
 	ticks atomic.Value
 	pool  sync.Pool
+	sum   func([]byte) uint
 }
 
 // NewRing new a hash ring.
@@ -37,16 +38,18 @@ func NewRing(n int) (h *HashRing) {
 	h = new(HashRing)
 	h.spots = n
 	h.pool.New = func() interface{} { return sha1.New() }
+	h.sum = h.sha1Sum
 	return
 }
 
-// NewRingWithHash new a hash ring with a hash func.
-// func NewRingWithHash(n int, hash func() hash.Hash) (h *HashRing) {
-// 	h = new(HashRing)
-// 	h.spots = n
-// 	h.hash = hash
-// 	return
-// }
+// NewRingWithHash new a hash ring with a hash func, which maps both the node spots
+// like '<node>:<i>' and the keys onto the ring. It makes the routing deterministic in tests.
+func NewRingWithHash(n int, hash func([]byte) uint) (h *HashRing) {
+	h = new(HashRing)
+	h.spots = n
+	h.sum = hash
+	return
+}
 
 // Init init hash ring with nodes.
 func (h *HashRing) Init(nodes []string, spots []int) {
@@ -54,21 +57,12 @@ func (h *HashRing) Init(nodes []string, spots []int) {
 		panic("nodes length not equal spots length")
 	}
 	var ticks []nodeHash
-	hash := h.hash()
 	for i := range nodes {
 		tSpots := h.spots * spots[i]
 		for j := 1; j <= tSpots; j++ {
-			hash.Write([]byte(nodes[i] + ":" + strconv.Itoa(j)))
-			hashBytes := hash.Sum(nil)
-			n := &nodeHash{
-				node: nodes[i],
-				hash: uint(hashBytes[19]) | uint(hashBytes[18])<<8 | uint(hashBytes[17])<<16 | uint(hashBytes[16])<<24,
-			}
-			ticks = append(ticks, *n)
-			hash.Reset()
+			ticks = append(ticks, nodeHash{node: nodes[i], hash: h.sum([]byte(nodes[i] + ":" + strconv.Itoa(j)))})
 		}
 	}
-	h.pool.Put(hash)
 	ts := &tickArray{nodes: ticks, length: len(ticks)}
 	ts.Sort()
 	h.ticks.Store(ts)
@@ -87,18 +81,9 @@ func (h *HashRing) AddNode(node string, spot int) {
 			tmpTs.nodes = append(tmpTs.nodes, ts.nodes[i])
 		}
 	}
-	hash := h.hash()
 	for i := 1; i <= h.spots*spot; i++ {
-		hash.Write([]byte(node + ":" + strconv.Itoa(i)))
-		hashBytes := hash.Sum(nil)
-		n := &nodeHash{
-			node: node,
-			hash: uint(hashBytes[19]) | uint(hashBytes[18])<<8 | uint(hashBytes[17])<<16 | uint(hashBytes[16])<<24,
-		}
-		tmpTs.nodes = append(tmpTs.nodes, *n)
-		hash.Reset()
+		tmpTs.nodes = append(tmpTs.nodes, nodeHash{node: node, hash: h.sum([]byte(node + ":" + strconv.Itoa(i)))})
 	}
-	h.pool.Put(hash)
 	tmpTs.length = len(tmpTs.nodes)
 	tmpTs.Sort()
 	h.ticks.Store(tmpTs)
@@ -126,23 +111,44 @@ func (h *HashRing) DelNode(n string) {
 
 // Hash returns result node.
 func (h *HashRing) Hash(bs []byte) (string, bool) {
+	node, _, _, ok := h.Locate(bs)
+	return node, ok
+}
+
+// Locate returns result node, with the hash of bs and the point of ring it hits.
+func (h *HashRing) Locate(bs []byte) (node string, hash, point uint, ok bool) {
 	ts, ok := h.ticks.Load().(*tickArray)
 	if !ok || ts.length == 0 {
-		return "", false
+		return "", 0, 0, false
 	}
-	hash := h.hash()
-	hash.Write(bs)
-	hashBytes := hash.Sum(nil)
-	hash.Reset()
-	h.pool.Put(hash)
-	v := uint(hashBytes[19]) | uint(hashBytes[18])<<8 | uint(hashBytes[17])<<16 | uint(hashBytes[16])<<24
-	i := sort.Search(ts.length, func(i int) bool { return ts.nodes[i].hash >= v })
+	hash = h.sum(bs)
+	i := sort.Search(ts.length, func(i int) bool { return ts.nodes[i].hash >= hash })
 	if i == ts.length {
-		i = 0
+		i = 0 // NOTE: wraps around the ring
+	}
+	return ts.nodes[i].node, hash, ts.nodes[i].hash, true
+}
+
+// Layout returns the points count of every node on the ring and the total points.
+func (h *HashRing) Layout() (points map[string]int, total int) {
+	points = map[string]int{}
+	ts, ok := h.ticks.Load().(*tickArray)
+	if !ok {
+		return
 	}
-	return ts.nodes[i].node, true
+	for i := 0; i < ts.length; i++ {
+		points[ts.nodes[i].node]++
+	}
+	total = ts.length
+	return
 }
 
-func (h *HashRing) hash() hash.Hash {
-	return h.pool.Get().(hash.Hash)
+// sha1Sum returns the ring point of bs by sha1.
+func (h *HashRing) sha1Sum(bs []byte) uint {
+	hash := h.pool.Get().(hash.Hash)
+	hash.Write(bs)
+	hashBytes := hash.Sum(nil)
+	hash.Reset()
+	h.pool.Put(hash)
+	return uint(hashBytes[19]) | uint(hashBytes[18])<<8 | uint(hashBytes[17])<<16 | uint(hashBytes[16])<<24
 }
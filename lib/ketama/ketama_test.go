@@ -2,6 +2,7 @@ package ketama_test
 
 import (
 	"bytes"
+	"fmt"
 	"strconv"
 	"testing"
 
@@ -74,3 +75,20 @@ func testHash(t *testing.T) {
 	}
 	t.Log(node5, m[node5])
 }
+
+func ExampleNewRingWithHash() {
+	// NOTE: maps by the first byte, the spots of node 'b' are all at 'b', so keys 'a*' and 'b*' hit 'b'.
+	firstByte := func(bs []byte) uint { return uint(bs[0]) }
+	r := ketama.NewRingWithHash(255, firstByte)
+	r.Init([]string{"b", "d"}, []int{1, 1})
+	for _, key := range []string{"apple", "banana", "cherry", "durian", "elderberry"} {
+		node, _ := r.Hash([]byte(key))
+		fmt.Println(key, node)
+	}
+	// Output:
+	// apple b
+	// banana b
+	// cherry d
+	// durian d
+	// elderberry b
+}
@@ -0,0 +1,78 @@
+package pool
+
+import (
+	"io"
+	"sync"
+
+	"github.com/felixhao/overlord/lib/bufio"
+)
+
+// Buffers is the free list of connection read and write buffers, the buffers of a closed
+// connection are put back and reset for the new one rather than allocated again.
+type Buffers struct {
+	max int
+
+	mu sync.Mutex
+	rs []*bufio.Reader
+	ws []*bufio.Writer
+}
+
+// NewBuffers new the free list which keeps max readers and max writers at most.
+func NewBuffers(max int) *Buffers {
+	return &Buffers{max: max}
+}
+
+// Reader returns the free reader reset to read from rd, or a new one of size when none.
+func (b *Buffers) Reader(rd io.Reader, size int) *bufio.Reader {
+	b.mu.Lock()
+	for n := len(b.rs); n > 0; n = len(b.rs) {
+		br := b.rs[n-1]
+		b.rs[n-1], b.rs = nil, b.rs[:n-1]
+		if br.Size() >= size { // NOTE: the smaller one is dropped
+			b.mu.Unlock()
+			br.Reset(rd)
+			return br
+		}
+	}
+	b.mu.Unlock()
+	return bufio.NewReaderSize(rd, size)
+}
+
+// Writer returns the free writer reset to write to wr, or a new one of size when none.
+func (b *Buffers) Writer(wr io.Writer, size int) *bufio.Writer {
+	b.mu.Lock()
+	for n := len(b.ws); n > 0; n = len(b.ws) {
+		bw := b.ws[n-1]
+		b.ws[n-1], b.ws = nil, b.ws[:n-1]
+		if bw.Size() >= size {
+			b.mu.Unlock()
+			bw.Reset(wr)
+			return bw
+		}
+	}
+	b.mu.Unlock()
+	return bufio.NewWriterSize(wr, size)
+}
+
+// Put puts the buffers of a closed connection back, they are dropped when the list is full.
+// NOTE: the buffers must be not used by the connection any more.
+func (b *Buffers) Put(br *bufio.Reader, bw *bufio.Writer) {
+	b.mu.Lock()
+	if br != nil && len(b.rs) < b.max {
+		br.Reset(nil) // NOTE: not hold the closed connection
+		b.rs = append(b.rs, br)
+	}
+	if bw != nil && len(b.ws) < b.max {
+		bw.Reset(nil)
+		b.ws = append(b.ws, bw)
+	}
+	b.mu.Unlock()
+}
+
+// Len returns the count of free readers and writers.
+func (b *Buffers) Len() (readers, writers int) {
+	b.mu.Lock()
+	readers, writers = len(b.rs), len(b.ws)
+	b.mu.Unlock()
+	return
+}
@@ -0,0 +1,178 @@
+package pool
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter limits the active connections shared by pools, like: all node pools of
+// a cluster. A limiter with parent also acquires from the parent, like: the global one.
+type Limiter struct {
+	max    int
+	parent *Limiter
+	change func(active int)
+
+	mu     sync.Mutex
+	active int
+}
+
+// NewLimiter new a limiter of max active connections, zero means no limit but counting.
+// The change func is called with the active count when changed, can be nil.
+func NewLimiter(max int, parent *Limiter, change func(active int)) *Limiter {
+	return &Limiter{max: max, parent: parent, change: change}
+}
+
+// Active returns the active connections count.
+func (l *Limiter) Active() int {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	return active
+}
+
+// acquire acquires one connection from limiter and its parents, returns false when any exhausted.
+func (l *Limiter) acquire() bool {
+	l.mu.Lock()
+	if l.max > 0 && l.active >= l.max {
+		l.mu.Unlock()
+		return false
+	}
+	if l.parent != nil && !l.parent.acquire() {
+		l.mu.Unlock()
+		return false
+	}
+	l.active++
+	l.changed()
+	l.mu.Unlock()
+	return true
+}
+
+// release releases one connection into limiter and its parents.
+func (l *Limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.changed()
+	l.mu.Unlock()
+	if l.parent != nil {
+		l.parent.release()
+	}
+}
+
+func (l *Limiter) changed() {
+	if l.change != nil {
+		l.change(l.active)
+	}
+}
+
+// Gate limits the concurrent in-progress dials, like: of one backend. The dials more than max wait
+// for the in-progress ones done. A gate with parent also waits for the parent, like: the global one.
+type Gate struct {
+	slots  chan struct{}
+	parent *Gate
+}
+
+// NewGate new a gate of max concurrent dials, zero means no limit but waiting for the parent.
+func NewGate(max int, parent *Gate) *Gate {
+	g := &Gate{parent: parent}
+	if max > 0 {
+		g.slots = make(chan struct{}, max)
+	}
+	return g
+}
+
+// dial calls dial after entered the gate and its parents, nil gate dials directly.
+func (g *Gate) dial(dial func() (Conn, error)) (Conn, error) {
+	if g == nil {
+		return dial()
+	}
+	g.enter()
+	defer g.leave()
+	return dial()
+}
+
+// enter waits for one slot of gate and its parents, the child first to keep the order.
+func (g *Gate) enter() {
+	if g.slots != nil {
+		g.slots <- struct{}{}
+	}
+	if g.parent != nil {
+		g.parent.enter()
+	}
+}
+
+func (g *Gate) leave() {
+	if g.parent != nil {
+		g.parent.leave()
+	}
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+// Budget limits the bytes held in total, like: of the response buffers in flight of all clusters.
+// The acquires more than max wait for the released ones until timeout.
+type Budget struct {
+	max    int64
+	change func(used int64)
+
+	mu       sync.Mutex
+	used     int64
+	released chan struct{} // NOTE: closed and renewed when released, wakes the waiters
+}
+
+// NewBudget new a budget of max bytes. The change func is called with the used bytes when changed, can be nil.
+func NewBudget(max int64, change func(used int64)) *Budget {
+	return &Budget{max: max, change: change, released: make(chan struct{})}
+}
+
+// Acquire acquires n bytes, waits for the released ones when exhausted until timeout, returns false
+// when timeout. The bytes more than max are acquired only when nothing held, never wait forever.
+func (b *Budget) Acquire(n int64, timeout time.Duration) bool {
+	var timer *time.Timer
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.max {
+			b.used += n
+			b.changed()
+			b.mu.Unlock()
+			return true
+		}
+		released := b.released
+		b.mu.Unlock()
+		if timeout <= 0 {
+			return false
+		}
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-released:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// Release releases n bytes acquired.
+func (b *Budget) Release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.changed()
+	close(b.released)
+	b.released = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// Used returns the used bytes.
+func (b *Budget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *Budget) changed() {
+	if b.change != nil {
+		b.change(b.used)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"errors"
 	"io"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -12,6 +13,8 @@ import (
 var (
 	ErrPoolExhausted = errors.New("pool: connection exhausted")
 	ErrPoolClosed    = errors.New("pool: get on closed")
+	ErrPoolLimited   = errors.New("pool: connection limited by shared limiter")
+	ErrPoolDraining  = errors.New("pool: get on draining")
 )
 
 var nowFunc = time.Now
@@ -46,18 +49,63 @@ type Pool struct {
 	// If Wait is true and the pool is at the MaxActive limit, then Get() waits
 	// for a connection to be returned to the pool before returning.
 	Wait bool
+	// Ping connections after remaining idle for this duration, keeps the NAT
+	// mappings alive and evicts the dead ones. If the value is zero, then idle
+	// connections are not pinged.
+	IdlePing time.Duration
+	// Ping is an application supplied function for pinging an idle connection.
+	Ping func(c Conn) error
+	// Minimum number of idle connections in the pool, they are kept regardless
+	// of IdleTimeout, and the dead ones are replaced in background so requests
+	// rarely pay dial latency, like: the sporadic request of rarely-accessed one.
+	MinIdle int
+	// Limiter limits the active connections shared with other pools, the Get
+	// fails with ErrPoolLimited rather than waits when it exhausted.
+	Limiter *Limiter
+	// Gate limits the concurrent in-progress dials, the dials more than its
+	// max wait rather than fail. If the value is nil, dials are not limited.
+	Gate *Gate
+	// Change is an optional application supplied function called with the
+	// active and idle connections count when changed, like: exports them as
+	// the pool utilization. It is called holding the pool lock.
+	Change func(active, idle int)
+	// The new connection is got for a share of requests ramping linearly to
+	// full in this duration, the others prefer the older idle connections, so
+	// a cold server instance is not flooded at once. If the value is zero,
+	// then connections are not slow started.
+	SlowStart time.Duration
+	// Maximum number of overflow connections allocated beyond MaxActive on
+	// burst, the idle ones more than MaxActive are closed after remaining idle
+	// for OverflowIdleTimeout, so the pool shrinks to MaxActive once the burst
+	// ends. It works only when MaxActive is not zero.
+	MaxOverflow         int
+	OverflowIdleTimeout time.Duration
+	// Close connections after living for this duration spread randomly by
+	// LifetimeJitter, like: 0.1 means ±10%, so the connections dialed together
+	// are not recycled at once. If the value is zero, then connections live
+	// until closed by others.
+	MaxLifetime    time.Duration
+	LifetimeJitter float64
 	// mu protects fields defined below.
-	mu     sync.Mutex
-	cond   *sync.Cond
-	closed bool
-	active int
+	mu       sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	draining bool
+	active   int
 	// Stack of idleConn with most recently used at the front.
 	idle list.List
+	// fill notifies the background min idle filling.
+	fill chan struct{}
+	// born is the dial time of connections within slow start.
+	born map[Conn]time.Time
+	// expire is the expiry time of connections by max lifetime.
+	expire map[Conn]time.Time
 }
 
 type idleConn struct {
 	c Conn
 	t time.Time
+	p time.Time // NOTE: last put or ping time
 }
 
 // PoolOption specifies an option for pool.
@@ -71,6 +119,18 @@ type poolOptions struct {
 	idle        int
 	idleTimeout time.Duration
 	wait        bool
+	idlePing    time.Duration
+	ping        func(Conn) error
+	minIdle     int
+	onBorrow    func(Conn, time.Time) error
+	limiter     *Limiter
+	gate        *Gate
+	change      func(active, idle int)
+	slowStart   time.Duration
+	overflow    int
+	overflowTo  time.Duration
+	lifetime    time.Duration
+	jitter      float64
 }
 
 // PoolDial set pool dial func.
@@ -108,6 +168,72 @@ func PoolWait(w bool) *PoolOption {
 	}}
 }
 
+// PoolIdlePing set pool idle ping duration and ping func.
+func PoolIdlePing(d time.Duration, ping func(Conn) error) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.idlePing = d
+		po.ping = ping
+	}}
+}
+
+// PoolMinIdle set pool min idle.
+func PoolMinIdle(idle int) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.minIdle = idle
+	}}
+}
+
+// PoolTestOnBorrow set pool test on borrow func.
+func PoolTestOnBorrow(f func(Conn, time.Time) error) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.onBorrow = f
+	}}
+}
+
+// PoolLimiter set pool shared limiter.
+func PoolLimiter(l *Limiter) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.limiter = l
+	}}
+}
+
+// PoolDialGate set pool dial gate.
+func PoolDialGate(g *Gate) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.gate = g
+	}}
+}
+
+// PoolChange set pool active and idle change func.
+func PoolChange(f func(active, idle int)) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.change = f
+	}}
+}
+
+// PoolSlowStart set pool new connection slow start duration.
+func PoolSlowStart(d time.Duration) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.slowStart = d
+	}}
+}
+
+// PoolOverflow set pool max overflow and the overflow idle timeout.
+func PoolOverflow(overflow int, it time.Duration) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.overflow = overflow
+		po.overflowTo = it
+	}}
+}
+
+// PoolMaxLifetime set pool connection max lifetime and its jitter ratio.
+func PoolMaxLifetime(d time.Duration, jitter float64) *PoolOption {
+	return &PoolOption{func(po *poolOptions) {
+		po.lifetime = d
+		po.jitter = jitter
+	}}
+}
+
 // NewPool creates a new pool.
 func NewPool(pos ...*PoolOption) (p *Pool) {
 	p = &Pool{}
@@ -125,6 +251,28 @@ func NewPool(pos ...*PoolOption) (p *Pool) {
 	p.MaxIdle = opts.idle
 	p.IdleTimeout = opts.idleTimeout
 	p.Wait = opts.wait
+	p.IdlePing = opts.idlePing
+	p.Ping = opts.ping
+	p.TestOnBorrow = opts.onBorrow
+	p.Limiter = opts.limiter
+	p.Gate = opts.gate
+	p.Change = opts.change
+	p.SlowStart = opts.slowStart
+	p.MaxLifetime = opts.lifetime
+	p.LifetimeJitter = opts.jitter
+	if p.IdlePing > 0 && p.Ping != nil {
+		go p.pingIdle()
+	}
+	if opts.overflow > 0 && opts.overflowTo > 0 && p.MaxActive > 0 {
+		p.MaxOverflow = opts.overflow
+		p.OverflowIdleTimeout = opts.overflowTo
+		go p.reapOverflow()
+	}
+	if opts.minIdle > 0 {
+		p.MinIdle = opts.minIdle
+		p.fill = make(chan struct{}, 1)
+		go p.fillIdle()
+	}
 	return
 }
 
@@ -145,8 +293,9 @@ func (p *Pool) Get() Conn {
 // idle len>maxIdle, then connection will close.
 func (p *Pool) Put(c Conn, forceClose bool) error {
 	p.mu.Lock()
-	if !p.closed && !forceClose {
-		p.idle.PushFront(idleConn{t: nowFunc(), c: c})
+	if !p.closed && !p.draining && !forceClose && !p.expired(c) {
+		now := nowFunc()
+		p.idle.PushFront(idleConn{t: now, p: now, c: c})
 		if p.idle.Len() > p.MaxIdle {
 			c = p.idle.Remove(p.idle.Back()).(idleConn).c
 		} else {
@@ -157,9 +306,11 @@ func (p *Pool) Put(c Conn, forceClose bool) error {
 		if p.cond != nil {
 			p.cond.Signal()
 		}
+		p.changed()
 		p.mu.Unlock()
 		return nil
 	}
+	p.forget(c)
 	p.release()
 	p.mu.Unlock()
 	return c.Close()
@@ -173,16 +324,43 @@ func (p *Pool) ActiveCount() int {
 	return active
 }
 
+// IdleCount returns the number of idle connections.
+func (p *Pool) IdleCount() int {
+	p.mu.Lock()
+	n := p.idle.Len()
+	p.mu.Unlock()
+	return n
+}
+
+// OverflowCount returns the number of active connections beyond MaxActive.
+func (p *Pool) OverflowCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.MaxActive == 0 || p.active <= p.MaxActive {
+		return 0
+	}
+	return p.active - p.MaxActive
+}
+
 // Close releases the resources used by the pool.
 func (p *Pool) Close() error {
 	p.mu.Lock()
 	idle := p.idle
 	p.idle.Init()
 	p.closed = true
+	p.born = nil
+	p.expire = nil
 	p.active -= idle.Len()
+	if p.Limiter != nil {
+		for i := 0; i < idle.Len(); i++ {
+			p.Limiter.release()
+		}
+	}
+	p.changed()
 	if p.cond != nil {
 		p.cond.Broadcast()
 	}
+	p.notifyFill()
 	p.mu.Unlock()
 	for e := idle.Front(); e != nil; e = e.Next() {
 		e.Value.(idleConn).c.Close()
@@ -190,22 +368,71 @@ func (p *Pool) Close() error {
 	return nil
 }
 
+// Drain sets the pool draining or not. The draining pool fails Get with
+// ErrPoolDraining and closes the idle and put back connections, so it drains
+// to empty once the checked-out connections are put back.
+func (p *Pool) Drain(on bool) {
+	p.mu.Lock()
+	p.draining = on
+	if !on {
+		p.notifyFill()
+		p.mu.Unlock()
+		return
+	}
+	idle := p.idle
+	p.idle.Init()
+	for e := idle.Front(); e != nil; e = e.Next() {
+		p.forget(e.Value.(idleConn).c)
+		p.release()
+	}
+	if p.cond != nil {
+		p.cond.Broadcast()
+	}
+	p.mu.Unlock()
+	for e := idle.Front(); e != nil; e = e.Next() {
+		e.Value.(idleConn).c.Close()
+	}
+}
+
 // release decrements the active count and signals waiters. The caller must
 // hold p.mu during the call.
 func (p *Pool) release() {
 	p.active--
+	if p.Limiter != nil {
+		p.Limiter.release()
+	}
+	p.changed()
 	if p.cond != nil {
 		p.cond.Signal()
 	}
+	p.notifyFill()
+}
+
+// changed calls Change with the active and idle count. The caller must hold
+// p.mu during the call.
+func (p *Pool) changed() {
+	if p.Change != nil {
+		p.Change(p.active, p.idle.Len())
+	}
+}
+
+// notifyFill notifies the background min idle filling.
+func (p *Pool) notifyFill() {
+	if p.fill != nil {
+		select {
+		case p.fill <- struct{}{}:
+		default:
+		}
+	}
 }
 
 // get prunes stale connections and returns a connection from the idle list or
 // creates a new connection.
 func (p *Pool) get() (Conn, error) {
 	p.mu.Lock()
-	// Prune stale connections.
+	// Prune stale connections, but the newest MinIdle ones.
 	if timeout := p.IdleTimeout; timeout > 0 {
-		for i, n := 0, p.idle.Len(); i < n; i++ {
+		for i, n := 0, p.idle.Len()-p.MinIdle; i < n; i++ {
 			e := p.idle.Back()
 			if e == nil {
 				break
@@ -215,6 +442,7 @@ func (p *Pool) get() (Conn, error) {
 				break
 			}
 			p.idle.Remove(e)
+			p.forget(ic.c)
 			p.release()
 			p.mu.Unlock()
 			ic.c.Close()
@@ -222,14 +450,30 @@ func (p *Pool) get() (Conn, error) {
 		}
 	}
 	for {
+		if p.draining {
+			p.mu.Unlock()
+			return nil, ErrPoolDraining
+		}
 		// Get idle connection.
 		for i, n := 0, p.idle.Len(); i < n; i++ {
 			e := p.idle.Front()
 			if e == nil {
 				break
 			}
+			if p.SlowStart > 0 {
+				e = p.slowStart(e)
+			}
 			ic := e.Value.(idleConn)
 			p.idle.Remove(e)
+			p.changed()
+			if p.expired(ic.c) {
+				p.forget(ic.c)
+				p.release()
+				p.mu.Unlock()
+				ic.c.Close()
+				p.mu.Lock()
+				continue
+			}
 			test := p.TestOnBorrow
 			p.mu.Unlock()
 			if test == nil || test(ic.c, ic.t) == nil {
@@ -237,6 +481,7 @@ func (p *Pool) get() (Conn, error) {
 			}
 			ic.c.Close()
 			p.mu.Lock()
+			p.forget(ic.c)
 			p.release()
 		}
 		// Check for pool closed before dialing a new connection.
@@ -245,17 +490,24 @@ func (p *Pool) get() (Conn, error) {
 			return nil, ErrPoolClosed
 		}
 		// Dial new connection if under limit.
-		if p.MaxActive == 0 || p.active < p.MaxActive {
-			dial := p.Dial
+		if p.MaxActive == 0 || p.active < p.MaxActive+p.MaxOverflow {
+			if p.Limiter != nil && !p.Limiter.acquire() {
+				p.mu.Unlock()
+				return nil, ErrPoolLimited
+			}
+			dial, gate := p.Dial, p.Gate
 			p.active++
+			p.changed()
 			p.mu.Unlock()
-			c, err := dial()
+			c, err := gate.dial(dial)
+			p.mu.Lock()
 			if err != nil {
-				p.mu.Lock()
 				p.release()
-				p.mu.Unlock()
 				c = nil
+			} else {
+				p.dialed(c)
 			}
+			p.mu.Unlock()
 			return c, err
 		}
 		if !p.Wait {
@@ -269,6 +521,209 @@ func (p *Pool) get() (Conn, error) {
 	}
 }
 
+// dialed records the dial time of new connection for slow start, and forgets
+// the ones out of slow start, also the expiry time by max lifetime with jitter.
+// The caller must hold p.mu during the call.
+func (p *Pool) dialed(c Conn) {
+	now := nowFunc()
+	if p.MaxLifetime > 0 {
+		if p.expire == nil {
+			p.expire = map[Conn]time.Time{}
+		}
+		d := p.MaxLifetime
+		if p.LifetimeJitter > 0 {
+			d += time.Duration(float64(p.MaxLifetime) * p.LifetimeJitter * (2*rand.Float64() - 1))
+		}
+		p.expire[c] = now.Add(d)
+	}
+	if p.SlowStart <= 0 {
+		return
+	}
+	if p.born == nil {
+		p.born = map[Conn]time.Time{}
+	}
+	for bc, t := range p.born {
+		if now.Sub(t) >= p.SlowStart {
+			delete(p.born, bc) // NOTE: also the closed ones, keeps it bounded
+		}
+	}
+	p.born[c] = now
+}
+
+// expired reports whether the connection lived more than its lifetime.
+// The caller must hold p.mu during the call.
+func (p *Pool) expired(c Conn) bool {
+	t, ok := p.expire[c]
+	return ok && !nowFunc().Before(t)
+}
+
+// forget forgets the expiry time of connection closed.
+// The caller must hold p.mu during the call.
+func (p *Pool) forget(c Conn) {
+	if p.expire != nil {
+		delete(p.expire, c)
+	}
+}
+
+// slowStart returns the first idle connection from e accepted by its share, the
+// share of new connection is its age in SlowStart, the older one is always accepted.
+// Returns e when none accepted. The caller must hold p.mu during the call.
+func (p *Pool) slowStart(e *list.Element) *list.Element {
+	now := nowFunc()
+	for se := e; se != nil; se = se.Next() {
+		c := se.Value.(idleConn).c
+		born, ok := p.born[c]
+		if !ok {
+			return se
+		}
+		age := now.Sub(born)
+		if age >= p.SlowStart {
+			delete(p.born, c)
+			return se
+		}
+		if rand.Int63n(int64(p.SlowStart)) < int64(age) {
+			return se
+		}
+	}
+	return e
+}
+
+// pingIdle pings the connections idle more than IdlePing until the pool closed.
+func (p *Pool) pingIdle() {
+	ticker := time.NewTicker(p.IdlePing / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		var ics []idleConn
+		for e := p.idle.Front(); e != nil; {
+			next := e.Next()
+			if ic := e.Value.(idleConn); nowFunc().Sub(ic.p) >= p.IdlePing {
+				p.idle.Remove(e) // NOTE: take out, avoid be got while pinging
+				ics = append(ics, ic)
+			}
+			e = next
+		}
+		if len(ics) > 0 {
+			p.changed()
+		}
+		p.mu.Unlock()
+		for _, ic := range ics {
+			if err := p.Ping(ic.c); err != nil {
+				ic.c.Close()
+				p.mu.Lock()
+				p.forget(ic.c)
+				p.release()
+				p.mu.Unlock()
+				continue
+			}
+			ic.p = nowFunc()
+			p.mu.Lock()
+			if p.closed || p.draining {
+				p.forget(ic.c)
+				p.release()
+				p.mu.Unlock()
+				ic.c.Close()
+				continue
+			}
+			p.idle.PushBack(ic) // NOTE: pinged ones are the oldest, keep the order
+			p.changed()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// reapOverflow closes the oldest idle connections remaining idle more than OverflowIdleTimeout
+// while the active more than MaxActive, until the pool closed.
+func (p *Pool) reapOverflow() {
+	ticker := time.NewTicker(p.OverflowIdleTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		var cs []Conn
+		for p.active > p.MaxActive {
+			e := p.idle.Back()
+			if e == nil {
+				break
+			}
+			ic := e.Value.(idleConn)
+			if nowFunc().Sub(ic.t) < p.OverflowIdleTimeout {
+				break
+			}
+			p.idle.Remove(e)
+			p.forget(ic.c)
+			p.release()
+			cs = append(cs, ic.c)
+		}
+		p.mu.Unlock()
+		for _, c := range cs {
+			c.Close()
+		}
+	}
+}
+
+// fillIdleInterval is the interval of min idle filling, also the retry interval after dial failed.
+var fillIdleInterval = time.Second
+
+// fillIdle keeps the idle connections at least MinIdle until the pool closed.
+func (p *Pool) fillIdle() {
+	ticker := time.NewTicker(fillIdleInterval)
+	defer ticker.Stop()
+	for {
+		p.mu.Lock()
+		for !p.closed && !p.draining && p.idle.Len() < p.MinIdle && (p.MaxActive == 0 || p.active < p.MaxActive) {
+			if p.Limiter != nil && !p.Limiter.acquire() {
+				break
+			}
+			dial, gate := p.Dial, p.Gate
+			p.active++
+			p.mu.Unlock()
+			c, err := gate.dial(dial)
+			p.mu.Lock()
+			if err != nil {
+				p.active-- // NOTE: no release, avoid notify fill again, retry after interval
+				if p.Limiter != nil {
+					p.Limiter.release()
+				}
+				break
+			}
+			if p.closed || p.draining {
+				p.active--
+				if p.Limiter != nil {
+					p.Limiter.release()
+				}
+				p.mu.Unlock()
+				c.Close()
+				p.mu.Lock()
+				break
+			}
+			p.dialed(c)
+			now := nowFunc()
+			p.idle.PushFront(idleConn{t: now, p: now, c: c}) // NOTE: keep the idle list ordered by time
+			p.changed()
+			if p.cond != nil {
+				p.cond.Signal()
+			}
+		}
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case <-p.fill:
+		case <-ticker.C:
+		}
+	}
+}
+
 type errorConnection struct{ err error }
 
 func (ec errorConnection) Close() error { return ec.err }
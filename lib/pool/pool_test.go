@@ -3,6 +3,7 @@ package pool_test
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,9 +33,10 @@ type poolDialer struct {
 func (d *poolDialer) dial() (pool.Conn, error) {
 	d.mu.Lock()
 	d.dialed++
+	id := d.dialed
 	d.mu.Unlock()
 
-	c, err := newPoolTestConn(d.t, d.dialed)
+	c, err := newPoolTestConn(d.t, id)
 	if err != nil {
 		return nil, err
 	}
@@ -379,3 +381,368 @@ func BenchmarkPoolGet(b *testing.B) {
 		p.Put(c, false)
 	}
 }
+
+func TestPoolIdlePing(t *testing.T) {
+	d := &poolDialer{t: t}
+	var (
+		mu    sync.Mutex
+		pings = map[pool.Conn]int{}
+		dead  pool.Conn
+	)
+	ping := func(c pool.Conn) error {
+		mu.Lock()
+		defer mu.Unlock()
+		pings[c]++
+		if c == dead {
+			return errors.New("dead")
+		}
+		return nil
+	}
+	p := pool.NewPool(pool.PoolDial(d.dial), pool.PoolIdle(2), pool.PoolIdlePing(100*time.Millisecond, ping))
+	defer p.Close()
+
+	c1 := p.Get()
+	c2 := p.Get()
+	mu.Lock()
+	dead = c2
+	mu.Unlock()
+	p.Put(c1, false)
+	p.Put(c2, false)
+	d.check("before ping", p, 2, 2)
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	if pings[c1] == 0 || pings[c2] == 0 {
+		t.Errorf("idle connections not pinged: %d %d", pings[c1], pings[c2])
+	}
+	mu.Unlock()
+	d.check("after ping", p, 2, 1)
+	if c := p.Get(); c != c1 {
+		t.Errorf("alive connection not kept after ping")
+	}
+}
+
+func TestPoolMinIdle(t *testing.T) {
+	d := &poolDialer{t: t}
+	p := pool.NewPool(pool.PoolDial(d.dial), pool.PoolIdle(3), pool.PoolMinIdle(2), pool.PoolIdleTimeout(100*time.Millisecond))
+	defer p.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	d.check("warm up", p, 2, 2)
+	time.Sleep(100 * time.Millisecond)
+	c := p.Get() // NOTE: the timeout ones kept as min idle, no dial
+	time.Sleep(50 * time.Millisecond)
+	d.check("after idle timeout", p, 2, 2)
+	p.Put(c, false)
+	time.Sleep(200 * time.Millisecond)
+	p.Put(p.Get(), false) // NOTE: prune the timeout ones but min idle
+	if n := p.IdleCount(); n != 2 {
+		t.Errorf("idle(%d) want min idle kept", n)
+	}
+}
+
+func TestPoolLimiter(t *testing.T) {
+	var gauge int
+	global := pool.NewLimiter(3, nil, nil)
+	clusterA := pool.NewLimiter(2, global, func(active int) { gauge = active })
+	clusterB := pool.NewLimiter(0, global, nil)
+	d := &poolDialer{t: t}
+	newLimitPool := func(l *pool.Limiter) *pool.Pool {
+		return pool.NewPool(pool.PoolDial(d.dial), pool.PoolActive(10), pool.PoolIdle(10), pool.PoolLimiter(l))
+	}
+	a1, a2, b1 := newLimitPool(clusterA), newLimitPool(clusterA), newLimitPool(clusterB)
+
+	c1, c2 := a1.Get(), a2.Get()
+	if err := a2.Get().Close(); err != pool.ErrPoolLimited {
+		t.Errorf("cluster A third conn error(%v) want limited", err)
+	}
+	if gauge != 2 || clusterA.Active() != 2 {
+		t.Errorf("cluster A gauge(%d) active(%d) want 2", gauge, clusterA.Active())
+	}
+	c3 := b1.Get()
+	if err := b1.Get().Close(); err != pool.ErrPoolLimited {
+		t.Errorf("cluster B second conn error(%v) want limited by global", err)
+	}
+	if global.Active() != 3 {
+		t.Errorf("global active(%d) want 3", global.Active())
+	}
+	a1.Put(c1, true) // NOTE: closed, release the limiter
+	if c := b1.Get(); c.Close() != nil {
+		t.Error("cluster B conn should be got after cluster A released")
+	}
+	a2.Put(c2, false)
+	b1.Put(c3, false)
+	a1.Close()
+	a2.Close()
+	b1.Close()
+	if global.Active() != 1 || clusterA.Active() != 0 {
+		t.Errorf("global active(%d) cluster A active(%d) after pools closed", global.Active(), clusterA.Active())
+	}
+}
+
+func TestPoolDialGate(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		dialing = map[string]int{}
+		peak    = map[string]int{}
+	)
+	slowDial := func(backend string) func() (pool.Conn, error) {
+		return func() (pool.Conn, error) {
+			mu.Lock()
+			for _, k := range []string{backend, "global"} {
+				if dialing[k]++; dialing[k] > peak[k] {
+					peak[k] = dialing[k]
+				}
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			dialing[backend]--
+			dialing["global"]--
+			mu.Unlock()
+			return newPoolTestConn(t, 0)
+		}
+	}
+	global := pool.NewGate(3, nil)
+	a := pool.NewPool(pool.PoolDial(slowDial("a")), pool.PoolIdle(10), pool.PoolDialGate(pool.NewGate(2, global)))
+	b := pool.NewPool(pool.PoolDial(slowDial("b")), pool.PoolIdle(10), pool.PoolDialGate(pool.NewGate(2, global)))
+	defer a.Close()
+	defer b.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, p := range []*pool.Pool{a, b} {
+			wg.Add(1)
+			go func(p *pool.Pool) {
+				defer wg.Done()
+				c := p.Get()
+				if err := c.Close(); err != nil {
+					t.Errorf("get conn error:%v", err)
+				}
+			}(p)
+		}
+	}
+	wg.Wait()
+	if peak["a"] > 2 || peak["b"] > 2 || peak["global"] > 3 {
+		t.Errorf("peak dials a(%d) b(%d) global(%d) want not more than 2 2 3", peak["a"], peak["b"], peak["global"])
+	}
+	if peak["global"] < 3 {
+		t.Errorf("peak global dials(%d) want 3, the gate should not serialize more than limit", peak["global"])
+	}
+}
+
+func TestPoolDrain(t *testing.T) {
+	d := &poolDialer{t: t}
+	p := newPool(t, d.dial, 0, 2, 0)
+	defer p.Close()
+
+	c1, c2 := p.Get(), p.Get()
+	p.Put(c1, false)
+	d.check("before drain", p, 2, 2)
+	p.Drain(true)
+	d.check("idle reaped", p, 2, 1)
+	if err := p.Get().Close(); err != pool.ErrPoolDraining {
+		t.Errorf("get error(%v) want draining", err)
+	}
+	p.Put(c2, false)
+	d.check("checked-out put back", p, 2, 0)
+	p.Drain(false)
+	c := p.Get()
+	p.Put(c, false)
+	d.check("after undrain", p, 3, 1)
+}
+
+func TestPoolChange(t *testing.T) {
+	var active, idle int
+	d := &poolDialer{t: t}
+	p := pool.NewPool(pool.PoolDial(d.dial), pool.PoolActive(3), pool.PoolIdle(1), pool.PoolChange(func(a, i int) {
+		active, idle = a, i
+	}))
+	check := func(message string, wantActive, wantIdle int) {
+		if active != wantActive || idle != wantIdle {
+			t.Errorf("%s: active(%d) idle(%d) want(%d) (%d)", message, active, idle, wantActive, wantIdle)
+		}
+	}
+	c1, c2 := p.Get(), p.Get()
+	check("two checked out", 2, 0)
+	p.Put(c1, false)
+	check("one checked in", 2, 1)
+	p.Put(c2, false)
+	check("more than max idle checked in", 1, 1)
+	c1 = p.Get()
+	check("idle checked out", 1, 0)
+	p.Put(c1, true)
+	check("force closed", 0, 0)
+	p.Put(p.Get(), false)
+	p.Close()
+	check("pool closed", 0, 0)
+}
+
+func TestPoolOverflow(t *testing.T) {
+	d := &poolDialer{t: t}
+	p := pool.NewPool(pool.PoolDial(d.dial), pool.PoolActive(2), pool.PoolIdle(4), pool.PoolOverflow(2, 100*time.Millisecond))
+	defer p.Close()
+	var cs []pool.Conn
+	for i := 0; i < 4; i++ { // NOTE: burst
+		cs = append(cs, p.Get())
+	}
+	if c := p.Get(); c.Close() != pool.ErrPoolExhausted {
+		t.Errorf("get more than active and overflow want exhausted")
+	}
+	if n := p.OverflowCount(); n != 2 {
+		t.Errorf("overflow(%d) want 2 on burst", n)
+	}
+	for _, c := range cs {
+		p.Put(c, false)
+	}
+	d.check("burst ends", p, 4, 4)
+	time.Sleep(300 * time.Millisecond)
+	d.check("overflow reaped", p, 4, 2)
+	if n := p.OverflowCount(); n != 0 {
+		t.Errorf("overflow(%d) want 0 after reaped", n)
+	}
+	c := p.Get()
+	p.Put(c, false)
+	d.check("core reused", p, 4, 2)
+}
+
+func TestPoolMaxLifetime(t *testing.T) {
+	const n = 20
+	d := &poolDialer{t: t}
+	p := pool.NewPool(pool.PoolDial(d.dial), pool.PoolIdle(n), pool.PoolMaxLifetime(200*time.Millisecond, 0.5))
+	defer p.Close()
+	var cs []pool.Conn
+	for i := 0; i < n; i++ { // NOTE: dialed together
+		cs = append(cs, p.Get())
+	}
+	for _, c := range cs {
+		p.Put(c, false)
+	}
+	time.Sleep(200 * time.Millisecond) // NOTE: the lifetime spreads in [100ms, 300ms]
+	cs = cs[:0]
+	for i := 0; i < n; i++ {
+		cs = append(cs, p.Get()) // NOTE: the expired ones are closed and redialed
+	}
+	for _, c := range cs {
+		p.Put(c, false)
+	}
+	d.mu.Lock()
+	expired := d.dialed - n
+	d.mu.Unlock()
+	if expired == 0 || expired == n {
+		t.Errorf("expired(%d) of %d want spread rather than clustered", expired, n)
+	}
+	time.Sleep(150 * time.Millisecond) // NOTE: all the first dialed ones expired
+	cs = cs[:0]
+	for i := 0; i < n; i++ {
+		cs = append(cs, p.Get())
+	}
+	for _, c := range cs {
+		p.Put(c, false)
+	}
+	d.mu.Lock()
+	if d.dialed-n < n {
+		t.Errorf("expired(%d) want all of %d expired later", d.dialed-n, n)
+	}
+	d.mu.Unlock()
+}
+
+func TestPoolSlowStart(t *testing.T) {
+	const slowStart = 400 * time.Millisecond
+	d := &poolDialer{t: t}
+	p := pool.NewPool(pool.PoolDial(d.dial), pool.PoolActive(2), pool.PoolIdle(2), pool.PoolSlowStart(slowStart))
+	defer p.Close()
+	old := p.Get()
+	p.Put(old, false)
+	time.Sleep(slowStart)
+	c1, c2 := p.Get(), p.Get() // NOTE: the old one and a new dialed one
+	if c1 != old {
+		t.Fatal("idle conn should be got first")
+	}
+	start := time.Now()
+	var early, earlyNew, late, lateNew int
+	for age := time.Duration(0); age < slowStart+100*time.Millisecond; age = time.Since(start) {
+		p.Put(old, false)
+		p.Put(c2, false) // NOTE: the new one is the most recently used
+		c1, c2 = p.Get(), p.Get()
+		isNew := 0
+		if c1 != old {
+			isNew = 1
+			c1, c2 = c2, c1
+		}
+		switch {
+		case age < slowStart/4:
+			early++
+			earlyNew += isNew
+		case age >= slowStart:
+			late++
+			lateNew += isNew
+		}
+	}
+	if early == 0 || late == 0 {
+		t.Fatalf("early(%d) late(%d) rounds want some", early, late)
+	}
+	if share := float64(earlyNew) / float64(early); share > 0.5 {
+		t.Errorf("new conn early share(%v) want ramping from zero", share)
+	}
+	if lateNew != late {
+		t.Errorf("new conn late share(%d/%d) want full after slow start", lateNew, late)
+	}
+	p.Put(c1, false)
+	p.Put(c2, false)
+}
+
+func TestBudget(t *testing.T) {
+	var used int64
+	b := pool.NewBudget(100, func(n int64) { atomic.StoreInt64(&used, n) })
+	if !b.Acquire(60, 0) {
+		t.Fatal("acquire within max should be granted")
+	}
+	if b.Acquire(60, 50*time.Millisecond) {
+		t.Fatal("acquire over max should time out")
+	}
+	granted := make(chan bool, 1)
+	go func() { granted <- b.Acquire(60, time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-granted:
+		t.Fatal("acquire over max should wait")
+	default:
+	}
+	b.Release(60)
+	if ok := <-granted; !ok {
+		t.Fatal("waiting acquire should be granted after release")
+	}
+	if n := atomic.LoadInt64(&used); n != 60 {
+		t.Errorf("used gauge(%d) want 60", n)
+	}
+	b.Release(60)
+	if !b.Acquire(200, 0) {
+		t.Fatal("oversized acquire should be granted when nothing held")
+	}
+	if n := b.Used(); n != 200 {
+		t.Errorf("used(%d) want 200", n)
+	}
+	b.Release(200)
+	if n := atomic.LoadInt64(&used); n != 0 {
+		t.Errorf("used gauge(%d) want 0", n)
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	b := pool.NewBuffers(1)
+	br, bw := b.Reader(nil, 64), b.Writer(nil, 32)
+	b.Put(br, bw)
+	b.Put(pool.NewBuffers(1).Reader(nil, 64), nil) // NOTE: dropped, the list is full
+	if rn, wn := b.Len(); rn != 1 || wn != 1 {
+		t.Fatalf("free readers(%d) writers(%d) want 1", rn, wn)
+	}
+	if b.Reader(nil, 64) != br || b.Writer(nil, 32) != bw {
+		t.Fatal("free buffers should be reused")
+	}
+	b.Put(br, bw)
+	if nbr := b.Reader(nil, 128); nbr == br || nbr.Size() != 128 {
+		t.Fatalf("reader size(%d) want a new one of larger size", nbr.Size())
+	}
+	if rn, _ := b.Len(); rn != 0 {
+		t.Errorf("free readers(%d) want the smaller one dropped", rn)
+	}
+}
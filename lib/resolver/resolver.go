@@ -0,0 +1,176 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/felixhao/overlord/lib/backoff"
+	"github.com/felixhao/overlord/lib/log"
+	"github.com/pkg/errors"
+)
+
+// LookupFunc looks up the addresses of host.
+type LookupFunc func(host string) ([]string, error)
+
+// ContextLookupFunc looks up the addresses of host, gives up when ctx done.
+type ContextLookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// LookupTimeout returns the lookup cancelled when not answered in timeout, lookup is the LookupHost
+// of the default net.Resolver when nil, like: the slow DNS is bounded by its own timeout rather than the connect one.
+func LookupTimeout(lookup ContextLookupFunc, timeout time.Duration) LookupFunc {
+	if lookup == nil {
+		lookup = (&net.Resolver{}).LookupHost
+	}
+	return func(host string) ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		addrs, err := lookup(ctx, host)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return nil, &net.DNSError{Err: "lookup timeout", Name: host, IsTimeout: true}
+		}
+		return addrs, err
+	}
+}
+
+// Resolver resolves the host of address by cache, the cached answer is refreshed
+// after ttl expired, so a changed DNS record eventually rotates the connections.
+// NOTE: only the first lookup of host waits for the answer, the expired one is refreshed in background
+// and used meanwhile, so the lookups never block the borrows or puts of connections.
+type Resolver struct {
+	ttl    time.Duration
+	lookup LookupFunc
+	retry  backoff.Config
+
+	lock  sync.Mutex
+	hosts map[string]*entry
+}
+
+type entry struct {
+	addrs      []string
+	expire     time.Time
+	next       int
+	fails      int // NOTE: the consecutive failed refreshes, backs off the next one
+	refreshing bool
+}
+
+// New new a resolver caches answers for ttl, lookup is net.LookupHost when nil.
+func New(ttl time.Duration, lookup LookupFunc) *Resolver {
+	if lookup == nil {
+		lookup = net.LookupHost
+	}
+	retry := backoff.Config{BaseDelay: ttl, MaxDelay: time.Minute, Factor: 1.6, Jitter: 0.2}
+	if retry.MaxDelay < ttl {
+		retry.MaxDelay = ttl
+	}
+	return &Resolver{ttl: ttl, lookup: lookup, retry: retry, hosts: map[string]*entry{}}
+}
+
+// Resolve resolves 'host:port' into 'ip:port', the ips of host are used round robin.
+func (r *Resolver) Resolve(addr string) (raddr string, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		err = errors.Wrapf(err, "Resolver resolve addr(%s)", addr)
+		return
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	e, err := r.entry(host)
+	if err != nil {
+		return
+	}
+	r.lock.Lock()
+	ip := e.addrs[e.next%len(e.addrs)]
+	e.next++
+	r.lock.Unlock()
+	return net.JoinHostPort(ip, port), nil
+}
+
+// Valid reports whether raddr is still in the answer of addr, the connections
+// dialed to the old address should be reaped when not valid.
+// NOTE: never looks up, the host not resolved yet is valid.
+func (r *Resolver) Valid(addr, raddr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return true
+	}
+	e := r.cached(host)
+	if e == nil {
+		return true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, a := range e.addrs {
+		if a == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// entry returns the cached entry of host, looks up and waits for the answer when not cached.
+func (r *Resolver) entry(host string) (e *entry, err error) {
+	if e = r.cached(host); e != nil {
+		return
+	}
+	addrs, err := r.lookupHost(host)
+	if err != nil {
+		err = errors.Wrapf(err, "Resolver lookup host(%s)", host)
+		return
+	}
+	r.lock.Lock()
+	e, ok := r.hosts[host]
+	if !ok { // NOTE: the concurrent first lookups, the one cached first wins
+		e = &entry{addrs: addrs, expire: time.Now().Add(r.ttl)}
+		r.hosts[host] = e
+	}
+	r.lock.Unlock()
+	return
+}
+
+// cached returns the cached entry of host or nil, starts the refresh in background when expired.
+func (r *Resolver) cached(host string) *entry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.hosts[host]
+	if !ok {
+		return nil
+	}
+	if !e.refreshing && !time.Now().Before(e.expire) {
+		e.refreshing = true
+		go r.refresh(host, e)
+	}
+	return e
+}
+
+// refresh looks up host again for the expired entry, the stale answer is kept when failed
+// and the next refresh backs off, so a DNS outage never floods the lookups and logs.
+func (r *Resolver) refresh(host string, e *entry) {
+	addrs, err := r.lookupHost(host)
+	r.lock.Lock()
+	e.refreshing = false
+	if err != nil {
+		e.expire = time.Now().Add(r.retry.Backoff(e.fails))
+		e.fails++
+	} else {
+		e.addrs, e.fails = addrs, 0
+		e.expire = time.Now().Add(r.ttl)
+	}
+	r.lock.Unlock()
+	if err != nil {
+		log.Warnf("Resolver lookup host(%s) error(%v), use the stale answer", host, err)
+	}
+}
+
+func (r *Resolver) lookupHost(host string) (addrs []string, err error) {
+	if addrs, err = r.lookup(host); err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host}
+	}
+	return
+}
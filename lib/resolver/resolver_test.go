@@ -0,0 +1,111 @@
+package resolver_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/lib/resolver"
+)
+
+type mockDNS struct {
+	lock  sync.Mutex
+	addrs []string
+	err   error
+	n     int
+}
+
+func (m *mockDNS) set(err error, addrs ...string) {
+	m.lock.Lock()
+	m.addrs, m.err = addrs, err
+	m.lock.Unlock()
+}
+
+func (m *mockDNS) lookup(host string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.n++
+	return m.addrs, m.err
+}
+
+func (m *mockDNS) times() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.n
+}
+
+// eventually polls cond until true or one second passed, the refreshes are in background.
+func eventually(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestResolver(t *testing.T) {
+	dns := &mockDNS{}
+	dns.set(nil, "10.0.0.1")
+	r := resolver.New(50*time.Millisecond, dns.lookup)
+	for i := 0; i < 3; i++ {
+		raddr, err := r.Resolve("mc.svc:11211")
+		if err != nil {
+			t.Fatalf("resolve error:%v", err)
+		}
+		if raddr != "10.0.0.1:11211" {
+			t.Fatalf("resolve got(%s) want 10.0.0.1:11211", raddr)
+		}
+	}
+	if n := dns.times(); n != 1 {
+		t.Errorf("lookup times(%d) want 1 by cache", n)
+	}
+	if raddr, _ := r.Resolve("127.0.0.1:11211"); raddr != "127.0.0.1:11211" || dns.times() != 1 {
+		t.Errorf("resolve ip got(%s) lookup times(%d)", raddr, dns.times())
+	}
+	// answer changed
+	dns.set(nil, "10.0.0.2")
+	if !r.Valid("mc.svc:11211", "10.0.0.1:11211") {
+		t.Error("old addr should be valid before ttl expired")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !eventually(func() bool { return !r.Valid("mc.svc:11211", "10.0.0.1:11211") }) {
+		t.Error("old addr should be invalid after answer changed")
+	}
+	if raddr, _ := r.Resolve("mc.svc:11211"); raddr != "10.0.0.2:11211" {
+		t.Errorf("resolve got(%s) want 10.0.0.2:11211 after answer changed", raddr)
+	}
+	// lookup failed, use the stale answer and back off
+	dns.set(errors.New("dns down"))
+	time.Sleep(60 * time.Millisecond)
+	n := dns.times()
+	for i := 0; i < 100; i++ {
+		if raddr, err := r.Resolve("mc.svc:11211"); err != nil || raddr != "10.0.0.2:11211" {
+			t.Fatalf("resolve got(%s) error(%v) want the stale answer", raddr, err)
+		}
+		if !r.Valid("mc.svc:11211", "10.0.0.2:11211") {
+			t.Fatal("stale addr should be valid when lookup failed")
+		}
+	}
+	if !eventually(func() bool { return dns.times() == n+1 }) {
+		t.Fatalf("lookup times(%d) want one refresh", dns.times()-n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	r.Valid("mc.svc:11211", "10.0.0.2:11211")
+	if m := dns.times(); m != n+1 {
+		t.Errorf("lookup times(%d) want no refresh before backoff", m-n)
+	}
+	dns.set(nil, "10.0.0.3")
+	if !eventually(func() bool { return !r.Valid("mc.svc:11211", "10.0.0.2:11211") }) {
+		t.Error("old addr should be invalid after lookup recovered")
+	}
+	dns.set(errors.New("dns down"))
+	if _, err := r.Resolve("other.svc:11211"); err == nil {
+		t.Error("resolve unknown host should error")
+	}
+	if !r.Valid("new.svc:11211", "10.0.0.9:11211") {
+		t.Error("addr of host not resolved should be valid")
+	}
+}
@@ -0,0 +1,127 @@
+package stat
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Registry is an isolated set of stat counters, the overlord instances embedded
+// in one process should use their own registry rather than the package globals.
+type Registry struct {
+	g    prometheus.Gatherer
+	hit  *prometheus.CounterVec
+	miss *prometheus.CounterVec
+}
+
+// NewRegistry new an isolated registry.
+func NewRegistry() *Registry {
+	reg := prometheus.NewRegistry()
+	return newRegistry(reg, reg)
+}
+
+func newRegistry(reg prometheus.Registerer, g prometheus.Gatherer) *Registry {
+	r := &Registry{g: g}
+	r.hit = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statHit,
+			Help: statHit,
+		}, clusterNodeLabels)
+	reg.MustRegister(r.hit)
+	r.miss = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statMiss,
+			Help: statMiss,
+		}, clusterNodeLabels)
+	reg.MustRegister(r.miss)
+	return r
+}
+
+// Hit increments one stat hit counter.
+func (r *Registry) Hit(cluster, node string) {
+	if r == nil {
+		return
+	}
+	r.hit.WithLabelValues(cluster, node).Inc()
+}
+
+// Miss increments one stat miss counter.
+func (r *Registry) Miss(cluster, node string) {
+	if r == nil {
+		return
+	}
+	r.miss.WithLabelValues(cluster, node).Inc()
+}
+
+// Reset clears all counters of registry.
+func (r *Registry) Reset() {
+	if r == nil {
+		return
+	}
+	r.hit.Reset()
+	r.miss.Reset()
+}
+
+// Gather gathers the metrics of registry.
+func (r *Registry) Gather() ([]*dto.MetricFamily, error) {
+	return r.g.Gather()
+}
+
+// Sample is one stat value, the name contains the labels but cluster, like: overlord_proxy_hit{node="a:11211"}.
+type Sample struct {
+	Name  string
+	Value float64
+}
+
+// Samples returns the counters and gauges of cluster sorted by name, and the ones of no cluster, like: response bytes.
+// The histogram is sampled as the count and sum, like: overlord_proxy_timer_count, the rates are derived by the scraper.
+func (r *Registry) Samples(cluster string) (ss []Sample) {
+	if r == nil {
+		return
+	}
+	mfs, err := r.g.Gather()
+	if err != nil {
+		return
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var ls []string
+			other := false
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "cluster" {
+					other = l.GetValue() != cluster
+					continue
+				}
+				ls = append(ls, l.GetName()+"="+strconv.Quote(l.GetValue()))
+			}
+			if other {
+				continue
+			}
+			name := mf.GetName()
+			if len(ls) > 0 {
+				name += "{" + strings.Join(ls, ",") + "}"
+			}
+			switch {
+			case m.Counter != nil:
+				ss = append(ss, Sample{Name: name, Value: m.GetCounter().GetValue()})
+			case m.Gauge != nil:
+				ss = append(ss, Sample{Name: name, Value: m.GetGauge().GetValue()})
+			case m.Histogram != nil:
+				ss = append(ss, Sample{Name: mf.GetName() + "_count" + strings.TrimPrefix(name, mf.GetName()), Value: float64(m.GetHistogram().GetSampleCount())},
+					Sample{Name: mf.GetName() + "_sum" + strings.TrimPrefix(name, mf.GetName()), Value: m.GetHistogram().GetSampleSum()})
+			}
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
+	return
+}
+
+// Handler returns the prometheus http handler of registry.
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.g, promhttp.HandlerOpts{})
+}
@@ -2,6 +2,8 @@ package stat
 
 import (
 	"net/http"
+	"sort"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -13,23 +15,108 @@ const (
 	statHit   = "overlord_proxy_hit"
 	statMiss  = "overlord_proxy_miss"
 
+	statFailOpenMiss = "overlord_proxy_fail_open_miss"
+	statChecksumMiss = "overlord_proxy_checksum_mismatch"
+
+	statStore       = "overlord_proxy_store"
+	statStoreFail   = "overlord_proxy_store_fail"
+	statCasConflict = "overlord_proxy_cas_conflict"
+	statDelete      = "overlord_proxy_delete"
+	statDeleteMiss  = "overlord_proxy_delete_miss"
+
+	statOutstanding = "overlord_proxy_outstanding"
+
+	statInflight = "overlord_proxy_inflight"
+	statOverload = "overlord_proxy_overload"
+	statOverHint = "overlord_proxy_overload_hinted"
+	statPipeline = "overlord_proxy_pipeline_throttled"
+	statMicroHit = "overlord_proxy_micro_cache_hit"
+
+	statPriorityServed = "overlord_proxy_priority_served"
+	statPriorityShed   = "overlord_proxy_priority_shed"
+
+	statHotKey     = "overlord_proxy_hot_key"
+	statHotKeyShed = "overlord_proxy_hot_key_shed"
+	statTier       = "overlord_proxy_tier"
+	statReadOnly   = "overlord_proxy_read_only_reject"
+	statAudit      = "overlord_proxy_audit_sampled"
+
+	statBackendConns  = "overlord_proxy_backend_conns"
+	statPoolActive    = "overlord_proxy_pool_active"
+	statPoolIdle      = "overlord_proxy_pool_idle"
+	statPoolMax       = "overlord_proxy_pool_max"
+	statPoolCore      = "overlord_proxy_pool_core"
+	statPoolOverflow  = "overlord_proxy_pool_overflow"
+	statConcurrency   = "overlord_proxy_concurrency_limit"
+	statBackendQueue  = "overlord_proxy_backend_queue"
+	statResponseBytes = "overlord_proxy_response_bytes"
+	statCompressSaved = "overlord_proxy_compress_saved"
+
+	statBytesIn  = "overlord_proxy_bytes_in"
+	statBytesOut = "overlord_proxy_bytes_out"
+
+	statRequestSize  = "overlord_proxy_request_size"
+	statResponseSize = "overlord_proxy_response_size"
+
 	statProxyTimer   = "overlord_proxy_timer"
 	statHandlerTimer = "overlord_proxy_handler_timer"
 )
 
 var (
-	conns        *prometheus.GaugeVec
-	gerr         *prometheus.GaugeVec
-	hit          *prometheus.CounterVec
-	miss         *prometheus.CounterVec
-	proxyTimer   *prometheus.HistogramVec
-	handlerTimer *prometheus.HistogramVec
+	conns         *prometheus.GaugeVec
+	gerr          *prometheus.GaugeVec
+	std           *Registry
+	failOpenMiss  *prometheus.CounterVec
+	checksumMiss  *prometheus.CounterVec
+	store         *prometheus.CounterVec
+	storeFail     *prometheus.CounterVec
+	casConflict   *prometheus.CounterVec
+	del           *prometheus.CounterVec
+	delMiss       *prometheus.CounterVec
+	outstanding   *prometheus.GaugeVec
+	inflight      *prometheus.GaugeVec
+	overload      *prometheus.CounterVec
+	overHint      *prometheus.CounterVec
+	pipeline      *prometheus.CounterVec
+	microHit      *prometheus.CounterVec
+	prioServed    *prometheus.CounterVec
+	prioShed      *prometheus.CounterVec
+	hotKey        *prometheus.GaugeVec
+	hotKeyShed    *prometheus.CounterVec
+	tier          *prometheus.CounterVec
+	readOnly      *prometheus.CounterVec
+	audit         *prometheus.CounterVec
+	backendConns  *prometheus.GaugeVec
+	poolActive    *prometheus.GaugeVec
+	poolIdle      *prometheus.GaugeVec
+	poolMax       *prometheus.GaugeVec
+	poolCore      *prometheus.GaugeVec
+	poolOverflow  *prometheus.GaugeVec
+	concurrency   *prometheus.GaugeVec
+	backendQueue  *prometheus.GaugeVec
+	responseBytes prometheus.Gauge
+	compressSaved *prometheus.CounterVec
+	bytesIn       *prometheus.CounterVec
+	bytesOut      *prometheus.CounterVec
+	proxyTimer    *prometheus.HistogramVec
+	handlerTimer  *prometheus.HistogramVec
+	requestSize   *prometheus.HistogramVec
+	responseSize  *prometheus.HistogramVec
 
 	clusterLabels        = []string{"cluster"}
 	clusterNodeLabels    = []string{"cluster", "node"}
 	clusterNodeErrLabels = []string{"cluster", "node", "cmd", "error"}
 	clusterCmdLabels     = []string{"cluster", "cmd"}
+	clusterPrioLabels    = []string{"cluster", "priority"}
 	clusterNodeCmdLabels = []string{"cluster", "node", "cmd"}
+	clusterKeyLabels     = []string{"cluster", "key"}
+	clusterTierLabels    = []string{"cluster", "tier", "result"}
+
+	// SizeBuckets are the upper bounds of request and response size histograms, 64B to 16MB by 4 times.
+	SizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+	hotKeyLock sync.Mutex
+	hotKeyLast = map[string]map[string]uint32{} // NOTE: the hot keys set last time of cluster
 )
 
 // Init init prometheus.
@@ -46,18 +133,119 @@ func Init() {
 			Help: statErr,
 		}, clusterNodeErrLabels)
 	prometheus.MustRegister(gerr)
-	hit = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: statHit,
-			Help: statHit,
+	std = newRegistry(prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
+	failOpenMiss = newNodeCounter(statFailOpenMiss)
+	checksumMiss = newNodeCounter(statChecksumMiss)
+	store = newNodeCounter(statStore)
+	storeFail = newNodeCounter(statStoreFail)
+	casConflict = newNodeCounter(statCasConflict)
+	del = newNodeCounter(statDelete)
+	delMiss = newNodeCounter(statDeleteMiss)
+	outstanding = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: statOutstanding,
+			Help: statOutstanding,
 		}, clusterNodeLabels)
-	prometheus.MustRegister(hit)
-	miss = prometheus.NewCounterVec(
+	prometheus.MustRegister(outstanding)
+	inflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: statInflight,
+			Help: statInflight,
+		}, clusterLabels)
+	prometheus.MustRegister(inflight)
+	overload = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: statMiss,
-			Help: statMiss,
-		}, clusterNodeLabels)
-	prometheus.MustRegister(miss)
+			Name: statOverload,
+			Help: statOverload,
+		}, clusterLabels)
+	prometheus.MustRegister(overload)
+	overHint = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statOverHint,
+			Help: statOverHint,
+		}, clusterLabels)
+	prometheus.MustRegister(overHint)
+	pipeline = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statPipeline,
+			Help: statPipeline,
+		}, clusterLabels)
+	prometheus.MustRegister(pipeline)
+	microHit = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statMicroHit,
+			Help: statMicroHit,
+		}, clusterLabels)
+	prometheus.MustRegister(microHit)
+	prioServed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statPriorityServed,
+			Help: statPriorityServed,
+		}, clusterPrioLabels)
+	prometheus.MustRegister(prioServed)
+	prioShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statPriorityShed,
+			Help: statPriorityShed,
+		}, clusterPrioLabels)
+	prometheus.MustRegister(prioShed)
+	hotKey = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: statHotKey,
+			Help: statHotKey,
+		}, clusterKeyLabels)
+	prometheus.MustRegister(hotKey)
+	hotKeyShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statHotKeyShed,
+			Help: statHotKeyShed,
+		}, clusterLabels)
+	prometheus.MustRegister(hotKeyShed)
+	tier = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statTier,
+			Help: statTier,
+		}, clusterTierLabels)
+	prometheus.MustRegister(tier)
+	readOnly = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statReadOnly,
+			Help: statReadOnly,
+		}, clusterLabels)
+	prometheus.MustRegister(readOnly)
+	audit = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statAudit,
+			Help: statAudit,
+		}, clusterLabels)
+	prometheus.MustRegister(audit)
+	backendConns = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: statBackendConns,
+			Help: statBackendConns,
+		}, clusterLabels)
+	prometheus.MustRegister(backendConns)
+	poolActive = newNodeGauge(statPoolActive)
+	poolIdle = newNodeGauge(statPoolIdle)
+	poolMax = newNodeGauge(statPoolMax)
+	poolCore = newNodeGauge(statPoolCore)
+	poolOverflow = newNodeGauge(statPoolOverflow)
+	concurrency = newNodeGauge(statConcurrency)
+	backendQueue = newNodeGauge(statBackendQueue)
+	responseBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: statResponseBytes,
+			Help: statResponseBytes,
+		})
+	prometheus.MustRegister(responseBytes)
+	compressSaved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: statCompressSaved,
+			Help: statCompressSaved,
+		}, clusterLabels)
+	prometheus.MustRegister(compressSaved)
+	bytesIn = newNodeCounter(statBytesIn)
+	bytesOut = newNodeCounter(statBytesOut)
 	proxyTimer = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    statProxyTimer,
@@ -72,10 +260,44 @@ func Init() {
 			Buckets: prometheus.LinearBuckets(0, 10, 1),
 		}, clusterNodeCmdLabels)
 	prometheus.MustRegister(handlerTimer)
+	requestSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    statRequestSize,
+			Help:    statRequestSize,
+			Buckets: SizeBuckets,
+		}, clusterCmdLabels)
+	prometheus.MustRegister(requestSize)
+	responseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    statResponseSize,
+			Help:    statResponseSize,
+			Buckets: SizeBuckets,
+		}, clusterCmdLabels)
+	prometheus.MustRegister(responseSize)
 	// metrics
 	metrics()
 }
 
+func newNodeCounter(name string) *prometheus.CounterVec {
+	cv := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: name,
+		}, clusterNodeLabels)
+	prometheus.MustRegister(cv)
+	return cv
+}
+
+func newNodeGauge(name string) *prometheus.GaugeVec {
+	gv := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: name,
+			Help: name,
+		}, clusterNodeLabels)
+	prometheus.MustRegister(gv)
+	return gv
+}
+
 func metrics() {
 	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
 		h := promhttp.Handler()
@@ -125,16 +347,323 @@ func ConnDecr(cluster string) {
 
 // Hit increments one stat hit counter.
 func Hit(cluster, node string) {
-	if hit == nil {
-		return
-	}
-	hit.WithLabelValues(cluster, node).Inc()
+	std.Hit(cluster, node)
 }
 
 // Miss decrements one stat miss counter.
 func Miss(cluster, node string) {
-	if miss == nil {
+	std.Miss(cluster, node)
+}
+
+// Samples returns the stat values of cluster, nil when stat not inited.
+func Samples(cluster string) []Sample {
+	return std.Samples(cluster)
+}
+
+// RegistrySamples returns the stat values of cluster counted into registry r and the package globals, sorted by name.
+func RegistrySamples(r *Registry, cluster string) []Sample {
+	ss := append(std.Samples(cluster), r.Samples(cluster)...)
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
+	return ss
+}
+
+// FailOpenMiss increments one stat miss counter synthesized by fail open on backend error,
+// which is not counted by Miss.
+func FailOpenMiss(cluster, node string) {
+	if failOpenMiss == nil {
+		return
+	}
+	failOpenMiss.WithLabelValues(cluster, node).Inc()
+}
+
+// ChecksumMismatch increments one stat value checksum mismatch counter.
+func ChecksumMismatch(cluster, node string) {
+	if checksumMiss == nil {
+		return
+	}
+	checksumMiss.WithLabelValues(cluster, node).Inc()
+}
+
+// Reset clears all stat counters and histograms, the gauges of live state are kept.
+// It is safe to be called concurrently, like: between tests.
+func Reset() {
+	std.Reset()
+	for _, cv := range []*prometheus.CounterVec{failOpenMiss, checksumMiss, store, storeFail, casConflict, del, delMiss, overload, overHint, pipeline, microHit, prioServed, prioShed, hotKeyShed, tier, readOnly, audit, compressSaved, bytesIn, bytesOut} {
+		if cv != nil {
+			cv.Reset()
+		}
+	}
+	for _, hv := range []*prometheus.HistogramVec{proxyTimer, handlerTimer, requestSize, responseSize} {
+		if hv != nil {
+			hv.Reset()
+		}
+	}
+	if gerr != nil {
+		gerr.Reset() // NOTE: error gauge works as a counter
+	}
+}
+
+// OutstandingIncr increments one stat outstanding request gauge.
+func OutstandingIncr(cluster, node string) {
+	if outstanding == nil {
+		return
+	}
+	outstanding.WithLabelValues(cluster, node).Inc()
+}
+
+// OutstandingDecr decrements one stat outstanding request gauge.
+func OutstandingDecr(cluster, node string) {
+	if outstanding == nil {
+		return
+	}
+	outstanding.WithLabelValues(cluster, node).Dec()
+}
+
+// Store increments one stat stored counter.
+func Store(cluster, node string) {
+	if store == nil {
+		return
+	}
+	store.WithLabelValues(cluster, node).Inc()
+}
+
+// StoreFail increments one stat not stored counter.
+func StoreFail(cluster, node string) {
+	if storeFail == nil {
+		return
+	}
+	storeFail.WithLabelValues(cluster, node).Inc()
+}
+
+// CasConflict increments one stat cas exists counter.
+func CasConflict(cluster, node string) {
+	if casConflict == nil {
+		return
+	}
+	casConflict.WithLabelValues(cluster, node).Inc()
+}
+
+// Delete increments one stat deleted counter.
+func Delete(cluster, node string) {
+	if del == nil {
+		return
+	}
+	del.WithLabelValues(cluster, node).Inc()
+}
+
+// DeleteMiss increments one stat delete not found counter.
+func DeleteMiss(cluster, node string) {
+	if delMiss == nil {
+		return
+	}
+	delMiss.WithLabelValues(cluster, node).Inc()
+}
+
+// InflightIncr increments one stat in-flight request gauge.
+func InflightIncr(cluster string) {
+	if inflight == nil {
+		return
+	}
+	inflight.WithLabelValues(cluster).Inc()
+}
+
+// InflightDecr decrements one stat in-flight request gauge.
+func InflightDecr(cluster string) {
+	if inflight == nil {
+		return
+	}
+	inflight.WithLabelValues(cluster).Dec()
+}
+
+// Overload increments one stat overload rejected counter.
+func Overload(cluster string) {
+	if overload == nil {
+		return
+	}
+	overload.WithLabelValues(cluster).Inc()
+}
+
+// OverloadHint increments one stat overload rejected with backoff hint counter.
+func OverloadHint(cluster string) {
+	if overHint == nil {
+		return
+	}
+	overHint.WithLabelValues(cluster).Inc()
+}
+
+// PipelineThrottle increments one stat client read throttled by max pipeline counter.
+func PipelineThrottle(cluster string) {
+	if pipeline == nil {
+		return
+	}
+	pipeline.WithLabelValues(cluster).Inc()
+}
+
+// MicroCacheHit increments one stat get replied by micro cache counter.
+func MicroCacheHit(cluster string) {
+	if microHit == nil {
+		return
+	}
+	microHit.WithLabelValues(cluster).Inc()
+}
+
+// PriorityServed increments one stat served request counter of priority.
+func PriorityServed(cluster, prio string) {
+	if prioServed == nil {
+		return
+	}
+	prioServed.WithLabelValues(cluster, prio).Inc()
+}
+
+// PriorityShed increments one stat shed request counter of priority.
+func PriorityShed(cluster, prio string) {
+	if prioShed == nil {
+		return
+	}
+	prioShed.WithLabelValues(cluster, prio).Inc()
+}
+
+// HotKeys sets stat hot key gauges of cluster to the counts in last window, the keys no longer hot are removed.
+func HotKeys(cluster string, keys map[string]uint32) {
+	if hotKey == nil {
+		return
+	}
+	hotKeyLock.Lock()
+	defer hotKeyLock.Unlock()
+	for key := range hotKeyLast[cluster] {
+		if _, ok := keys[key]; !ok {
+			hotKey.DeleteLabelValues(cluster, key)
+		}
+	}
+	for key, n := range keys {
+		hotKey.WithLabelValues(cluster, key).Set(float64(n))
+	}
+	hotKeyLast[cluster] = keys
+}
+
+// HotKeyShed increments one stat hot key shed request counter.
+func HotKeyShed(cluster string) {
+	if hotKeyShed == nil {
+		return
+	}
+	hotKeyShed.WithLabelValues(cluster).Inc()
+}
+
+// Tier increments one stat request counter of cache tier by result, like: hit|miss|populate|write|error.
+func Tier(cluster, t, result string) {
+	if tier == nil {
+		return
+	}
+	tier.WithLabelValues(cluster, t, result).Inc()
+}
+
+// ReadOnlyReject increments one stat write rejected by read-only mode counter.
+func ReadOnlyReject(cluster string) {
+	if readOnly == nil {
+		return
+	}
+	readOnly.WithLabelValues(cluster).Inc()
+}
+
+// AuditSampled increments one stat audit sampled command counter.
+func AuditSampled(cluster string) {
+	if audit == nil {
+		return
+	}
+	audit.WithLabelValues(cluster).Inc()
+}
+
+// BackendConns sets stat active backend connections gauge.
+func BackendConns(cluster string, n int) {
+	if backendConns == nil {
+		return
+	}
+	backendConns.WithLabelValues(cluster).Set(float64(n))
+}
+
+// PoolConns sets stat active, idle and max connections gauges of node pool,
+// the active/max ratio is the pool utilization.
+func PoolConns(cluster, node string, active, idle, max int) {
+	if poolActive == nil {
+		return
+	}
+	poolActive.WithLabelValues(cluster, node).Set(float64(active))
+	poolIdle.WithLabelValues(cluster, node).Set(float64(idle))
+	poolMax.WithLabelValues(cluster, node).Set(float64(max))
+}
+
+// PoolOverflow sets stat core and overflow connections gauges of node pool,
+// the overflow ones are allocated beyond the pool active on burst.
+func PoolOverflow(cluster, node string, core, overflow int) {
+	if poolCore == nil {
+		return
+	}
+	poolCore.WithLabelValues(cluster, node).Set(float64(core))
+	poolOverflow.WithLabelValues(cluster, node).Set(float64(overflow))
+}
+
+// ConcurrencyLimit sets stat adaptive concurrency limit gauge of node.
+func ConcurrencyLimit(cluster, node string, limit int) {
+	if concurrency == nil {
+		return
+	}
+	concurrency.WithLabelValues(cluster, node).Set(float64(limit))
+}
+
+// BackendQueue sets stat backend queue depth gauge of node.
+func BackendQueue(cluster, node string, n int) {
+	if backendQueue == nil {
+		return
+	}
+	backendQueue.WithLabelValues(cluster, node).Set(float64(n))
+}
+
+// ResponseBytes sets stat response buffer bytes in flight gauge of all clusters.
+func ResponseBytes(n int64) {
+	if responseBytes == nil {
+		return
+	}
+	responseBytes.Set(float64(n))
+}
+
+// CompressSaved adds the bytes saved by client response compression.
+// NOTE: n must not be negative, the bytes expanded are paid off by the writer before counted.
+func CompressSaved(cluster string, n int) {
+	if compressSaved == nil || n <= 0 {
+		return
+	}
+	compressSaved.WithLabelValues(cluster).Add(float64(n))
+}
+
+// BytesIn adds the response bytes read from node into stat counter.
+func BytesIn(cluster, node string, n int) {
+	if bytesIn == nil {
+		return
+	}
+	bytesIn.WithLabelValues(cluster, node).Add(float64(n))
+}
+
+// BytesOut adds the request bytes written into node into stat counter.
+func BytesOut(cluster, node string, n int) {
+	if bytesOut == nil {
+		return
+	}
+	bytesOut.WithLabelValues(cluster, node).Add(float64(n))
+}
+
+// RequestSize observes the request bytes written into node into stat histogram.
+func RequestSize(cluster, cmd string, n int) {
+	if requestSize == nil {
+		return
+	}
+	requestSize.WithLabelValues(cluster, cmd).Observe(float64(n))
+}
+
+// ResponseSize observes the response bytes read from node into stat histogram,
+// the spike of giant ones may be an anomaly, like: a bad multi-get.
+func ResponseSize(cluster, cmd string, n int) {
+	if responseSize == nil {
 		return
 	}
-	miss.WithLabelValues(cluster, node).Inc()
+	responseSize.WithLabelValues(cluster, cmd).Observe(float64(n))
 }
@@ -0,0 +1,51 @@
+package stat_test
+
+import (
+	"testing"
+
+	"github.com/felixhao/overlord/lib/stat"
+)
+
+func counter(t *testing.T, r *stat.Registry, name, node string) float64 {
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatalf("gather error:%v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "node" && l.GetValue() == node {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestRegistry(t *testing.T) {
+	r1, r2 := stat.NewRegistry(), stat.NewRegistry()
+	r1.Hit("c", "n1")
+	r1.Hit("c", "n1")
+	r1.Miss("c", "n1")
+	r2.Hit("c", "n1")
+	if v := counter(t, r1, "overlord_proxy_hit", "n1"); v != 2 {
+		t.Errorf("registry1 hit(%v) want 2", v)
+	}
+	if v := counter(t, r2, "overlord_proxy_hit", "n1"); v != 1 {
+		t.Errorf("registry2 hit(%v) want 1, registries not isolated", v)
+	}
+	r1.Reset()
+	if h, m := counter(t, r1, "overlord_proxy_hit", "n1"), counter(t, r1, "overlord_proxy_miss", "n1"); h != 0 || m != 0 {
+		t.Errorf("registry1 hit(%v) miss(%v) want 0 after reset", h, m)
+	}
+	if v := counter(t, r2, "overlord_proxy_hit", "n1"); v != 1 {
+		t.Errorf("registry2 hit(%v) want 1 after registry1 reset", v)
+	}
+	var nilr *stat.Registry
+	nilr.Hit("c", "n1") // NOTE: no-op, like stat not inited
+	stat.Reset()
+}
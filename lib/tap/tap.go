@@ -0,0 +1,140 @@
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	errs "errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// errors
+var (
+	ErrReplayMismatch = errs.New("tap: replay request mismatch")
+)
+
+// Recorder records framed request/response pairs into writer.
+// Frame format: 4 bytes request length, request, 4 bytes response length, response.
+type Recorder struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewRecorder new a recorder writes frames into w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Conn returns a conn tees the bytes written and read into recorder.
+func (r *Recorder) Conn(c net.Conn) *Conn {
+	return &Conn{Conn: c, r: r}
+}
+
+func (r *Recorder) record(req, resp []byte) (err error) {
+	var l [4]byte
+	r.lock.Lock()
+	for _, bs := range [][]byte{req, resp} {
+		binary.BigEndian.PutUint32(l[:], uint32(len(bs)))
+		if _, err = r.w.Write(l[:]); err != nil {
+			break
+		}
+		if _, err = r.w.Write(bs); err != nil {
+			break
+		}
+	}
+	r.lock.Unlock()
+	return
+}
+
+// Conn is a net.Conn tees bytes into the recorder, the bytes are not altered.
+type Conn struct {
+	net.Conn
+	r    *Recorder
+	req  bytes.Buffer
+	resp bytes.Buffer
+}
+
+// Read reads from conn and tees the bytes as response.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.resp.Write(p[:n])
+	return
+}
+
+// Write writes into conn and tees the bytes as request.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.req.Write(p[:n])
+	return
+}
+
+// Record records the pending request/response pair as one frame.
+func (c *Conn) Record() error {
+	if c.req.Len() == 0 && c.resp.Len() == 0 {
+		return nil
+	}
+	err := c.r.record(c.req.Bytes(), c.resp.Bytes())
+	c.req.Reset()
+	c.resp.Reset()
+	return err
+}
+
+// Pair is a recorded request/response pair.
+type Pair struct {
+	Req  []byte
+	Resp []byte
+}
+
+// ReadPair reads one frame from r, returns io.EOF when no more frame.
+func ReadPair(r io.Reader) (p *Pair, err error) {
+	p = &Pair{}
+	if p.Req, err = readFrame(r); err != nil {
+		return nil, err
+	}
+	if p.Resp, err = readFrame(r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return
+}
+
+func readFrame(r io.Reader) (bs []byte, err error) {
+	var l [4]byte
+	if _, err = io.ReadFull(r, l[:]); err != nil {
+		return
+	}
+	bs = make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err = io.ReadFull(r, bs); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// Replay acts as the recorded backend on conn, for every recorded pair it reads
+// the request, checks it equal to the recorded one and writes the recorded response.
+func Replay(conn net.Conn, r io.Reader) error {
+	for {
+		p, err := ReadPair(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "tap Replay read pair")
+		}
+		req := make([]byte, len(p.Req))
+		if _, err = io.ReadFull(conn, req); err != nil {
+			return errors.Wrap(err, "tap Replay read request")
+		}
+		if !bytes.Equal(req, p.Req) {
+			return errors.Wrapf(ErrReplayMismatch, "tap Replay got(%q) want(%q)", req, p.Req)
+		}
+		if _, err = conn.Write(p.Resp); err != nil {
+			return errors.Wrap(err, "tap Replay write response")
+		}
+	}
+}
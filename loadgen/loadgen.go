@@ -0,0 +1,229 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	errs "errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/felixhao/overlord/lib/pool"
+	"github.com/felixhao/overlord/proto"
+	"github.com/felixhao/overlord/proto/memcache"
+	"github.com/pkg/errors"
+)
+
+// key distributions.
+const (
+	DistUniform = "uniform"
+	DistZipfian = "zipfian"
+)
+
+const (
+	defaultZipfS = 1.1 // NOTE: must be greater than 1, the larger the more skewed
+	keyPrefix    = "loadgen_"
+)
+
+// loadgen errors
+var (
+	ErrDist = errs.New("loadgen key distribution unsupported")
+)
+
+// Config is the load config, the requests are driven by Concurrency workers until
+// Requests sent or Duration elapsed, whichever first, zero means no limit of either.
+type Config struct {
+	Addr        string
+	CacheType   proto.CacheType
+	Concurrency int
+	Requests    int64
+	Duration    time.Duration
+	Keys        int     // NOTE: the key space, like: loadgen_0..loadgen_<Keys-1>
+	Dist        string  // NOTE: uniform|zipfian, empty means uniform
+	ZipfS       float64 // NOTE: the zipfian skew, zero means 1.1
+	ValueSize   int
+	ReadRatio   float64 // NOTE: the share of get, the others are set
+	Timeout     time.Duration
+}
+
+// Report is the result of load.
+type Report struct {
+	Requests int64
+	Errors   int64
+	Hits     int64
+	Misses   int64
+	Elapsed  time.Duration
+	// Latencies are the percentiles of request latency, like: 50|90|99|99.9.
+	Latencies map[float64]time.Duration
+}
+
+// Percentiles are the latency percentiles reported.
+var Percentiles = []float64{50, 90, 99, 99.9}
+
+// Throughput returns the requests per second.
+func (r *Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// Run drives the server by the real handler and pool of proxy, reports when done or ctx canceled.
+func Run(ctx context.Context, c *Config) (*Report, error) {
+	var dial func() (pool.Conn, error)
+	switch c.CacheType {
+	case proto.CacheTypeMemcache, "":
+		dial = memcache.Dial("loadgen", c.Addr, c.Timeout, c.Timeout, c.Timeout)
+	default:
+		return nil, errors.Wrapf(proto.ErrNoSupportCacheType, "loadgen run cache type(%s)", c.CacheType)
+	}
+	if c.Dist != "" && c.Dist != DistUniform && c.Dist != DistZipfian {
+		return nil, errors.Wrapf(ErrDist, "loadgen run dist(%s)", c.Dist)
+	}
+	n := c.Concurrency
+	if n <= 0 {
+		n = 1
+	}
+	p := pool.NewPool(pool.PoolDial(dial), pool.PoolActive(n), pool.PoolIdle(n))
+	defer p.Close()
+	if c.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Duration)
+		defer cancel()
+	}
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		sent int64
+		r    = &Report{}
+		lats []time.Duration
+	)
+	next := func() bool { // NOTE: reserves one request of the limit
+		lock.Lock()
+		defer lock.Unlock()
+		if c.Requests > 0 && sent >= c.Requests {
+			return false
+		}
+		sent++
+		return true
+	}
+	value := bytes.Repeat([]byte{'v'}, c.ValueSize)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			w := newWorker(c, seed, value)
+			for ctx.Err() == nil && next() {
+				w.do(p)
+			}
+			lock.Lock()
+			r.Requests += w.r.Requests
+			r.Errors += w.r.Errors
+			r.Hits += w.r.Hits
+			r.Misses += w.r.Misses
+			lats = append(lats, w.lats...)
+			lock.Unlock()
+		}(start.UnixNano() + int64(i))
+	}
+	wg.Wait()
+	r.Elapsed = time.Since(start)
+	r.Latencies = percentiles(lats)
+	return r, nil
+}
+
+// percentiles returns the latency percentiles, empty when no latency.
+func percentiles(lats []time.Duration) map[float64]time.Duration {
+	ps := make(map[float64]time.Duration, len(Percentiles))
+	if len(lats) == 0 {
+		return ps
+	}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	for _, p := range Percentiles {
+		i := int(float64(len(lats))*p/100+0.5) - 1
+		if i < 0 {
+			i = 0
+		} else if i >= len(lats) {
+			i = len(lats) - 1
+		}
+		ps[p] = lats[i]
+	}
+	return ps
+}
+
+// worker sends requests one by one, like a client connection.
+type worker struct {
+	c     *Config
+	rand  *rand.Rand
+	zipf  *rand.Zipf
+	value []byte
+	buf   bytes.Buffer
+	r     Report
+	lats  []time.Duration
+}
+
+func newWorker(c *Config, seed int64, value []byte) *worker {
+	w := &worker{c: c, rand: rand.New(rand.NewSource(seed)), value: value}
+	if c.Dist == DistZipfian && c.Keys > 1 {
+		s := c.ZipfS
+		if s <= 1 {
+			s = defaultZipfS
+		}
+		w.zipf = rand.NewZipf(w.rand, s, 1, uint64(c.Keys-1))
+	}
+	return w
+}
+
+// key returns the next key by distribution.
+func (w *worker) key() string {
+	var k uint64
+	switch {
+	case w.zipf != nil:
+		k = w.zipf.Uint64()
+	case w.c.Keys > 1:
+		k = uint64(w.rand.Intn(w.c.Keys))
+	}
+	return keyPrefix + strconv.FormatUint(k, 10)
+}
+
+// do sends one get or set by read ratio, the request is decoded as from a client.
+func (w *worker) do(p *pool.Pool) {
+	w.buf.Reset()
+	key := w.key()
+	if w.rand.Float64() < w.c.ReadRatio {
+		w.buf.WriteString("get " + key + "\r\n")
+	} else {
+		w.buf.WriteString("set " + key + " 0 0 " + strconv.Itoa(len(w.value)) + "\r\n")
+		w.buf.Write(w.value)
+		w.buf.WriteString("\r\n")
+	}
+	w.r.Requests++
+	req, err := memcache.NewDecoder(&w.buf).Decode()
+	if err != nil {
+		w.r.Errors++
+		return
+	}
+	start := time.Now()
+	conn := p.Get()
+	hdl, ok := conn.(proto.Handler)
+	if !ok {
+		w.r.Errors++
+		return
+	}
+	resp, err := hdl.Handle(req)
+	w.lats = append(w.lats, time.Since(start))
+	p.Put(conn, err != nil)
+	if err != nil || resp.Err() != nil {
+		w.r.Errors++
+		return
+	}
+	switch resp.Status() {
+	case "HIT":
+		w.r.Hits++
+	case "MISS":
+		w.r.Misses++
+	}
+	resp.Release()
+}
@@ -0,0 +1,100 @@
+package loadgen_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/loadgen"
+	"github.com/pkg/errors"
+)
+
+// mockStore is the mock memcache server of get|set.
+func mockStore(t *testing.T) (addr string, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		lock  sync.Mutex
+		items = map[string]string{}
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fs := strings.Fields(line)
+					switch fs[0] {
+					case "get":
+						lock.Lock()
+						v, ok := items[fs[1]]
+						lock.Unlock()
+						if ok {
+							conn.Write([]byte("VALUE " + fs[1] + " 0 " + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"))
+						}
+						conn.Write([]byte("END\r\n"))
+					case "set":
+						n, _ := strconv.Atoi(fs[4])
+						data := make([]byte, n+2)
+						if _, err = io.ReadFull(br, data); err != nil {
+							return
+						}
+						lock.Lock()
+						items[fs[1]] = string(data[:n])
+						lock.Unlock()
+						conn.Write([]byte("STORED\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestRun(t *testing.T) {
+	addr, closer := mockStore(t)
+	defer closer()
+	r, err := loadgen.Run(context.Background(), &loadgen.Config{
+		Addr:        addr,
+		Concurrency: 4,
+		Requests:    1000,
+		Keys:        100,
+		Dist:        loadgen.DistZipfian,
+		ValueSize:   16,
+		ReadRatio:   0.5,
+		Timeout:     time.Second,
+	})
+	if err != nil {
+		t.Fatalf("run error:%v", err)
+	}
+	if r.Requests != 1000 || r.Errors != 0 {
+		t.Fatalf("requests(%d) errors(%d) want 1000 without error", r.Requests, r.Errors)
+	}
+	if r.Hits == 0 || r.Misses == 0 || r.Hits+r.Misses >= r.Requests {
+		t.Errorf("hits(%d) misses(%d) want both of the gets", r.Hits, r.Misses)
+	}
+	if p50, p99 := r.Latencies[50], r.Latencies[99]; p50 <= 0 || p99 < p50 {
+		t.Errorf("p50(%v) p99(%v) want ordered percentiles", p50, p99)
+	}
+	if r.Throughput() <= 0 {
+		t.Errorf("throughput(%v) want positive", r.Throughput())
+	}
+	if _, err = loadgen.Run(context.Background(), &loadgen.Config{Addr: addr, Dist: "none"}); errors.Cause(err) != loadgen.ErrDist {
+		t.Errorf("run dist none error(%v) want ErrDist", err)
+	}
+}
@@ -0,0 +1,48 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DetectCacheType connects to the server and sniffs the protocol it speaks by the reply shape:
+// memcache replies 'VERSION <version>' to 'version', and redis replies '+PONG' or '-NOAUTH' to 'PING'.
+// It returns CacheTypeUnknown when neither.
+func DetectCacheType(addr string, timeout time.Duration) (ct CacheType, err error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		err = errors.Wrapf(err, "Detect cache type dial addr(%s)", addr)
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for _, probe := range []struct {
+		req     string
+		replies [][]byte
+		ct      CacheType
+	}{
+		{"version\r\n", [][]byte{[]byte("VERSION ")}, CacheTypeMemcache},
+		{"PING\r\n", [][]byte{[]byte("+PONG"), []byte("-NOAUTH")}, CacheTypeRedis},
+	} {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err = conn.Write([]byte(probe.req)); err != nil {
+			err = errors.Wrapf(err, "Detect cache type write addr(%s)", addr)
+			return
+		}
+		var bs []byte
+		if bs, err = br.ReadSlice('\n'); err != nil {
+			err = errors.Wrapf(err, "Detect cache type read addr(%s)", addr)
+			return
+		}
+		for _, reply := range probe.replies {
+			if bytes.HasPrefix(bs, reply) {
+				return probe.ct, nil
+			}
+		}
+	}
+	return CacheTypeUnknown, nil
+}
@@ -0,0 +1,106 @@
+package memcache
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NOTE: the admin commands are never decoded from client, only issued by admin API through RawHandler.
+
+// CacheMemlimit sets the memory limit in megabytes of node by 'cache_memlimit <megabytes>\r\n'.
+func CacheMemlimit(rh RawHandler, mb int) (err error) {
+	req := []byte(RequestTypeCacheMemlimit.String() + " " + strconv.Itoa(mb) + "\r\n")
+	bs, err := rh.HandleRaw(req, RawReplyLine)
+	if err != nil {
+		err = errors.Wrap(err, "MC CacheMemlimit handle")
+		return
+	}
+	if !bytes.Equal(bs, okBytes) {
+		err = replyError(bs)
+	}
+	return
+}
+
+// LruCrawler enables or disables the LRU crawler of node by 'lru_crawler <enable|disable>\r\n'.
+func LruCrawler(rh RawHandler, enable bool) (err error) {
+	arg := "disable"
+	if enable {
+		arg = "enable"
+	}
+	return okCommand(rh, RequestTypeLruCrawler.String()+" "+arg)
+}
+
+// LruCrawlerMetadump streams the metadata of all items of node into w by 'lru_crawler metadump all\r\n',
+// the reply lines are terminated by 'END\r\n'.
+func LruCrawlerMetadump(sh RawStreamHandler, w io.Writer) (err error) {
+	req := []byte(RequestTypeLruCrawler.String() + " metadump all\r\n")
+	if err = sh.HandleRawStream(req, w); err != nil {
+		err = errors.Wrap(err, "MC LruCrawlerMetadump handle")
+	}
+	return
+}
+
+// Lru tunes the LRU of node by 'lru <args>\r\n', like: 'lru mode flat'.
+func Lru(rh RawHandler, args []string) (err error) {
+	if len(args) == 0 {
+		return errors.Wrap(ErrBadRequest, "MC Lru args")
+	}
+	for _, arg := range args {
+		if !isAdminArg(arg) {
+			return errors.Wrapf(ErrBadRequest, "MC Lru arg(%q)", arg)
+		}
+	}
+	return okCommand(rh, RequestTypeLru.String()+" "+strings.Join(args, " "))
+}
+
+// StatsReset resets the stats counters of node by 'stats reset\r\n', which replies 'RESET\r\n'.
+func StatsReset(rh RawHandler) (err error) {
+	bs, err := rh.HandleRaw([]byte(RequestTypeStats.String()+" reset\r\n"), RawReplyLine)
+	if err != nil {
+		err = errors.Wrap(err, "MC StatsReset handle")
+		return
+	}
+	if !bytes.Equal(bs, resetBytes) {
+		err = replyError(bs)
+	}
+	return
+}
+
+// okCommand handles the admin command which replies 'OK\r\n'.
+func okCommand(rh RawHandler, cmd string) (err error) {
+	bs, err := rh.HandleRaw([]byte(cmd+"\r\n"), RawReplyLine)
+	if err != nil {
+		err = errors.Wrapf(err, "MC admin handle(%s)", cmd)
+		return
+	}
+	if !bytes.Equal(bs, okBytes) {
+		err = replyError(bs)
+	}
+	return
+}
+
+// isAdminArg reports whether arg is safe to be sent as one admin command argument.
+func isAdminArg(arg string) bool {
+	if arg == "" {
+		return false
+	}
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// replyError returns the error of unexpected admin command reply.
+func replyError(bs []byte) error {
+	if bytes.Equal(bs, []byte(errorPrefix+"\r\n")) {
+		return errors.Wrap(ErrError, "MC admin reply")
+	}
+	return errors.Wrapf(ErrBadResponse, "MC admin reply(%q)", bs)
+}
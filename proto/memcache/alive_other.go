@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package memcache
+
+import "net"
+
+// peekAlive always reports alive, the non-blocking peek is not supported on this platform.
+func peekAlive(conn net.Conn) bool {
+	return true
+}
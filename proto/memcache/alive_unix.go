@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package memcache
+
+import (
+	"net"
+	"syscall"
+)
+
+// peekAlive peeks one byte without blocking, EAGAIN means nothing pending and the conn is alive.
+func peekAlive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var (
+		b    [1]byte
+		n    int
+		perr error
+	)
+	if err = rc.Read(func(fd uintptr) bool {
+		n, _, perr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true // NOTE: never wait for readable
+	}); err != nil {
+		return false
+	}
+	return n <= 0 && (perr == syscall.EAGAIN || perr == syscall.EWOULDBLOCK)
+}
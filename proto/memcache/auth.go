@@ -0,0 +1,49 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	errs "errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// authentication errors
+var (
+	ErrAuth = errs.New("SERVER_ERROR backend authentication failed")
+)
+
+// Credential is the user and token of ASCII authentication.
+type Credential struct {
+	User  string
+	Token string
+}
+
+// CredentialProvider returns the current credential, the connections authenticated by an old one
+// are stale and drained, like: the short-lived token rotated by secrets manager.
+// NOTE: called by every dial and stale check, so must be cheap.
+type CredentialProvider func() Credential
+
+// authenticate authenticates the new connection by 'set <key> <flags> <exptime> <bytes>\r\n<user> <token>\r\n',
+// the key, flags and exptime are ignored by server, and replies 'STORED' when succeeded.
+func authenticate(conn net.Conn, cred Credential, timeout time.Duration) error {
+	data := cred.User + " " + cred.Token
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if _, err := conn.Write([]byte("set auth 0 0 " + strconv.Itoa(len(data)) + "\r\n" + data + "\r\n")); err != nil {
+		return errors.Wrap(err, "MC authenticate write request bytes")
+	}
+	bs, err := bufio.NewReaderSize(conn, 64).ReadSlice(delim) // NOTE: nothing pending after the reply
+	if err != nil {
+		return errors.Wrap(err, "MC authenticate read response bytes")
+	}
+	if !bytes.Equal(bs, storedBytes) {
+		return errors.Wrapf(ErrAuth, "MC authenticate user(%s) response(%q)", cred.User, bs)
+	}
+	return nil
+}
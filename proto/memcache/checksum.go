@@ -0,0 +1,64 @@
+package memcache
+
+import (
+	"bytes"
+	"hash/crc32"
+)
+
+// FlagChecksum is the flags bit marks the value is appended with its checksum.
+// NOTE: reserved by proxy, the value marked by it is verified even after checksum disabled, clients must not use it.
+const FlagChecksum = uint32(1 << 30)
+
+// Checksum sums the value for integrity check, the sum is stored after the value.
+type Checksum interface {
+	// Size returns the fixed length of sum.
+	Size() int
+	// Sum returns the sum of value.
+	Sum(value []byte) []byte
+}
+
+type crc32Checksum struct {
+	table *crc32.Table
+}
+
+// CRC32 returns the crc32 castagnoli checksum.
+func CRC32() Checksum {
+	return &crc32Checksum{table: crc32.MakeTable(crc32.Castagnoli)}
+}
+
+func (c *crc32Checksum) Size() int {
+	return crc32.Size
+}
+
+func (c *crc32Checksum) Sum(value []byte) []byte {
+	s := crc32.Checksum(value, c.table)
+	return []byte{byte(s >> 24), byte(s >> 16), byte(s >> 8), byte(s)}
+}
+
+// ChecksumCodec returns the value codec appends the sum to value, and verifies then strips it.
+// The mismatched value fails to decode with ErrChecksum.
+func ChecksumCodec(cs Checksum) ValueCodec {
+	return &checksumCodec{cs: cs}
+}
+
+type checksumCodec struct {
+	cs Checksum
+}
+
+func (c *checksumCodec) Flag() uint32 {
+	return FlagChecksum
+}
+
+func (c *checksumCodec) Encode(key, value []byte) ([]byte, uint32, error) {
+	nv := make([]byte, 0, len(value)+c.cs.Size())
+	nv = append(nv, value...)
+	return append(nv, c.cs.Sum(value)...), FlagChecksum, nil
+}
+
+func (c *checksumCodec) Decode(key, value []byte, flags uint32) ([]byte, error) {
+	n := len(value) - c.cs.Size()
+	if n < 0 || !bytes.Equal(c.cs.Sum(value[:n]), value[n:]) {
+		return nil, ErrChecksum
+	}
+	return value[:n], nil
+}
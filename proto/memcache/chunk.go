@@ -0,0 +1,316 @@
+package memcache
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/felixhao/overlord/lib/conv"
+	"github.com/felixhao/overlord/proto"
+	"github.com/pkg/errors"
+)
+
+// FlagChunked is the flags bit marks the value is a chunk manifest.
+// NOTE: reserved by proxy when chunking enabled, clients must not use it.
+const FlagChunked = uint32(1 << 31)
+
+// chunkSet splits the large set value into chunks '<key>:<i>' and stores them
+// with a manifest '<count> <length>' under '<key>' on the same connection.
+// ok is false means the value no need to be chunked.
+// NOTE: the chunks of noreply set are stored with replies still, which are read but not replied.
+func (h *handler) chunkSet(mcr *MCRequest, data []byte) (resp *proto.Response, ok bool, err error) {
+	i := bytes.Index(data, crlfBytes)
+	if i < 0 {
+		return
+	}
+	fs := bytes.Fields(data[:i]) // NOTE: <flags> <exptime> <bytes> [noreply]
+	noreply := len(fs) == 4 && bytes.Equal(fs[3], noreplyBytes)
+	if len(fs) != 3 && !noreply {
+		return
+	}
+	length, err1 := conv.ParseLen(fs[2])
+	flags, err2 := conv.Btoi(fs[0])
+	if err1 != nil || err2 != nil || length <= int64(h.chunkSize) || len(data) < i+2+int(length) {
+		return // NOTE: let backend reply the bad request
+	}
+	ok = true
+	value := data[i+2 : i+2+int(length)]
+	n := (len(value) + h.chunkSize - 1) / h.chunkSize
+	if h.writeTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	}
+	key := h.wireKey(mcr.key)
+	for j := 0; j < n; j++ {
+		chunk := value[j*h.chunkSize:]
+		if len(chunk) > h.chunkSize {
+			chunk = chunk[:h.chunkSize]
+		}
+		h.writeSet(key, strconv.Itoa(j), 0, fs[1], chunk)
+	}
+	manifest := []byte(strconv.Itoa(n) + " " + strconv.Itoa(len(value)))
+	h.writeSet(key, "", uint32(flags)|FlagChunked, fs[1], manifest) // NOTE: manifest last, never points to unstored chunks
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler chunk set flush request bytes")
+		return
+	}
+	var reply []byte
+	for j := 0; j <= n; j++ {
+		h.setReadDeadline()
+		var bs []byte
+		if bs, err = h.br.ReadBytes(delim); err != nil {
+			err = errors.Wrap(err, "MC Handler chunk set read response bytes")
+			return
+		}
+		if reply == nil || (bytes.Equal(reply, storedBytes) && !bytes.Equal(bs, storedBytes)) {
+			reply = bs // NOTE: the first failure reply
+		}
+	}
+	h.outcome(mcr.rTp, reply)
+	if noreply {
+		reply = nil
+	}
+	resp = &proto.Response{Type: proto.CacheTypeMemcache}
+	resp.WithProto(&MCResponse{rTp: mcr.rTp, data: reply})
+	return
+}
+
+// chunkKeyed handles the delete|touch|append|prepend of the chunked key after fetched its manifest,
+// the delete and touch go to the manifest and then its chunks, the append and prepend are rejected,
+// which would corrupt the manifest. ok is false means the key not chunked, the request is handled as is.
+// NOTE: costs a get of the key before every such request when chunking enabled.
+func (h *handler) chunkKeyed(mcr *MCRequest, data []byte) (resp *proto.Response, ok bool, err error) {
+	key := h.wireKey(mcr.key)
+	n, chunked, err := h.chunkManifest(key)
+	if err != nil || !chunked {
+		return
+	}
+	ok = true
+	resp = &proto.Response{Type: proto.CacheTypeMemcache}
+	if mcr.rTp == RequestTypeAppend || mcr.rTp == RequestTypePrepend {
+		resp.WithProto(&MCResponse{rTp: mcr.rTp})
+		resp.WithError(errors.Wrapf(ErrChunkedAppend, "MC Handler chunk %s key(%s)", mcr.rTp, mcr.key))
+		return
+	}
+	if h.writeTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	}
+	for j := -1; j < n; j++ { // NOTE: manifest first, never points to the removed chunks
+		h.bw.WriteString(mcr.rTp.String())
+		h.bw.WriteByte(spaceByte)
+		h.bw.Write(h.prefix)
+		h.bw.Write(key)
+		if j >= 0 {
+			h.bw.WriteByte(':')
+			h.bw.WriteString(strconv.Itoa(j))
+		}
+		h.bw.Write(data) // NOTE: '\r\n' of delete or ' <exptime>\r\n' of touch
+	}
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler chunk keyed flush request bytes")
+		return
+	}
+	var reply []byte
+	for j := -1; j < n; j++ {
+		h.setReadDeadline()
+		var bs []byte
+		if bs, err = h.br.ReadBytes(delim); err != nil {
+			err = errors.Wrap(err, "MC Handler chunk keyed read response bytes")
+			return
+		}
+		if reply == nil {
+			reply = append([]byte(nil), bs...) // NOTE: the reply of manifest, chunks maybe evicted already
+		}
+	}
+	h.outcome(mcr.rTp, reply)
+	resp.WithProto(&MCResponse{rTp: mcr.rTp, data: reply})
+	return
+}
+
+// chunkManifest fetches the value of key, returns the chunk count when it is a chunk manifest.
+// NOTE: the value not chunked is not larger than chunk size, which is read and dropped.
+func (h *handler) chunkManifest(key []byte) (n int, chunked bool, err error) {
+	if h.writeTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	}
+	h.bw.WriteString("get ")
+	h.bw.Write(h.prefix)
+	h.bw.Write(key)
+	h.bw.Write(crlfBytes)
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler chunk manifest flush request bytes")
+		return
+	}
+	h.setReadDeadline()
+	var line []byte
+	if line, err = h.br.ReadBytes(delim); err != nil {
+		err = errors.Wrap(err, "MC Handler chunk manifest read response bytes")
+		return
+	}
+	if bytes.Equal(line, endBytes) {
+		return
+	}
+	_, chunked = chunkFlags(line)
+	var length int64
+	if length, err = valueLen(line); err != nil {
+		return
+	}
+	var value []byte
+	if value, err = h.br.ReadFull(int(length + 2)); err != nil {
+		err = errors.Wrap(ErrBadResponse, "MC Handler chunk manifest read value")
+		return
+	}
+	if chunked {
+		ms := bytes.Fields(value[:length])
+		var cnt int64
+		if len(ms) != 2 {
+			err = errors.Wrapf(ErrBadResponse, "MC Handler chunk manifest(%q)", value[:length])
+		} else if cnt, err = conv.ParseLen(ms[0]); err != nil {
+			err = errors.Wrapf(ErrBadResponse, "MC Handler chunk manifest count:%v", err)
+		}
+		n = int(cnt)
+	}
+	if err != nil {
+		return
+	}
+	h.setReadDeadline()
+	if line, err = h.br.ReadBytes(delim); err != nil {
+		err = errors.Wrap(err, "MC Handler chunk manifest read response end")
+		return
+	}
+	if !bytes.Equal(line, endBytes) {
+		err = errors.Wrapf(ErrBadResponse, "MC Handler chunk manifest response(%q) want END", line)
+	}
+	return
+}
+
+func (h *handler) writeSet(key []byte, idx string, flags uint32, exp, value []byte) {
+	h.bw.WriteString("set ")
+	h.bw.Write(h.prefix)
+	h.bw.Write(key)
+	if idx != "" {
+		h.bw.WriteByte(':')
+		h.bw.WriteString(idx)
+	}
+	h.bw.WriteByte(spaceByte)
+	h.bw.WriteString(strconv.FormatUint(uint64(flags), 10))
+	h.bw.WriteByte(spaceByte)
+	h.bw.Write(exp)
+	h.bw.WriteByte(spaceByte)
+	h.bw.WriteString(strconv.Itoa(len(value)))
+	h.bw.Write(crlfBytes)
+	h.bw.Write(value)
+	h.bw.Write(crlfBytes)
+}
+
+// chunkFlags returns the flags of 'VALUE <key> <flags> <bytes> [<cas unique>]\r\n' line.
+func chunkFlags(line []byte) (flags uint32, chunked bool) {
+	fs := bytes.Fields(line)
+	if len(fs) < 4 {
+		return
+	}
+	f, err := conv.Btoi(fs[2])
+	if err != nil {
+		return
+	}
+	flags = uint32(f)
+	chunked = flags&FlagChunked != 0
+	return
+}
+
+// chunkGet fetches the chunks of manifest and reassembles the value on the same connection,
+// the chunks of gat|gats are touched by the exptime as the manifest.
+// The value is treated as missing when any chunk missing.
+func (h *handler) chunkGet(mcr *MCRequest, key, line, manifest []byte, flags uint32) (bs []byte, err error) {
+	ms := bytes.Fields(manifest)
+	if len(ms) != 2 {
+		err = errors.Wrapf(ErrBadResponse, "MC Handler chunk get manifest(%q)", manifest)
+		return
+	}
+	n, err1 := conv.ParseLen(ms[0])
+	total, err2 := conv.ParseLen(ms[1])
+	if err1 != nil || err2 != nil {
+		err = errors.Wrapf(ErrBadResponse, "MC Handler chunk get manifest(%q)", manifest)
+		return
+	}
+	if !h.acquire(int(total)) {
+		err = errors.Wrap(ErrResponseBudget, "MC Handler chunk get acquire response budget")
+		return
+	}
+	if h.writeTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	}
+	if mcr.rTp == RequestTypeGat || mcr.rTp == RequestTypeGats {
+		h.bw.WriteString("gat ")
+		h.bw.Write(mcr.data) // NOTE: exptime
+	} else {
+		h.bw.WriteString("get")
+	}
+	for j := 0; j < int(n); j++ {
+		h.bw.WriteByte(spaceByte)
+		h.bw.Write(h.prefix)
+		h.bw.Write(key)
+		h.bw.WriteByte(':')
+		h.bw.WriteString(strconv.Itoa(j))
+	}
+	h.bw.Write(crlfBytes)
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler chunk get flush request bytes")
+		return
+	}
+	value := make([]byte, 0, total)
+	next := 0
+	for {
+		h.setReadDeadline()
+		var vl []byte
+		if vl, err = h.br.ReadBytes(delim); err != nil {
+			err = errors.Wrap(err, "MC Handler chunk get read response bytes")
+			return
+		}
+		if bytes.Equal(vl, endBytes) {
+			break
+		}
+		fs := bytes.Fields(vl)
+		if len(fs) < 4 {
+			err = errors.Wrapf(ErrBadResponse, "MC Handler chunk get response(%q)", vl)
+			return
+		}
+		var length int64
+		if length, err = conv.ParseLen(fs[3]); err != nil {
+			err = errors.Wrapf(ErrBadResponse, "MC Handler chunk get response length:%v", err)
+			return
+		}
+		var data []byte
+		if data, err = h.br.ReadFull(int(length + 2)); err != nil {
+			err = errors.Wrap(ErrBadResponse, "MC Handler chunk get read chunk")
+			return
+		}
+		if bytes.Equal(fs[1], []byte(string(h.prefix)+string(key)+":"+strconv.Itoa(next))) {
+			value = append(value, data[:length]...)
+			next++
+		}
+	}
+	if next != int(n) || len(value) != int(total) {
+		bs = endBytes // NOTE: partial chunks missing, as a miss
+		return
+	}
+	// VALUE <key> <flags> <bytes> [<cas unique>]\r\n
+	fs := bytes.Fields(line)
+	b := bytes.NewBuffer(make([]byte, 0, len(line)+len(value)+16))
+	b.Write(fs[0])
+	b.WriteByte(spaceByte)
+	b.Write(fs[1])
+	b.WriteByte(spaceByte)
+	b.WriteString(strconv.FormatUint(uint64(flags&^FlagChunked), 10))
+	b.WriteByte(spaceByte)
+	b.WriteString(strconv.Itoa(len(value)))
+	for _, f := range fs[4:] {
+		b.WriteByte(spaceByte)
+		b.Write(f)
+	}
+	b.Write(crlfBytes)
+	b.Write(value)
+	b.Write(crlfBytes)
+	b.Write(endBytes)
+	bs = b.Bytes()
+	return
+}
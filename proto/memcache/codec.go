@@ -0,0 +1,189 @@
+package memcache
+
+import (
+	"bytes"
+	errs "errors"
+	"strconv"
+
+	"github.com/felixhao/overlord/lib/conv"
+	"github.com/felixhao/overlord/lib/stat"
+	"github.com/pkg/errors"
+)
+
+// value codec errors
+var (
+	ErrCodecMissing = errs.New("SERVER_ERROR value codec not configured")
+	ErrDecompress   = errs.New("SERVER_ERROR value decompress failed")
+)
+
+// codecFlags are the flags bits of the codecs known by proxy, the value marked by them is decoded
+// even after the codec removed from config, or fails when the codec can not be built without config.
+// NOTE: reserved only by the cluster opted in, that is any codec configured or the flags reserved,
+// the others pass the flags through as the clients set.
+const codecFlags = FlagCompressed | FlagEncrypted | FlagChecksum
+
+// ValueCodec transforms the value stored by set|add|replace|cas, and restores it when read
+// by get|gets|gat|gats. The flags bit of codec marks the value encoded.
+// NOTE: the bits are reserved by proxy, clients must not use them.
+type ValueCodec interface {
+	// Flag returns the flags bit of codec.
+	Flag() uint32
+	// Encode returns the encoded value of key and the flags bit, zero flags means the value kept as is.
+	// NOTE: the key is the one stored by backend, that is the key prefix and rules applied.
+	Encode(key, value []byte) ([]byte, uint32, error)
+	// Decode returns the value of key decoded, called only when the flags bit of codec set.
+	Decode(key, value []byte, flags uint32) ([]byte, error)
+}
+
+// valueDecoders returns the codecs decode the values read, the configured ones and the builtin ones
+// of the flags bits not configured, so the values encoded before a config change are still decoded.
+// It returns nil when no codec configured and the flags not reserved, the values are never decoded.
+// NOTE: the builtin ones are ordered as the encoding of proxy, compressed first and checksummed last.
+func valueDecoders(cs []ValueCodec, reserve bool) []ValueCodec {
+	if len(cs) == 0 && !reserve {
+		return nil
+	}
+	var mask uint32
+	for _, c := range cs {
+		mask |= c.Flag()
+	}
+	ds := make([]ValueCodec, 0, len(cs)+2)
+	if mask&FlagCompressed == 0 {
+		ds = append(ds, CompressCodec(0))
+	}
+	ds = append(ds, cs...)
+	if mask&FlagChecksum == 0 {
+		ds = append(ds, ChecksumCodec(CRC32()))
+	}
+	return ds
+}
+
+// reservedFlags returns the flags bits reserved by the decoders, the known ones and the custom ones.
+func reservedFlags(ds []ValueCodec) uint32 {
+	if len(ds) == 0 {
+		return 0
+	}
+	mask := uint32(codecFlags)
+	for _, c := range ds {
+		mask |= c.Flag()
+	}
+	return mask
+}
+
+// encodeValue encodes the value of set|add|replace|cas data by codecs in order and marks the flags,
+// the reserved bits set by client are cleared first, or the value would be decoded by them when read.
+// NOTE: data like ' <flags> <exptime> <bytes> [<cas unique>]\r\n<value>\r\n', key is the one stored by backend.
+func encodeValue(cs []ValueCodec, reserved uint32, rTp RequestType, key, data []byte) ([]byte, error) {
+	switch rTp {
+	case RequestTypeSet, RequestTypeAdd, RequestTypeReplace, RequestTypeCas:
+	default:
+		return data, nil
+	}
+	i := bytes.Index(data, crlfBytes)
+	if i < 0 {
+		return data, nil
+	}
+	fs := bytes.Fields(data[:i])
+	if len(fs) < 3 {
+		return data, nil
+	}
+	flags, err1 := conv.Btoi(fs[0])
+	length, err2 := conv.ParseLen(fs[2])
+	if err1 != nil || err2 != nil || len(data) < i+2+int(length)+2 {
+		return data, nil // NOTE: let backend reply the bad request
+	}
+	value, nflags := data[i+2:i+2+int(length)], uint32(flags)&^reserved
+	for _, c := range cs {
+		var (
+			f   uint32
+			err error
+		)
+		if value, f, err = c.Encode(key, value); err != nil {
+			return nil, errors.Wrapf(err, "MC Handler encode value key(%s)", key)
+		}
+		nflags |= f
+	}
+	nd := make([]byte, 0, len(value)+i+16)
+	nd = append(nd, spaceByte)
+	nd = strconv.AppendUint(nd, uint64(nflags), 10)
+	nd = append(nd, spaceByte)
+	nd = append(nd, fs[1]...)
+	nd = append(nd, spaceByte)
+	nd = strconv.AppendInt(nd, int64(len(value)), 10)
+	for _, f := range fs[3:] {
+		nd = append(nd, spaceByte)
+		nd = append(nd, f...)
+	}
+	nd = append(nd, crlfBytes...)
+	nd = append(nd, value...)
+	return append(nd, crlfBytes...), nil
+}
+
+// decodeValue decodes the value of 'VALUE <key> <flags> <bytes> [<cas unique>]\r\n<value>\r\nEND\r\n' by codecs
+// in reverse order, returns the reply with codec flags cleared. The value failed to decode replies a miss when decMiss.
+func (h *handler) decodeValue(bs []byte) ([]byte, error) {
+	if f, err := conv.Btoi(lineField(bs, 2)); err != nil || uint32(f)&h.reserved == 0 {
+		return bs, nil // NOTE: cheap check of the most values not encoded
+	}
+	i := bytes.Index(bs, crlfBytes)
+	if i < 0 {
+		return bs, nil
+	}
+	fs := bytes.Fields(bs[:i])
+	if len(fs) < 4 {
+		return bs, nil
+	}
+	flags, err1 := conv.Btoi(fs[2])
+	length, err2 := conv.ParseLen(fs[3])
+	if err1 != nil || err2 != nil || int64(len(bs)) < int64(i)+2+length {
+		return bs, nil
+	}
+	var mask uint32
+	for _, c := range h.decoders {
+		mask |= c.Flag()
+	}
+	nflags := uint32(flags)
+	if missing := nflags & codecFlags &^ mask; missing != 0 {
+		return h.decodeFailed(fs[1], errors.Wrapf(ErrCodecMissing, "MC Handler decode value flags(%d)", missing))
+	}
+	if nflags&mask == 0 {
+		return bs, nil
+	}
+	value, key := bs[i+2:i+2+int(length)], h.storedKey(fs[1])
+	for j := len(h.decoders) - 1; j >= 0; j-- {
+		c := h.decoders[j]
+		if nflags&c.Flag() == 0 {
+			continue
+		}
+		var err error
+		if value, err = c.Decode(key, value, nflags); err != nil {
+			return h.decodeFailed(fs[1], err)
+		}
+	}
+	b := bytes.NewBuffer(make([]byte, 0, len(value)+i+16))
+	b.Write(fs[0])
+	b.WriteByte(spaceByte)
+	b.Write(fs[1])
+	b.WriteByte(spaceByte)
+	b.WriteString(strconv.FormatUint(uint64(nflags&^mask), 10))
+	b.WriteByte(spaceByte)
+	b.WriteString(strconv.Itoa(len(value)))
+	for _, f := range fs[4:] {
+		b.WriteByte(spaceByte)
+		b.Write(f)
+	}
+	b.Write(crlfBytes)
+	b.Write(value)
+	b.Write(bs[i+2+int(length):]) // NOTE: '\r\nEND\r\n'
+	return b.Bytes(), nil
+}
+
+func (h *handler) decodeFailed(key []byte, err error) ([]byte, error) {
+	if errors.Cause(err) == ErrChecksum {
+		stat.ChecksumMismatch(h.cluster, h.addr)
+	}
+	if h.decMiss {
+		return endBytes, nil
+	}
+	return nil, errors.Wrapf(err, "MC Handler decode value key(%s)", key)
+}
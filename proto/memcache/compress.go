@@ -0,0 +1,49 @@
+package memcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// FlagCompressed is the flags bit marks the value is compressed by deflate.
+// NOTE: reserved by proxy, clients must not use it.
+const FlagCompressed = uint32(1 << 28)
+
+// CompressCodec returns the value codec compresses the value not less than min bytes by deflate,
+// the value is kept as is when it not shrinks, like: the encrypted or compressed by client.
+func CompressCodec(min int) ValueCodec {
+	return &compressCodec{min: min}
+}
+
+type compressCodec struct {
+	min int
+}
+
+func (c *compressCodec) Flag() uint32 {
+	return FlagCompressed
+}
+
+func (c *compressCodec) Encode(key, value []byte) ([]byte, uint32, error) {
+	if len(value) < c.min {
+		return value, 0, nil
+	}
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.BestSpeed) // NOTE: never fails by valid level
+	w.Write(value)
+	w.Close()
+	if b.Len() >= len(value) {
+		return value, 0, nil
+	}
+	return b.Bytes(), FlagCompressed, nil
+}
+
+func (c *compressCodec) Decode(key, value []byte, flags uint32) ([]byte, error) {
+	bs, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(value)))
+	if err != nil {
+		return nil, errors.Wrapf(ErrDecompress, "CompressCodec decode:%v", err)
+	}
+	return bs, nil
+}
@@ -36,6 +36,9 @@ func (d *decoder) Decode() (req *proto.Request, err error) {
 		return
 	}
 	i := bytes.IndexByte(bs, spaceByte)
+	if i < 0 && bytes.EqualFold(bs, metaNoopCmdBytes) { // NOTE: the only command without args
+		return metaNoopRequest(RequestTypeMetaNoop)
+	}
 	if i <= 0 {
 		err = errors.Wrap(ErrBadRequest, "MC decoder Decode get cmd index")
 		return
@@ -77,6 +80,21 @@ func (d *decoder) Decode() (req *proto.Request, err error) {
 		return getAndTouchRequest(d.br, RequestTypeGat, ds)
 	case "gats":
 		return getAndTouchRequest(d.br, RequestTypeGats, ds)
+	// Meta Get:
+	case "mg":
+		return metaRequest(d.br, RequestTypeMetaGet, ds)
+	// Meta Debug:
+	case "me":
+		return metaRequest(d.br, RequestTypeMetaDebug, ds)
+	// Compress:
+	case "overlord_compress":
+		return compressRequest(d.br, RequestTypeCompress, ds)
+	// Priority:
+	case "overlord_priority":
+		return priorityRequest(d.br, RequestTypePriority, ds)
+	// Stats:
+	case "stats":
+		return statsRequest(d.br, RequestTypeStats, ds)
 	}
 	return nil, errors.Wrap(ErrError, "MC Decoder Decode command no exist")
 }
@@ -349,6 +367,94 @@ func getAndTouchRequest(r *bufio.Reader, reqType RequestType, bs []byte) (req *p
 	return
 }
 
+func metaRequest(r *bufio.Reader, reqType RequestType, bs []byte) (req *proto.Request, err error) {
+	// sanity check
+	if len(bs) <= 3 {
+		err = errors.Wrapf(ErrBadRequest, "MC Decoder meta request sanity check bsLen(%d)", len(bs))
+		return
+	}
+	index := 1
+	// key
+	ki := bytes.IndexByte(bs[index:], spaceByte)
+	if ki < 0 {
+		ki = len(bs) - 2 - index // NOTE: no flags
+	}
+	if ki <= 0 {
+		err = errors.Wrap(ErrBadRequest, "MC Decoder meta request get key index")
+		return
+	}
+	key := bs[index : index+ki]
+	if !legalKey(key, false) {
+		err = errors.Wrap(ErrBadKey, "MC Decoder meta request legal key")
+		return
+	}
+	req = &proto.Request{Type: proto.CacheTypeMemcache}
+	req.WithProto(&MCRequest{
+		rTp:  reqType,
+		key:  key,
+		data: bs[ki+1:], // NOTE: flags contains '\r\n'
+	})
+	return
+}
+
+func metaNoopRequest(reqType RequestType) (req *proto.Request, err error) {
+	req = &proto.Request{Type: proto.CacheTypeMemcache}
+	req.WithProto(&MCRequest{rTp: reqType})
+	return
+}
+
+func compressRequest(r *bufio.Reader, reqType RequestType, bs []byte) (req *proto.Request, err error) {
+	// NOTE: only gzip supported
+	if alg := bs[1:]; !bytes.Equal(alg, []byte("gzip\r\n")) {
+		err = errors.Wrapf(ErrBadRequest, "MC Decoder compress request algorithm(%q)", alg)
+		return
+	}
+	req = &proto.Request{Type: proto.CacheTypeMemcache}
+	req.WithProto(&MCRequest{
+		rTp: reqType,
+		key: bs[1 : len(bs)-2],
+	})
+	return
+}
+
+func priorityRequest(r *bufio.Reader, reqType RequestType, bs []byte) (req *proto.Request, err error) {
+	if !bytes.HasSuffix(bs, crlfBytes) {
+		err = errors.Wrap(ErrBadRequest, "MC Decoder priority request not end with CRLF")
+		return
+	}
+	name := bs[1 : len(bs)-2]
+	if _, ok := proto.ParsePriority(string(name)); !ok {
+		err = errors.Wrapf(ErrBadRequest, "MC Decoder priority request name(%q)", name)
+		return
+	}
+	req = &proto.Request{Type: proto.CacheTypeMemcache}
+	req.WithProto(&MCRequest{
+		rTp: reqType,
+		key: name,
+	})
+	return
+}
+
+func statsRequest(r *bufio.Reader, reqType RequestType, bs []byte) (req *proto.Request, err error) {
+	// NOTE: only 'stats proxy' served by proxy, the stats of backend are not forwarded
+	if !bytes.HasSuffix(bs, crlfBytes) || !bytes.Equal(bytes.TrimSpace(bs), statsProxyBytes) {
+		err = errors.Wrapf(ErrBadRequest, "MC Decoder stats request args(%q)", bytes.TrimSpace(bs))
+		return
+	}
+	req = &proto.Request{Type: proto.CacheTypeMemcache}
+	req.WithProto(&MCRequest{
+		rTp: reqType,
+		key: statsProxyBytes,
+	})
+	return
+}
+
+// ValidKey reports whether the single key is legal, that is at most 250 characters
+// without control characters or whitespace, like: the key of multi-get split.
+func ValidKey(key []byte) bool {
+	return legalKey(key, false)
+}
+
 // Currently the length limit of a key is set at 250 characters.
 // the key must not include control characters or whitespace.
 func legalKey(key []byte, isMulti bool) bool {
@@ -46,7 +46,7 @@ func (e *encoder) Encode(resp *proto.Response) (err error) {
 		e.bw.WriteString(se)
 		e.bw.Write(crlfBytes)
 	} else {
-		e.bw.Write(mcr.data)
+		io.Copy(e.bw, mcr.Reader()) // NOTE: the large part is written through without buffering, the write error is returned by flush
 	}
 	if fe := e.bw.Flush(); fe != nil {
 		err = errors.Wrap(fe, "MC Encoder encode response flush bytes")
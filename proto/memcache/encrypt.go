@@ -0,0 +1,137 @@
+package memcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	errs "errors"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FlagEncrypted is the flags bit marks the value is encrypted.
+// NOTE: reserved by proxy, the value marked by it fails to read without encryption keys, clients must not use it.
+const FlagEncrypted = uint32(1 << 29)
+
+// encryption errors
+var (
+	ErrKeyRetired = errs.New("SERVER_ERROR encryption key retired")
+	ErrDecrypt    = errs.New("SERVER_ERROR value decrypt failed")
+	ErrEncryptKey = errs.New("encryption key invalid")
+	ErrEncrypt    = errs.New("SERVER_ERROR value encrypt failed")
+)
+
+// KeyProvider provides the AEAD of key versions, the current one encrypts the new values
+// and the older ones still decrypt the values encrypted before rotation.
+type KeyProvider interface {
+	// Current returns the version and AEAD of current key.
+	Current() (version byte, aead cipher.AEAD)
+	// Key returns the AEAD of key version, ok is false when the version retired or unknown.
+	Key(version byte) (aead cipher.AEAD, ok bool)
+}
+
+// Keyring is the in-memory key provider of AES-GCM keys.
+type Keyring struct {
+	lock    sync.RWMutex
+	current byte
+	aeads   map[byte]cipher.AEAD
+}
+
+// NewKeyring new a keyring with the current key, the key must be 16, 24 or 32 bytes.
+func NewKeyring(version byte, key []byte) (*Keyring, error) {
+	kr := &Keyring{aeads: map[byte]cipher.AEAD{}}
+	if err := kr.Rotate(version, key); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Rotate adds the key of version and makes it current, the older keys still decrypt.
+func (kr *Keyring) Rotate(version byte, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.Wrapf(ErrEncryptKey, "Keyring rotate version(%d):%v", version, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrapf(ErrEncryptKey, "Keyring rotate version(%d):%v", version, err)
+	}
+	kr.lock.Lock()
+	kr.aeads[version] = aead
+	kr.current = version
+	kr.lock.Unlock()
+	return nil
+}
+
+// Retire removes the key of version, the values encrypted by it fail to decrypt with ErrKeyRetired.
+// NOTE: the current key can not be retired.
+func (kr *Keyring) Retire(version byte) {
+	kr.lock.Lock()
+	if version != kr.current {
+		delete(kr.aeads, version)
+	}
+	kr.lock.Unlock()
+}
+
+// Current returns the version and AEAD of current key.
+func (kr *Keyring) Current() (byte, cipher.AEAD) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return kr.current, kr.aeads[kr.current]
+}
+
+// Key returns the AEAD of key version.
+func (kr *Keyring) Key(version byte) (aead cipher.AEAD, ok bool) {
+	kr.lock.RLock()
+	aead, ok = kr.aeads[version]
+	kr.lock.RUnlock()
+	return
+}
+
+// EncryptCodec returns the value codec encrypts the value by the current key of provider,
+// the stored value is '<key version><nonce><sealed value>' with a random nonce per write.
+// The value is sealed with its cache key as additional data, so it fails to decrypt with ErrDecrypt
+// when copied to another key.
+func EncryptCodec(kp KeyProvider) ValueCodec {
+	return &encryptCodec{kp: kp}
+}
+
+type encryptCodec struct {
+	kp KeyProvider
+}
+
+func (c *encryptCodec) Flag() uint32 {
+	return FlagEncrypted
+}
+
+func (c *encryptCodec) Encode(key, value []byte) ([]byte, uint32, error) {
+	version, aead := c.kp.Current()
+	ns := aead.NonceSize()
+	nv := make([]byte, 1+ns, 1+ns+len(value)+aead.Overhead())
+	nv[0] = version
+	if _, err := io.ReadFull(rand.Reader, nv[1:]); err != nil {
+		return nil, 0, errors.Wrapf(ErrEncrypt, "EncryptCodec read random nonce:%v", err) // NOTE: never reuse nonce
+	}
+	return aead.Seal(nv, nv[1:], value, key), FlagEncrypted, nil
+}
+
+func (c *encryptCodec) Decode(key, value []byte, flags uint32) ([]byte, error) {
+	if len(value) < 1 {
+		return nil, errors.Wrap(ErrDecrypt, "EncryptCodec value too short")
+	}
+	aead, ok := c.kp.Key(value[0])
+	if !ok {
+		return nil, errors.Wrapf(ErrKeyRetired, "EncryptCodec key version(%d)", value[0])
+	}
+	ns := aead.NonceSize()
+	if len(value) < 1+ns+aead.Overhead() {
+		return nil, errors.Wrap(ErrDecrypt, "EncryptCodec value too short")
+	}
+	bs, err := aead.Open(nil, value[1:1+ns], value[1+ns:], key)
+	if err != nil {
+		return nil, errors.Wrapf(ErrDecrypt, "EncryptCodec key version(%d):%v", value[0], err)
+	}
+	return bs, nil
+}
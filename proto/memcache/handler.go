@@ -2,14 +2,20 @@ package memcache
 
 import (
 	"bytes"
+	"io"
 	"net"
+	"strconv"
 	"sync/atomic"
 	"time"
 
 	"github.com/felixhao/overlord/lib/bufio"
 	"github.com/felixhao/overlord/lib/conv"
+	"github.com/felixhao/overlord/lib/dialer"
+	"github.com/felixhao/overlord/lib/fault"
 	"github.com/felixhao/overlord/lib/pool"
+	"github.com/felixhao/overlord/lib/resolver"
 	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/lib/tap"
 	"github.com/felixhao/overlord/proto"
 	"github.com/pkg/errors"
 )
@@ -20,111 +26,665 @@ const (
 
 	handlerWriteBufferSize = 8 * 1024   // NOTE: write command, so relatively small
 	handlerReadBufferSize  = 128 * 1024 // NOTE: read data, so relatively large
+
+	batchCmd = "batch" // NOTE: the size stat cmd of pipelined requests
 )
 
 type handler struct {
 	cluster string
 	addr    string
+	raddr   string
 	conn    net.Conn
 	br      *bufio.Reader
 	bw      *bufio.Writer
 	bss     [][]byte
 	buf     []byte
+	tap     *tap.Conn
+	prefix  []byte
+	rules   []KeyRule
+	counter *countConn
+
+	chunkSize int
+	resolver  *resolver.Resolver
+	maxTTL    int64
+	codecs    []ValueCodec
+	decoders  []ValueCodec // NOTE: the codecs and the builtin ones, decode by the flags bits regardless of config
+	reserved  uint32       // NOTE: the flags bits of decoders, cleared from the flags set by client
+	decMiss   bool
+	budget    *pool.Budget
+	held      int64 // NOTE: the budget bytes held by the response reading
+	buffers   *pool.Buffers
+	pending   bool // NOTE: checks the unexpected data pending before request written
+	debugAddr bool
+	endGrace  time.Duration // NOTE: waits for the next line after a value block, the END may be missing
+	endStrict bool
+	hints     [][]byte // NOTE: the error reply contains any hints the server to reconnect
+	recycle   bool
+	auth      CredentialProvider
+	cred      Credential // NOTE: authenticated by
+	maxReqs   int        // NOTE: the connection is stale after served them
+	served    int
+	stats     *stat.Registry // NOTE: counts the hits and misses, the package globals when nil
 
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	dialTime     time.Duration // NOTE: reported by the first profiled request
+	dialEnd      time.Time
+	deadline     time.Time // NOTE: of the request handling, reads never wait beyond it
+
+	closed   int32
+	refs     int32 // NOTE: the initial one dropped by close, the others by the in-flight requests
+	recycled int32
+}
+
+// DialOption specifies an option for dial.
+type DialOption struct {
+	f func(*dialOptions)
+}
+
+type dialOptions struct {
+	tap       *tap.Recorder
+	prefix    []byte
+	rules     []KeyRule
+	auth      CredentialProvider
+	localAddr net.Addr
+	fault     *fault.Injector
+	maxReqs   int
+	stats     *stat.Registry
+	chunkSize int
+	resolver  *resolver.Resolver
+	lookup    resolver.LookupFunc
+	maxTTL    int64
+	dialer    *dialer.Dialer
+	codecs    []ValueCodec
+	reserve   bool
+	decMiss   bool
+	budget    *pool.Budget
+	buffers   *pool.Buffers
+	pending   bool
+	debugAddr bool
+	endGrace  time.Duration
+	endStrict bool
+	hints     [][]byte
+}
+
+// DialTap set dial tap recorder, records the bytes written into and read from backend.
+func DialTap(r *tap.Recorder) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.tap = r
+	}}
+}
+
+// DialKeyPrefix set dial key prefix, which is prepended to every key on the wire
+// and stripped from the keys of response.
+func DialKeyPrefix(prefix string) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.prefix = []byte(prefix)
+	}}
+}
+
+// DialKeyRules set dial key rules, which rewrite every key on the wire in order before prefixed,
+// and the keys of response are restored as requested.
+func DialKeyRules(rules ...KeyRule) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.rules = rules
+	}}
+}
+
+// DialStat set dial stat registry, the hits and misses are counted into it rather than the package globals,
+// like: the clusters of embedded proxies never share the counters.
+func DialStat(r *stat.Registry) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.stats = r
+	}}
+}
+
+// DialChunkSize set dial chunk size, the set value larger than it is split into
+// chunks '<key>:<i>' with a manifest under '<key>', and reassembled by get|gets|gat|gats.
+// The delete and touch of the chunked key go to its chunks too, the append and prepend are rejected.
+func DialChunkSize(n int) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.chunkSize = n
+	}}
+}
+
+// DialResolver set dial resolver, resolves the addr by cache instead of per dial lookup.
+func DialResolver(r *resolver.Resolver) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.resolver = r
+	}}
+}
+
+// DialLookup set dial lookup, the host of addr is looked up by it before connected, so the dial timeout
+// only bounds the connect, like: the lookup bounded by its own timeout.
+// NOTE: ignored when dial resolver or dual stack set, which look up by their own.
+func DialLookup(lookup resolver.LookupFunc) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.lookup = lookup
+	}}
+}
+
+// DialMaxTTL set dial max TTL in seconds, the larger exptime of set|add|replace|cas|touch
+// is clamped down to it before forwarding.
+func DialMaxTTL(sec int64) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.maxTTL = sec
+	}}
+}
+
+// DialCheckPending set dial check pending, the connection is checked by a non-blocking peek before the request
+// written, and the request fails with ErrPoisoned when any data pending, like: pushed by a desynced server,
+// which would be mis-parsed as the reply. Nothing is written, so the request can be retried by another connection.
+func DialCheckPending() *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.pending = true
+	}}
+}
+
+// DialDebugAddr set dial debug addr, the response carries the address of backend served it, like: for debugging
+// which node replied. NOTE: costs a little per response, so for debugging only.
+func DialDebugAddr() *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.debugAddr = true
+	}}
+}
+
+// DialEndGrace set dial end grace, the line after a value block fully read is waited for the grace rather than
+// the read timeout, the get is complete without 'END' when not arrived in it, or fails with ErrMissingEnd when strict.
+// NOTE: the 'END' arrived late is unexpected data of the next request, works with DialCheckPending.
+func DialEndGrace(grace time.Duration, strict bool) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.endGrace = grace
+		do.endStrict = strict
+	}}
+}
+
+// DialReconnectHints appends dial reconnect hints, the connection is stale after the error reply
+// containing any of them, like: the proxy in front of server asks to rebalance, so it is recycled
+// after the current request served.
+func DialReconnectHints(hints ...string) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		for _, hint := range hints {
+			do.hints = append(do.hints, []byte(hint))
+		}
+	}}
+}
+
+// DialDualStack set dial dialer, races the IPv4 and IPv6 addresses of server name.
+// NOTE: ignored when dial resolver set, which resolves one address per dial.
+func DialDualStack(d *dialer.Dialer) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.dialer = d
+	}}
+}
+
+// DialValueCodec appends dial value codecs, the value written by set|add|replace|cas is encoded by
+// them in order and marked by their flags bits, then decoded in reverse order when read by get|gets|gat|gats.
+// NOTE: mg replies the stored bytes without decoding.
+func DialValueCodec(cs ...ValueCodec) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.codecs = append(do.codecs, cs...)
+	}}
+}
+
+// DialReserveFlags reserves the flags bits of the known value codecs even though no codec configured,
+// the values marked by them are decoded when read and the bits set by client are cleared when written,
+// like: the codecs removed from config but the values encoded still stored.
+// NOTE: without it and any codec, the flags are passed through as the clients set.
+func DialReserveFlags() *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.reserve = true
+	}}
+}
+
+// DialChecksum appends the checksum value codec, the mismatched value replies a miss when miss true, else an error.
+func DialChecksum(cs Checksum, miss bool) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.codecs = append(do.codecs, ChecksumCodec(cs))
+		do.decMiss = miss
+	}}
+}
+
+// DialBudget set dial response budget, the large response buffer is allocated after acquired from it,
+// waits for read timeout when exhausted, and released after the response written to client.
+func DialBudget(b *pool.Budget) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.budget = b
+	}}
+}
+
+// DialBuffers set dial buffers free list, the read and write buffers are drawn from it,
+// and put back when the connection closed.
+func DialBuffers(b *pool.Buffers) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.buffers = b
+	}}
+}
 
-	closed int32
+// DialAuth set dial credential provider, the new connection is authenticated by the current credential,
+// and is stale when the credential rotated.
+func DialAuth(p CredentialProvider) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.auth = p
+	}}
+}
+
+// DialLocalAddr set dial local address, the source of connection is bound to it, like: the egress
+// to servers must originate from a specific IP.
+// NOTE: the dual stack dialer dials by its own dial func, which should bind the address too.
+func DialLocalAddr(addr net.Addr) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.localAddr = addr
+	}}
+}
+
+// DialFault set dial fault injector, the dial failures and read faults are injected by it.
+func DialFault(i *fault.Injector) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.fault = i
+	}}
+}
+
+// DialMaxRequests set max requests of connection, the connection is stale after served them,
+// like: bounds the blast radius of a subtly corrupted connection.
+// NOTE: only the client requests count, the ping and the raw admin commands don't.
+func DialMaxRequests(n int) *DialOption {
+	return &DialOption{func(do *dialOptions) {
+		do.maxReqs = n
+	}}
 }
 
 // Dial returns pool Dial func.
-func Dial(cluster, addr string, dialTimeout, readTimeout, writeTimeout time.Duration) (dial func() (pool.Conn, error)) {
+func Dial(cluster, addr string, dialTimeout, readTimeout, writeTimeout time.Duration, dos ...*DialOption) (dial func() (pool.Conn, error)) {
+	opts := &dialOptions{}
+	for _, do := range dos {
+		do.f(opts)
+	}
 	dial = func() (pool.Conn, error) {
-		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
-		if err != nil {
+		var (
+			raddr = addr
+			conn  net.Conn
+			err   error
+			start = time.Now()
+		)
+		if opts.fault != nil {
+			if err = opts.fault.Dial(); err != nil {
+				return nil, err
+			}
+		}
+		if opts.resolver != nil {
+			if raddr, err = opts.resolver.Resolve(addr); err != nil {
+				return nil, err
+			}
+		} else if opts.lookup != nil && opts.dialer == nil {
+			if raddr, err = lookupAddr(opts.lookup, addr); err != nil {
+				return nil, err
+			}
+		}
+		if opts.resolver == nil && opts.dialer != nil {
+			if conn, err = opts.dialer.Dial(addr); err != nil {
+				return nil, err
+			}
+			raddr = conn.RemoteAddr().String()
+		} else if conn, err = (&net.Dialer{Timeout: dialTimeout, LocalAddr: opts.localAddr}).Dial("tcp", raddr); err != nil {
 			return nil, err
 		}
+		if opts.fault != nil {
+			conn = opts.fault.Conn(conn)
+		}
+		var cred Credential
+		if opts.auth != nil {
+			cred = opts.auth()
+			if err = authenticate(conn, cred, dialTimeout); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
 		h := &handler{
 			cluster:      cluster,
 			addr:         addr,
+			raddr:        raddr,
 			conn:         conn,
-			bw:           bufio.NewWriterSize(conn, handlerWriteBufferSize),
-			br:           bufio.NewReaderSize(conn, handlerReadBufferSize),
 			bss:          make([][]byte, 2), // NOTE: like: 'VALUE a_11 0 0 3\r\naaa\r\nEND\r\n', and not copy 'END\r\n'
 			readTimeout:  readTimeout,
 			writeTimeout: writeTimeout,
+			prefix:       opts.prefix,
+			rules:        opts.rules,
+			chunkSize:    opts.chunkSize,
+			resolver:     opts.resolver,
+			maxTTL:       opts.maxTTL,
+			codecs:       opts.codecs,
+			decoders:     valueDecoders(opts.codecs, opts.reserve),
+			decMiss:      opts.decMiss,
+			budget:       opts.budget,
+			buffers:      opts.buffers,
+			pending:      opts.pending,
+			debugAddr:    opts.debugAddr,
+			endGrace:     opts.endGrace,
+			endStrict:    opts.endStrict,
+			hints:        opts.hints,
+			auth:         opts.auth,
+			cred:         cred,
+			maxReqs:      opts.maxReqs,
+			stats:        opts.stats,
+			refs:         1,
+		}
+		h.reserved = reservedFlags(h.decoders)
+		h.dialEnd = time.Now()
+		h.dialTime = h.dialEnd.Sub(start)
+		h.counter = &countConn{Conn: conn, cluster: cluster, addr: addr}
+		conn = h.counter
+		if opts.tap != nil {
+			h.tap = opts.tap.Conn(conn)
+			conn = h.tap
+		}
+		if h.buffers != nil {
+			h.bw = h.buffers.Writer(conn, handlerWriteBufferSize)
+			h.br = h.buffers.Reader(conn, handlerReadBufferSize)
+		} else {
+			h.bw = bufio.NewWriterSize(conn, handlerWriteBufferSize)
+			h.br = bufio.NewReaderSize(conn, handlerReadBufferSize)
 		}
 		return h, nil
 	}
 	return
 }
 
+// lookupAddr looks up the host of 'host:port' into 'ip:port' by the first answer, the ip address kept as is.
+func lookupAddr(lookup resolver.LookupFunc, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil // NOTE: the bad addr failed by dial
+	}
+	ips, err := lookup(host)
+	if err != nil {
+		return "", errors.Wrapf(err, "MC lookup host(%s)", host)
+	}
+	if len(ips) == 0 {
+		return "", errors.Wrapf(&net.DNSError{Err: "no such host", Name: host}, "MC lookup host(%s)", host)
+	}
+	return net.JoinHostPort(ips[0], port), nil
+}
+
 // Handle call server node by request and read response returned.
 func (h *handler) Handle(req *proto.Request) (resp *proto.Response, err error) {
-	if h.Closed() {
+	if h.tap != nil {
+		defer h.tap.Record()
+	}
+	if h.debugAddr {
+		defer func() {
+			if resp != nil {
+				resp.WithAddr(h.raddr)
+			}
+		}()
+	}
+	if !h.enter() {
 		err = errors.Wrap(ErrClosed, "MC Handler handle request")
 		return
 	}
+	defer h.exit(&err, "MC Handler handle request")
+	h.served++
+	if h.poisoned() {
+		err = errors.Wrap(ErrPoisoned, "MC Handler handle request")
+		return
+	}
 	mcr, ok := req.Proto().(*MCRequest)
 	if !ok {
 		err = errors.Wrap(ErrAssertRequest, "MC Handler handle assert MCRequest")
 		return
 	}
+	buffered := h.sizing()
+	defer func() {
+		if err == nil {
+			h.sized(mcr.rTp.String(), buffered)
+		}
+	}()
+	h.deadline, _ = req.Deadline()
+	var (
+		t     = req.Timing()
+		start time.Time
+	)
+	if t != nil {
+		h.timeDial(t)
+		start = time.Now()
+	}
+	data, err := h.requestData(mcr)
+	if err != nil {
+		return
+	}
+	if h.chunkSize > 0 {
+		chunked := false
+		switch mcr.rTp {
+		case RequestTypeSet:
+			resp, chunked, err = h.chunkSet(mcr, data)
+		case RequestTypeDelete, RequestTypeTouch, RequestTypeAppend, RequestTypePrepend:
+			resp, chunked, err = h.chunkKeyed(mcr, data)
+		}
+		if chunked || err != nil {
+			return
+		}
+	}
 	if h.writeTimeout > 0 {
 		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
 	}
+	h.writeRequest(mcr, data)
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler handle flush request bytes")
+		return
+	}
+	if t != nil {
+		flushed := time.Now()
+		t.Write = flushed.Sub(start)
+		h.counter.first = time.Time{}
+		defer h.timeRead(t, flushed)
+	}
+	return h.readResponse(mcr)
+}
+
+// setReadDeadline sets the read deadline by read timeout, but not later than the request deadline.
+// NOTE: the requests of one cluster all have deadline or not, so no stale one left.
+func (h *handler) setReadDeadline() {
+	if d := h.readDeadline(); !d.IsZero() {
+		h.conn.SetReadDeadline(d)
+	}
+}
+
+// readDeadline returns the read deadline by read timeout and request deadline, zero means none.
+func (h *handler) readDeadline() time.Time {
+	d := h.deadline
+	if rd := time.Now().Add(h.readTimeout); h.readTimeout > 0 && (d.IsZero() || rd.Before(d)) {
+		d = rd
+	}
+	return d
+}
+
+// readNext reads the next line after a value block, waits for the end grace if any rather than the read timeout.
+// It returns nil line when the grace passed without any byte, that is the 'END' missing tolerated.
+func (h *handler) readNext() (bs []byte, err error) {
+	grace := false
+	if h.endGrace > 0 && h.br.Buffered() == 0 {
+		gd := time.Now().Add(h.endGrace)
+		if d := h.readDeadline(); d.IsZero() || gd.Before(d) {
+			h.conn.SetReadDeadline(gd)
+			grace = true
+		}
+	}
+	if !grace {
+		h.setReadDeadline()
+	}
+	if bs, err = h.br.ReadBytes(delim); err == nil {
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && grace && h.br.Buffered() == 0 {
+		if h.endStrict {
+			return nil, errors.Wrap(ErrMissingEnd, "MC Handler handle reread response bytes")
+		}
+		h.br.ResetErr()
+		return nil, nil
+	}
+	return nil, errors.Wrap(err, "MC Handler handle reread response bytes")
+}
+
+// sizing starts sizing the request and response bytes, returns the bytes buffered before.
+func (h *handler) sizing() int {
+	h.counter.in, h.counter.out = 0, 0
+	return h.br.Buffered()
+}
+
+// sized records the request bytes written and the response bytes consumed since sizing,
+// that is read from connection plus buffered before, but not the read ahead still buffered.
+func (h *handler) sized(cmd string, buffered int) {
+	stat.RequestSize(h.cluster, cmd, h.counter.out)
+	stat.ResponseSize(h.cluster, cmd, h.counter.in+buffered-h.br.Buffered())
+}
+
+// timeDial reports the dial time into the timing of the first request, when the connection
+// was dialed while the request waiting for it.
+func (h *handler) timeDial(t *proto.Timing) {
+	if h.dialTime > 0 {
+		if h.dialEnd.After(t.Start) {
+			t.Dial = h.dialTime
+		}
+		h.dialTime = 0
+	}
+}
+
+// timeRead reports the think and read time after the request flushed, the response already
+// buffered is all read time.
+func (h *handler) timeRead(t *proto.Timing, flushed time.Time) {
+	now := time.Now()
+	if first := h.counter.first; !first.IsZero() {
+		t.Think = first.Sub(flushed)
+		t.Read = now.Sub(first)
+		return
+	}
+	t.Read = now.Sub(flushed)
+}
+
+// HandleBatch writes the requests pipelined by one flush, then reads the responses in order.
+// The responses of the requests before the error are returned.
+// NOTE: the chunked set|get can not be pipelined, the handler with chunk size handles them one by one.
+func (h *handler) HandleBatch(reqs []*proto.Request) (resps []*proto.Response, err error) {
+	if h.debugAddr && h.chunkSize <= 0 { // NOTE: the chunked ones by Handle
+		defer func() {
+			for _, resp := range resps {
+				resp.WithAddr(h.raddr)
+			}
+		}()
+	}
+	if h.chunkSize > 0 {
+		for _, req := range reqs {
+			var resp *proto.Response
+			if resp, err = h.Handle(req); err != nil {
+				return
+			}
+			resps = append(resps, resp)
+		}
+		return
+	}
+	if h.tap != nil {
+		defer h.tap.Record()
+	}
+	if !h.enter() {
+		err = errors.Wrap(ErrClosed, "MC Handler handle batch request")
+		return
+	}
+	defer h.exit(&err, "MC Handler handle batch request")
+	h.served += len(reqs)
+	if h.poisoned() {
+		err = errors.Wrap(ErrPoisoned, "MC Handler handle batch request")
+		return
+	}
+	buffered := h.sizing()
+	defer func() {
+		if err == nil {
+			h.sized(batchCmd, buffered) // NOTE: the pipelined requests as one
+		}
+	}()
+	mcrs := make([]*MCRequest, len(reqs))
+	for i, req := range reqs {
+		mcr, ok := req.Proto().(*MCRequest)
+		if !ok {
+			err = errors.Wrap(ErrAssertRequest, "MC Handler handle batch assert MCRequest")
+			return
+		}
+		mcrs[i] = mcr
+	}
+	datas := make([][]byte, len(mcrs))
+	for i, mcr := range mcrs {
+		if datas[i], err = h.requestData(mcr); err != nil {
+			return // NOTE: nothing written, connection reusable
+		}
+	}
+	if h.writeTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	}
+	for i, mcr := range mcrs {
+		h.writeRequest(mcr, datas[i])
+	}
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler handle batch flush request bytes")
+		return
+	}
+	resps = make([]*proto.Response, 0, len(mcrs))
+	for i, mcr := range mcrs {
+		var resp *proto.Response
+		h.deadline, _ = reqs[i].Deadline()
+		if resp, err = h.readResponse(mcr); err != nil {
+			return
+		}
+		resps = append(resps, resp)
+	}
+	return
+}
+
+// requestData returns the request data written after key, the exptime is clamped by max TTL,
+// and the value is encoded by value codecs.
+func (h *handler) requestData(mcr *MCRequest) ([]byte, error) {
+	data := mcr.data
+	if h.maxTTL > 0 {
+		data = clampExptime(mcr.rTp, data, h.maxTTL)
+	}
+	if len(h.decoders) > 0 {
+		return encodeValue(h.codecs, h.reserved, mcr.rTp, h.storedKey(mcr.key), data)
+	}
+	return data, nil
+}
+
+// writeRequest writes the request into buffer without flush.
+func (h *handler) writeRequest(mcr *MCRequest, data []byte) {
 	h.bw.WriteString(mcr.rTp.String())
 	h.bw.WriteByte(spaceByte)
 	if mcr.rTp == RequestTypeGat || mcr.rTp == RequestTypeGats {
 		h.bw.Write(mcr.data) // NOTE: exptime
 		h.bw.WriteByte(spaceByte)
-		h.bw.Write(mcr.key)
+		h.bw.Write(h.prefix)
+		h.bw.Write(h.wireKey(mcr.key))
 		h.bw.Write(crlfBytes)
 	} else {
-		h.bw.Write(mcr.key)
-		h.bw.Write(mcr.data)
-	}
-	if err = h.bw.Flush(); err != nil {
-		err = errors.Wrap(err, "MC Handler handle flush request bytes")
-		return
-	}
-	if h.readTimeout > 0 {
-		h.conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+		h.bw.Write(h.prefix)
+		h.bw.Write(h.wireKey(mcr.key))
+		h.bw.Write(data)
 	}
+}
+
+// readResponse reads the response of request.
+func (h *handler) readResponse(mcr *MCRequest) (resp *proto.Response, err error) {
+	defer func() {
+		h.hold(resp, err)
+	}()
+	h.setReadDeadline()
 	bs, err := h.br.ReadBytes(delim)
 	if err != nil {
 		err = errors.Wrap(err, "MC Handler handle read response bytes")
 		return
 	}
+	h.hint(bs)
 	if mcr.rTp == RequestTypeGet || mcr.rTp == RequestTypeGets || mcr.rTp == RequestTypeGat || mcr.rTp == RequestTypeGats {
 		if !bytes.Equal(bs, endBytes) {
-			stat.Hit(h.cluster, h.addr)
-			c := bytes.Count(bs, spaceBytes)
-			if c < 3 {
-				err = errors.Wrap(ErrBadResponse, "MC Handler handle read response bytes split")
-				return
-			}
-			var (
-				lenBs  []byte
-				length int64
-			)
-			i := bytes.IndexByte(bs, spaceByte) + 1 // VALUE <key> <flags> <bytes> [<cas unique>]\r\n
-			i = i + bytes.IndexByte(bs[i:], spaceByte) + 1
-			i = i + bytes.IndexByte(bs[i:], spaceByte) + 1
-			if c == 3 { // NOTE: if c==3, means get|gat
-				lenBs = bs[i:]
-				l := len(lenBs)
-				if l < 2 {
-					err = errors.Wrap(ErrBadResponse, "MC Handler handle read response bytes check")
-					return
-				}
-				lenBs = lenBs[:l-2] // NOTE: get|gat contains '\r\n'
-			} else { // NOTE: if c>3, means gets|gats
-				j := i + bytes.IndexByte(bs[i:], spaceByte)
-				lenBs = bs[i:j]
-			}
-			if length, err = conv.Btoi(lenBs); err != nil {
-				err = errors.Wrap(ErrBadResponse, "MC Handler handle read response bytes length")
+			bs = h.restoreKey(bs, mcr.key)
+			var length int64
+			if length, err = valueLen(bs); err != nil {
 				return
 			}
 			var bs2 []byte
@@ -136,21 +696,29 @@ func (h *handler) Handle(req *proto.Request) (resp *proto.Response, err error) {
 			h.bss[0] = bs
 			h.bss[1] = bs2
 			tl := len(bs) + len(bs2)
-			var bs3 []byte
-			for !bytes.Equal(bs3, endBytes) {
-				if bs3 != nil { // NOTE: here, avoid copy 'END\r\n'
-					h.bss = append(h.bss, bs3)
-					tl += len(bs3)
+			for {
+				var bs3 []byte
+				if bs3, err = h.readNext(); err != nil {
+					return
 				}
-				if h.readTimeout > 0 {
-					h.conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+				if bs3 == nil || bytes.Equal(bs3, endBytes) { // NOTE: here, avoid copy 'END\r\n'
+					break
+				}
+				if length, err = valueLen(bs3); err != nil {
+					return
 				}
-				if bs3, err = h.br.ReadBytes(delim); err != nil {
-					err = errors.Wrap(err, "MC Handler handle reread response bytes")
+				if bs2, err = h.br.ReadFull(int(length + 2)); err != nil {
+					err = errors.Wrap(ErrBadResponse, "MC Handler handle reread response bytes read")
 					return
 				}
+				h.bss = append(h.bss, bs3, bs2)
+				tl += len(bs3) + len(bs2)
 			}
 			const endBytesLen = 5 // NOTE: endBytes length
+			if !h.acquire(tl + endBytesLen) {
+				h.hit()
+				return budgetResponse(mcr), nil // NOTE: the response read through, connection reusable
+			}
 			tmp := h.makeBytes(tl + endBytesLen)
 			off := 0
 			for i := range h.bss {
@@ -159,27 +727,518 @@ func (h *handler) Handle(req *proto.Request) (resp *proto.Response, err error) {
 			}
 			copy(tmp[off:], endBytes)
 			bs = tmp
+			if h.chunkSize > 0 {
+				if flags, chunked := chunkFlags(h.bss[0]); chunked {
+					ll := len(h.bss[0]) // NOTE: use the copied bytes, buffer of reader would be reused
+					if bs, err = h.chunkGet(mcr, h.wireKey(mcr.key), tmp[:ll], tmp[ll:ll+int(length)], flags); err != nil {
+						if errors.Cause(err) == ErrResponseBudget {
+							h.hit()
+							return budgetResponse(mcr), nil
+						}
+						return
+					}
+				}
+			}
+			if bytes.Equal(bs, endBytes) {
+				h.miss() // NOTE: the chunks missing
+			} else {
+				h.hit()
+			}
+			if len(h.decoders) > 0 {
+				if bs, err = h.decodeValue(bs); err != nil {
+					return
+				}
+			}
 		} else {
-			stat.Miss(h.cluster, h.addr)
+			h.miss()
 		}
+	} else if mcr.rTp == RequestTypeMetaGet {
+		return h.metaGet(mcr, bs)
+	} else if mcr.rTp == RequestTypeMetaDebug {
+		bs = h.restoreKey(bs, mcr.key) // NOTE: like 'ME <key> <k>=<v>*\r\n' or 'EN\r\n'
+	} else {
+		h.outcome(mcr.rTp, bs)
 	}
 	resp = &proto.Response{Type: proto.CacheTypeMemcache}
 	pr := &MCResponse{rTp: mcr.rTp, data: bs}
+	if (mcr.rTp == RequestTypeGets || mcr.rTp == RequestTypeGats) && !bytes.Equal(bs, endBytes) {
+		if pr.values, err = parseValues(bs); err != nil {
+			err = errors.Wrapf(ErrBadResponse, "MC Handler handle parse values:%v", err)
+			return
+		}
+	}
 	resp.WithProto(pr)
 	return
 }
 
+// valueLen returns the data length of 'VALUE <key> <flags> <bytes> [<cas unique>]\r\n', the unknown
+// trailing fields are opaque, like: added by a newer server, so are the extra whitespaces.
+func valueLen(bs []byte) (length int64, err error) {
+	lenBs := lineField(bs, 3)
+	if lenBs == nil {
+		err = errors.Wrap(ErrBadResponse, "MC Handler handle read response bytes split")
+		return
+	}
+	if length, err = conv.ParseLen(lenBs); err != nil {
+		err = errors.Wrapf(ErrBadResponse, "MC Handler handle read response bytes length:%v", err)
+	}
+	return
+}
+
+// lineField returns the n-th field of line separated by whitespaces, nil when no such field.
+// NOTE: no allocation, the value line is parsed for every value read.
+func lineField(bs []byte, n int) []byte {
+	for i := 0; i < len(bs); {
+		for i < len(bs) && isSpace(bs[i]) {
+			i++
+		}
+		j := i
+		for j < len(bs) && !isSpace(bs[j]) {
+			j++
+		}
+		if i == j {
+			return nil
+		}
+		if n == 0 {
+			return bs[i:j]
+		}
+		n--
+		i = j
+	}
+	return nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// parseValues parses the items of 'VALUE <key> <flags> <bytes> <cas unique>\r\n<data>\r\n...END\r\n',
+// the unknown trailing fields of value line are ignored.
+func parseValues(bs []byte) (vs []*Value, err error) {
+	for !bytes.Equal(bs, endBytes) {
+		i := bytes.Index(bs, crlfBytes)
+		if i < 0 {
+			return nil, errors.Errorf("value line(%q) not terminated", bs)
+		}
+		fs := bytes.Fields(bs[:i])
+		if len(fs) < 5 || !bytes.Equal(fs[0], []byte("VALUE")) {
+			return nil, errors.Errorf("value line(%q) bad format", bs[:i])
+		}
+		v := &Value{Key: fs[1]}
+		var flags, length int64
+		if flags, err = conv.Btoi(fs[2]); err != nil {
+			return
+		}
+		if length, err = conv.ParseLen(fs[3]); err != nil {
+			return
+		}
+		if v.Cas, err = strconv.ParseUint(string(fs[4]), 10, 64); err != nil {
+			return
+		}
+		v.Flags = uint32(flags)
+		bs = bs[i+2:]
+		if int64(len(bs)) < length+2 {
+			return nil, errors.Errorf("value data length(%d) short", len(bs))
+		}
+		v.Data = bs[:length]
+		bs = bs[length+2:]
+		vs = append(vs, v)
+	}
+	return
+}
+
+func (h *handler) hit() {
+	if h.stats != nil {
+		h.stats.Hit(h.cluster, h.addr)
+		return
+	}
+	stat.Hit(h.cluster, h.addr)
+}
+
+func (h *handler) miss() {
+	if h.stats != nil {
+		h.stats.Miss(h.cluster, h.addr)
+		return
+	}
+	stat.Miss(h.cluster, h.addr)
+}
+
+// metaGet reads the meta get response, bs is the first line.
+// NOTE: like 'VA <size> <flag>*\r\n<data>\r\n' or 'HD <flag>*\r\n' or 'EN\r\n'.
+func (h *handler) metaGet(mcr *MCRequest, bs []byte) (resp *proto.Response, err error) {
+	pr := &MCResponse{rTp: mcr.rTp, data: bs}
+	if bytes.Equal(bs, metaEndBytes) {
+		h.miss()
+	} else if isErrorLine(bs) {
+		h.outcome(mcr.rTp, bs)
+	} else {
+		h.hit()
+		fs := bytes.Fields(bs)
+		if bytes.HasPrefix(bs, metaValueBytes) {
+			if len(fs) < 2 {
+				err = errors.Wrap(ErrBadResponse, "MC Handler handle read meta response bytes split")
+				return
+			}
+			var length int64
+			if length, err = conv.ParseLen(fs[1]); err != nil {
+				err = errors.Wrapf(ErrBadResponse, "MC Handler handle read meta response bytes length:%v", err)
+				return
+			}
+			var bs2 []byte
+			if bs2, err = h.br.ReadFull(int(length + 2)); err != nil { // NOTE: +2 read contains '\r\n'
+				err = errors.Wrap(ErrBadResponse, "MC Handler handle read meta response bytes read")
+				return
+			}
+			if !h.acquire(len(bs) + len(bs2)) {
+				return budgetResponse(mcr), nil
+			}
+			tmp := h.makeBytes(len(bs) + len(bs2))
+			copy(tmp[copy(tmp, bs):], bs2)
+			pr.data = tmp
+			fs = fs[2:]
+		} else {
+			fs = fs[1:]
+		}
+		for _, f := range fs {
+			if len(f) > 1 && f[0] == 't' {
+				if pr.ttl, err = conv.Btoi(f[1:]); err != nil {
+					err = errors.Wrapf(ErrBadResponse, "MC Handler handle read meta response ttl(%s)", f)
+					return
+				}
+				pr.hasTTL = true
+			}
+		}
+	}
+	resp = &proto.Response{Type: proto.CacheTypeMemcache}
+	resp.WithProto(pr)
+	return
+}
+
+// outcome stats the write command reply outcome.
+func (h *handler) outcome(rTp RequestType, bs []byte) {
+	switch rTp {
+	case RequestTypeSet, RequestTypeAdd, RequestTypeReplace, RequestTypeAppend, RequestTypePrepend, RequestTypeCas:
+		switch {
+		case bytes.Equal(bs, storedBytes):
+			stat.Store(h.cluster, h.addr)
+		case bytes.Equal(bs, existsBytes):
+			stat.CasConflict(h.cluster, h.addr)
+		case bytes.Equal(bs, notStoredBytes), bytes.Equal(bs, notFoundBytes):
+			stat.StoreFail(h.cluster, h.addr)
+		}
+	case RequestTypeDelete:
+		switch {
+		case bytes.Equal(bs, deletedBytes):
+			stat.Delete(h.cluster, h.addr)
+		case bytes.Equal(bs, notFoundBytes):
+			stat.DeleteMiss(h.cluster, h.addr)
+		}
+	}
+}
+
+// wireKey returns the key rewritten by rules, the prefix not included.
+func (h *handler) wireKey(key []byte) []byte {
+	return RewriteKey(h.rules, key)
+}
+
+// storedKey returns the key stored by backend, that is the key prefix and rules applied.
+func (h *handler) storedKey(key []byte) []byte {
+	wk := h.wireKey(key)
+	sk := make([]byte, 0, len(h.prefix)+len(wk))
+	return append(append(sk, h.prefix...), wk...)
+}
+
+// restoreKey restores the key requested in the 'VALUE <key> ...' or 'ME <key> ...' line,
+// that is the key prefix stripped, or the key rewritten by rules replaced.
+func (h *handler) restoreKey(bs, key []byte) []byte {
+	i := bytes.IndexByte(bs, spaceByte) + 1 // NOTE: 'VALUE ' or 'ME ' length
+	if i == 0 {
+		return bs
+	}
+	if len(h.rules) > 0 {
+		j := bytes.IndexByte(bs[i:], spaceByte)
+		if j < 0 {
+			return bs
+		}
+		rs := make([]byte, 0, len(bs)-j+len(key))
+		return append(append(append(rs, bs[:i]...), key...), bs[i+j:]...)
+	}
+	if len(h.prefix) == 0 || !bytes.HasPrefix(bs[i:], h.prefix) {
+		return bs
+	}
+	n := copy(bs[i:], bs[i+len(h.prefix):])
+	return bs[:i+n]
+}
+
+// Ping pings the connection by 'version' command, keeps it alive and detects the dead.
+func (h *handler) Ping() (err error) {
+	if h.Closed() {
+		err = errors.Wrap(ErrClosed, "MC Handler ping")
+		return
+	}
+	bs, err := h.HandleRaw(versionBytes, RawReplyLine)
+	if err != nil {
+		err = errors.Wrap(err, "MC Handler ping")
+		return
+	}
+	if !bytes.HasPrefix(bs, versionPrefixBytes) {
+		err = errors.Wrapf(ErrPingerPong, "MC Handler ping response(%q)", bs)
+	}
+	return
+}
+
+// RawReply is the reply terminator detection of raw request.
+type RawReply int
+
+// raw reply terminators.
+const (
+	// RawReplyLine means the reply is a single line, like: 'VERSION 1.5.0\r\n'.
+	RawReplyLine RawReply = iota
+	// RawReplyEnd means the reply is lines terminated by 'END\r\n', like: stats.
+	RawReplyEnd
+)
+
+// RawHandler handles raw request bytes, is the escape hatch of unparsed commands.
+type RawHandler interface {
+	HandleRaw(req []byte, rr RawReply) ([]byte, error)
+}
+
+// HandleRaw writes raw request bytes and reads the reply verbatim by rr detection.
+// NOTE: it is UNSAFE for commands which cannot be framed by rr, like values contains
+// '\r\n', the connection would be out of sync and must be closed when error returned.
+func (h *handler) HandleRaw(req []byte, rr RawReply) (reply []byte, err error) {
+	if h.tap != nil {
+		defer h.tap.Record()
+	}
+	if !h.enter() {
+		err = errors.Wrap(ErrClosed, "MC Handler handle raw request")
+		return
+	}
+	defer h.exit(&err, "MC Handler handle raw request")
+	if h.poisoned() {
+		err = errors.Wrap(ErrPoisoned, "MC Handler handle raw request")
+		return
+	}
+	if h.writeTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	}
+	h.bw.Write(req)
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler handle raw flush request bytes")
+		return
+	}
+	for {
+		if h.readTimeout > 0 {
+			h.conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+		}
+		var bs []byte
+		if bs, err = h.br.ReadBytes(delim); err != nil {
+			err = errors.Wrap(err, "MC Handler handle raw read response bytes")
+			return
+		}
+		reply = append(reply, bs...)
+		if rr == RawReplyLine || bytes.Equal(bs, endBytes) || isErrorLine(bs) {
+			return
+		}
+	}
+}
+
+// RawStreamHandler handles raw request bytes and streams the reply, is the escape hatch of large replies.
+type RawStreamHandler interface {
+	HandleRawStream(req []byte, w io.Writer) error
+}
+
+// HandleRawStream writes raw request bytes and copies the reply lines into w until 'END\r\n',
+// the reply is never buffered whole, like: lru_crawler metadump.
+// NOTE: the error or 'BUSY' line is returned as error and never copied.
+func (h *handler) HandleRawStream(req []byte, w io.Writer) (err error) {
+	if h.tap != nil {
+		defer h.tap.Record()
+	}
+	if !h.enter() {
+		err = errors.Wrap(ErrClosed, "MC Handler handle raw stream request")
+		return
+	}
+	defer h.exit(&err, "MC Handler handle raw stream request")
+	if h.poisoned() {
+		err = errors.Wrap(ErrPoisoned, "MC Handler handle raw stream request")
+		return
+	}
+	if h.writeTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+	}
+	h.bw.Write(req)
+	if err = h.bw.Flush(); err != nil {
+		err = errors.Wrap(err, "MC Handler handle raw stream flush request bytes")
+		return
+	}
+	for {
+		if h.readTimeout > 0 {
+			h.conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+		}
+		var bs []byte
+		if bs, err = h.br.ReadBytes(delim); err != nil {
+			err = errors.Wrap(err, "MC Handler handle raw stream read response bytes")
+			return
+		}
+		if isErrorLine(bs) || bytes.HasPrefix(bs, busyPrefixBytes) {
+			err = replyError(bs)
+			return
+		}
+		if _, err = w.Write(bs); err != nil {
+			err = errors.Wrap(err, "MC Handler handle raw stream copy response bytes")
+			return
+		}
+		if bytes.Equal(bs, endBytes) {
+			return
+		}
+	}
+}
+
+func isErrorLine(bs []byte) bool {
+	return bytes.HasPrefix(bs, []byte(errorPrefix)) || bytes.HasPrefix(bs, []byte(clientErrorPrefix)) || bytes.HasPrefix(bs, []byte(serverErrorPrefix))
+}
+
+// countConn counts the bytes written into and read from backend.
+type countConn struct {
+	net.Conn
+	cluster string
+	addr    string
+	first   time.Time // NOTE: the first read time since reset
+	in, out int       // NOTE: the bytes read and written since sizing
+}
+
+func (c *countConn) Read(p []byte) (n int, err error) {
+	if n, err = c.Conn.Read(p); n > 0 {
+		c.in += n
+		stat.BytesIn(c.cluster, c.addr, n)
+		if c.first.IsZero() {
+			c.first = time.Now()
+		}
+	}
+	return
+}
+
+func (c *countConn) Write(p []byte) (n int, err error) {
+	if n, err = c.Conn.Write(p); n > 0 {
+		c.out += n
+		stat.BytesOut(c.cluster, c.addr, n)
+	}
+	return
+}
+
+// Alive reports whether the idle connection is still usable by a non-blocking peek, which
+// would block for the healthy one. The connection reset or closed by peer, or with
+// unexpected pending data, is not alive.
+func (h *handler) Alive() bool {
+	if h.Closed() {
+		return false
+	}
+	return peekAlive(h.conn)
+}
+
+// poisoned reports whether any data pending before the request written when check pending,
+// either read ahead in the buffer or in the socket.
+func (h *handler) poisoned() bool {
+	return h.pending && (h.br.Buffered() > 0 || !peekAlive(h.conn))
+}
+
+// Stale reports whether the resolved address of connection is not in the answer any more,
+// or the server hinted to reconnect, or the credential authenticated by rotated, or the max requests served.
+func (h *handler) Stale() bool {
+	return h.recycle || (h.maxReqs > 0 && h.served >= h.maxReqs) || (h.resolver != nil && !h.resolver.Valid(h.addr, h.raddr)) || (h.auth != nil && h.auth() != h.cred)
+}
+
+// hint marks the connection to be recycled when the error reply contains any reconnect hints.
+func (h *handler) hint(bs []byte) {
+	if len(h.hints) == 0 || !isErrorLine(bs) {
+		return
+	}
+	for _, hint := range h.hints {
+		if bytes.Contains(bs, hint) {
+			h.recycle = true
+			return
+		}
+	}
+}
+
+// Close closes the connection, the buffers are put back into the free list if any.
+// The in-flight request fails by ErrClosed, and the buffers are put back when it exits.
 func (h *handler) Close() error {
 	if atomic.CompareAndSwapInt32(&h.closed, handlerOpening, handlerClosed) {
-		return h.conn.Close()
+		err := h.conn.Close()
+		h.release()
+		return err
 	}
 	return nil
 }
 
+// enter enters the request handling, returns false when closed.
+func (h *handler) enter() bool {
+	atomic.AddInt32(&h.refs, 1)
+	if h.Closed() {
+		h.release()
+		return false
+	}
+	return true
+}
+
+// exit exits the request handling, the error is replaced by ErrClosed when closed concurrently,
+// like: the use of closed network connection.
+func (h *handler) exit(err *error, msg string) {
+	if *err != nil && h.Closed() && errors.Cause(*err) != ErrClosed {
+		*err = errors.Wrap(ErrClosed, msg)
+	}
+	h.release()
+}
+
+// release drops one reference, the buffers are put back once by the last one.
+func (h *handler) release() {
+	if atomic.AddInt32(&h.refs, -1) == 0 && atomic.CompareAndSwapInt32(&h.recycled, 0, 1) && h.buffers != nil {
+		h.buffers.Put(h.br, h.bw)
+	}
+}
+
 func (h *handler) Closed() bool {
 	return atomic.LoadInt32(&h.closed) == handlerClosed
 }
 
+// acquire acquires n bytes of response budget before the large buffer allocated, returns false when exhausted.
+// NOTE: the small buffer is sliced from the handler buffer, not counted.
+func (h *handler) acquire(n int) bool {
+	if h.budget == nil || n < handlerWriteBufferSize {
+		return true
+	}
+	if !h.budget.Acquire(int64(n), h.readTimeout) {
+		return false
+	}
+	h.held += int64(n)
+	return true
+}
+
+// hold hands the budget bytes held over to the response, which releases them after written,
+// or releases them when no response.
+func (h *handler) hold(resp *proto.Response, err error) {
+	if h.held == 0 {
+		return
+	}
+	n, b := h.held, h.budget
+	h.held = 0
+	if err != nil || resp == nil {
+		b.Release(n)
+		return
+	}
+	resp.WithRelease(func() { b.Release(n) })
+}
+
+// budgetResponse returns the error response of request failed by response budget exhausted.
+func budgetResponse(mcr *MCRequest) *proto.Response {
+	resp := &proto.Response{Type: proto.CacheTypeMemcache}
+	resp.WithProto(&MCResponse{rTp: mcr.rTp})
+	resp.WithError(errors.Wrap(ErrResponseBudget, "MC Handler handle acquire response budget"))
+	return resp
+}
+
 func (h *handler) makeBytes(n int) (ss []byte) {
 	switch {
 	case n == 0:
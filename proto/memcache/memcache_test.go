@@ -3,16 +3,31 @@ package memcache_test
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/felixhao/overlord/lib/pool"
+	"github.com/felixhao/overlord/lib/resolver"
+	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/lib/tap"
 	"github.com/felixhao/overlord/proto"
 	"github.com/felixhao/overlord/proto/memcache"
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -43,7 +58,8 @@ func mockProxyServer(t *testing.T, wg *sync.WaitGroup) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		fmt.Println("wocao111111")
 		handlerConn(t, wg, conn)
@@ -57,6 +73,9 @@ func handlerConn(t *testing.T, wg *sync.WaitGroup, conn net.Conn) {
 	e := memcache.NewEncoder(conn)
 	for {
 		req, err := d.Decode()
+		if errors.Cause(err) == io.EOF {
+			return // NOTE: client closed
+		}
 		wg.Done()
 		if err != nil {
 			if errors.Cause(err) == memcache.ErrError {
@@ -98,7 +117,7 @@ func newPool(t *testing.T) *pool.Pool {
 	dto := time.Duration(1000) * time.Millisecond
 	rto := time.Duration(1000) * time.Millisecond
 	wto := time.Duration(1000) * time.Millisecond
-	dial := pool.PoolDial(memcache.Dial("127.0.0.1:11211", dto, rto, wto))
+	dial := pool.PoolDial(memcache.Dial("test-cluster", "127.0.0.1:11211", dto, rto, wto))
 	act := pool.PoolActive(2)
 	idle := pool.PoolIdle(1)
 	idleTo := pool.PoolIdleTimeout(time.Duration(10) * time.Second)
@@ -142,3 +161,1660 @@ func TestMemcache(t *testing.T) {
 	wg.Wait()
 	t.Log("all commands handle success")
 }
+
+func handle(t *testing.T, dial func() (pool.Conn, error), cmd string) []byte {
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	req, err := memcache.NewDecoder(bytes.NewBufferString(cmd)).Decode()
+	if err != nil {
+		t.Fatalf("decode cmd(%q) error:%v", cmd, err)
+	}
+	resp, err := conn.(proto.Handler).Handle(req)
+	if err != nil {
+		t.Fatalf("handle cmd(%q) error:%v", cmd, err)
+	}
+	var b bytes.Buffer
+	if err = memcache.NewEncoder(&b).Encode(resp); err != nil {
+		t.Fatalf("encode cmd(%q) error:%v", cmd, err)
+	}
+	return b.Bytes()
+}
+
+func TestHandlerTap(t *testing.T) {
+	const reply = "VALUE a_tap 0 3\r\ntap\r\nEND\r\n"
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte(reply))
+		}
+	})
+	defer closer()
+	var record bytes.Buffer
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialTap(tap.NewRecorder(&record)))
+	if bs := handle(t, dial, "get a_tap\r\n"); string(bs) != reply {
+		t.Fatalf("record get got(%q) want(%q)", bs, reply)
+	}
+	p, err := tap.ReadPair(bytes.NewReader(record.Bytes()))
+	if err != nil {
+		t.Fatalf("read record pair error:%v", err)
+	}
+	if string(p.Req) != "get a_tap\r\n" || string(p.Resp) != reply {
+		t.Fatalf("record pair req(%q) resp(%q) unexpected", p.Req, p.Resp)
+	}
+	// replay
+	errCh := make(chan error, 1)
+	addr, closer = memcachetest.Backend(t, func(conn net.Conn) {
+		errCh <- tap.Replay(conn, bytes.NewReader(record.Bytes()))
+	})
+	defer closer()
+	dial = memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)
+	if bs := handle(t, dial, "get a_tap\r\n"); string(bs) != reply {
+		t.Fatalf("replay get got(%q) want(%q)", bs, reply)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatalf("replay error:%v", err)
+	}
+}
+
+func TestHandlerKeyPrefix(t *testing.T) {
+	wires := make(chan string, 2)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			wires <- bs
+			if strings.HasPrefix(bs, "set") {
+				br.ReadString('\n')
+				conn.Write([]byte("STORED\r\n"))
+				continue
+			}
+			conn.Write([]byte("VALUE svc:a_pre 0 3\r\npre\r\nEND\r\n"))
+		}
+	})
+	defer closer()
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialKeyPrefix("svc:"))
+	if bs := handle(t, dial, "set a_pre 0 0 3\r\npre\r\n"); string(bs) != "STORED\r\n" {
+		t.Errorf("prefix set got(%q)", bs)
+	}
+	if w := <-wires; w != "set svc:a_pre 0 0 3\r\n" {
+		t.Errorf("prefix set wire(%q) not prefixed", w)
+	}
+	if bs := handle(t, dial, "get a_pre\r\n"); string(bs) != "VALUE a_pre 0 3\r\npre\r\nEND\r\n" {
+		t.Errorf("prefix get got(%q) not de-prefixed", bs)
+	}
+	if w := <-wires; w != "get svc:a_pre\r\n" {
+		t.Errorf("prefix get wire(%q) not prefixed", w)
+	}
+}
+
+func TestHandlerRaw(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch bs {
+			case "version\r\n":
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+			case "stats slabs\r\n":
+				conn.Write([]byte("STAT 1:chunk_size 96\r\nSTAT active_slabs 1\r\nEND\r\n"))
+			default:
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	defer closer()
+	conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	rh := conn.(memcache.RawHandler)
+	for _, c := range []struct {
+		req   string
+		rr    memcache.RawReply
+		reply string
+	}{
+		{"version\r\n", memcache.RawReplyLine, "VERSION 1.5.0\r\n"},
+		{"stats slabs\r\n", memcache.RawReplyEnd, "STAT 1:chunk_size 96\r\nSTAT active_slabs 1\r\nEND\r\n"},
+		{"noexist\r\n", memcache.RawReplyEnd, "ERROR\r\n"},
+	} {
+		bs, err := rh.HandleRaw([]byte(c.req), c.rr)
+		if err != nil {
+			t.Fatalf("handle raw(%q) error:%v", c.req, err)
+		}
+		if string(bs) != c.reply {
+			t.Errorf("handle raw(%q) got(%q) want(%q)", c.req, bs, c.reply)
+		}
+	}
+}
+
+func TestHandlerMetaGetTTL(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch bs {
+			case "mg a_mg t v\r\n":
+				conn.Write([]byte("VA 3 t86400\r\nabc\r\n"))
+			case "mg a_mg t\r\n":
+				conn.Write([]byte("HD t-1\r\n"))
+			default:
+				conn.Write([]byte("EN\r\n"))
+			}
+		}
+	})
+	defer closer()
+	conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	for _, c := range []struct {
+		cmd   string
+		reply string
+		ttl   int64
+		ok    bool
+	}{
+		{"mg a_mg t v\r\n", "VA 3 t86400\r\nabc\r\n", 86400, true},
+		{"mg a_mg t\r\n", "HD t-1\r\n", -1, true},
+		{"mg a_miss t v\r\n", "EN\r\n", 0, false},
+	} {
+		req, err := memcache.NewDecoder(bytes.NewBufferString(c.cmd)).Decode()
+		if err != nil {
+			t.Fatalf("decode cmd(%q) error:%v", c.cmd, err)
+		}
+		resp, err := conn.(proto.Handler).Handle(req)
+		if err != nil {
+			t.Fatalf("handle cmd(%q) error:%v", c.cmd, err)
+		}
+		ttl, ok := resp.Proto().(*memcache.MCResponse).TTL()
+		if ttl != c.ttl || ok != c.ok {
+			t.Errorf("cmd(%q) ttl(%d) ok(%t) want ttl(%d) ok(%t)", c.cmd, ttl, ok, c.ttl, c.ok)
+		}
+		var b bytes.Buffer
+		memcache.NewEncoder(&b).Encode(resp)
+		if b.String() != c.reply {
+			t.Errorf("cmd(%q) reply(%q) want(%q)", c.cmd, b.String(), c.reply)
+		}
+	}
+}
+
+func TestHandlerMetaDebug(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if bs == "me pre_a_me\r\n" {
+				conn.Write([]byte("ME pre_a_me exp=-1 la=3 cas=7 fetch=no cls=1 size=63\r\n"))
+			} else {
+				conn.Write([]byte("EN\r\n"))
+			}
+		}
+	})
+	defer closer()
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialKeyPrefix("pre_"))
+	if bs := handle(t, dial, "me a_me\r\n"); string(bs) != "ME a_me exp=-1 la=3 cas=7 fetch=no cls=1 size=63\r\n" {
+		t.Errorf("me reply(%q) want the debug line of key without prefix", bs)
+	}
+	if bs := handle(t, dial, "me a_miss\r\n"); string(bs) != "EN\r\n" {
+		t.Errorf("me reply(%q) want EN of miss", bs)
+	}
+}
+
+func TestMetaNoop(t *testing.T) {
+	for _, cmd := range []string{"mn\r\n", "MN\r\n"} {
+		req, err := memcache.NewDecoder(bytes.NewBufferString(cmd)).Decode()
+		if err != nil {
+			t.Fatalf("decode cmd(%q) error:%v", cmd, err)
+		}
+		if req.Cmd() != "mn" {
+			t.Fatalf("cmd(%q) decoded(%s) want mn", cmd, req.Cmd())
+		}
+		var b bytes.Buffer
+		memcache.NewEncoder(&b).Encode(memcache.LocalResponse(req))
+		if b.String() != "MN\r\n" {
+			t.Errorf("cmd(%q) reply(%q) want MN", cmd, b.String())
+		}
+	}
+	if _, err := memcache.NewDecoder(bytes.NewBufferString("mg\r\n")).Decode(); errors.Cause(err) != memcache.ErrBadRequest {
+		t.Errorf("decode mg without key error(%v) want bad request", err)
+	}
+}
+
+// mockStore is the mock backend stores the items of set, and replies them by get.
+type mockStore struct {
+	lock  sync.Mutex
+	items map[string]string // NOTE: key => 'flags\r\nvalue'
+	exps  map[string]string // NOTE: key => exptime, by set|touch|gat
+}
+
+func newMockStore(t *testing.T) (s *mockStore, addr string, closer func()) {
+	s = &mockStore{items: map[string]string{}, exps: map[string]string{}}
+	addr, closer = memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fs := strings.Fields(bs)
+			s.lock.Lock()
+			switch fs[0] {
+			case "set", "append":
+				var n int
+				fmt.Sscan(fs[4], &n)
+				v := make([]byte, n+2)
+				io.ReadFull(br, v)
+				if it, ok := s.items[fs[1]]; ok && fs[0] == "append" {
+					s.items[fs[1]] = it + string(v[:n])
+				} else if fs[0] == "set" {
+					s.items[fs[1]] = fs[2] + "\r\n" + string(v[:n])
+					s.exps[fs[1]] = fs[3]
+				} else {
+					conn.Write([]byte("NOT_STORED\r\n"))
+					break
+				}
+				conn.Write([]byte("STORED\r\n"))
+			case "get", "gat":
+				keys := fs[1:]
+				if fs[0] == "gat" {
+					keys = fs[2:]
+				}
+				var b bytes.Buffer
+				for _, k := range keys {
+					if it, ok := s.items[k]; ok {
+						i := strings.Index(it, "\r\n")
+						fmt.Fprintf(&b, "VALUE %s %s %d\r\n%s\r\n", k, it[:i], len(it)-i-2, it[i+2:])
+						if fs[0] == "gat" {
+							s.exps[k] = fs[1]
+						}
+					}
+				}
+				b.WriteString("END\r\n")
+				conn.Write(b.Bytes())
+			case "delete":
+				if _, ok := s.items[fs[1]]; ok {
+					delete(s.items, fs[1])
+					conn.Write([]byte("DELETED\r\n"))
+				} else {
+					conn.Write([]byte("NOT_FOUND\r\n"))
+				}
+			case "touch":
+				if _, ok := s.items[fs[1]]; ok {
+					s.exps[fs[1]] = fs[2]
+					conn.Write([]byte("TOUCHED\r\n"))
+				} else {
+					conn.Write([]byte("NOT_FOUND\r\n"))
+				}
+			}
+			s.lock.Unlock()
+		}
+	})
+	return
+}
+
+func TestHandlerChunk(t *testing.T) {
+	initStat()
+	s, addr, closer := newMockStore(t)
+	defer closer()
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialChunkSize(4))
+	if bs := handle(t, dial, "set a_chunk 7 0 10\r\n0123456789\r\n"); string(bs) != "STORED\r\n" {
+		t.Fatalf("chunk set got(%q)", bs)
+	}
+	s.lock.Lock()
+	if len(s.items) != 4 || s.items["a_chunk:0"] != "0\r\n0123" || s.items["a_chunk:2"] != "0\r\n89" {
+		t.Errorf("chunk items(%v) unexpected", s.items)
+	}
+	s.lock.Unlock()
+	if bs := handle(t, dial, "get a_chunk\r\n"); string(bs) != "VALUE a_chunk 7 10\r\n0123456789\r\nEND\r\n" {
+		t.Errorf("chunk get got(%q)", bs)
+	}
+	if bs := handle(t, dial, "set a_small 0 0 3\r\nabc\r\n"); string(bs) != "STORED\r\n" {
+		t.Fatalf("small set got(%q)", bs)
+	}
+	if bs := handle(t, dial, "get a_small\r\n"); string(bs) != "VALUE a_small 0 3\r\nabc\r\nEND\r\n" {
+		t.Errorf("small get got(%q)", bs)
+	}
+	// the key commands of the chunked key go to the chunks
+	if bs := handle(t, dial, "gat 60 a_chunk\r\n"); string(bs) != "VALUE a_chunk 7 10\r\n0123456789\r\nEND\r\n" {
+		t.Errorf("chunk gat got(%q)", bs)
+	}
+	if bs := handle(t, dial, "touch a_chunk 90\r\n"); string(bs) != "TOUCHED\r\n" {
+		t.Errorf("chunk touch got(%q)", bs)
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	for _, cmd := range []string{"append a_chunk 0 0 2\r\nxx\r\n", "prepend a_chunk 0 0 2\r\nxx\r\n"} {
+		req, _ := memcache.NewDecoder(bytes.NewBufferString(cmd)).Decode()
+		resp, err := conn.(proto.Handler).Handle(req)
+		if err != nil {
+			t.Fatalf("chunk cmd(%q) error:%v", cmd, err)
+		}
+		if errors.Cause(resp.Err()) != memcache.ErrChunkedAppend {
+			t.Errorf("chunk cmd(%q) reply error(%v) want rejected", cmd, resp.Err())
+		}
+	}
+	conn.Close()
+	if bs := handle(t, dial, "append a_small 0 0 2\r\nxx\r\n"); string(bs) != "STORED\r\n" {
+		t.Errorf("small append got(%q)", bs)
+	}
+	s.lock.Lock()
+	for _, k := range []string{"a_chunk", "a_chunk:0", "a_chunk:1", "a_chunk:2"} {
+		if s.exps[k] != "90" {
+			t.Errorf("chunk item(%s) exptime(%s) want touched", k, s.exps[k])
+		}
+	}
+	if s.items["a_chunk"] != strconv.FormatUint(7|uint64(memcache.FlagChunked), 10)+"\r\n3 10" || s.items["a_small"] != "0\r\nabcxx" {
+		t.Errorf("items(%v) want manifest intact and small appended", s.items)
+	}
+	s.lock.Unlock()
+	if bs := handle(t, dial, "delete a_chunk\r\n"); string(bs) != "DELETED\r\n" {
+		t.Errorf("chunk delete got(%q)", bs)
+	}
+	if bs := handle(t, dial, "delete a_chunk\r\n"); string(bs) != "NOT_FOUND\r\n" {
+		t.Errorf("chunk delete again got(%q)", bs)
+	}
+	s.lock.Lock()
+	if len(s.items) != 1 {
+		t.Errorf("items(%v) want the chunks deleted", s.items)
+	}
+	s.lock.Unlock()
+	// partial chunk missing
+	if bs := handle(t, dial, "set a_chunk 7 0 10\r\n0123456789\r\n"); string(bs) != "STORED\r\n" {
+		t.Fatalf("chunk set got(%q)", bs)
+	}
+	s.lock.Lock()
+	delete(s.items, "a_chunk:1")
+	s.lock.Unlock()
+	before := nodeCounters(t, addr)
+	if bs := handle(t, dial, "get a_chunk\r\n"); string(bs) != "END\r\n" {
+		t.Errorf("chunk missing get got(%q) want miss", bs)
+	}
+	after := nodeCounters(t, addr)
+	if hit, miss := after["overlord_proxy_hit"]-before["overlord_proxy_hit"], after["overlord_proxy_miss"]-before["overlord_proxy_miss"]; hit != 0 || miss != 1 {
+		t.Errorf("chunk missing hit(%v) miss(%v) want a miss", hit, miss)
+	}
+	// NOTE: noreply is rejected by decoder, never written to backend unchunked
+	if _, err := memcache.NewDecoder(bytes.NewBufferString("set a_chunk 0 0 10 noreply\r\n0123456789\r\n")).Decode(); errors.Cause(err) != memcache.ErrBadRequest {
+		t.Errorf("decode noreply set error(%v) want bad request", err)
+	}
+}
+
+func TestHandlerKeyRules(t *testing.T) {
+	s, addr, closer := newMockStore(t)
+	defer closer()
+	rules := []memcache.KeyRule{memcache.KeyReplacePrefix("legacy_", "v2_"), memcache.KeyLower(), memcache.KeyHash(32)}
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialKeyPrefix("svc:"), memcache.DialKeyRules(rules...))
+	long := "legacy_" + strings.Repeat("K", 60)
+	sum := sha1.Sum([]byte("v2_" + strings.Repeat("k", 60)))
+	for _, c := range []struct {
+		key  string
+		wire string
+	}{
+		{"legacy_User", "svc:v2_user"},
+		{"a_rule", "svc:a_rule"},
+		{long, "svc:" + hex.EncodeToString(sum[:])},
+	} {
+		if bs := handle(t, dial, "set "+c.key+" 0 0 3\r\nabc\r\n"); string(bs) != "STORED\r\n" {
+			t.Fatalf("key(%s) set got(%q)", c.key, bs)
+		}
+		s.lock.Lock()
+		_, ok := s.items[c.wire]
+		s.lock.Unlock()
+		if !ok {
+			t.Errorf("key(%s) not stored as wire key(%s)", c.key, c.wire)
+		}
+		if bs := handle(t, dial, "get "+c.key+"\r\n"); string(bs) != "VALUE "+c.key+" 0 3\r\nabc\r\nEND\r\n" {
+			t.Errorf("key(%s) get got(%q) want the key restored", c.key, bs)
+		}
+	}
+}
+
+func TestHandlerChecksum(t *testing.T) {
+	initStat()
+	s, addr, closer := newMockStore(t)
+	defer closer()
+	for _, miss := range []bool{false, true} {
+		dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialChecksum(memcache.CRC32(), miss))
+		if bs := handle(t, dial, "set a_checksum 7 0 5\r\nhello\r\n"); string(bs) != "STORED\r\n" {
+			t.Fatalf("checksum set got(%q)", bs)
+		}
+		s.lock.Lock()
+		it := s.items["a_checksum"]
+		s.lock.Unlock()
+		if want := strconv.FormatUint(uint64(7|memcache.FlagChecksum), 10) + "\r\nhello"; !strings.HasPrefix(it, want) || len(it) != len(want)+4 {
+			t.Fatalf("checksum item(%q) want(%q) with 4 bytes sum", it, want)
+		}
+		if bs := handle(t, dial, "get a_checksum\r\n"); string(bs) != "VALUE a_checksum 7 5\r\nhello\r\nEND\r\n" {
+			t.Errorf("checksum get got(%q)", bs)
+		}
+		// NOTE: the unmarked value is untouched
+		s.lock.Lock()
+		s.items["a_plain"] = "3\r\nabc"
+		s.items["a_checksum"] = strings.Replace(it, "hello", "hellO", 1) // NOTE: bit flipped
+		s.lock.Unlock()
+		if bs := handle(t, dial, "get a_plain\r\n"); string(bs) != "VALUE a_plain 3 3\r\nabc\r\nEND\r\n" {
+			t.Errorf("plain get got(%q)", bs)
+		}
+		before := nodeCounters(t, addr)["overlord_proxy_checksum_mismatch"]
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := memcache.NewDecoder(bytes.NewBufferString("get a_checksum\r\n")).Decode()
+		resp, err := conn.(proto.Handler).Handle(req)
+		conn.Close()
+		if miss {
+			if err != nil || resp.Status() != "MISS" {
+				t.Errorf("corrupted get status(%v) error(%v) want miss", resp, err)
+			}
+		} else if errors.Cause(err) != memcache.ErrChecksum {
+			t.Errorf("corrupted get error(%v) want checksum mismatch", err)
+		}
+		if n := nodeCounters(t, addr)["overlord_proxy_checksum_mismatch"]; n != before+1 {
+			t.Errorf("checksum mismatch counter(%v) want(%v)", n, before+1)
+		}
+	}
+	// NOTE: chunked value is verified after reassembled
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialChecksum(memcache.CRC32(), false), memcache.DialChunkSize(4))
+	if bs := handle(t, dial, "set a_checksum_chunk 0 0 10\r\n0123456789\r\n"); string(bs) != "STORED\r\n" {
+		t.Fatalf("chunk checksum set got(%q)", bs)
+	}
+	if bs := handle(t, dial, "get a_checksum_chunk\r\n"); string(bs) != "VALUE a_checksum_chunk 0 10\r\n0123456789\r\nEND\r\n" {
+		t.Errorf("chunk checksum get got(%q)", bs)
+	}
+}
+
+func TestHandlerAlive(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		conns <- conn
+	})
+	defer closer()
+	conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(proto.Checker)
+	if !c.Alive() {
+		t.Fatal("idle conn should be alive")
+	}
+	sc := <-conns
+	sc.Write([]byte("END\r\n")) // NOTE: unexpected data
+	time.Sleep(50 * time.Millisecond)
+	if c.Alive() {
+		t.Error("conn with unexpected data should not be alive")
+	}
+	conn2, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	(<-conns).Close() // NOTE: closed by server while idle
+	time.Sleep(50 * time.Millisecond)
+	if conn2.(proto.Checker).Alive() {
+		t.Error("conn closed by server should not be alive")
+	}
+}
+
+// flateCodec compresses the value not less than min bytes.
+type flateCodec struct {
+	min int
+}
+
+const flagFlate = uint32(1 << 28)
+
+func (c *flateCodec) Flag() uint32 {
+	return flagFlate
+}
+
+func (c *flateCodec) Encode(key, value []byte) ([]byte, uint32, error) {
+	if len(value) < c.min {
+		return value, 0, nil
+	}
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.BestSpeed)
+	w.Write(value)
+	w.Close()
+	return b.Bytes(), flagFlate, nil
+}
+
+func (c *flateCodec) Decode(key, value []byte, flags uint32) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(value)))
+}
+
+func TestHandlerValueCodec(t *testing.T) {
+	s, addr, closer := newMockStore(t)
+	defer closer()
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second,
+		memcache.DialValueCodec(&flateCodec{min: 16}, memcache.ChecksumCodec(memcache.CRC32())))
+	value := strings.Repeat("overlord", 16)
+	if bs := handle(t, dial, "set a_codec 3 0 128\r\n"+value+"\r\n"); string(bs) != "STORED\r\n" {
+		t.Fatalf("codec set got(%q)", bs)
+	}
+	if bs := handle(t, dial, "set a_codec_small 3 0 5\r\nsmall\r\n"); string(bs) != "STORED\r\n" {
+		t.Fatalf("codec small set got(%q)", bs)
+	}
+	s.lock.Lock()
+	it, small := s.items["a_codec"], s.items["a_codec_small"]
+	s.lock.Unlock()
+	flags := strconv.FormatUint(uint64(3|flagFlate|memcache.FlagChecksum), 10)
+	if !strings.HasPrefix(it, flags+"\r\n") || len(it) >= len(flags)+2+len(value) {
+		t.Errorf("codec item(%q) want compressed and checksummed", it)
+	}
+	if want := strconv.FormatUint(uint64(3|memcache.FlagChecksum), 10) + "\r\nsmall"; !strings.HasPrefix(small, want) || len(small) != len(want)+4 {
+		t.Errorf("codec small item(%q) want checksummed only", small)
+	}
+	if bs := handle(t, dial, "get a_codec\r\n"); string(bs) != "VALUE a_codec 3 128\r\n"+value+"\r\nEND\r\n" {
+		t.Errorf("codec get got(%q)", bs)
+	}
+	if bs := handle(t, dial, "get a_codec_small\r\n"); string(bs) != "VALUE a_codec_small 3 5\r\nsmall\r\nEND\r\n" {
+		t.Errorf("codec small get got(%q)", bs)
+	}
+	// NOTE: the checksum is verified before decompressed
+	s.lock.Lock()
+	b := []byte(it)
+	b[len(flags)+4] ^= 0xff
+	s.items["a_codec"] = string(b)
+	s.lock.Unlock()
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, _ := memcache.NewDecoder(bytes.NewBufferString("get a_codec\r\n")).Decode()
+	if _, err = conn.(proto.Handler).Handle(req); errors.Cause(err) != memcache.ErrChecksum {
+		t.Errorf("corrupted codec get error(%v) want checksum mismatch", err)
+	}
+}
+
+func TestEncryptCodec(t *testing.T) {
+	kr, err := memcache.NewKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = memcache.NewKeyring(1, []byte("short")); errors.Cause(err) != memcache.ErrEncryptKey {
+		t.Errorf("short key error(%v) want invalid", err)
+	}
+	c := memcache.EncryptCodec(kr)
+	key, value := []byte("a_encrypt"), []byte("overlord")
+	v1, flags, err := c.Encode(key, value)
+	if err != nil || flags != memcache.FlagEncrypted || bytes.Contains(v1, value) {
+		t.Fatalf("encrypted value(%q) flags(%d)", v1, flags)
+	}
+	if v2, _, _ := c.Encode(key, value); bytes.Equal(v1, v2) {
+		t.Error("encrypted twice should differ by nonce")
+	}
+	if bs, err := c.Decode(key, v1, flags); err != nil || !bytes.Equal(bs, value) {
+		t.Errorf("decrypted(%q) error(%v)", bs, err)
+	}
+	// NOTE: the value is bound to its key
+	if _, err = c.Decode([]byte("b_encrypt"), v1, flags); errors.Cause(err) != memcache.ErrDecrypt {
+		t.Errorf("other key decrypt error(%v) want decrypt failed", err)
+	}
+	// NOTE: rotated keys still decrypt the old values
+	if err = kr.Rotate(2, bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	v3, _, _ := c.Encode(key, value)
+	if v3[0] != 2 {
+		t.Errorf("encrypted key version(%d) want 2", v3[0])
+	}
+	for _, v := range [][]byte{v1, v3} {
+		if bs, err := c.Decode(key, v, flags); err != nil || !bytes.Equal(bs, value) {
+			t.Errorf("rotated decrypted(%q) error(%v)", bs, err)
+		}
+	}
+	kr.Retire(1)
+	if _, err = c.Decode(key, v1, flags); errors.Cause(err) != memcache.ErrKeyRetired {
+		t.Errorf("retired key decrypt error(%v) want retired", err)
+	}
+	kr.Retire(2) // NOTE: current key is kept
+	if _, err = c.Decode(key, v3, flags); err != nil {
+		t.Errorf("current key decrypt error(%v)", err)
+	}
+	v3[len(v3)-1] ^= 0xff
+	if _, err = c.Decode(key, v3, flags); errors.Cause(err) != memcache.ErrDecrypt {
+		t.Errorf("tampered decrypt error(%v) want decrypt failed", err)
+	}
+	if _, err = c.Decode(key, v3[:5], flags); errors.Cause(err) != memcache.ErrDecrypt {
+		t.Errorf("short decrypt error(%v) want decrypt failed", err)
+	}
+	reader := rand.Reader
+	rand.Reader = errReader{}
+	_, _, err = c.Encode(key, value)
+	rand.Reader = reader
+	if errors.Cause(err) != memcache.ErrEncrypt {
+		t.Errorf("nonce read failed encrypt error(%v) want encrypt failed", err)
+	}
+}
+
+// errReader fails every read.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestHandlerEncrypt(t *testing.T) {
+	s, addr, closer := newMockStore(t)
+	defer closer()
+	kr, err := memcache.NewKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second,
+		memcache.DialValueCodec(memcache.EncryptCodec(kr)), memcache.DialChecksum(memcache.CRC32(), false))
+	if bs := handle(t, dial, "set a_encrypt 2 0 8\r\noverlord\r\n"); string(bs) != "STORED\r\n" {
+		t.Fatalf("encrypt set got(%q)", bs)
+	}
+	s.lock.Lock()
+	it := s.items["a_encrypt"]
+	s.lock.Unlock()
+	flags := strconv.FormatUint(uint64(2|memcache.FlagEncrypted|memcache.FlagChecksum), 10)
+	if !strings.HasPrefix(it, flags+"\r\n") || strings.Contains(it, "overlord") {
+		t.Errorf("encrypt item(%q) want encrypted", it)
+	}
+	// NOTE: the value copied to another key fails to decrypt
+	s.lock.Lock()
+	s.items["b_encrypt"] = it
+	s.lock.Unlock()
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, _ := memcache.NewDecoder(bytes.NewBufferString("get b_encrypt\r\n")).Decode()
+	if _, err = conn.(proto.Handler).Handle(req); errors.Cause(err) != memcache.ErrDecrypt {
+		t.Errorf("copied value get error(%v) want decrypt failed", err)
+	}
+	kr.Rotate(2, bytes.Repeat([]byte{2}, 32))
+	if bs := handle(t, dial, "get a_encrypt\r\n"); string(bs) != "VALUE a_encrypt 2 8\r\noverlord\r\nEND\r\n" {
+		t.Errorf("encrypt get got(%q)", bs)
+	}
+	kr.Retire(1)
+	req, _ = memcache.NewDecoder(bytes.NewBufferString("get a_encrypt\r\n")).Decode()
+	if _, err = conn.(proto.Handler).Handle(req); errors.Cause(err) != memcache.ErrKeyRetired {
+		t.Errorf("retired key get error(%v) want retired", err)
+	}
+}
+
+var statOnce sync.Once
+
+// initStat inits the stat globals once, they are registered into the default prometheus registry.
+func initStat() {
+	statOnce.Do(stat.Init)
+}
+
+// nodeCounters returns the stat counters of node by metric name.
+func nodeCounters(t *testing.T, addr string) map[string]float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather error:%v", err)
+	}
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "node" && l.GetValue() == addr {
+					got[mf.GetName()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return got
+}
+
+func TestHandlerBytes(t *testing.T) {
+	const (
+		req   = "get a_bytes\r\n"
+		reply = "VALUE a_bytes 0 5\r\nbytes\r\nEND\r\n"
+	)
+	initStat()
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte(reply))
+		}
+	})
+	defer closer()
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)
+	handle(t, dial, req)
+	handle(t, dial, req)
+	got := nodeCounters(t, addr)
+	if got["overlord_proxy_bytes_out"] != 2*float64(len(req)) {
+		t.Errorf("bytes out(%v) want(%d)", got["overlord_proxy_bytes_out"], 2*len(req))
+	}
+	if got["overlord_proxy_bytes_in"] != 2*float64(len(reply)) {
+		t.Errorf("bytes in(%v) want(%d)", got["overlord_proxy_bytes_in"], 2*len(reply))
+	}
+}
+
+func TestHandlerSize(t *testing.T) {
+	initStat()
+	value := strings.Repeat("s", 1000)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "get a_big\r\n" {
+				conn.Write([]byte("VALUE a_big 0 1000\r\n" + value + "\r\nEND\r\n")) // NOTE: 1027 bytes
+				continue
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	dial := memcache.Dial("size-cluster", addr, time.Second, time.Second, time.Second)
+	handle(t, dial, "get a_small\r\n")
+	handle(t, dial, "get a_big\r\n")
+	buckets := func(name string) map[float64]uint64 {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatalf("gather error:%v", err)
+		}
+		bs := map[float64]uint64{}
+		for _, mf := range mfs {
+			if mf.GetName() != name {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "cluster" && l.GetValue() == "size-cluster" {
+						for _, b := range m.GetHistogram().GetBucket() {
+							bs[b.GetUpperBound()] = b.GetCumulativeCount()
+						}
+					}
+				}
+			}
+		}
+		return bs
+	}
+	if bs := buckets("overlord_proxy_request_size"); bs[64] != 2 {
+		t.Errorf("request size buckets(%v) want both in 64", bs)
+	}
+	if bs := buckets("overlord_proxy_response_size"); bs[64] != 1 || bs[1024] != 1 || bs[4096] != 2 {
+		t.Errorf("response size buckets(%v) want the big one in 4096", bs)
+	}
+}
+
+func TestHandlerOutcome(t *testing.T) {
+	initStat()
+	replies := map[string]string{
+		"a_stored":    "STORED\r\n",
+		"a_notstored": "NOT_STORED\r\n",
+		"a_notfound":  "NOT_FOUND\r\n",
+		"a_exists":    "EXISTS\r\n",
+		"a_deleted":   "DELETED\r\n",
+		"a_missed":    "NOT_FOUND\r\n",
+	}
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fs := strings.Fields(line)
+			if fs[0] != "delete" {
+				if _, err = br.ReadString('\n'); err != nil { // NOTE: the data
+					return
+				}
+			}
+			conn.Write([]byte(replies[fs[1]]))
+		}
+	})
+	defer closer()
+	dial := memcache.Dial("outcome-cluster", addr, time.Second, time.Second, time.Second)
+	for _, cmd := range []string{
+		"set a_stored 0 0 1\r\n1\r\n",
+		"add a_notstored 0 0 1\r\n1\r\n",
+		"replace a_notfound 0 0 1\r\n1\r\n",
+		"cas a_exists 0 0 1 39\r\n1\r\n",
+		"delete a_deleted\r\n",
+		"delete a_missed\r\n",
+	} {
+		handle(t, dial, cmd)
+	}
+	got := map[string]float64{}
+	for _, s := range stat.Samples("outcome-cluster") {
+		got[s.Name] = s.Value
+	}
+	node := "{node=" + strconv.Quote(addr) + "}"
+	for name, want := range map[string]float64{
+		"overlord_proxy_store":        1,
+		"overlord_proxy_store_fail":   2, // NOTE: NOT_STORED and NOT_FOUND
+		"overlord_proxy_cas_conflict": 1,
+		"overlord_proxy_delete":       1,
+		"overlord_proxy_delete_miss":  1,
+	} {
+		if got[name+node] != want {
+			t.Errorf("%s(%v) want(%v)", name, got[name+node], want)
+		}
+	}
+}
+
+func TestCacheMemlimit(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch bs {
+			case "cache_memlimit 1024\r\n":
+				conn.Write([]byte("OK\r\n"))
+			case "cache_memlimit 1\r\n":
+				conn.Write([]byte("CLIENT_ERROR memlimit too small\r\n"))
+			default:
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	defer closer()
+	conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	rh := conn.(memcache.RawHandler)
+	if err = memcache.CacheMemlimit(rh, 1024); err != nil {
+		t.Errorf("cache_memlimit error:%v", err)
+	}
+	if err = memcache.CacheMemlimit(rh, 1); errors.Cause(err) != memcache.ErrBadResponse || !strings.Contains(err.Error(), "memlimit too small") {
+		t.Errorf("cache_memlimit error(%v) want bad response", err)
+	}
+	if err = memcache.CacheMemlimit(rh, 0); errors.Cause(err) != memcache.ErrError {
+		t.Errorf("cache_memlimit error(%v) want ERROR", err)
+	}
+}
+
+func TestStatsReset(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for _, reply := range []string{"RESET\r\n", "ERROR\r\n", "OK\r\n"} {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if bs != "stats reset\r\n" {
+				reply = "ERROR\r\n"
+			}
+			conn.Write([]byte(reply))
+		}
+	})
+	defer closer()
+	conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	rh := conn.(memcache.RawHandler)
+	if err = memcache.StatsReset(rh); err != nil {
+		t.Errorf("stats reset error:%v", err)
+	}
+	if err = memcache.StatsReset(rh); errors.Cause(err) != memcache.ErrError {
+		t.Errorf("stats reset error(%v) want ERROR", err)
+	}
+	if err = memcache.StatsReset(rh); errors.Cause(err) != memcache.ErrBadResponse {
+		t.Errorf("stats reset error(%v) want bad response", err)
+	}
+}
+
+// lineWriter records every write, the stream handler writes one reply line per write.
+type lineWriter struct {
+	lines []string
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lines = append(w.lines, string(p))
+	return len(p), nil
+}
+
+func TestLruCrawler(t *testing.T) {
+	const dump = "key=a exp=-1 la=1 cas=1 fetch=no cls=1 size=63\n" +
+		"key=b exp=-1 la=2 cas=2 fetch=no cls=1 size=63\n" +
+		"key=c exp=100 la=3 cas=3 fetch=yes cls=2 size=120\n"
+	busy := false
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch bs {
+			case "lru_crawler enable\r\n", "lru mode flat\r\n":
+				conn.Write([]byte("OK\r\n"))
+			case "lru_crawler metadump all\r\n":
+				if busy {
+					conn.Write([]byte("BUSY currently processing crawler request\r\n"))
+					continue
+				}
+				busy = true
+				conn.Write([]byte(dump + "END\r\n"))
+			default:
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	defer closer()
+	conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	rh := conn.(memcache.RawHandler)
+	if err = memcache.LruCrawler(rh, true); err != nil {
+		t.Errorf("lru_crawler enable error:%v", err)
+	}
+	if err = memcache.LruCrawler(rh, false); errors.Cause(err) != memcache.ErrError {
+		t.Errorf("lru_crawler disable error(%v) want ERROR", err)
+	}
+	if err = memcache.Lru(rh, []string{"mode", "flat"}); err != nil {
+		t.Errorf("lru mode flat error:%v", err)
+	}
+	if err = memcache.Lru(rh, []string{"mode", "flat\r\nflush_all"}); errors.Cause(err) != memcache.ErrBadRequest {
+		t.Errorf("lru injected arg error(%v) want bad request", err)
+	}
+	w := &lineWriter{}
+	if err = memcache.LruCrawlerMetadump(conn.(memcache.RawStreamHandler), w); err != nil {
+		t.Fatalf("metadump error:%v", err)
+	}
+	if len(w.lines) != 4 || strings.Join(w.lines, "") != dump+"END\r\n" {
+		t.Errorf("metadump lines(%q)", w.lines)
+	}
+	if err = memcache.LruCrawlerMetadump(conn.(memcache.RawStreamHandler), w); errors.Cause(err) != memcache.ErrBadResponse {
+		t.Errorf("metadump error(%v) want busy", err)
+	}
+}
+
+func TestHandlerMaxTTL(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const day = 86400
+	now := time.Now().Unix()
+	for _, c := range []struct {
+		cmd  string
+		wire string
+	}{
+		{"set a_ttl 0 3600 3\r\nabc\r\n", "set a_ttl 0 3600 3"},
+		{"set a_ttl 0 172800 3\r\nabc\r\n", "set a_ttl 0 86400 3"},
+		{"add a_ttl 0 0 3\r\nabc\r\n", "add a_ttl 0 0 3"},
+		{fmt.Sprintf("replace a_ttl 0 %d 3\r\nabc\r\n", now+3600), fmt.Sprintf("replace a_ttl 0 %d 3", now+3600)},
+		{fmt.Sprintf("replace a_ttl 0 %d 3\r\nabc\r\n", now+100*day), "replace a_ttl 0 86400 3"},
+		{"touch a_ttl 172800\r\n", "touch a_ttl 86400"},
+		{"append a_ttl 0 172800 3\r\nabc\r\n", "append a_ttl 0 172800 3"},
+	} {
+		s.Expect(c.wire).Reply([]byte("STORED\r\n"))
+		dial := memcache.Dial("test-cluster", s.Addr(), time.Second, time.Second, time.Second, memcache.DialMaxTTL(day))
+		if bs := handle(t, dial, c.cmd); string(bs) != "STORED\r\n" {
+			rs := s.Received()
+			t.Errorf("cmd(%q) wire(%q) want(%q)", c.cmd, rs[len(rs)-1], c.wire)
+		}
+	}
+	// NOTE: max more than 30 days, clamped as absolute
+	dial := memcache.Dial("test-cluster", s.Addr(), time.Second, time.Second, time.Second, memcache.DialMaxTTL(60*day))
+	handle(t, dial, "set a_abs 0 1999999999 3\r\nabc\r\n")
+	rs := s.Received()
+	var exp int64
+	fmt.Sscanf(rs[len(rs)-1], "set a_abs 0 %d 3", &exp)
+	if exp < now+60*day || exp > now+60*day+5 {
+		t.Errorf("absolute clamp wire(%q) want exptime about %d", rs[len(rs)-1], now+60*day)
+	}
+}
+
+func TestHandlerGetsValues(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("gets a_cas").Reply([]byte("VALUE a_cas 1 3 18446744073709551615\r\naaa\r\nEND\r\n"))
+	s.Expect("gets b_cas").Reply([]byte("VALUE b_cas 2 4 42\r\nbb\r\n\r\nEND\r\n"))
+	s.Expect("gets c_cas").Reply([]byte("END\r\n"))
+	conn, err := memcache.Dial("test-cluster", s.Addr(), time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	req, err := memcache.NewDecoder(bytes.NewBufferString("gets a_cas b_cas c_cas\r\n")).Decode()
+	if err != nil {
+		t.Fatalf("decode error:%v", err)
+	}
+	subs, resp := req.Batch()
+	for i := range subs {
+		if subs[i].Resp, err = conn.(proto.Handler).Handle(&subs[i]); err != nil {
+			t.Fatalf("handle sub(%s) error:%v", subs[i].Key(), err)
+		}
+	}
+	resp.Merge(subs)
+	vs := resp.Proto().(*memcache.MCResponse).Values()
+	if len(vs) != 2 {
+		t.Fatalf("values(%d) want 2", len(vs))
+	}
+	for i, want := range []memcache.Value{
+		{Key: []byte("a_cas"), Flags: 1, Data: []byte("aaa"), Cas: 18446744073709551615},
+		{Key: []byte("b_cas"), Flags: 2, Data: []byte("bb\r\n"), Cas: 42},
+	} {
+		v := vs[i]
+		if !bytes.Equal(v.Key, want.Key) || v.Flags != want.Flags || !bytes.Equal(v.Data, want.Data) || v.Cas != want.Cas {
+			t.Errorf("value(%s %d %q %d) want(%s %d %q %d)", v.Key, v.Flags, v.Data, v.Cas, want.Key, want.Flags, want.Data, want.Cas)
+		}
+	}
+}
+
+func TestHandlerValueExtraFields(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("get a_ext").Reply([]byte("VALUE a_ext 1 3 opaque x=2\r\naaa\r\nEND\r\n"))
+	s.Expect("get b_ext").Reply([]byte("VALUE  b_ext  2   4 \r\nbbbb\r\nEND\r\n"))
+	s.Expect("gets c_ext").Reply([]byte("VALUE c_ext 3 2 42 opaque\r\ncc\r\nEND\r\n"))
+	dial := memcache.Dial("test-cluster", s.Addr(), time.Second, time.Second, time.Second)
+	for _, c := range []struct {
+		cmd, reply string
+	}{
+		{"get a_ext\r\n", "VALUE a_ext 1 3 opaque x=2\r\naaa\r\nEND\r\n"},
+		{"get b_ext\r\n", "VALUE  b_ext  2   4 \r\nbbbb\r\nEND\r\n"},
+	} {
+		if reply := handle(t, dial, c.cmd); string(reply) != c.reply {
+			t.Errorf("cmd(%q) reply(%q) want(%q)", c.cmd, reply, c.reply)
+		}
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	req, err := memcache.NewDecoder(bytes.NewBufferString("gets c_ext\r\n")).Decode()
+	if err != nil {
+		t.Fatalf("decode error:%v", err)
+	}
+	resp, err := conn.(proto.Handler).Handle(req)
+	if err != nil {
+		t.Fatalf("handle error:%v", err)
+	}
+	if vs := resp.Proto().(*memcache.MCResponse).Values(); len(vs) != 1 || vs[0].Cas != 42 || string(vs[0].Data) != "cc" {
+		t.Errorf("values(%v) want cas 42 and data cc", vs)
+	}
+}
+
+func TestHandlerEmptyValue(t *testing.T) {
+	initStat()
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("set e_empty 0 0 0").Reply([]byte("STORED\r\n"))
+	s.Expect("get e_empty").Reply([]byte("VALUE e_empty 0 0\r\n\r\nEND\r\n"))
+	s.Expect("gets e_empty").Reply([]byte("VALUE e_empty 0 0 7\r\n\r\nEND\r\n"))
+	s.Expect("get e_miss").Reply([]byte("END\r\n"))
+	conn, err := memcache.Dial("test-cluster", s.Addr(), time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	for _, c := range []struct {
+		cmd   string
+		reply string
+	}{
+		{"set e_empty 0 0 0\r\n\r\n", "STORED\r\n"},
+		{"get e_empty\r\n", "VALUE e_empty 0 0\r\n\r\nEND\r\n"},
+		{"gets e_empty\r\n", "VALUE e_empty 0 0 7\r\n\r\nEND\r\n"},
+		{"get e_empty\r\n", "VALUE e_empty 0 0\r\n\r\nEND\r\n"},
+		{"get e_miss\r\n", "END\r\n"}, // NOTE: one connection, the empty value reading keeps it in sync
+	} {
+		req, err := memcache.NewDecoder(bytes.NewBufferString(c.cmd)).Decode()
+		if err != nil {
+			t.Fatalf("decode cmd(%q) error:%v", c.cmd, err)
+		}
+		resp, err := conn.(proto.Handler).Handle(req)
+		if err != nil {
+			t.Fatalf("handle cmd(%q) error:%v", c.cmd, err)
+		}
+		var b bytes.Buffer
+		memcache.NewEncoder(&b).Encode(resp)
+		if b.String() != c.reply {
+			t.Errorf("cmd(%q) reply(%q) want(%q)", c.cmd, b.String(), c.reply)
+		}
+		if req.Cmd() == "gets" {
+			if vs := resp.Proto().(*memcache.MCResponse).Values(); len(vs) != 1 || len(vs[0].Data) != 0 || vs[0].Cas != 7 {
+				t.Errorf("gets empty values(%v)", vs)
+			}
+		}
+	}
+	got := nodeCounters(t, s.Addr())
+	if got["overlord_proxy_hit"] != 3 || got["overlord_proxy_miss"] != 1 {
+		t.Errorf("hit(%v) miss(%v) want 3 1, the empty value is a hit", got["overlord_proxy_hit"], got["overlord_proxy_miss"])
+	}
+}
+
+func TestHandlerBatch(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("set a_batch 0 0 3").Reply([]byte("STORED\r\n"))
+	s.Expect("get a_batch").Reply([]byte("VALUE a_batch 0 3\r\naaa\r\nEND\r\n"))
+	s.Expect("get b_batch").Reply([]byte("END\r\n"))
+	s.Expect("gets c_batch").Reply([]byte("VALUE c_batch 0 4 9\r\ncc\r\n\r\nEND\r\n"))
+	s.Expect("delete a_batch").Reply([]byte("DELETED\r\n"))
+	conn, err := memcache.Dial("test-cluster", s.Addr(), time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	cmds := []string{"set a_batch 0 0 3\r\naaa\r\n", "get a_batch\r\n", "get b_batch\r\n", "gets c_batch\r\n", "delete a_batch\r\n"}
+	replies := []string{"STORED\r\n", "VALUE a_batch 0 3\r\naaa\r\nEND\r\n", "END\r\n", "VALUE c_batch 0 4 9\r\ncc\r\n\r\nEND\r\n", "DELETED\r\n"}
+	reqs := make([]*proto.Request, len(cmds))
+	for i, cmd := range cmds {
+		if reqs[i], err = memcache.NewDecoder(bytes.NewBufferString(cmd)).Decode(); err != nil {
+			t.Fatalf("decode cmd(%q) error:%v", cmd, err)
+		}
+	}
+	resps, err := conn.(proto.BatchHandler).HandleBatch(reqs)
+	if err != nil {
+		t.Fatalf("handle batch error:%v", err)
+	}
+	if len(resps) != len(reqs) {
+		t.Fatalf("responses(%d) want(%d)", len(resps), len(reqs))
+	}
+	for i, resp := range resps {
+		var b bytes.Buffer
+		memcache.NewEncoder(&b).Encode(resp)
+		if b.String() != replies[i] {
+			t.Errorf("cmd(%q) reply(%q) want(%q)", cmds[i], b.String(), replies[i])
+		}
+	}
+	s.Expect("get d_batch").Close()
+	reqs = reqs[:0]
+	for _, cmd := range []string{"get a_batch\r\n", "get d_batch\r\n", "get b_batch\r\n"} {
+		req, _ := memcache.NewDecoder(bytes.NewBufferString(cmd)).Decode()
+		reqs = append(reqs, req)
+	}
+	if resps, err = conn.(proto.BatchHandler).HandleBatch(reqs); err == nil || len(resps) != 1 {
+		t.Errorf("broken batch responses(%d) error(%v) want 1 and error", len(resps), err)
+	}
+}
+
+func TestMergeReader(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("get a_merge_1").Reply([]byte("VALUE a_merge_1 0 1\r\n1\r\nEND\r\n"))
+	s.Expect("get a_merge_2").Reply([]byte("END\r\n"))
+	s.Expect("get a_merge_3").Reply([]byte("VALUE a_merge_3 0 3\r\n333\r\nEND\r\n"))
+	conn, err := memcache.Dial("test", s.Addr(), time.Second, time.Second, time.Second)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, c := range []struct {
+		cmd    string
+		reply  string
+		status string
+	}{
+		{"get a_merge_1 a_merge_2 a_merge_3\r\n", "VALUE a_merge_1 0 1\r\n1\r\nVALUE a_merge_3 0 3\r\n333\r\nEND\r\n", "HIT"},
+		{"get a_merge_2 a_merge_2\r\n", "END\r\n", "MISS"},
+	} {
+		req, err := memcache.NewDecoder(bytes.NewBufferString(c.cmd)).Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs, resp := req.Batch()
+		for i := range subs {
+			subs[i].Process()
+			sr, err := conn.(proto.Handler).Handle(&subs[i])
+			if err != nil {
+				t.Fatalf("handle sub(%s) error:%v", subs[i].Key(), err)
+			}
+			subs[i].Done(sr)
+		}
+		resp.Merge(subs)
+		bs, err := ioutil.ReadAll(resp.Proto().(*memcache.MCResponse).Reader())
+		if err != nil || string(bs) != c.reply {
+			t.Errorf("cmd(%q) reader(%q) error(%v) want(%q)", c.cmd, bs, err, c.reply)
+		}
+		var b bytes.Buffer
+		if err = memcache.NewEncoder(&b).Encode(resp); err != nil || b.String() != c.reply {
+			t.Errorf("cmd(%q) encoded(%q) error(%v) want(%q)", c.cmd, b.String(), err, c.reply)
+		}
+		if resp.Status() != c.status {
+			t.Errorf("cmd(%q) status(%s) want(%s)", c.cmd, resp.Status(), c.status)
+		}
+	}
+}
+
+func BenchmarkMergeEncode(b *testing.B) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	const n, size = 16, 64 * 1024
+	keys := make([]string, n)
+	value := strings.Repeat("v", size)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("a_merge_%d", i)
+		s.Expect("get " + keys[i]).Reply([]byte(fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", keys[i], size, value)))
+	}
+	conn, err := memcache.Dial("bench", s.Addr(), time.Second, time.Second, time.Second)()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := memcache.NewDecoder(bytes.NewBufferString("get " + strings.Join(keys, " ") + "\r\n")).Decode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	subs, _ := req.Batch()
+	for i := range subs {
+		subs[i].Process()
+		resp, err := conn.(proto.Handler).Handle(&subs[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+		subs[i].Done(resp)
+	}
+	e := memcache.NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	b.SetBytes(n * size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, resp := req.Batch()
+		resp.Merge(subs)
+		if err := e.Encode(resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHandlerBudget(t *testing.T) {
+	s, addr, closer := newMockStore(t)
+	defer closer()
+	value := strings.Repeat("b", 16*1024)
+	s.items["a_budget"] = "0\r\n" + value
+	budget := pool.NewBudget(20*1024, nil)
+	get := func(readTimeout time.Duration) (*proto.Response, error) {
+		conn, err := memcache.Dial("test-cluster", addr, time.Second, readTimeout, time.Second, memcache.DialBudget(budget))()
+		if err != nil {
+			t.Fatalf("dial error:%v", err)
+		}
+		defer conn.Close()
+		req, err := memcache.NewDecoder(bytes.NewBufferString("get a_budget\r\n")).Decode()
+		if err != nil {
+			t.Fatalf("decode error:%v", err)
+		}
+		return conn.(proto.Handler).Handle(req)
+	}
+	held, err := get(time.Second)
+	if err != nil || held.Err() != nil {
+		t.Fatalf("first get error:%v resp error:%v", err, held.Err())
+	}
+	if n := budget.Used(); n < int64(len(value)) {
+		t.Fatalf("budget used(%d) want the value held until released", n)
+	}
+	resp, err := get(100 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("second get error:%v", err)
+	}
+	if errors.Cause(resp.Err()) != memcache.ErrResponseBudget {
+		t.Fatalf("second get resp error(%v) want budget exhausted", resp.Err())
+	}
+	done := make(chan *proto.Response, 1)
+	go func() {
+		resp, _ := get(time.Second)
+		done <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+	held.Release()
+	resp = <-done
+	if resp == nil || resp.Err() != nil {
+		t.Fatalf("throttled get resp(%v) want granted after release", resp)
+	}
+	var b bytes.Buffer
+	if err = memcache.NewEncoder(&b).Encode(resp); err != nil || !strings.Contains(b.String(), value) {
+		t.Errorf("throttled get encode error:%v want the value", err)
+	}
+	resp.Release()
+	if n := budget.Used(); n != 0 {
+		t.Errorf("budget used(%d) want 0 after all released", n)
+	}
+}
+
+func BenchmarkHandlerChurn(b *testing.B) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("get a_churn").Reply([]byte("VALUE a_churn 0 1\r\n1\r\nEND\r\n"))
+	req, err := memcache.NewDecoder(bytes.NewBufferString("get a_churn\r\n")).Decode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		dos  []*memcache.DialOption
+	}{
+		{"alloc", nil},
+		{"free_list", []*memcache.DialOption{memcache.DialBuffers(pool.NewBuffers(1))}},
+	} {
+		dial := memcache.Dial("bench", s.Addr(), time.Second, time.Second, time.Second, c.dos...)
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				conn, err := dial() // NOTE: a new connection replaces the closed one every time
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = conn.(proto.Handler).Handle(req); err != nil {
+					b.Fatal(err)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestHandlerCheckPending(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			// NOTE: the stale reply of a former request pushed after the expected one
+			conn.Write([]byte("END\r\nVALUE a_stale 0 5\r\nstale\r\nEND\r\n"))
+		}
+	})
+	defer closer()
+	get := func(conn pool.Conn) (*proto.Response, error) {
+		req, err := memcache.NewDecoder(bytes.NewBufferString("get a_pending\r\n")).Decode()
+		if err != nil {
+			t.Fatalf("decode error:%v", err)
+		}
+		return conn.(proto.Handler).Handle(req)
+	}
+	for _, check := range []bool{false, true} {
+		var dos []*memcache.DialOption
+		if check {
+			dos = append(dos, memcache.DialCheckPending())
+		}
+		conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, dos...)()
+		if err != nil {
+			t.Fatalf("dial error:%v", err)
+		}
+		if resp, err := get(conn); err != nil || resp.Status() != "MISS" {
+			t.Fatalf("check(%v) first get error:%v want miss", check, err)
+		}
+		time.Sleep(50 * time.Millisecond) // NOTE: the stale reply arrived
+		resp, err := get(conn)
+		if !check {
+			if err != nil || resp.Status() == "MISS" {
+				t.Errorf("get error:%v want the stale reply mis-parsed without check", err)
+			}
+		} else if errors.Cause(err) != memcache.ErrPoisoned {
+			t.Errorf("get error:%v want poisoned", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandlerDebugAddr(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("get a_addr").Reply([]byte("END\r\n"))
+	for _, debug := range []bool{false, true} {
+		var dos []*memcache.DialOption
+		want := ""
+		if debug {
+			dos = append(dos, memcache.DialDebugAddr())
+			want = s.Addr()
+		}
+		conn, err := memcache.Dial("test-cluster", s.Addr(), time.Second, time.Second, time.Second, dos...)()
+		if err != nil {
+			t.Fatalf("dial error:%v", err)
+		}
+		req, err := memcache.NewDecoder(bytes.NewBufferString("get a_addr\r\n")).Decode()
+		if err != nil {
+			t.Fatalf("decode error:%v", err)
+		}
+		resp, err := conn.(proto.Handler).Handle(req)
+		if err != nil {
+			t.Fatalf("handle error:%v", err)
+		}
+		if resp.Addr() != want {
+			t.Errorf("debug(%v) response addr(%s) want(%s)", debug, resp.Addr(), want)
+		}
+		var b bytes.Buffer
+		if err = memcache.NewEncoder(&b).Encode(resp); err != nil || b.String() != "END\r\n" {
+			t.Errorf("encoded(%q) error(%v) want the addr not on the wire", b.String(), err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandlerEndGrace(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "get a_end") {
+				conn.Write([]byte("VALUE a_end 0 3\r\nend\r\n")) // NOTE: the END missing
+				continue
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	get := func(conn pool.Conn, key string) (*proto.Response, error) {
+		req, err := memcache.NewDecoder(bytes.NewBufferString("get " + key + "\r\n")).Decode()
+		if err != nil {
+			t.Fatalf("decode error:%v", err)
+		}
+		return conn.(proto.Handler).Handle(req)
+	}
+	for _, strict := range []bool{false, true} {
+		conn, err := memcache.Dial("test-cluster", addr, time.Second, 5*time.Second, time.Second, memcache.DialEndGrace(50*time.Millisecond, strict))()
+		if err != nil {
+			t.Fatalf("dial error:%v", err)
+		}
+		start := time.Now()
+		resp, err := get(conn, "a_end")
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("strict(%v) get took(%v) want the grace rather than read timeout", strict, d)
+		}
+		if strict {
+			if errors.Cause(err) != memcache.ErrMissingEnd {
+				t.Errorf("get error(%v) want END missing", err)
+			}
+			conn.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("get error:%v", err)
+		}
+		var b bytes.Buffer
+		if err = memcache.NewEncoder(&b).Encode(resp); err != nil || b.String() != "VALUE a_end 0 3\r\nend\r\nEND\r\n" {
+			t.Errorf("encoded(%q) error(%v) want complete value", b.String(), err)
+		}
+		if resp, err = get(conn, "a_next"); err != nil || resp.Status() != "MISS" {
+			t.Errorf("next get error(%v) want the connection reusable", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandlerCloseRace(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			conn.Write([]byte("VALUE a_race 0 4\r\nrace\r\nEND\r\n"))
+		}
+	})
+	defer closer()
+	bufs := pool.NewBuffers(1) // NOTE: the buffers reused by the next handler, raced if put back in-flight
+	for i := 0; i < 20; i++ {
+		conn, err := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialBuffers(bufs))()
+		if err != nil {
+			t.Fatalf("dial error:%v", err)
+		}
+		req, err := memcache.NewDecoder(bytes.NewBufferString("get a_race\r\n")).Decode()
+		if err != nil {
+			t.Fatalf("decode error:%v", err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, err := conn.(proto.Handler).Handle(req)
+			done <- err
+		}()
+		time.Sleep(time.Duration(i%3) * 5 * time.Millisecond)
+		conn.Close()
+		if err = <-done; err != nil && errors.Cause(err) != memcache.ErrClosed {
+			t.Fatalf("handle error(%v) want ErrClosed when closed concurrently", err)
+		}
+	}
+}
+
+func TestHandlerLocalAddr(t *testing.T) {
+	laddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+	l, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		t.Skipf("loopback 127.0.0.2 unavailable:%v", err)
+	}
+	l.Close()
+	sources := make(chan string, 2)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(bs, "set") {
+				br.ReadString('\n')
+				conn.Write([]byte("STORED\r\n"))
+				continue
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	dial := memcache.Dial("test-cluster", addr, time.Second, time.Second, time.Second, memcache.DialLocalAddr(laddr))
+	if bs := handle(t, dial, "get a_source\r\n"); string(bs) != "END\r\n" {
+		t.Errorf("get got(%q)", bs)
+	}
+	p := memcache.NewPinger(addr, time.Second, time.Second, time.Second, memcache.PingerLocalAddr(laddr))
+	defer p.Close()
+	if err = p.Ping(); err != nil {
+		t.Errorf("ping error:%v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if src := <-sources; src != "127.0.0.2" {
+			t.Errorf("source(%s) want the local addr bound", src)
+		}
+	}
+}
+
+func TestHandlerLookup(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(bs, "set") {
+				br.ReadString('\n')
+				conn.Write([]byte("STORED\r\n"))
+				continue
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	_, port, _ := net.SplitHostPort(addr)
+	var cancelled int32
+	slow := func(ctx context.Context, host string) ([]string, error) {
+		select {
+		case <-time.After(150 * time.Millisecond): // NOTE: longer than the connect timeout
+			return []string{"127.0.0.1"}, nil
+		case <-ctx.Done():
+			atomic.AddInt32(&cancelled, 1)
+			return nil, ctx.Err()
+		}
+	}
+	lookup := resolver.LookupTimeout(slow, time.Second)
+	dial := memcache.Dial("test-cluster", "mc.test:"+port, 50*time.Millisecond, time.Second, time.Second, memcache.DialLookup(lookup))
+	if bs := handle(t, dial, "get a_lookup\r\n"); string(bs) != "END\r\n" {
+		t.Errorf("get got(%q)", bs)
+	}
+	p := memcache.NewPinger("mc.test:"+port, 50*time.Millisecond, time.Second, time.Second, memcache.PingerLookup(lookup))
+	defer p.Close()
+	if err := p.Ping(); err != nil {
+		t.Errorf("ping error:%v", err)
+	}
+	start := time.Now()
+	dial = memcache.Dial("test-cluster", "mc.test:"+port, time.Second, time.Second, time.Second, memcache.DialLookup(resolver.LookupTimeout(slow, 50*time.Millisecond)))
+	if _, err := dial(); err == nil {
+		t.Error("dial want the lookup timeout")
+	} else if ne, ok := errors.Cause(err).(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("dial error(%v) want the lookup timeout", err)
+	}
+	if d := time.Since(start); d >= 150*time.Millisecond {
+		t.Errorf("dial elapsed(%v) want bounded by the lookup timeout", d)
+	}
+	if n := atomic.LoadInt32(&cancelled); n != 1 {
+		t.Errorf("lookups cancelled(%d) want the timed out one", n)
+	}
+}
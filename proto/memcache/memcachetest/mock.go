@@ -0,0 +1,211 @@
+package memcachetest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	crlfBytes  = []byte("\r\n")
+	errorBytes = []byte("ERROR\r\n")
+)
+
+// MockServer is an in-process memcache server speaks the text protocol,
+// the replies are scripted by Expect, and unexpected commands reply 'ERROR'.
+// The one new by NewMockServerFunc serves the connections by its func instead.
+type MockServer struct {
+	l  net.Listener
+	fn func(net.Conn)
+
+	lock     sync.Mutex
+	expects  []*Expectation
+	received []string
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// Expectation is the scripted reply of the command line.
+type Expectation struct {
+	cmd   string
+	reply []byte
+	delay time.Duration
+	close bool
+}
+
+// NewMockServer new a mock server listens on a random local port.
+func NewMockServer() (s *MockServer, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	s = &MockServer{l: l, conns: map[net.Conn]struct{}{}}
+	go s.serve()
+	return
+}
+
+// NewMockServerFunc new a mock server listens on a random local port, every connection is served by serve,
+// like: the stateful or protocol-broken backends can not be scripted.
+func NewMockServerFunc(serve func(net.Conn)) (s *MockServer, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	s = &MockServer{l: l, fn: serve, conns: map[net.Conn]struct{}{}}
+	go s.serve()
+	return
+}
+
+// Backend starts the mock server serves every connection by serve, t fails when listen failed.
+// closer closes the listener and all connections.
+func Backend(t testing.TB, serve func(net.Conn)) (addr string, closer func()) {
+	s, err := NewMockServerFunc(serve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Addr(), func() { s.Close() }
+}
+
+// Addr returns the listen address.
+func (s *MockServer) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Expect adds the expectation of command line without '\r\n', like: 'get a_11'.
+// The expectation matches every time the command received, the earlier added wins.
+func (s *MockServer) Expect(cmd string) *Expectation {
+	e := &Expectation{cmd: cmd}
+	s.lock.Lock()
+	s.expects = append(s.expects, e)
+	s.lock.Unlock()
+	return e
+}
+
+// Reply sets the reply bytes written verbatim, can be multi-line or malformed.
+func (e *Expectation) Reply(bs []byte) *Expectation {
+	e.reply = bs
+	return e
+}
+
+// Delay sets the delay before reply, injects the slow backend.
+func (e *Expectation) Delay(d time.Duration) *Expectation {
+	e.delay = d
+	return e
+}
+
+// Close closes the connection instead of reply, injects the broken backend.
+func (e *Expectation) Close() *Expectation {
+	e.close = true
+	return e
+}
+
+// Received returns the command lines received without '\r\n'.
+func (s *MockServer) Received() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// Close closes the listener and all connections.
+func (s *MockServer) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	return s.l.Close()
+}
+
+func (s *MockServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the conn until closed, can be used with one end of net.Pipe.
+func (s *MockServer) ServeConn(conn net.Conn) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.lock.Unlock()
+	if s.fn != nil {
+		s.fn(conn) // NOTE: the conn is owned by fn, closed by server only when the server closed
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		return
+	}
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+	br := bufio.NewReader(conn)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		line = bytes.TrimSuffix(line, crlfBytes)
+		if n, ok := dataLen(line); ok { // NOTE: storage command, discard data block
+			if _, err = io.CopyN(ioutil.Discard, br, n+2); err != nil {
+				return
+			}
+		}
+		cmd := string(line)
+		s.lock.Lock()
+		s.received = append(s.received, cmd)
+		var e *Expectation
+		for _, ex := range s.expects {
+			if ex.cmd == cmd {
+				e = ex
+				break
+			}
+		}
+		s.lock.Unlock()
+		if e == nil {
+			conn.Write(errorBytes)
+			continue
+		}
+		if e.delay > 0 {
+			time.Sleep(e.delay)
+		}
+		if e.close {
+			return
+		}
+		if _, err = conn.Write(e.reply); err != nil {
+			return
+		}
+	}
+}
+
+// dataLen returns the data block length of storage command line.
+func dataLen(line []byte) (n int64, ok bool) {
+	fs := bytes.Fields(line)
+	if len(fs) < 5 {
+		return
+	}
+	switch string(fs[0]) {
+	case "set", "add", "replace", "append", "prepend", "cas":
+	default:
+		return
+	}
+	n, err := strconv.ParseInt(string(fs[4]), 10, 64)
+	return n, err == nil && n >= 0
+}
@@ -0,0 +1,113 @@
+package memcachetest_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/proto"
+	"github.com/felixhao/overlord/proto/memcache"
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+)
+
+func handle(t *testing.T, addr, cmd string) ([]byte, error) {
+	conn, err := memcache.Dial("test-cluster", addr, time.Second, 100*time.Millisecond, time.Second)()
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	req, err := memcache.NewDecoder(bytes.NewBufferString(cmd)).Decode()
+	if err != nil {
+		t.Fatalf("decode cmd(%q) error:%v", cmd, err)
+	}
+	resp, err := conn.(proto.Handler).Handle(req)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	err = memcache.NewEncoder(&b).Encode(resp)
+	return b.Bytes(), err
+}
+
+func TestMockServer(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("get a_mock").Reply([]byte("VALUE a_mock 0 4\r\nmock\r\nEND\r\n"))
+	s.Expect("set a_mock 0 0 4").Reply([]byte("STORED\r\n"))
+	s.Expect("get a_bad").Reply([]byte("VALUE a_bad 0 x\r\n"))
+	s.Expect("get a_slow").Delay(200 * time.Millisecond).Reply([]byte("END\r\n"))
+	s.Expect("get a_close").Close()
+
+	for _, c := range []struct {
+		cmd   string
+		reply string
+		err   bool
+	}{
+		{"get a_mock\r\n", "VALUE a_mock 0 4\r\nmock\r\nEND\r\n", false},
+		{"set a_mock 0 0 4\r\nmock\r\n", "STORED\r\n", false},
+		{"delete a_mock\r\n", "ERROR\r\n", false},
+		{"get a_bad\r\n", "", true},
+		{"get a_slow\r\n", "", true},
+		{"get a_close\r\n", "", true},
+	} {
+		bs, err := handle(t, s.Addr(), c.cmd)
+		if c.err {
+			if err == nil {
+				t.Errorf("cmd(%q) reply(%q) want error", c.cmd, bs)
+			}
+			continue
+		}
+		if err != nil || string(bs) != c.reply {
+			t.Errorf("cmd(%q) reply(%q) error(%v) want(%q)", c.cmd, bs, err, c.reply)
+		}
+	}
+	if rs := s.Received(); len(rs) != 6 || rs[1] != "set a_mock 0 0 4" {
+		t.Errorf("received(%q) unexpected", rs)
+	}
+}
+
+func TestMockServerPipe(t *testing.T) {
+	s, err := memcachetest.NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expect("version").Reply([]byte("VERSION mock\r\n"))
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte("version\r\n"))
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "VERSION mock\r\n" {
+		t.Errorf("pipe reply(%q) error(%v)", buf[:n], err)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		conn.Write([]byte("VERSION func\r\n"))
+		io.Copy(ioutil.Discard, conn) // NOTE: held until closed by closer
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "VERSION func\r\n" {
+		t.Fatalf("func reply(%q) error(%v)", buf[:n], err)
+	}
+	closer()
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("read want error after closer closed the connections")
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/felixhao/overlord/lib/fault"
+	"github.com/felixhao/overlord/lib/resolver"
 	"github.com/felixhao/overlord/proto"
 	"github.com/pkg/errors"
 )
@@ -24,28 +26,89 @@ type pinger struct {
 	dialTimeout  time.Duration
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	auth         CredentialProvider
+	localAddr    net.Addr
+	fault        *fault.Injector
+	lookup       resolver.LookupFunc
 
 	closed int32
 }
 
+// PingerOption specifies an option for pinger.
+type PingerOption struct {
+	f func(*pinger)
+}
+
+// PingerAuth set pinger credential provider, the connection is authenticated by the current credential.
+func PingerAuth(p CredentialProvider) *PingerOption {
+	return &PingerOption{func(per *pinger) {
+		per.auth = p
+	}}
+}
+
+// PingerLocalAddr set pinger local address, the source of connection is bound to it.
+func PingerLocalAddr(addr net.Addr) *PingerOption {
+	return &PingerOption{func(per *pinger) {
+		per.localAddr = addr
+	}}
+}
+
+// PingerFault set pinger fault injector, the pings see the same faults as the requests.
+func PingerFault(i *fault.Injector) *PingerOption {
+	return &PingerOption{func(per *pinger) {
+		per.fault = i
+	}}
+}
+
+// PingerLookup set pinger lookup, the host of addr is looked up by it before connected.
+func PingerLookup(lookup resolver.LookupFunc) *PingerOption {
+	return &PingerOption{func(per *pinger) {
+		per.lookup = lookup
+	}}
+}
+
 // NewPinger returns pinger.
-func NewPinger(addr string, dialTimeout, readTimeout, writeTimeout time.Duration) (p proto.Pinger) {
+func NewPinger(addr string, dialTimeout, readTimeout, writeTimeout time.Duration, pos ...*PingerOption) (p proto.Pinger) {
 	per := &pinger{
 		addr:         addr,
 		dialTimeout:  dialTimeout,
 		readTimeout:  readTimeout,
 		writeTimeout: writeTimeout,
 	}
+	for _, po := range pos {
+		po.f(per)
+	}
 	per.reconn()
 	p = per
 	return
 }
 
 func (p *pinger) reconn() error {
-	conn, err := net.DialTimeout("tcp", p.addr, p.dialTimeout)
+	if p.fault != nil {
+		if err := p.fault.Dial(); err != nil {
+			return err
+		}
+	}
+	addr := p.addr
+	if p.lookup != nil {
+		var err error
+		if addr, err = lookupAddr(p.lookup, addr); err != nil {
+			return err
+		}
+	}
+	conn, err := (&net.Dialer{Timeout: p.dialTimeout, LocalAddr: p.localAddr}).Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
+	if p.fault != nil {
+		conn = p.fault.Conn(conn)
+	}
+	if p.auth != nil {
+		if err = authenticate(conn, p.auth(), p.dialTimeout); err != nil {
+			conn.Close()
+			return err
+		}
+	}
 	p.conn = conn
 	if p.br != nil {
 		p.br.Reset(conn)
@@ -0,0 +1,69 @@
+package memcache
+
+import (
+	"github.com/felixhao/overlord/proto"
+)
+
+// GetCommand returns the exact command of get request and its keys, which identifies the reply,
+// like: 'get a_11 a_22'. ok is false for other requests.
+// NOTE: copied, never references the buffers of request.
+func GetCommand(req *proto.Request) (cmd string, keys []string, ok bool) {
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok || mcr.rTp != RequestTypeGet {
+		return "", nil, false
+	}
+	return "get " + string(mcr.key), splitKeys(mcr.key), true
+}
+
+// splitKeys splits the keys of multi-get, like: 'a_11 a_22'.
+func splitKeys(key []byte) (keys []string) {
+	begin := 0
+	for i, c := range key {
+		if c == spaceByte {
+			if i > begin {
+				keys = append(keys, string(key[begin:i]))
+			}
+			begin = i + 1
+		}
+	}
+	if begin < len(key) {
+		keys = append(keys, string(key[begin:]))
+	}
+	return
+}
+
+// ReplyBytes returns the copy of reply bytes of response, which outlives the buffers of response,
+// ok is false for the failed response or the one of partial failures.
+func ReplyBytes(resp *proto.Response) (bs []byte, ok bool) {
+	if resp == nil || resp.Err() != nil || len(resp.Partial()) > 0 {
+		return nil, false
+	}
+	mcr, ok := resp.Proto().(*MCResponse)
+	if !ok {
+		return nil, false
+	}
+	n := len(mcr.data)
+	for _, part := range mcr.parts {
+		n += len(part)
+	}
+	bs = make([]byte, 0, n)
+	for _, part := range mcr.parts {
+		bs = append(bs, part...)
+	}
+	bs = append(bs, mcr.data...)
+	return bs, true
+}
+
+// CachedResponse returns the response of request replied by the reply bytes cached by proxy.
+// NOTE: the bytes must not be modified, they are shared by the responses.
+func CachedResponse(req *proto.Request, bs []byte) *proto.Response {
+	resp := &proto.Response{Type: proto.CacheTypeMemcache}
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok {
+		resp.WithError(ErrAssertRequest)
+		return resp
+	}
+	resp.WithProto(&MCResponse{rTp: mcr.rTp, data: bs})
+	resp.WithCached()
+	return resp
+}
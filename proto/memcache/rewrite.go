@@ -0,0 +1,55 @@
+package memcache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// KeyRule rewrites the key, returns the key itself when not matched.
+// NOTE: must be pure, the same key is rewritten by routing and by handler.
+type KeyRule func(key []byte) []byte
+
+// KeyLower rewrites the key to lower case.
+func KeyLower() KeyRule {
+	return func(key []byte) []byte {
+		for _, c := range key {
+			if 'A' <= c && c <= 'Z' {
+				return bytes.ToLower(key)
+			}
+		}
+		return key
+	}
+}
+
+// KeyHash rewrites the key longer than max bytes to the hex of its sha1, the 40 bytes,
+// like: satisfies the 250 bytes limit of server.
+func KeyHash(max int) KeyRule {
+	return func(key []byte) []byte {
+		if len(key) <= max {
+			return key
+		}
+		sum := sha1.Sum(key)
+		hs := make([]byte, hex.EncodedLen(len(sum)))
+		hex.Encode(hs, sum[:])
+		return hs
+	}
+}
+
+// KeyReplacePrefix rewrites the key of prefix old to prefix new, like: the legacy prefix migrated.
+func KeyReplacePrefix(old, new string) KeyRule {
+	return func(key []byte) []byte {
+		if !bytes.HasPrefix(key, []byte(old)) {
+			return key
+		}
+		return append([]byte(new), key[len(old):]...)
+	}
+}
+
+// RewriteKey rewrites the key by rules in order.
+func RewriteKey(rules []KeyRule, key []byte) []byte {
+	for _, r := range rules {
+		key = r(key)
+	}
+	return key
+}
@@ -0,0 +1,78 @@
+package memcache
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/felixhao/overlord/lib/conv"
+)
+
+// maxRelativeExptime is the max relative exptime in seconds, larger one is treated
+// as an absolute unix timestamp by memcache.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// clampExptime rewrites the exptime of request data down to max seconds when larger.
+// NOTE: exptime 0 means never expire and the negative means expired immediately, both untouched.
+func clampExptime(rTp RequestType, data []byte, max int64) []byte {
+	var idx int // NOTE: the exptime field index of data
+	switch rTp {
+	case RequestTypeSet, RequestTypeAdd, RequestTypeReplace, RequestTypeCas:
+		idx = 1 // NOTE: ' <flags> <exptime> <bytes> ...\r\n'
+	case RequestTypeTouch:
+		idx = 0 // NOTE: ' <exptime> [noreply]\r\n'
+	default:
+		return data
+	}
+	end := bytes.Index(data, crlfBytes)
+	if end < 0 {
+		return data
+	}
+	b, e := fieldRange(data[:end], idx)
+	if b < 0 {
+		return data
+	}
+	exp, err := conv.Btoi(data[b:e])
+	if err != nil || exp <= 0 {
+		return data
+	}
+	now := time.Now().Unix()
+	if exp > maxRelativeExptime {
+		if exp-now <= max {
+			return data
+		}
+	} else if exp <= max {
+		return data
+	}
+	nexp := max
+	if max > maxRelativeExptime {
+		nexp = now + max // NOTE: cannot be relative, use absolute
+	}
+	ns := strconv.FormatInt(nexp, 10)
+	nd := make([]byte, 0, len(data)-(e-b)+len(ns))
+	nd = append(nd, data[:b]...)
+	nd = append(nd, ns...)
+	return append(nd, data[e:]...)
+}
+
+// fieldRange returns the [begin, end) of the idx field separated by space, begin is -1 when not found.
+func fieldRange(bs []byte, idx int) (b, e int) {
+	b = -1
+	for i, n := 0, 0; i < len(bs); n++ {
+		for i < len(bs) && bs[i] == spaceByte {
+			i++
+		}
+		j := i
+		for j < len(bs) && bs[j] != spaceByte {
+			j++
+		}
+		if i == j {
+			break
+		}
+		if n == idx {
+			return i, j
+		}
+		i = j
+	}
+	return
+}
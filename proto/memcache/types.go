@@ -3,10 +3,14 @@ package memcache
 import (
 	"bytes"
 	errs "errors"
+	"io"
 	"math"
-	"sync"
+	"net"
+	"strconv"
+	"strings"
 
-	"github.com/felixhao/overlord/lib/bufio"
+	"github.com/felixhao/overlord/lib/conv"
+	"github.com/felixhao/overlord/lib/stat"
 	"github.com/felixhao/overlord/proto"
 )
 
@@ -28,12 +32,19 @@ var (
 	notFoundBytes  = []byte("NOT_FOUND\r\n")
 	deletedBytes   = []byte("DELETED\r\n")
 	touchedBytes   = []byte("TOUCHED\r\n")
-)
+	versionBytes   = []byte("version\r\n")
+	okBytes        = []byte("OK\r\n")
+	resetBytes     = []byte("RESET\r\n")
+	noreplyBytes   = []byte("noreply")
 
-var (
-	bufPool = &sync.Pool{New: func() interface{} {
-		return &bufio.SliceAlloc{}
-	}}
+	versionPrefixBytes = []byte("VERSION ")
+	metaValueBytes     = []byte("VA ")
+	metaEndBytes       = []byte("EN\r\n")
+	metaNoopBytes      = []byte("MN\r\n")
+	metaNoopCmdBytes   = []byte("mn\r\n")
+	busyPrefixBytes    = []byte("BUSY ")
+	statPrefixBytes    = []byte("STAT ")
+	statsProxyBytes    = []byte("proxy")
 )
 
 // RequestType is the protocol-agnostic identifier for the command
@@ -69,6 +80,24 @@ func (rt RequestType) String() string {
 		return "gat"
 	case RequestTypeGats:
 		return "gats"
+	case RequestTypeMetaGet:
+		return "mg"
+	case RequestTypeMetaDebug:
+		return "me"
+	case RequestTypeMetaNoop:
+		return "mn"
+	case RequestTypeCacheMemlimit:
+		return "cache_memlimit"
+	case RequestTypeCompress:
+		return "overlord_compress"
+	case RequestTypeLruCrawler:
+		return "lru_crawler"
+	case RequestTypeLru:
+		return "lru"
+	case RequestTypePriority:
+		return "overlord_priority"
+	case RequestTypeStats:
+		return "stats"
 	}
 	return "unknown"
 }
@@ -90,6 +119,15 @@ const (
 	RequestTypeTouch
 	RequestTypeGat
 	RequestTypeGats
+	RequestTypeMetaGet
+	RequestTypeCacheMemlimit
+	RequestTypeCompress
+	RequestTypeLruCrawler
+	RequestTypeLru
+	RequestTypePriority
+	RequestTypeStats
+	RequestTypeMetaDebug
+	RequestTypeMetaNoop
 )
 
 // errors
@@ -108,6 +146,8 @@ var (
 	ErrBadLength  = errs.New("CLIENT_ERROR length is not a valid integer")
 	ErrBadCas     = errs.New("CLIENT_ERROR cas is not a valid integer")
 
+	ErrChunkedAppend = errs.New("CLIENT_ERROR append|prepend to chunked value not supported")
+
 	// SERVER_ERROR
 	// means some sort of server error prevents the server from carrying
 	// out the command. <error> is a human-readable error string. In cases
@@ -120,6 +160,10 @@ var (
 	ErrAssertRequest  = errs.New("SERVER_ERROR assert MC request not ok")
 	ErrAssertResponse = errs.New("SERVER_ERROR assert MC response not ok")
 	ErrBadResponse    = errs.New("SERVER_ERROR bad response")
+	ErrChecksum       = errs.New("SERVER_ERROR checksum mismatch")
+	ErrResponseBudget = errs.New("SERVER_ERROR response memory exhausted")
+	ErrPoisoned       = errs.New("SERVER_ERROR connection poisoned by unexpected data")
+	ErrMissingEnd     = errs.New("SERVER_ERROR response END missing")
 )
 
 // MCRequest is the mc client request type and data.
@@ -136,6 +180,16 @@ var (
 // 	touch <key> <exptime> [noreply]\r\n
 // Get And Touch:
 // 	gat|gats <exptime> <key>*\r\n
+// Meta Get:
+// 	mg <key> <flag>*\r\n
+// Meta Debug:
+// 	me <key> <flag>*\r\n
+// Meta No-op (proxy-local, never dispatched):
+// 	mn\r\n
+// Compress (proxy-local handshake, never dispatched):
+// 	overlord_compress gzip\r\n
+// Priority (proxy-local handshake, never dispatched):
+// 	overlord_priority high|normal|low\r\n
 type MCRequest struct {
 	rTp   RequestType
 	key   []byte
@@ -190,24 +244,236 @@ func (r *MCRequest) String() string {
 	return "type:" + r.rTp.String() + " key:" + string(r.key) + " data:" + string(r.data)
 }
 
+// LocalResponse returns the 'OK' response of proxy-local request, like: overlord_compress|overlord_priority,
+// but the 'MN' response of mn, which terminates the quiet pipeline.
+func LocalResponse(req *proto.Request) *proto.Response {
+	resp := &proto.Response{Type: proto.CacheTypeMemcache}
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok {
+		resp.WithError(ErrAssertRequest)
+		return resp
+	}
+	data := okBytes
+	if mcr.rTp == RequestTypeMetaNoop {
+		data = metaNoopBytes
+	}
+	resp.WithProto(&MCResponse{rTp: mcr.rTp, data: data})
+	return resp
+}
+
+// StatsResponse returns the response of 'stats proxy', which replies the stat values of proxy
+// as 'STAT <name> <value>' lines terminated by 'END', the spaces of name are replaced by '_'.
+func StatsResponse(req *proto.Request, ss []stat.Sample) *proto.Response {
+	resp := &proto.Response{Type: proto.CacheTypeMemcache}
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok {
+		resp.WithError(ErrAssertRequest)
+		return resp
+	}
+	var b bytes.Buffer
+	for _, s := range ss {
+		b.Write(statPrefixBytes)
+		b.WriteString(strings.Replace(s.Name, " ", "_", -1))
+		b.WriteByte(spaceByte)
+		b.WriteString(strconv.FormatFloat(s.Value, 'f', -1, 64))
+		b.Write(crlfBytes)
+	}
+	b.Write(endBytes)
+	resp.WithProto(&MCResponse{rTp: mcr.rTp, data: b.Bytes()})
+	return resp
+}
+
+// MissResponse returns the miss response of retrieval request, like: get|gets|gat|gats|mg.
+// ok is false for other requests, which can not be treated as a miss.
+func MissResponse(req *proto.Request) (resp *proto.Response, ok bool) {
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok {
+		return
+	}
+	var data []byte
+	switch mcr.rTp {
+	case RequestTypeGet, RequestTypeGets, RequestTypeGat, RequestTypeGats:
+		data = endBytes
+	case RequestTypeMetaGet:
+		data = metaEndBytes
+	default:
+		ok = false
+		return
+	}
+	resp = &proto.Response{Type: proto.CacheTypeMemcache}
+	resp.WithProto(&MCResponse{rTp: mcr.rTp, data: data})
+	return
+}
+
+// IsWrite returns whether the request modifies the item, like: set|add|replace|append|prepend|delete|incr|decr|touch.
+// NOTE: cas is not, the cas unique is of one server only.
+func IsWrite(req *proto.Request) bool {
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok {
+		return false
+	}
+	switch mcr.rTp {
+	case RequestTypeSet, RequestTypeAdd, RequestTypeReplace, RequestTypeAppend, RequestTypePrepend,
+		RequestTypeDelete, RequestTypeIncr, RequestTypeDecr, RequestTypeTouch:
+		return true
+	}
+	return false
+}
+
+// PopulateRequest returns the set request which stores the value of get|gat hit response with exptime,
+// ok is false for other requests or responses.
+func PopulateRequest(req *proto.Request, resp *proto.Response, exptime int64) (preq *proto.Request, ok bool) {
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok || (mcr.rTp != RequestTypeGet && mcr.rTp != RequestTypeGat) || resp.Err() != nil {
+		return nil, false
+	}
+	pr, ok := resp.Proto().(*MCResponse)
+	if !ok || len(pr.parts) > 0 {
+		return nil, false
+	}
+	i := bytes.Index(pr.data, crlfBytes)
+	if i < 0 {
+		return nil, false
+	}
+	fs := bytes.Fields(pr.data[:i]) // NOTE: VALUE <key> <flags> <bytes> [<opaque>]*
+	if len(fs) < 4 || !bytes.Equal(fs[0], []byte("VALUE")) {
+		return nil, false
+	}
+	length, err := conv.ParseLen(fs[3])
+	if err != nil || int64(len(pr.data)) < int64(i)+2+length+2 {
+		return nil, false
+	}
+	data := make([]byte, 0, len(fs[2])+len(fs[3])+int(length)+32)
+	data = append(data, spaceByte)
+	data = append(data, fs[2]...)
+	data = append(data, spaceByte)
+	data = strconv.AppendInt(data, exptime, 10)
+	data = append(data, spaceByte)
+	data = append(data, fs[3]...)
+	data = append(data, crlfBytes...)
+	data = append(data, pr.data[i+2:int64(i)+2+length+2]...)
+	preq = &proto.Request{Type: proto.CacheTypeMemcache}
+	preq.WithProto(&MCRequest{rTp: RequestTypeSet, key: mcr.key, data: data})
+	return preq, true
+}
+
+// CasCheck returns the gets request which rechecks the item of cas request, like after the connection
+// dropped during the cas. ok is false for other requests.
+func CasCheck(req *proto.Request) (greq *proto.Request, ok bool) {
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok || mcr.rTp != RequestTypeCas {
+		return nil, false
+	}
+	greq = &proto.Request{Type: proto.CacheTypeMemcache}
+	greq.WithProto(&MCRequest{rTp: RequestTypeGets, key: mcr.key, data: crlfBytes})
+	return greq, true
+}
+
+// CasChecked returns the response of cas request by the response of CasCheck request.
+// retry is true when the item unchanged since the cas unique, the cas can be retried safely,
+// else the response is 'EXISTS' or 'NOT_FOUND' as the cas replied, because the item may be
+// stored by the dropped cas or others, and the client should gets the item again.
+func CasChecked(req *proto.Request, gresp *proto.Response) (resp *proto.Response, retry bool) {
+	mcr, ok := req.Proto().(*MCRequest)
+	if !ok || mcr.rTp != RequestTypeCas {
+		return nil, false
+	}
+	var cas uint64
+	if i := bytes.Index(mcr.data, crlfBytes); i >= 0 {
+		if fs := bytes.Fields(mcr.data[:i]); len(fs) >= 4 { // NOTE: <flags> <exptime> <bytes> <cas unique> [noreply]
+			cas, _ = strconv.ParseUint(string(fs[3]), 10, 64)
+		}
+	}
+	if gresp.Err() != nil {
+		return gresp, false
+	}
+	data := notFoundBytes
+	if gr, ok := gresp.Proto().(*MCResponse); ok && len(gr.values) > 0 {
+		if gr.values[0].Cas == cas {
+			return nil, true
+		}
+		data = existsBytes
+	}
+	resp = &proto.Response{Type: proto.CacheTypeMemcache}
+	resp.WithProto(&MCResponse{rTp: mcr.rTp, data: data})
+	return resp, false
+}
+
 // MCResponse is the mc server response type and data.
 type MCResponse struct {
 	rTp  RequestType
 	data []byte
+
+	ttl    int64
+	hasTTL bool
+
+	values []*Value
+	parts  [][]byte // NOTE: the merged values written before data, never reassembled into one buffer
+}
+
+// Value is the parsed item of gets|gats response.
+type Value struct {
+	Key   []byte
+	Flags uint32
+	Data  []byte
+	Cas   uint64
+}
+
+// Values returns the parsed items with cas of gets|gats response, nil for other requests.
+func (r *MCResponse) Values() []*Value {
+	return r.values
+}
+
+// TTL returns the remaining TTL in seconds of meta get with 't' flag, -1 means never expire.
+// ok is false when the TTL was not requested or the item miss.
+func (r *MCResponse) TTL() (ttl int64, ok bool) {
+	return r.ttl, r.hasTTL
+}
+
+// Reader returns the reader of reply bytes, the merged reply yields the values of subs in order
+// then 'END\r\n' without reassembling them into one buffer. The encoder writes the reply by it.
+func (r *MCResponse) Reader() io.Reader {
+	bufs := make(net.Buffers, 0, len(r.parts)+1)
+	bufs = append(bufs, r.parts...)
+	bufs = append(bufs, r.data)
+	return &bufs
+}
+
+// Status returns the reply status, never contains value data.
+func (r *MCResponse) Status() string {
+	switch r.rTp {
+	case RequestTypeGet, RequestTypeGets, RequestTypeGat, RequestTypeGats:
+		if len(r.parts) == 0 && bytes.Equal(r.data, endBytes) {
+			return "MISS"
+		}
+		return "HIT"
+	}
+	i := bytes.IndexByte(r.data, spaceByte)
+	if i < 0 {
+		i = bytes.IndexByte(r.data, '\r')
+	}
+	if i < 0 {
+		return "UNKNOWN"
+	}
+	if (r.rTp == RequestTypeIncr || r.rTp == RequestTypeDecr) && r.data[0] >= '0' && r.data[0] <= '9' {
+		return "OK" // NOTE: incr|decr reply the new value, no value data.
+	}
+	return string(r.data[:i])
 }
 
 // Merge merges subs response into self.
 // NOTE: This normally means that the Merge func for an get|gets|gat|gats command.
+// The values of subs are referenced as parts rather than copied, the large multi-get
+// is written to client part by part.
 func (r *MCResponse) Merge(subs []proto.Request) {
 	if r.rTp != RequestTypeGet && r.rTp != RequestTypeGets && r.rTp != RequestTypeGat && r.rTp != RequestTypeGats {
 		// TODO(felix): log or ???
 		return
 	}
 	const endBytesLen = 5 // NOTE: endBytes length
-	subl := len(subs)
-	rebs := make([][]byte, subl)
-	reln := 0
-	for i := 0; i < subl; i++ {
+	r.values = nil
+	r.parts = nil
+	for i := range subs {
 		if err := subs[i].Resp.Err(); err != nil {
 			// TODO(felix): log or ???
 			continue
@@ -217,27 +483,11 @@ func (r *MCResponse) Merge(subs []proto.Request) {
 			// TODO(felix): log or ???
 			continue
 		}
-		if bytes.Equal(mcr.data, endBytes) {
-			continue
-		}
-		rebs[i] = mcr.data[:len(mcr.data)-endBytesLen]
-		reln += len(rebs[i])
-	}
-	sa, ok := bufPool.Get().(*bufio.SliceAlloc)
-	if !ok {
-		r.data = make([]byte, reln+endBytesLen) // TODO(felix): optimize
-	} else {
-		r.data = sa.Make(reln + endBytesLen)
-		bufPool.Put(sa)
-	}
-	off := 0
-	for i := 0; i < subl; i++ {
-		bs := rebs[i]
-		if len(bs) == 0 {
-			continue
+		r.parts = append(r.parts, mcr.parts...)
+		if len(mcr.data) > endBytesLen {
+			r.parts = append(r.parts, mcr.data[:len(mcr.data)-endBytesLen])
 		}
-		copy(r.data[off:], bs)
-		off += len(bs)
+		r.values = append(r.values, mcr.values...)
 	}
-	copy(r.data[off:], endBytes)
+	r.data = endBytes
 }
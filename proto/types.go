@@ -3,6 +3,7 @@ package proto
 import (
 	errs "errors"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +22,39 @@ const (
 	CacheTypeRedis    CacheType = "redis"
 )
 
+// Priority is the request priority, the higher one is served first and shed last under overload.
+type Priority int
+
+// Request priorities, normal by default.
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// ParsePriority parses the priority name: high|normal|low.
+func ParsePriority(name string) (p Priority, ok bool) {
+	switch name {
+	case "high":
+		return PriorityHigh, true
+	case "normal":
+		return PriorityNormal, true
+	case "low":
+		return PriorityLow, true
+	}
+	return PriorityNormal, false
+}
+
 type protoRequest interface {
 	Cmd() string
 	Key() []byte
@@ -35,8 +69,26 @@ type Request struct {
 	wg    *sync.WaitGroup
 	bWg   *sync.WaitGroup
 
-	Resp *Response
-	st   time.Time
+	Resp   *Response
+	st     time.Time
+	client string
+	prio   Priority
+	timing *Timing
+
+	done     int32 // NOTE: atomic, the request is done once, by handling or deadline
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// Timing is the time spent by the phases of handling request by node, for profiling the latency.
+// The phases except Dial sum to the node handling time.
+type Timing struct {
+	Start    time.Time     // NOTE: node handling started, before waiting for the connection
+	PoolWait time.Duration // NOTE: waiting for the connection from pool, includes Dial
+	Dial     time.Duration // NOTE: dialing the new connection, zero when reused
+	Write    time.Duration // NOTE: writing the request until flushed
+	Think    time.Duration // NOTE: flushed until the first response byte read
+	Read     time.Duration // NOTE: the first response byte until the response read
 }
 
 type errProto struct{}
@@ -66,6 +118,7 @@ func (r *Request) Process() {
 	}
 	r.wg.Add(1)
 	r.st = time.Now()
+	atomic.StoreInt32(&r.done, 0)
 }
 
 // Done done.
@@ -73,6 +126,12 @@ func (r *Request) Done(resp *Response) {
 	if r.wg == nil {
 		panic("request waitgroup nil")
 	}
+	if !atomic.CompareAndSwapInt32(&r.done, 0, 1) {
+		if resp != nil {
+			resp.Release() // NOTE: done by deadline already, never written
+		}
+		return
+	}
 	r.Resp = resp
 	r.wg.Done()
 }
@@ -83,6 +142,9 @@ func (r *Request) DoneWithError(err error) {
 	if r.wg == nil {
 		panic("request waitgroup nil")
 	}
+	if !atomic.CompareAndSwapInt32(&r.done, 0, 1) {
+		return
+	}
 	r.Resp = &Response{Type: r.Type, err: err}
 	r.wg.Done()
 }
@@ -105,6 +167,55 @@ func (r *Request) Proto() protoRequest {
 	return r.proto
 }
 
+// WithClient with client address.
+func (r *Request) WithClient(addr string) {
+	r.client = addr
+}
+
+// Client returns client address.
+func (r *Request) Client() string {
+	return r.client
+}
+
+// WithPriority with request priority.
+func (r *Request) WithPriority(p Priority) {
+	r.prio = p
+}
+
+// Priority returns request priority.
+func (r *Request) Priority() Priority {
+	return r.prio
+}
+
+// WithTiming with the timing populated by node handling, nil means no profiling.
+func (r *Request) WithTiming(t *Timing) {
+	r.timing = t
+}
+
+// Timing returns request timing, nil when not profiled.
+func (r *Request) Timing() *Timing {
+	return r.timing
+}
+
+// WithDeadline with the deadline of request, expire is called when not done before the deadline,
+// which should done the request with error. The handling one stops it by StopDeadline.
+func (r *Request) WithDeadline(d time.Time, expire func()) {
+	r.deadline = d
+	r.timer = time.AfterFunc(time.Until(d), expire)
+}
+
+// Deadline returns the deadline of request, ok is false when no deadline.
+func (r *Request) Deadline() (d time.Time, ok bool) {
+	return r.deadline, !r.deadline.IsZero()
+}
+
+// StopDeadline stops the expire func of deadline after the request handled.
+func (r *Request) StopDeadline() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
 // Cmd returns proto request cmd.
 func (r *Request) Cmd() string {
 	return r.proto.Cmd()
@@ -130,6 +241,11 @@ func (r *Request) Batch() ([]Request, *Response) {
 	r.bWg = &sync.WaitGroup{}
 	for i := 0; i < subl; i++ {
 		subs[i].wg = r.bWg
+		subs[i].client = r.client
+		subs[i].prio = r.prio
+		if r.timing != nil {
+			subs[i].timing = &Timing{} // NOTE: every sub request handled by its node
+		}
 	}
 	return subs, resp
 }
@@ -148,13 +264,40 @@ func (r *Request) Since() time.Duration {
 
 type protoResponse interface {
 	Merge([]Request)
+	Status() string
 }
 
 // Response read from cache server.
 type Response struct {
-	Type  CacheType
-	proto protoResponse
-	err   error
+	Type    CacheType
+	proto   protoResponse
+	err     error
+	partial []*KeyError
+	release func() // NOTE: releases the buffers held, after the response written
+	addr    string // NOTE: the backend address served, only when debug
+	cached  bool   // NOTE: replied by proxy cache rather than backend
+}
+
+// NodeError is the error of request failed by the backend node.
+type NodeError struct {
+	Node string
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return "node(" + e.Node + "): " + e.Err.Error()
+}
+
+// Cause returns the underlying error, keeps the errors.Cause works.
+func (e *NodeError) Cause() error {
+	return e.Err
+}
+
+// KeyError is the key of batch request which couldn't be fetched, Node is empty when the error not from backend node.
+type KeyError struct {
+	Key  []byte
+	Node string
+	Err  error
 }
 
 // WithProto with proto response.
@@ -177,12 +320,91 @@ func (r *Response) Err() error {
 	return r.err
 }
 
+// Status returns response status without value data, like: HIT|MISS|STORED.
+func (r *Response) Status() string {
+	if r.err != nil {
+		return "ERROR"
+	}
+	if r.proto == nil {
+		return ""
+	}
+	return r.proto.Status()
+}
+
 // Merge merges subs response into self.
+// The failed subs are skipped by merging, and recorded as the partial failures.
 func (r *Response) Merge(subs []Request) {
+	var rs []func()
+	for i := range subs {
+		if sr := subs[i].Resp; sr != nil && sr.release != nil {
+			rs = append(rs, sr.release) // NOTE: the merged response references the buffers of subs
+			sr.release = nil
+		}
+	}
+	if len(rs) > 0 {
+		r.release = func() {
+			for _, f := range rs {
+				f()
+			}
+		}
+	}
 	if r.err != nil || r.proto == nil {
 		return
 	}
 	r.proto.Merge(subs)
+	r.partial = nil
+	for i := range subs {
+		if subs[i].Resp == nil || subs[i].Resp.err == nil {
+			continue
+		}
+		ke := &KeyError{Key: subs[i].Key(), Err: subs[i].Resp.err}
+		if ne, ok := ke.Err.(*NodeError); ok {
+			ke.Node = ne.Node
+			ke.Err = ne.Err
+		}
+		r.partial = append(r.partial, ke)
+	}
+}
+
+// WithAddr with the backend address which served the response.
+func (r *Response) WithAddr(addr string) {
+	r.addr = addr
+}
+
+// Addr returns the backend address which served the response, empty when not debug.
+// NOTE: never encoded to client.
+func (r *Response) Addr() string {
+	return r.addr
+}
+
+// WithCached marks the response replied by proxy cache rather than backend.
+func (r *Response) WithCached() {
+	r.cached = true
+}
+
+// Cached returns whether the response replied by proxy cache rather than backend.
+// NOTE: never encoded to client.
+func (r *Response) Cached() bool {
+	return r.cached
+}
+
+// WithRelease with the func releases the buffers held by response.
+func (r *Response) WithRelease(f func()) {
+	r.release = f
+}
+
+// Release releases the buffers held by response once, it must not be used after released.
+func (r *Response) Release() {
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+}
+
+// Partial returns the keys failed of merged batch response, nil means all keys fetched.
+// NOTE: never encoded to client, the client sees the failed keys as missing.
+func (r *Response) Partial() []*KeyError {
+	return r.partial
 }
 
 // Encoder encode response.
@@ -200,12 +422,28 @@ type Handler interface {
 	Handle(*Request) (*Response, error)
 }
 
+// BatchHandler handles the requests pipelined to backend cache server and reads responses in order.
+// The responses of the requests before the error are returned.
+type BatchHandler interface {
+	HandleBatch([]*Request) ([]*Response, error)
+}
+
 // Pinger ping node connection.
 type Pinger interface {
 	Ping() error
 	Close() error
 }
 
+// Staler reports whether the node connection is stale and should be reaped.
+type Staler interface {
+	Stale() bool
+}
+
+// Checker reports whether the idle node connection is still alive before reused.
+type Checker interface {
+	Alive() bool
+}
+
 // RequestChan is queue be used process request.
 type RequestChan struct {
 	lock sync.Mutex
@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/felixhao/overlord/lib/fault"
+	"github.com/felixhao/overlord/lib/log"
+)
+
+const redacted = "******"
+
+// secretKeys are the config keys redacted by the effective config.
+var secretKeys = map[string]struct{}{
+	"redis_auth":   struct{}{},
+	"encrypt_keys": struct{}{},
+}
+
+// Admin registers the admin API into mux, the operational commands are only issued by it.
+// NOTE: the mutating ones must be POST, so a plain GET never changes state, like: by a crawler or prefetch.
+func (p *Proxy) Admin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/cache_memlimit", p.cacheMemlimit)
+	mux.HandleFunc("/admin/lru_crawler", p.lruCrawler)
+	mux.HandleFunc("/admin/lru_crawler/metadump", p.lruCrawlerMetadump)
+	mux.HandleFunc("/admin/lru", p.lru)
+	mux.HandleFunc("/admin/stats_reset", p.statsReset)
+	mux.HandleFunc("/admin/config", p.effectiveConfig)
+	mux.HandleFunc("/admin/route", p.route)
+	mux.HandleFunc("/admin/read_only", p.readOnly)
+	mux.HandleFunc("/admin/fault", p.fault)
+}
+
+// effectiveConfig handles '/admin/config', writes the loaded config of proxy and clusters
+// with the defaults applied and the nodes of clusters as json, the secrets are redacted.
+func (p *Proxy) effectiveConfig(w http.ResponseWriter, r *http.Request) {
+	pc, err := configMap(p.c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.lock.Lock()
+	ccs, cs := p.ccs, make([]*Cluster, len(p.ccs))
+	for i, cc := range ccs {
+		cs[i] = p.clusters[cc.Name]
+	}
+	p.lock.Unlock()
+	clusters := make([]map[string]interface{}, 0, len(ccs))
+	for i, cc := range ccs {
+		m, err := configMap(cc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m["max_multi_keys"] = maxMultiKeys(cc.MaxMultiKeys)
+		if cs[i] != nil { // NOTE: nil when the cluster is not served yet
+			m["nodes"] = cs[i].Nodes()
+		}
+		clusters = append(clusters, m)
+	}
+	writeJSON(w, map[string]interface{}{"proxy": pc, "clusters": clusters})
+}
+
+// configMap converts the config into map by its toml keys, the secrets are redacted.
+func configMap(v interface{}) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if _, err := toml.Decode(buf.String(), &m); err != nil {
+		return nil, err
+	}
+	return redact(m), nil
+}
+
+// redact lowers the keys like the config file and redacts the not empty secrets.
+func redact(m map[string]interface{}) map[string]interface{} {
+	rm := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		k = strings.ToLower(k)
+		switch sv := v.(type) {
+		case map[string]interface{}:
+			v = redact(sv)
+		case string:
+			if _, ok := secretKeys[k]; ok && sv != "" {
+				v = redacted
+			}
+		case []interface{}:
+			if _, ok := secretKeys[k]; ok && len(sv) > 0 {
+				v = redacted
+			}
+		}
+		rm[k] = v
+	}
+	return rm
+}
+
+// cacheMemlimit handles POST '/admin/cache_memlimit?cluster=<name>&mb=<megabytes>'.
+func (p *Proxy) cacheMemlimit(w http.ResponseWriter, r *http.Request) {
+	if !adminPost(w, r) {
+		return
+	}
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	mb, err := strconv.Atoi(r.FormValue("mb"))
+	if err != nil || mb < 0 {
+		http.Error(w, "mb must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	writeNodeErrors(w, c.CacheMemlimit(mb))
+}
+
+// lruCrawler handles POST '/admin/lru_crawler?cluster=<name>&op=<enable|disable>'.
+func (p *Proxy) lruCrawler(w http.ResponseWriter, r *http.Request) {
+	if !adminPost(w, r) {
+		return
+	}
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	op := r.FormValue("op")
+	if op != "enable" && op != "disable" {
+		http.Error(w, "op must be enable or disable", http.StatusBadRequest)
+		return
+	}
+	writeNodeErrors(w, c.LruCrawler(op == "enable"))
+}
+
+// lru handles POST '/admin/lru?cluster=<name>&args=<args>', like: args=mode+flat.
+func (p *Proxy) lru(w http.ResponseWriter, r *http.Request) {
+	if !adminPost(w, r) {
+		return
+	}
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	args := strings.Fields(r.FormValue("args"))
+	if len(args) == 0 {
+		http.Error(w, "args must be not empty", http.StatusBadRequest)
+		return
+	}
+	writeNodeErrors(w, c.Lru(args))
+}
+
+// statsReset handles POST '/admin/stats_reset?cluster=<name>', like: before a benchmark run.
+func (p *Proxy) statsReset(w http.ResponseWriter, r *http.Request) {
+	if !adminPost(w, r) {
+		return
+	}
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	writeNodeErrors(w, c.StatsReset())
+}
+
+// route handles '/admin/route?cluster=<name>&key=<key>', explains where the key routes.
+func (p *Proxy) route(w http.ResponseWriter, r *http.Request) {
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "key must be not empty", http.StatusBadRequest)
+		return
+	}
+	rt, ok := c.Route(key)
+	if !ok {
+		http.Error(w, "key("+key+") hash no node or not distributed by ketama", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, rt)
+}
+
+// readOnly handles POST '/admin/read_only?cluster=<name>&op=<enable|disable>', the writes are rejected
+// with 'SERVER_ERROR read-only' when enabled, like: the primaries down in a backend incident.
+// The mode is replied without op, which can be GET.
+func (p *Proxy) readOnly(w http.ResponseWriter, r *http.Request) {
+	op := r.FormValue("op")
+	if op != "" && !adminPost(w, r) {
+		return
+	}
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	switch op {
+	case "enable", "disable":
+		c.SetReadOnly(op == "enable")
+		log.Infof("cluster(%s) addr(%s) read-only mode %sd", c.cc.Name, c.cc.ListenAddr, op)
+	case "":
+	default:
+		http.Error(w, "op must be enable or disable", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]bool{"read_only": c.ReadOnly()})
+}
+
+// fault handles POST '/admin/fault?cluster=<name>&node=<node>&op=<enable|disable>&dial=<p>&timeout=<p>&malformed=<p>',
+// injects the faults into node by the probabilities in [0, 1] when enabled, like: chaos testing the ejection.
+// Forbidden unless the cluster config fault_injection set. The faults are replied without op, which can be GET.
+func (p *Proxy) fault(w http.ResponseWriter, r *http.Request) {
+	op := r.FormValue("op")
+	if op != "" && !adminPost(w, r) {
+		return
+	}
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	if !c.cc.FaultInjection {
+		http.Error(w, "fault injection not allowed by cluster("+c.cc.Name+") config", http.StatusForbidden)
+		return
+	}
+	node := r.FormValue("node")
+	if _, ok = c.nodePool[node]; !ok {
+		http.Error(w, "node("+node+") not found", http.StatusNotFound)
+		return
+	}
+	switch op {
+	case "enable":
+		var f fault.Faults
+		for _, pf := range []struct {
+			name string
+			p    *float64
+		}{{"dial", &f.Dial}, {"timeout", &f.Timeout}, {"malformed", &f.Malformed}} {
+			v := r.FormValue(pf.name)
+			if v == "" {
+				continue
+			}
+			pv, err := strconv.ParseFloat(v, 64)
+			if err != nil || pv < 0 || pv > 1 {
+				http.Error(w, pf.name+" must be a probability in [0, 1]", http.StatusBadRequest)
+				return
+			}
+			*pf.p = pv
+		}
+		c.SetFault(node, &f)
+		log.Warnf("cluster(%s) addr(%s) node(%s) fault injection enabled:%+v", c.cc.Name, c.cc.ListenAddr, node, f)
+	case "disable":
+		c.SetFault(node, nil)
+		log.Warnf("cluster(%s) addr(%s) node(%s) fault injection disabled", c.cc.Name, c.cc.ListenAddr, node)
+	case "":
+	default:
+		http.Error(w, "op must be enable or disable", http.StatusBadRequest)
+		return
+	}
+	f, enabled := c.Fault(node)
+	writeJSON(w, map[string]interface{}{"enabled": enabled, "faults": f})
+}
+
+// lruCrawlerMetadump handles '/admin/lru_crawler/metadump?cluster=<name>&node=<node>',
+// pipes the metadump of node to the caller.
+// NOTE: the error after partial dump written can only be noticed by the missing 'END'.
+func (p *Proxy) lruCrawlerMetadump(w http.ResponseWriter, r *http.Request) {
+	c, ok := p.adminCluster(w, r)
+	if !ok {
+		return
+	}
+	node := r.FormValue("node")
+	if _, ok = c.nodePool[node]; !ok {
+		http.Error(w, "node("+node+") not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	sw := &startWriter{w: w}
+	if err := c.LruCrawlerMetadump(node, sw); err != nil && !sw.started {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// startWriter records whether any bytes written, the status can not be changed after it.
+type startWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (sw *startWriter) Write(p []byte) (int, error) {
+	sw.started = true
+	return sw.w.Write(p)
+}
+
+// adminPost returns whether the mutating request is POST, writes 405 when not.
+func adminPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, "method "+r.Method+" not allowed, must be POST", http.StatusMethodNotAllowed)
+	return false
+}
+
+// adminCluster returns the cluster by 'cluster' param, writes the error when not found.
+func (p *Proxy) adminCluster(w http.ResponseWriter, r *http.Request) (c *Cluster, ok bool) {
+	name := r.FormValue("cluster")
+	p.lock.Lock()
+	c, ok = p.clusters[name]
+	p.lock.Unlock()
+	if !ok {
+		http.Error(w, "cluster("+name+") not found", http.StatusNotFound)
+	}
+	return
+}
+
+// writeNodeErrors writes the result of every node as json, like: {"node":"OK"}.
+func writeNodeErrors(w http.ResponseWriter, errs map[string]error) {
+	res := make(map[string]string, len(errs))
+	for node, err := range errs {
+		if err != nil {
+			res[node] = err.Error()
+		} else {
+			res[node] = "OK"
+		}
+	}
+	writeJSON(w, res)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
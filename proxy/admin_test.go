@@ -0,0 +1,450 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+)
+
+func TestAdminCacheMemlimit(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if bs == "cache_memlimit 64\r\n" {
+				conn.Write([]byte("OK\r\n"))
+			} else {
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Name = "admin-cluster"
+	cc.ListenAddr = "127.0.0.1:21217"
+	cc.Servers = []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	mux := http.NewServeMux()
+	p.Admin(mux)
+
+	for _, c := range []struct {
+		query string
+		code  int
+		reply string
+	}{
+		{"cluster=admin-cluster&mb=64", http.StatusOK, "OK"},
+		{"cluster=admin-cluster&mb=65", http.StatusOK, "ERROR"},
+		{"cluster=admin-cluster&mb=x", http.StatusBadRequest, ""},
+		{"cluster=noexist&mb=64", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/admin/cache_memlimit?"+c.query, nil))
+		if w.Code != c.code {
+			t.Errorf("query(%s) code(%d) want(%d)", c.query, w.Code, c.code)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+		res := map[string]string{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("query(%s) unmarshal error:%v", c.query, err)
+		}
+		if len(res) != 1 || !strings.HasSuffix(res[addr], c.reply) {
+			t.Errorf("query(%s) result(%v) want(%s)", c.query, res, c.reply)
+		}
+	}
+	// NOTE: the mutating ones never change state by GET
+	for _, path := range []string{
+		"/admin/cache_memlimit?cluster=admin-cluster&mb=64",
+		"/admin/lru_crawler?cluster=admin-cluster&op=enable",
+		"/admin/lru?cluster=admin-cluster&args=mode+flat",
+		"/admin/stats_reset?cluster=admin-cluster",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+			t.Errorf("GET path(%s) code(%d) want 405", path, w.Code)
+		}
+	}
+}
+
+func TestAdminLruCrawlerMetadump(t *testing.T) {
+	var dump string
+	for i := 0; i < 1000; i++ {
+		dump += "key=k_" + strconv.Itoa(i) + " exp=-1 la=1 cas=" + strconv.Itoa(i) + " fetch=no cls=1 size=63\n"
+	}
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch bs {
+			case "lru_crawler metadump all\r\n":
+				conn.Write([]byte(dump + "END\r\n"))
+			case "lru_crawler enable\r\n":
+				conn.Write([]byte("OK\r\n"))
+			case "version\r\n":
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+			default:
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Name = "admin-lru-cluster"
+	cc.ListenAddr = "127.0.0.1:21220"
+	cc.Servers = []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	mux := http.NewServeMux()
+	p.Admin(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/lru_crawler/metadump?cluster=admin-lru-cluster&node="+addr, nil))
+	if w.Code != http.StatusOK || w.Body.String() != dump+"END\r\n" {
+		t.Errorf("metadump code(%d) body length(%d) want(%d)", w.Code, w.Body.Len(), len(dump)+5)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/lru_crawler/metadump?cluster=admin-lru-cluster&node=noexist", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("metadump noexist node code(%d) want 404", w.Code)
+	}
+	for _, c := range []struct {
+		path  string
+		code  int
+		reply string
+	}{
+		{"/admin/lru_crawler?cluster=admin-lru-cluster&op=enable", http.StatusOK, "OK"},
+		{"/admin/lru_crawler?cluster=admin-lru-cluster&op=x", http.StatusBadRequest, ""},
+		{"/admin/lru?cluster=admin-lru-cluster&args=mode+flat", http.StatusOK, "ERROR"},
+		{"/admin/lru?cluster=admin-lru-cluster&args=", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("path(%s) code(%d) want(%d)", c.path, w.Code, c.code)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+		res := map[string]string{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("path(%s) unmarshal error:%v", c.path, err)
+		}
+		if len(res) != 1 || !strings.HasSuffix(res[addr], c.reply) {
+			t.Errorf("path(%s) result(%v) want(%s)", c.path, res, c.reply)
+		}
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	cc := *ccs[0]
+	cc.Name = "admin-config-cluster"
+	cc.ListenAddr = "127.0.0.1:21223"
+	cc.Servers = []string{"127.0.0.1:21224:3 node1", "127.0.0.1:21225:5 node2"}
+	cc.RedisAuth = "auth-secret"
+	cc.EncryptKeys = []string{"1:00112233445566778899aabbccddeeff"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	mux := http.NewServeMux()
+	p.Admin(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("code(%d) want ok", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "auth-secret") || strings.Contains(body, "00112233") {
+		t.Fatalf("config(%s) secrets not redacted", body)
+	}
+	var res struct {
+		Proxy    map[string]interface{}
+		Clusters []struct {
+			Name         string
+			RedisAuth    string `json:"redis_auth"`
+			EncryptKeys  string `json:"encrypt_keys"`
+			ReadTimeout  int    `json:"read_timeout"`
+			PoolActive   int    `json:"pool_active"`
+			MaxMultiKeys int    `json:"max_multi_keys"`
+			Nodes        []proxy.Node
+		}
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unmarshal error:%v", err)
+	}
+	if _, ok := res.Proxy["proxy"]; !ok || len(res.Clusters) != 1 {
+		t.Fatalf("config(%s) want proxy and one cluster", w.Body.Bytes())
+	}
+	c := res.Clusters[0]
+	if c.Name != cc.Name || c.RedisAuth != "******" || c.EncryptKeys != "******" || c.ReadTimeout != cc.ReadTimeout || c.PoolActive != cc.PoolActive {
+		t.Errorf("cluster config(%+v) mismatch", c)
+	}
+	if c.MaxMultiKeys != 1000 {
+		t.Errorf("max multi keys(%d) want default 1000", c.MaxMultiKeys)
+	}
+	want := []proxy.Node{{Name: "node1", Addr: "127.0.0.1:21224", Weight: 3}, {Name: "node2", Addr: "127.0.0.1:21225", Weight: 5}}
+	if len(c.Nodes) != 2 || c.Nodes[0] != want[0] || c.Nodes[1] != want[1] {
+		t.Errorf("nodes(%+v) want(%+v)", c.Nodes, want)
+	}
+}
+
+func TestAdminRoute(t *testing.T) {
+	addrs := map[string]string{} // NOTE: addr => the value replied by it
+	cc := *ccs[0]
+	cc.Name = "route-cluster"
+	cc.ListenAddr = "127.0.0.1:21230"
+	cc.HashTag = "{}"
+	cc.Servers = nil
+	for i := 0; i < 3; i++ {
+		v := strconv.Itoa(i)
+		addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+			br := bufio.NewReader(conn)
+			for {
+				bs, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				key := strings.TrimSpace(strings.TrimPrefix(bs, "get "))
+				conn.Write([]byte("VALUE " + key + " 0 1\r\n" + v + "\r\nEND\r\n"))
+			}
+		})
+		defer closer()
+		addrs[addr] = v
+		cc.Servers = append(cc.Servers, addr+":1")
+	}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	mux := http.NewServeMux()
+	p.Admin(mux)
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	for i := 0; i < 20; i++ {
+		key := "a_route" + strconv.Itoa(i)
+		if i%2 == 1 {
+			key = "user{" + strconv.Itoa(i) + "}:name"
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/route?cluster=route-cluster&key="+key, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("route key(%s) code(%d)", key, w.Code)
+		}
+		var rt proxy.Route
+		if err := json.Unmarshal(w.Body.Bytes(), &rt); err != nil {
+			t.Fatalf("route key(%s) unmarshal error:%v", key, err)
+		}
+		if i%2 == 1 && (rt.HashTag != strconv.Itoa(i) || rt.HashKey != rt.HashTag) {
+			t.Errorf("route key(%s) hash tag(%s) hash key(%s) not extracted", key, rt.HashTag, rt.HashKey)
+		}
+		if i%2 == 0 && (rt.HashTag != "" || rt.HashKey != key) {
+			t.Errorf("route key(%s) hash tag(%s) hash key(%s) want the key", key, rt.HashTag, rt.HashKey)
+		}
+		conn.Write([]byte("get " + key + "\r\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var reply string
+		for !strings.HasSuffix(reply, "END\r\n") {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("get key(%s) read error:%v", key, err)
+			}
+			reply += bs
+		}
+		if want := addrs[rt.Addr]; !strings.Contains(reply, "\r\n"+want+"\r\n") {
+			t.Errorf("key(%s) routed to addr(%s) value(%s) but served reply(%q)", key, rt.Addr, want, reply)
+		}
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/route?cluster=route-cluster", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("route no key code(%d) want(%d)", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	s, addr, closer := mockTierStore(t)
+	defer closer()
+	s.items["a_ro"] = "0 ro"
+	cc := *ccs[0]
+	cc.Name = "read-only-cluster"
+	cc.ListenAddr = "127.0.0.1:21231"
+	cc.Servers = []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	mux := http.NewServeMux()
+	p.Admin(mux)
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	readOnly := func(op string, want bool) {
+		w := httptest.NewRecorder()
+		method := "POST"
+		if op == "" {
+			method = "GET"
+		}
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/admin/read_only?cluster=read-only-cluster&op="+op, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("read only op(%s) code(%d)", op, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"read_only":%v}`, want) {
+			t.Fatalf("read only op(%s) body(%s) want(%v)", op, body, want)
+		}
+	}
+
+	readOnly("enable", true)
+	readOnly("", true)
+	if reply := tierCmd(t, br, conn, "get a_ro\r\n"); reply != "VALUE a_ro 0 2\r\nro\r\nEND\r\n" {
+		t.Errorf("get reply(%q) want the value in read-only mode", reply)
+	}
+	for _, cmd := range []string{"set a_ro 0 0 1\r\n1\r\n", "delete a_ro\r\n", "incr a_ro 1\r\n", "cas a_ro 0 0 1 1\r\n1\r\n"} {
+		if reply := tierCmd(t, br, conn, cmd); reply != "SERVER_ERROR read-only\r\n" {
+			t.Errorf("cmd(%q) reply(%q) want rejected in read-only mode", cmd, reply)
+		}
+	}
+	if item, _ := s.get("a_ro"); item != "0 ro" {
+		t.Errorf("item(%q) written in read-only mode", item)
+	}
+	readOnly("disable", false)
+	if reply := tierCmd(t, br, conn, "set a_ro 0 0 1\r\n1\r\n"); reply != "STORED\r\n" {
+		t.Errorf("set reply(%q) want STORED after read-only mode disabled", reply)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/admin/read_only?cluster=read-only-cluster&op=on", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("read only bad op code(%d) want 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/read_only?cluster=read-only-cluster&op=enable", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("read only GET op code(%d) want 405", w.Code)
+	}
+	readOnly("", false)
+}
+
+func TestAdminFault(t *testing.T) {
+	_, addr, closer := mockTierStore(t)
+	defer closer()
+	cc := *ccs[0]
+	cc.Name = "fault-cluster"
+	cc.ListenAddr = "127.0.0.1:21240"
+	cc.Servers = []string{addr + ":1"}
+	cc.FaultInjection = true
+	cc.PingAutoEject = true
+	cc.PingFailLimit = 1
+	pc := *ccs[0]
+	pc.Name = "prod-cluster"
+	pc.ListenAddr = "127.0.0.1:21241"
+	pc.Servers = []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc, &pc})
+	time.Sleep(100 * time.Millisecond)
+	mux := http.NewServeMux()
+	p.Admin(mux)
+	faultOp := func(cluster, query string, code int) string {
+		w := httptest.NewRecorder()
+		method := "POST"
+		if query == "" {
+			method = "GET"
+		}
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/admin/fault?cluster="+cluster+"&node="+addr+query, nil))
+		if w.Code != code {
+			t.Fatalf("fault cluster(%s) query(%s) code(%d) want(%d)", cluster, query, w.Code, code)
+		}
+		return strings.TrimSpace(w.Body.String())
+	}
+	faultOp("prod-cluster", "&op=enable&timeout=1", http.StatusForbidden)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/fault?cluster=fault-cluster&node="+addr+"&op=enable&timeout=1", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("fault GET op code(%d) want 405", w.Code)
+	}
+	faultOp("fault-cluster", "&op=enable&timeout=2", http.StatusBadRequest)
+	if body := faultOp("fault-cluster", "", http.StatusOK); body != `{"enabled":false,"faults":{"dial":0,"timeout":0,"malformed":0}}` {
+		t.Fatalf("fault body(%s) want disabled by default", body)
+	}
+	set := func() string { // NOTE: new conn each, the client conn is closed after a backend timeout replied
+		conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+		if err != nil {
+			t.Fatalf("net dial error:%v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("set a_f 0 0 1\r\n1\r\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		bs, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("set read error:%v", err)
+		}
+		return bs
+	}
+	if reply := set(); reply != "STORED\r\n" {
+		t.Fatalf("set reply(%q) want STORED before faults", reply)
+	}
+	faultOp("fault-cluster", "&op=enable&timeout=1", http.StatusOK)
+	timeout := set()
+	if !strings.HasPrefix(timeout, "SERVER_ERROR") {
+		t.Fatalf("set reply(%q) want the injected timeout", timeout)
+	}
+	time.Sleep(1200 * time.Millisecond) // NOTE: the next ping fails and ejects the node
+	if reply := set(); !strings.HasPrefix(reply, "SERVER_ERROR") || reply == timeout {
+		t.Fatalf("set reply(%q) want rejected by the node ejected", reply)
+	}
+	faultOp("fault-cluster", "&op=disable", http.StatusOK)
+	time.Sleep(1200 * time.Millisecond) // NOTE: the next ping succeeds and re-adds the node
+	if reply := set(); reply != "STORED\r\n" {
+		t.Fatalf("set reply(%q) want STORED after faults disabled", reply)
+	}
+}
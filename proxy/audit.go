@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/felixhao/overlord/lib/log"
+	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/proto"
+)
+
+// AuditEntry is one audited command, NOTE: never contains value data.
+type AuditEntry struct {
+	Time    time.Time
+	Client  string
+	Cluster string
+	Node    string
+	Addr    string // NOTE: the server address served, only when debug_addr
+	Cmd     string
+	Key     []byte
+	Status  string
+	Latency time.Duration // NOTE: since the request read from client
+	Err     error
+}
+
+var (
+	auditFn     func(*AuditEntry)
+	auditSample uint64 // NOTE: zero means none sampled but the errors
+	auditCount  uint64
+	auditErrors bool
+)
+
+// SetAudit sets the audit hook which receives one of every sample commands,
+// sample<=1 means all commands. Nil fn disables audit.
+// NOTE: must be called before proxy Serve.
+func SetAudit(fn func(*AuditEntry), sample int) {
+	auditFn = fn
+	auditSample = 1
+	if sample > 1 {
+		auditSample = uint64(sample)
+	}
+}
+
+// SetAuditErrors sets whether the failed commands are always audited, not sampled.
+// NOTE: must be called before proxy Serve.
+func SetAuditErrors(on bool) {
+	auditErrors = on
+}
+
+// setAuditLog sets the audit hook logs one of every sample commands by config, zero means none,
+// and the failed commands always when errors.
+func setAuditLog(sample int, errors bool) {
+	auditFn = LogAudit
+	auditSample = uint64(sample)
+	auditErrors = errors
+}
+
+// LogAudit is the audit hook which logs the entry, like: the sampled commands for debugging.
+func LogAudit(e *AuditEntry) {
+	log.Infof("audit cluster(%s) client(%s) node(%s) addr(%s) cmd(%s) key(%s) status(%s) latency(%v) error(%v)",
+		e.Cluster, e.Client, e.Node, e.Addr, e.Cmd, e.Key, e.Status, e.Latency, e.Err)
+}
+
+func auditOn() bool {
+	return auditFn != nil
+}
+
+func audit(cluster, node string, req *proto.Request, resp *proto.Response, err error) {
+	if auditFn == nil {
+		return
+	}
+	if err == nil && resp != nil {
+		err = resp.Err()
+	}
+	if !auditErrors || (err == nil && resp != nil) {
+		if auditSample == 0 || (auditSample > 1 && atomic.AddUint64(&auditCount, 1)%auditSample != 0) {
+			return
+		}
+	}
+	stat.AuditSampled(cluster)
+	e := &AuditEntry{
+		Time:    time.Now(),
+		Client:  req.Client(),
+		Cluster: cluster,
+		Node:    node,
+		Cmd:     req.Cmd(),
+		Key:     req.Key(),
+		Latency: req.Since(),
+		Err:     err,
+	}
+	if resp != nil {
+		e.Status = resp.Status()
+		e.Addr = resp.Addr()
+	} else {
+		e.Status = "ERROR"
+	}
+	auditFn(e)
+}
@@ -0,0 +1,100 @@
+package proxy_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+)
+
+func TestAudit(t *testing.T) {
+	var (
+		lock sync.Mutex
+		es   []*proxy.AuditEntry
+	)
+	proxy.SetAudit(func(e *proxy.AuditEntry) {
+		lock.Lock()
+		es = append(es, e)
+		lock.Unlock()
+	}, 0)
+	defer proxy.SetAudit(nil, 0)
+	testCmd(t, []byte("set a_audit 0 0 5\r\nhello\r\n"), []byte("get a_audit\r\n"))
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(es) != 2 {
+		t.Fatalf("audit entries(%d) want 2", len(es))
+	}
+	for i, want := range [][2]string{{"set", "STORED"}, {"get", "HIT"}} {
+		e := es[i]
+		if e.Cmd != want[0] || e.Status != want[1] {
+			t.Errorf("audit entry cmd(%s) status(%s) want cmd(%s) status(%s)", e.Cmd, e.Status, want[0], want[1])
+		}
+		if string(e.Key) != "a_audit" || e.Cluster != "test-cluster" || e.Node != "127.0.0.1:11211" {
+			t.Errorf("audit entry key(%s) cluster(%s) node(%s) unexpected", e.Key, e.Cluster, e.Node)
+		}
+		if e.Client == "" || e.Time.IsZero() {
+			t.Errorf("audit entry client(%s) time(%v) unexpected", e.Client, e.Time)
+		}
+	}
+}
+
+func TestAuditSample(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil || strings.Contains(bs, "a_fail") {
+				conn.Close() // NOTE: the request fails by the broken connection
+				return
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	var (
+		lock     sync.Mutex
+		ok, fail int
+	)
+	proxy.SetAudit(func(e *proxy.AuditEntry) {
+		lock.Lock()
+		defer lock.Unlock()
+		if e.Err != nil {
+			fail++
+			return
+		}
+		if e.Node != addr || e.Status != "MISS" || e.Latency <= 0 {
+			t.Errorf("audit entry node(%s) status(%s) latency(%v) unexpected", e.Node, e.Status, e.Latency)
+		}
+		ok++
+	}, 4)
+	proxy.SetAuditErrors(true)
+	defer proxy.SetAuditErrors(false)
+	defer proxy.SetAudit(nil, 0)
+	c, _ := newTestCluster(t, addr)
+	defer c.Close()
+
+	const n, failed = 400, 5
+	for i := 0; i < n; i++ {
+		req := newRequest(t, "get a_sample\r\n")
+		c.Dispatch(req)
+		req.Wait()
+	}
+	for i := 0; i < failed; i++ {
+		req := newRequest(t, "get a_fail\r\n")
+		c.Dispatch(req)
+		req.Wait()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if ok < n/4*8/10 || ok > n/4*12/10 {
+		t.Errorf("sampled(%d) of (%d) want about a quarter", ok, n)
+	}
+	if fail != failed {
+		t.Errorf("sampled errors(%d) want all of (%d)", fail, failed)
+	}
+}
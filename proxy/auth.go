@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixhao/overlord/lib/log"
+	"github.com/felixhao/overlord/proto/memcache"
+	"github.com/pkg/errors"
+)
+
+// credentialCheckInterval is the interval that the credential file checked for modification.
+const credentialCheckInterval = time.Second
+
+// credentialFile provides the credential of file 'user token', reloaded when the file modified,
+// like: the short-lived token rotated by secrets manager.
+type credentialFile struct {
+	path string
+
+	lock    sync.Mutex
+	checked time.Time
+	mod     time.Time
+	cred    memcache.Credential
+}
+
+// newCredentialFile new the credential file, fails when the file not loaded.
+func newCredentialFile(path string) (*credentialFile, error) {
+	f := &credentialFile{path: path, checked: time.Now()}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(ErrClusterAuth, "Cluster auth file(%s):%v", path, err)
+	}
+	if f.cred, err = f.load(); err != nil {
+		return nil, err
+	}
+	f.mod = fi.ModTime()
+	return f, nil
+}
+
+// Credential returns the current credential, the file is checked at most once per interval,
+// and the old one kept when the modified file not loaded.
+func (f *credentialFile) Credential() memcache.Credential {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= credentialCheckInterval {
+		f.checked = now
+		if fi, err := os.Stat(f.path); err == nil && !fi.ModTime().Equal(f.mod) {
+			if cred, err := f.load(); err != nil {
+				log.Errorf("auth file(%s) reload error:%v", f.path, err)
+			} else {
+				f.cred, f.mod = cred, fi.ModTime()
+			}
+		}
+	}
+	return f.cred
+}
+
+func (f *credentialFile) load() (cred memcache.Credential, err error) {
+	bs, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		err = errors.Wrapf(ErrClusterAuth, "Cluster auth file(%s):%v", f.path, err)
+		return
+	}
+	fs := strings.Fields(string(bs))
+	if len(fs) != 2 {
+		err = errors.Wrapf(ErrClusterAuth, "Cluster auth file(%s) not 'user token'", f.path)
+		return
+	}
+	cred.User, cred.Token = fs[0], fs[1]
+	return
+}
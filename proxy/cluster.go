@@ -3,19 +3,29 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	errs "errors"
+	"io"
 	"net"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/felixhao/overlord/lib/aimd"
 	"github.com/felixhao/overlord/lib/backoff"
 	"github.com/felixhao/overlord/lib/conv"
-	"github.com/felixhao/overlord/lib/ketama"
+	"github.com/felixhao/overlord/lib/dialer"
+	"github.com/felixhao/overlord/lib/fault"
+	"github.com/felixhao/overlord/lib/hotkey"
 	"github.com/felixhao/overlord/lib/log"
 	"github.com/felixhao/overlord/lib/pool"
+	"github.com/felixhao/overlord/lib/resolver"
 	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/lib/tap"
 	"github.com/felixhao/overlord/proto"
 	"github.com/felixhao/overlord/proto/memcache"
 	"github.com/pkg/errors"
@@ -23,18 +33,43 @@ import (
 
 const (
 	hashRingSpots = 255
+
+	batchMaxRequests = 128 // NOTE: the max requests coalesced into one flush
+
+	hotKeyTopK   = 16 // NOTE: the max hot keys kept of one window
+	hotKeyWindow = time.Second
+
+	defaultPoolOverflowIdle = time.Second
 )
 
 // cluster errors
 var (
 	ErrClusterServerFormat = errs.New("cluster servers format error")
 	ErrClusterHashNoNode   = errs.New("cluster hash no hit node")
+	ErrClusterConnStale    = errs.New("cluster conn stale")
+	ErrClusterConnDead     = errs.New("cluster conn dead")
+	ErrClusterNoRaw        = errs.New("cluster node handler not support raw command")
+	ErrClusterHotKey       = errs.New("cluster hot key shed")
+	ErrClusterChecksum     = errs.New("cluster checksum unsupported")
+	ErrClusterEncryptKey   = errs.New("cluster encrypt keys format error")
+	ErrClusterKeyRule      = errs.New("cluster key rules format error")
+	ErrClusterAuth         = errs.New("cluster auth file error")
+	ErrClusterDialSource   = errs.New("cluster dial source not ip")
+	ErrClusterLimited      = errs.New("cluster node concurrency limited")
+	ErrClusterTimeout      = errs.New("cluster request timeout")
+	ErrClusterTierWrite    = errs.New("cluster tier write policy unsupported")
+	ErrClusterBadKey       = errs.New("cluster bad key policy unsupported")
+	ErrClusterDupKey       = errs.New("cluster duplicate key policy unsupported")
+	ErrClusterSelector     = errs.New("cluster hash distribution unsupported")
+	ErrClusterFault        = errs.New("cluster fault injection not allowed")
+	ErrBackendBusy         = errs.New("backend busy")
+	ErrClusterProtocol     = errs.New("cluster backend protocol mismatch")
 )
 
 type pinger struct {
 	ping   proto.Pinger
 	node   string
-	weight int
+	weight int32 // NOTE: atomic, changed by SetWeight
 
 	failure int
 	retries int
@@ -43,20 +78,27 @@ type pinger struct {
 type channel struct {
 	idx int32
 	cnt int32
-	chs []chan *proto.Request
+	qs  []*queue
+
+	outstanding int32
+	limit       *aimd.Limiter // NOTE: nil means no adaptive limit
+
+	pending  int32 // NOTE: atomic, the requests pushed and not served yet
+	draining int32 // NOTE: atomic, the pool drained once the pending ones served
 }
 
 func newChannel(n int32) *channel {
-	chs := make([]chan *proto.Request, n)
+	qs := make([]*queue, n)
 	for i := int32(0); i < n; i++ {
-		chs[i] = make(chan *proto.Request, requestChanBuffer)
+		qs[i] = newQueue(requestChanBuffer)
 	}
-	return &channel{cnt: n, chs: chs}
+	return &channel{cnt: n, qs: qs}
 }
 
 func (c *channel) push(req *proto.Request) {
+	atomic.AddInt32(&c.pending, 1)
 	i := atomic.AddInt32(&c.idx, 1)
-	c.chs[i%c.cnt] <- req
+	c.qs[i%c.cnt].push(req)
 }
 
 // Cluster is cache cluster.
@@ -66,21 +108,52 @@ type Cluster struct {
 	cancel context.CancelFunc
 
 	hashTag []byte
+	prefix  []byte
+	rules   []memcache.KeyRule
 
-	ring      *ketama.HashRing
+	selector  Selector
+	ringLog   *ringLogger
+	hot       *hotkey.Detector
 	alias     bool
 	nodePool  map[string]*pool.Pool
 	nodeAlias map[string]string
 	nodePing  map[string]*pinger
 	nodeCh    map[string]*channel
 
+	record *os.File
+	faults map[string]*fault.Injector // NOTE: nil means no fault injection
+	tier   *tier                      // NOTE: nil means no tier 2
+	micro  *microCache                // NOTE: nil means no micro cache
+
+	inflight int32
+	readOnly int32 // NOTE: 1 means the writes are rejected
+	limiter  *pool.Limiter
+	budget   *pool.Budget
+	buffers  *pool.Buffers
+	stats    *stat.Registry // NOTE: nil means the package globals
+
 	lock   sync.Mutex
 	closed bool
 }
 
 // NewCluster new a cluster by cluster config.
 func NewCluster(ctx context.Context, cc *ClusterConfig) (c *Cluster) {
-	c = &Cluster{cc: cc}
+	return newCluster(ctx, cc, nil, nil, nil, nil, nil)
+}
+
+// NewClusterRegistry new a cluster by cluster config, the hits and misses are counted into the stat registry.
+func NewClusterRegistry(ctx context.Context, cc *ClusterConfig, r *stat.Registry) (c *Cluster) {
+	return newCluster(ctx, cc, nil, nil, nil, nil, r)
+}
+
+// newCluster new a cluster, the backend conns are also limited by the parent limiter,
+// the backend dials by the parent gate, and the response buffers by the budget.
+// The connection buffers are recycled by the buffers free list if any, and the stat counted into the registry if any.
+func newCluster(ctx context.Context, cc *ClusterConfig, parent *pool.Limiter, gate *pool.Gate, budget *pool.Budget, buffers *pool.Buffers, reg *stat.Registry) (c *Cluster) {
+	c = &Cluster{cc: cc, budget: budget, buffers: buffers, stats: reg}
+	c.limiter = pool.NewLimiter(cc.MaxBackendConns, parent, func(active int) {
+		stat.BackendConns(cc.Name, active)
+	})
 	c.ctx, c.cancel = context.WithCancel(ctx)
 	// parse
 	addrs, ws, ans, alias, err := parseServers(cc.Servers)
@@ -90,16 +163,120 @@ func NewCluster(ctx context.Context, cc *ClusterConfig) (c *Cluster) {
 	if len(cc.HashTag) == 2 {
 		c.hashTag = []byte{cc.HashTag[0], cc.HashTag[1]}
 	}
-	ring := ketama.NewRing(hashRingSpots)
-	if alias {
-		ring.Init(ans, ws)
-	} else {
-		ring.Init(addrs, ws)
-	}
 	nm := map[string]*pool.Pool{}
 	am := map[string]string{}
 	pm := map[string]*pinger{}
 	cm := map[string]*channel{}
+	var dos []*memcache.DialOption
+	if reg != nil {
+		dos = append(dos, memcache.DialStat(reg))
+	}
+	if cc.KeyPrefix != "" {
+		c.prefix = []byte(cc.KeyPrefix)
+		dos = append(dos, memcache.DialKeyPrefix(cc.KeyPrefix))
+	}
+	if len(cc.KeyRules) > 0 {
+		if c.rules, err = parseKeyRules(cc.KeyRules); err != nil {
+			panic(err)
+		}
+		dos = append(dos, memcache.DialKeyRules(c.rules...))
+	}
+	if cc.RecordFile != "" {
+		f, err := os.OpenFile(cc.RecordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			panic(err)
+		}
+		c.record = f
+		dos = append(dos, memcache.DialTap(tap.NewRecorder(f)))
+	}
+	var (
+		pos    []*memcache.PingerOption
+		lookup resolver.LookupFunc
+		dial   dialer.DialFunc
+	)
+	if cc.DNSTimeout > 0 {
+		lookup = resolver.LookupTimeout(nil, time.Duration(cc.DNSTimeout)*time.Millisecond)
+		dos = append(dos, memcache.DialLookup(lookup))
+		pos = append(pos, memcache.PingerLookup(lookup))
+	}
+	if cc.DNSTTL > 0 {
+		dos = append(dos, memcache.DialResolver(resolver.New(time.Duration(cc.DNSTTL)*time.Millisecond, lookup)))
+	}
+	if cc.DialSource != "" {
+		ip := net.ParseIP(cc.DialSource)
+		if ip == nil {
+			panic(errors.Wrapf(ErrClusterDialSource, "Cluster new dial source(%s)", cc.DialSource))
+		}
+		laddr := &net.TCPAddr{IP: ip} // NOTE: any port
+		dos = append(dos, memcache.DialLocalAddr(laddr))
+		pos = append(pos, memcache.PingerLocalAddr(laddr))
+		dial = func(addr string, timeout time.Duration) (net.Conn, error) {
+			return (&net.Dialer{Timeout: timeout, LocalAddr: laddr}).Dial("tcp", addr)
+		}
+	}
+	if cc.DialFallback > 0 {
+		dto := time.Duration(cc.DialTimeout) * time.Millisecond
+		dos = append(dos, memcache.DialDualStack(dialer.New(dto, time.Duration(cc.DialFallback)*time.Millisecond, lookup, dial)))
+	}
+	if cc.MaxTTL > 0 {
+		dos = append(dos, memcache.DialMaxTTL(cc.MaxTTL))
+	}
+	if cc.ChunkSize > 0 {
+		dos = append(dos, memcache.DialChunkSize(cc.ChunkSize))
+	}
+	if cc.ValueCompress > 0 {
+		dos = append(dos, memcache.DialValueCodec(memcache.CompressCodec(cc.ValueCompress))) // NOTE: before encrypted, which never shrinks
+	}
+	if len(cc.EncryptKeys) > 0 {
+		kr, err := parseEncryptKeys(cc.EncryptKeys)
+		if err != nil {
+			panic(err)
+		}
+		dos = append(dos, memcache.DialValueCodec(memcache.EncryptCodec(kr)))
+	}
+	if budget != nil {
+		dos = append(dos, memcache.DialBudget(budget))
+	}
+	if buffers != nil {
+		dos = append(dos, memcache.DialBuffers(buffers))
+	}
+	if cc.CheckPending {
+		dos = append(dos, memcache.DialCheckPending())
+	}
+	if cc.DebugAddr {
+		dos = append(dos, memcache.DialDebugAddr())
+	}
+	if len(cc.ReconnectErrors) > 0 {
+		dos = append(dos, memcache.DialReconnectHints(cc.ReconnectErrors...))
+	}
+	if cc.PoolMaxRequests > 0 {
+		dos = append(dos, memcache.DialMaxRequests(cc.PoolMaxRequests))
+	}
+	if cc.EndGrace > 0 {
+		dos = append(dos, memcache.DialEndGrace(time.Duration(cc.EndGrace)*time.Millisecond, cc.EndStrict))
+	}
+	if cc.AuthFile != "" {
+		f, err := newCredentialFile(cc.AuthFile)
+		if err != nil {
+			panic(err)
+		}
+		dos = append(dos, memcache.DialAuth(f.Credential))
+		pos = append(pos, memcache.PingerAuth(f.Credential))
+	}
+	switch cc.Checksum {
+	case "":
+	case "crc32":
+		dos = append(dos, memcache.DialChecksum(memcache.CRC32(), cc.ChecksumMiss))
+	default:
+		panic(errors.Wrapf(ErrClusterChecksum, "Cluster new checksum(%s)", cc.Checksum))
+	}
+	if cc.ReserveFlags {
+		dos = append(dos, memcache.DialReserveFlags())
+	}
+	if cc.FaultInjection {
+		c.faults = map[string]*fault.Injector{}
+		log.Warnf("cluster(%s) addr(%s) fault injection allowed, never in production", cc.Name, cc.ListenAddr)
+	}
 	// for addrs
 	for i := range addrs {
 		node := addrs[i]
@@ -107,18 +284,76 @@ func NewCluster(ctx context.Context, cc *ClusterConfig) (c *Cluster) {
 			node = ans[i]
 			am[ans[i]] = addrs[i]
 		}
-		nm[node] = newPool(cc, addrs[i])
-		pm[node] = &pinger{ping: newPinger(cc, addrs[i]), node: node, weight: ws[i]}
-		rc := newChannel(int32(cc.PoolActive))
+		ndos, npos := dos, pos
+		if c.faults != nil {
+			inj := fault.New() // NOTE: per server, disabled until enabled by admin
+			c.faults[node] = inj
+			ndos = append(dos[:len(dos):len(dos)], memcache.DialFault(inj))
+			npos = append(pos[:len(pos):len(pos)], memcache.PingerFault(inj))
+		}
+		nm[node] = newPool(cc, addrs[i], c.limiter, gate, ndos...)
+		if ws[i] == 0 {
+			nm[node].Drain(true) // NOTE: weight 0 means no traffic
+		}
+		pm[node] = &pinger{ping: newPinger(cc, addrs[i], npos...), node: node, weight: int32(ws[i])}
+		rc := newChannel(int32(cc.PoolActive + cc.PoolOverflow)) // NOTE: the overflow connections served by more goroutines
+		if cc.AdaptiveLatency > 0 {
+			addr := addrs[i]
+			rc.limit = aimd.New(1, cc.PoolActive, time.Duration(cc.AdaptiveLatency)*time.Millisecond, func(limit int) {
+				stat.ConcurrencyLimit(cc.Name, addr, limit)
+			})
+			if cc.BackendQueue > 0 {
+				rc.limit.Queue(cc.BackendQueue, func(n int) {
+					stat.BackendQueue(cc.Name, addr, n)
+				})
+			}
+		}
 		cm[node] = rc
 		go c.process(node, rc)
 	}
-	c.ring = ring
 	c.alias = alias
 	c.nodePool = nm
 	c.nodeAlias = am
 	c.nodePing = pm
 	c.nodeCh = cm
+	if c.selector, err = newSelector(c, cc.HashDistribution); err != nil {
+		panic(err)
+	}
+	c.selector.Update(c.Nodes())
+	if cc.HotKeyThreshold > 0 {
+		c.hot = hotkey.New(uint32(cc.HotKeyThreshold), hotKeyTopK, hotKeyWindow, func(ks []hotkey.Key) {
+			hm := make(map[string]uint32, len(ks))
+			for _, k := range ks {
+				hm[k.Key] = k.Count
+			}
+			stat.HotKeys(cc.Name, hm)
+		})
+	}
+	if ks, ok := c.selector.(*ketamaSelector); ok && cc.RingLogInterval > 0 {
+		c.ringLog = newRingLogger(cc.Name, ks.ring, time.Duration(cc.RingLogInterval)*time.Millisecond)
+		c.ringLog.changed("init")
+	}
+	switch cc.BadKeyPolicy {
+	case "", badKeyMiss, badKeyError:
+	default:
+		panic(errors.Wrapf(ErrClusterBadKey, "Cluster new bad key policy(%s)", cc.BadKeyPolicy))
+	}
+	switch cc.DupKeyPolicy {
+	case "", dupKeyOnce, dupKeyEach:
+	default:
+		panic(errors.Wrapf(ErrClusterDupKey, "Cluster new duplicate key policy(%s)", cc.DupKeyPolicy))
+	}
+	if len(cc.TierServers) > 0 {
+		switch cc.TierWrite {
+		case "", tierWriteAll, tierWritePrimary:
+		default:
+			panic(errors.Wrapf(ErrClusterTierWrite, "Cluster new tier write(%s)", cc.TierWrite))
+		}
+		c.tier = newTier(c.ctx, c)
+	}
+	if cc.MicroCacheTTL > 0 {
+		c.micro = newMicroCache(cc.Name, time.Duration(cc.MicroCacheTTL)*time.Millisecond)
+	}
 	// auto eject
 	if cc.PingAutoEject {
 		go c.keepAlive()
@@ -128,66 +363,635 @@ func NewCluster(ctx context.Context, cc *ClusterConfig) (c *Cluster) {
 
 // Dispatch dispatchs request.
 func (c *Cluster) Dispatch(req *proto.Request) {
-	// hash
-	node, ok := c.hash(req.Key())
-	if !ok {
+	// select
+	n, err := c.selector.Select(req)
+	if err != nil {
 		if log.V(3) {
-			log.Warnf("cluster(%s) addr(%s) request(%s) hash node not ok", c.cc.Name, c.cc.ListenAddr, req.Key())
+			log.Warnf("cluster(%s) addr(%s) request(%s) select node error:%v", c.cc.Name, c.cc.ListenAddr, req.Key(), err)
 		}
-		req.DoneWithError(errors.Wrap(ErrClusterHashNoNode, "Cluster Dispatch dispatch request hash"))
+		c.doneWithError("", req, errors.Wrap(err, "Cluster Dispatch dispatch request select"))
 		return
 	}
+	node := n.Name
 	rc, ok := c.nodeCh[node]
 	if !ok {
 		if log.V(3) {
 			log.Warnf("cluster(%s) addr(%s) request(%s) node(%s) have not Chan", c.cc.Name, c.cc.ListenAddr, req.Key(), node)
 		}
-		req.DoneWithError(errors.Wrap(ErrClusterHashNoNode, "Cluster Dispatch dispatch request node chan"))
+		c.doneWithError(node, req, errors.Wrap(ErrClusterHashNoNode, "Cluster Dispatch dispatch request node chan"))
 		return
 	}
+	if c.shedHot(node, req) {
+		return
+	}
+	c.deadline(node, req)
 	rc.push(req)
 }
 
+// deadline sets the deadline of request by request_timeout, the request expired is done with timeout.
+func (c *Cluster) deadline(node string, req *proto.Request) {
+	if c.cc.RequestTimeout > 0 {
+		req.WithDeadline(time.Now().Add(time.Duration(c.cc.RequestTimeout)*time.Millisecond), func() {
+			c.doneWithError(node, req, errors.Wrap(ErrClusterTimeout, "Cluster Dispatch request deadline"))
+		})
+	}
+}
+
+// shedHot counts the request key, and sheds the request of hot key when its node is struggling,
+// that is the outstanding requests not less than hot_key_shed. The other keys are served as usual.
+func (c *Cluster) shedHot(node string, req *proto.Request) bool {
+	if c.hot == nil || !c.hot.Add(req.Key()) {
+		return false
+	}
+	if c.cc.HotKeyShed <= 0 || c.Outstanding(node) < c.cc.HotKeyShed {
+		return false
+	}
+	stat.HotKeyShed(c.cc.Name)
+	req.DoneWithError(&proto.NodeError{Node: node, Err: errors.Wrap(ErrClusterHotKey, "Cluster Dispatch shed hot key")})
+	return true
+}
+
 func (c *Cluster) process(node string, rc *channel) {
 	for i := int32(0); i < rc.cnt; i++ {
 		go func(i int32) {
-			ch := rc.chs[i]
+			q := rc.qs[i]
 			for {
-				var req *proto.Request
-				select {
-				case req = <-ch:
-				case <-c.ctx.Done():
+				req, ok := q.pop(c.ctx.Done(), nil)
+				if !ok {
 					return
 				}
-				hdl, err := c.get(node)
-				if err != nil {
-					req.DoneWithError(errors.Wrap(err, "Cluster process get handler"))
-					if log.V(1) {
-						log.Errorf("cluster(%s) addr(%s) cluster process init error:%+v", c.cc.Name, c.cc.ListenAddr, err)
-					}
-					return
+				reqs := []*proto.Request{req}
+				if c.cc.BatchWindow > 0 {
+					reqs = c.coalesce(req, q, time.Duration(c.cc.BatchWindow)*time.Microsecond)
 				}
-				now := time.Now()
-				resp, err := hdl.Handle(req)
-				c.put(node, hdl, err)
-				stat.HandleTime(c.cc.Name, node, req.Cmd(), int64(time.Since(now)/time.Millisecond))
-				if err != nil {
-					req.DoneWithError(errors.Wrap(err, "Cluster process handle"))
-					if log.V(1) {
-						log.Errorf("cluster(%s) addr(%s) request(%s) cluster process handle error:%+v", c.cc.Name, c.cc.ListenAddr, req.Key(), err)
-					}
-					stat.ErrIncr(c.cc.Name, node, req.Cmd(), err.Error())
-					continue
-				}
-				req.Done(resp)
+				c.serve(node, rc, reqs)
+				c.served(node, rc, len(reqs))
 			}
 		}(i)
 	}
 }
 
-// hash returns node by hash hit.
-func (c *Cluster) hash(key []byte) (node string, ok bool) {
-	var realKey []byte
+// served counts n requests of node served, and drains the pool of node when its weight changed to
+// zero and no requests pending any more.
+func (c *Cluster) served(node string, rc *channel, n int) {
+	if atomic.AddInt32(&rc.pending, -int32(n)) == 0 && atomic.LoadInt32(&rc.draining) == 1 {
+		c.lock.Lock()
+		c.drain(node, rc)
+		c.lock.Unlock()
+	}
+}
+
+// drain drains the pool of node when it is draining and no requests pending, the checked-out
+// connections are closed once put back. The caller must hold c.lock during the call.
+func (c *Cluster) drain(node string, rc *channel) {
+	if atomic.LoadInt32(&rc.pending) == 0 && atomic.CompareAndSwapInt32(&rc.draining, 1, 0) {
+		c.nodePool[node].Drain(true)
+	}
+}
+
+// serve serves the requests popped from the queue of node.
+func (c *Cluster) serve(node string, rc *channel, reqs []*proto.Request) {
+	if reqs = c.admit(node, rc, unexpired(reqs)); len(reqs) == 0 {
+		return
+	}
+	start := time.Now()
+	hdl, err := c.get(node)
+	for _, r := range reqs {
+		if t := r.Timing(); t != nil {
+			t.Start, t.PoolWait = start, time.Since(start)
+		}
+	}
+	if err == nil {
+		n := len(reqs)
+		if reqs = unexpired(reqs); len(reqs) < n { // NOTE: expired while waiting for connection
+			c.release(rc, make([]*proto.Request, n-len(reqs)), start, ErrClusterTimeout)
+		}
+		if len(reqs) == 0 {
+			c.put(node, hdl, nil)
+			return
+		}
+	}
+	if err != nil {
+		for _, r := range reqs {
+			c.doneWithError(node, r, errors.Wrap(err, "Cluster process get handler"))
+		}
+		c.release(rc, reqs, start, err)
+		if log.V(1) {
+			log.Errorf("cluster(%s) addr(%s) cluster process get handler error:%+v", c.cc.Name, c.cc.ListenAddr, err)
+		}
+		return // NOTE: the worker keeps serving, like: the limited one succeeds once the conns put back
+	}
+	var cas *proto.Request
+	if bh, ok := hdl.(proto.BatchHandler); ok && len(reqs) > 1 {
+		err = c.handleBatch(node, rc, bh, reqs)
+		if p, ok := err.(*poisoned); ok {
+			hdl, err = c.reconnect(node, rc, hdl, p)
+		}
+	} else {
+		for i, r := range reqs {
+			err = c.handle(node, rc, hdl, r)
+			if p, ok := err.(*poisoned); ok {
+				hdl, err = c.reconnect(node, rc, hdl, p)
+			}
+			if cas, err = handled(err); err != nil {
+				for _, r := range reqs[i+1:] { // NOTE: the connection is broken
+					c.doneWithError(node, r, errors.Wrap(err, "Cluster process handle"))
+				}
+				break
+			}
+		}
+	}
+	c.release(rc, reqs, start, err)
+	c.put(node, hdl, err)
+	if cas != nil {
+		c.casRecheck(node, cas, err)
+	}
+	for _, r := range reqs {
+		r.StopDeadline()
+	}
+}
+
+// unexpired returns the requests not expired, the expired ones are done by their deadline.
+func unexpired(reqs []*proto.Request) []*proto.Request {
+	n := 0
+	now := time.Now()
+	for _, r := range reqs {
+		if d, ok := r.Deadline(); ok && !now.Before(d) {
+			continue
+		}
+		reqs[n] = r
+		n++
+	}
+	return reqs[:n]
+}
+
+// admit acquires the adaptive limit of node for the requests, the ones over the limit are
+// rejected without waiting, so a struggling node is not piled up. When backend queue, they
+// wait in the queue as one batch until the latest request deadline or read timeout, and are
+// granted all at once or fail together when the queue is full or timeout.
+// NOTE: the ones expired while waiting are done by their deadline, their limit released after.
+func (c *Cluster) admit(node string, rc *channel, reqs []*proto.Request) []*proto.Request {
+	if rc.limit == nil || len(reqs) == 0 {
+		return reqs
+	}
+	if c.cc.BackendQueue > 0 {
+		var wait time.Duration
+		for _, r := range reqs {
+			if w := c.queueWait(r); w > wait {
+				wait = w
+			}
+		}
+		if !rc.limit.WaitN(len(reqs), wait) {
+			for _, r := range reqs {
+				stat.Overload(c.cc.Name)
+				c.doneWithError(node, r, errors.Wrap(ErrBackendBusy, "Cluster process admit queue"))
+			}
+			return nil
+		}
+		return reqs
+	}
+	n := 0
+	for _, r := range reqs {
+		if !rc.limit.Acquire() {
+			stat.Overload(c.cc.Name)
+			c.doneWithError(node, r, errors.Wrap(ErrClusterLimited, "Cluster process admit"))
+			continue
+		}
+		reqs[n] = r
+		n++
+	}
+	return reqs[:n]
+}
+
+// queueWait returns the max waiting in backend queue of request, until its deadline or read timeout.
+func (c *Cluster) queueWait(req *proto.Request) time.Duration {
+	if d, ok := req.Deadline(); ok {
+		return time.Until(d)
+	}
+	return time.Duration(c.cc.ReadTimeout) * time.Millisecond
+}
+
+// release releases the adaptive limit of node for the handled requests with their latency.
+func (c *Cluster) release(rc *channel, reqs []*proto.Request, start time.Time, err error) {
+	if rc.limit == nil {
+		return
+	}
+	rtt := time.Since(start)
+	for range reqs {
+		rc.limit.Release(rtt, err != nil)
+	}
+}
+
+// handle handles request by node handler and dones the request.
+func (c *Cluster) handle(node string, rc *channel, hdl proto.Handler, req *proto.Request) error {
+	now := time.Now()
+	atomic.AddInt32(&rc.outstanding, 1)
+	stat.OutstandingIncr(c.cc.Name, node)
+	resp, err := hdl.Handle(req)
+	atomic.AddInt32(&rc.outstanding, -1)
+	stat.OutstandingDecr(c.cc.Name, node)
+	stat.HandleTime(c.cc.Name, node, req.Cmd(), int64(time.Since(now)/time.Millisecond))
+	if err != nil {
+		if errors.Cause(err) == memcache.ErrPoisoned {
+			return &poisoned{reqs: []*proto.Request{req}, err: err} // NOTE: nothing written, retried by reconnect
+		}
+		err = deadlineError(req, err)
+		if _, ok := memcache.CasCheck(req); ok && errors.Cause(err) != ErrClusterTimeout {
+			return &casDropped{req: req, err: err} // NOTE: rechecked after the broken connection put
+		}
+		c.failed(node, req, err)
+		return err
+	}
+	audit(c.cc.Name, node, req, resp, nil)
+	req.Done(resp)
+	return nil
+}
+
+// failed dones the request failed by handling with error.
+func (c *Cluster) failed(node string, req *proto.Request, err error) {
+	c.doneWithError(node, req, errors.Wrap(err, "Cluster process handle"))
+	if log.V(1) {
+		log.Errorf("cluster(%s) addr(%s) request(%s) cluster process handle error:%+v", c.cc.Name, c.cc.ListenAddr, req.Key(), err)
+	}
+	stat.ErrIncr(c.cc.Name, node, req.Cmd(), err.Error())
+	audit(c.cc.Name, node, req, nil, err)
+}
+
+// casDropped is the error of cas failed by connection, the cas is not done until rechecked.
+type casDropped struct {
+	req *proto.Request
+	err error
+}
+
+func (e *casDropped) Error() string {
+	return e.err.Error()
+}
+
+// handled returns the dropped cas request if any, and the error of handling.
+func handled(err error) (*proto.Request, error) {
+	if cd, ok := err.(*casDropped); ok {
+		return cd.req, cd.err
+	}
+	return nil, err
+}
+
+// poisoned is the error of requests not written by the connection poisoned, the requests are not done until retried.
+type poisoned struct {
+	reqs []*proto.Request // NOTE: one request, or the batch
+	err  error
+}
+
+func (e *poisoned) Error() string {
+	return e.err.Error()
+}
+
+// reconnect closes the poisoned connection, and retries the requests once by a fresh connection which is returned,
+// the requests fail when no fresh one or poisoned again. The returned handler is nil when no fresh one.
+// NOTE: the batch is retried as a batch, the fresh connection is dialed as the poisoned one.
+func (c *Cluster) reconnect(node string, rc *channel, hdl proto.Handler, p *poisoned) (proto.Handler, error) {
+	if log.V(2) {
+		log.Warnf("cluster(%s) addr(%s) node(%s) request(%s) batch(%d) connection poisoned, retry by a fresh one", c.cc.Name, c.cc.ListenAddr, node, p.reqs[0].Key(), len(p.reqs))
+	}
+	c.put(node, hdl, p.err)
+	nh, err := c.get(node)
+	if err != nil {
+		for _, r := range p.reqs {
+			c.failed(node, r, err)
+		}
+		return nil, err
+	}
+	if bh, ok := nh.(proto.BatchHandler); ok && len(p.reqs) > 1 {
+		err = c.handleBatch(node, rc, bh, p.reqs)
+	} else {
+		err = c.handle(node, rc, nh, p.reqs[0])
+	}
+	if pp, ok := err.(*poisoned); ok {
+		for _, r := range pp.reqs {
+			c.failed(node, r, pp.err)
+		}
+		return nh, pp.err
+	}
+	return nh, err
+}
+
+// casRecheck rechecks the item by gets on the same node after the cas failed by connection, and retries
+// the cas once by a new connection when the item unchanged since the cas unique, else replies 'EXISTS'
+// or 'NOT_FOUND', the client should gets the item again. The cas fails with err when the recheck failed.
+// NOTE: it must be called after the broken connection put, and the cas never retries on other nodes,
+// the cas unique is of the node.
+func (c *Cluster) casRecheck(node string, req *proto.Request, err error) {
+	greq, _ := memcache.CasCheck(req)
+	hdl, gerr := c.get(node)
+	if gerr != nil {
+		c.failed(node, req, err)
+		return
+	}
+	var resp *proto.Response
+	gresp, gerr := hdl.Handle(greq)
+	if gerr == nil {
+		var retry bool
+		resp, retry = memcache.CasChecked(req, gresp)
+		gresp.Release()
+		if retry {
+			resp, gerr = hdl.Handle(req)
+		}
+	}
+	c.put(node, hdl, gerr)
+	if gerr != nil {
+		c.failed(node, req, err)
+		return
+	}
+	audit(c.cc.Name, node, req, resp, nil)
+	req.Done(resp)
+}
+
+// deadlineError returns the timeout error instead when the request failed by its deadline,
+// the read of node is cut off by the deadline before the request expired.
+func deadlineError(req *proto.Request, err error) error {
+	if d, ok := req.Deadline(); ok && !time.Now().Before(d) {
+		return errors.Wrapf(ErrClusterTimeout, "Cluster request deadline error(%v)", err)
+	}
+	return err
+}
+
+// doneWithError dones the request with error, but the read request is done with a miss when fail open.
+// NOTE: the write request always fails, never fail open.
+func (c *Cluster) doneWithError(node string, req *proto.Request, err error) {
+	if c.cc.FailOpen {
+		var (
+			resp *proto.Response
+			ok   bool
+		)
+		switch c.cc.CacheType {
+		case proto.CacheTypeMemcache:
+			resp, ok = memcache.MissResponse(req)
+		}
+		if ok {
+			stat.FailOpenMiss(c.cc.Name, node)
+			req.Done(resp)
+			return
+		}
+	}
+	if node != "" {
+		err = &proto.NodeError{Node: node, Err: err}
+	}
+	req.DoneWithError(err)
+}
+
+// coalesce collects the requests arrived within window after the first one, which are
+// written pipelined by one flush. The added latency is bounded by window.
+func (c *Cluster) coalesce(req *proto.Request, q *queue, window time.Duration) []*proto.Request {
+	reqs := []*proto.Request{req}
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(reqs) < batchMaxRequests {
+		r, ok := q.pop(c.ctx.Done(), timer.C)
+		if !ok {
+			break
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs
+}
+
+// handleBatch handles the coalesced requests by node handler and dones them.
+func (c *Cluster) handleBatch(node string, rc *channel, bh proto.BatchHandler, reqs []*proto.Request) error {
+	now := time.Now()
+	atomic.AddInt32(&rc.outstanding, int32(len(reqs)))
+	for range reqs {
+		stat.OutstandingIncr(c.cc.Name, node)
+	}
+	resps, err := bh.HandleBatch(reqs)
+	atomic.AddInt32(&rc.outstanding, -int32(len(reqs)))
+	if errors.Cause(err) == memcache.ErrPoisoned {
+		for range reqs {
+			stat.OutstandingDecr(c.cc.Name, node)
+		}
+		return &poisoned{reqs: reqs, err: err} // NOTE: nothing written, retried by reconnect
+	}
+	ts := int64(time.Since(now) / time.Millisecond)
+	if err != nil && log.V(1) {
+		log.Errorf("cluster(%s) addr(%s) cluster process handle batch(%d) error:%+v", c.cc.Name, c.cc.ListenAddr, len(reqs), err)
+	}
+	for i, req := range reqs {
+		stat.OutstandingDecr(c.cc.Name, node)
+		stat.HandleTime(c.cc.Name, node, req.Cmd(), ts)
+		if i < len(resps) {
+			audit(c.cc.Name, node, req, resps[i], nil)
+			req.Done(resps[i])
+			continue
+		}
+		rerr := deadlineError(req, err)
+		c.doneWithError(node, req, errors.Wrap(rerr, "Cluster process handle batch"))
+		stat.ErrIncr(c.cc.Name, node, req.Cmd(), rerr.Error())
+		audit(c.cc.Name, node, req, nil, rerr)
+	}
+	return err
+}
+
+// Outstanding returns the in-flight request count of node, which can be consulted by load-aware routing.
+func (c *Cluster) Outstanding(node string) int32 {
+	rc, ok := c.nodeCh[node]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt32(&rc.outstanding)
+}
+
+// ConcurrencyLimit returns the adaptive concurrency limit of node, zero when not adaptive.
+func (c *Cluster) ConcurrencyLimit(node string) int {
+	rc, ok := c.nodeCh[node]
+	if !ok || rc.limit == nil {
+		return 0
+	}
+	return rc.limit.Limit()
+}
+
+// CacheMemlimit sets the memory limit in megabytes of all nodes, returns the error of every node.
+func (c *Cluster) CacheMemlimit(mb int) map[string]error {
+	return c.fanout(func(h proto.Handler) error {
+		rh, ok := h.(memcache.RawHandler)
+		if !ok {
+			return ErrClusterNoRaw
+		}
+		return memcache.CacheMemlimit(rh, mb)
+	})
+}
+
+// LruCrawler enables or disables the LRU crawler of all nodes, returns the error of every node.
+func (c *Cluster) LruCrawler(enable bool) map[string]error {
+	return c.fanout(func(h proto.Handler) error {
+		rh, ok := h.(memcache.RawHandler)
+		if !ok {
+			return ErrClusterNoRaw
+		}
+		return memcache.LruCrawler(rh, enable)
+	})
+}
+
+// Lru tunes the LRU of all nodes, returns the error of every node.
+func (c *Cluster) Lru(args []string) map[string]error {
+	return c.fanout(func(h proto.Handler) error {
+		rh, ok := h.(memcache.RawHandler)
+		if !ok {
+			return ErrClusterNoRaw
+		}
+		return memcache.Lru(rh, args)
+	})
+}
+
+// StatsReset resets the stats counters of all nodes, returns the error of every node.
+func (c *Cluster) StatsReset() map[string]error {
+	return c.fanout(func(h proto.Handler) error {
+		rh, ok := h.(memcache.RawHandler)
+		if !ok {
+			return ErrClusterNoRaw
+		}
+		return memcache.StatsReset(rh)
+	})
+}
+
+// LruCrawlerMetadump streams the item metadata of node into w.
+func (c *Cluster) LruCrawlerMetadump(node string, w io.Writer) (err error) {
+	h, err := c.get(node)
+	if err != nil {
+		return errors.Wrap(err, "Cluster LruCrawlerMetadump get handler")
+	}
+	sh, ok := h.(memcache.RawStreamHandler)
+	if !ok {
+		c.put(node, h, nil)
+		return ErrClusterNoRaw
+	}
+	err = memcache.LruCrawlerMetadump(sh, w)
+	c.put(node, h, err)
+	return
+}
+
+// fanout calls fn with the handler of every node concurrently, returns the error of every node.
+func (c *Cluster) fanout(fn func(h proto.Handler) error) map[string]error {
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(map[string]error, len(c.nodePool))
+	)
+	for node := range c.nodePool {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			h, err := c.get(node)
+			if err == nil {
+				err = fn(h)
+				c.put(node, h, err)
+			}
+			lock.Lock()
+			errs[node] = err
+			lock.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	return errs
+}
+
+// SetWeight changes the weight of node. The node of weight 0 is excluded from hashing and its pool
+// is drained once the requests already queued served: no new connection is got, the checked-out ones
+// finish their requests and are closed. The node of weight restored serves again.
+func (c *Cluster) SetWeight(node string, weight int) error {
+	p, ok := c.nodePing[node]
+	if !ok || weight < 0 {
+		return errors.Wrapf(ErrClusterHashNoNode, "Cluster SetWeight node(%s) weight(%d)", node, weight)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	atomic.StoreInt32(&p.weight, int32(weight))
+	rc := c.nodeCh[node]
+	if weight == 0 {
+		c.selector.RemoveNode(node)
+		c.ringLog.changed("weight")
+		atomic.StoreInt32(&rc.draining, 1) // NOTE: the queued requests are served before the pool drained
+		c.drain(node, rc)
+		return nil
+	}
+	atomic.StoreInt32(&rc.draining, 0)
+	c.nodePool[node].Drain(false)
+	c.selector.AddNode(c.node(node, weight))
+	c.ringLog.changed("weight")
+	return nil
+}
+
+// Node is the node of cluster with its address and current weight.
+type Node struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+}
+
+// SetFault enables the faults injected into node, or disables them when f is nil.
+// NOTE: fails when the fault injection not allowed by config.
+func (c *Cluster) SetFault(node string, f *fault.Faults) error {
+	if c.faults == nil {
+		return errors.Wrapf(ErrClusterFault, "Cluster SetFault node(%s)", node)
+	}
+	inj, ok := c.faults[node]
+	if !ok {
+		return errors.Wrapf(ErrClusterHashNoNode, "Cluster SetFault node(%s)", node)
+	}
+	if f != nil {
+		inj.Enable(*f)
+	} else {
+		inj.Disable()
+	}
+	return nil
+}
+
+// Fault returns the faults of node and whether they are enabled.
+func (c *Cluster) Fault(node string) (f fault.Faults, enabled bool) {
+	if inj, ok := c.faults[node]; ok {
+		f, enabled = inj.Faults()
+	}
+	return
+}
+
+// SetReadOnly switches the read-only mode of cluster, the writes are rejected in it while the reads proceed.
+func (c *Cluster) SetReadOnly(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.readOnly, v)
+}
+
+// ReadOnly returns whether the cluster is in read-only mode.
+func (c *Cluster) ReadOnly() bool {
+	return atomic.LoadInt32(&c.readOnly) == 1
+}
+
+// Nodes returns the nodes ordered by name, the address of alias node is resolved.
+func (c *Cluster) Nodes() []Node {
+	ns := make([]Node, 0, len(c.nodePing))
+	for node, p := range c.nodePing {
+		ns = append(ns, c.node(node, int(atomic.LoadInt32(&p.weight))))
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Name < ns[j].Name })
+	return ns
+}
+
+// node returns the node of name with weight, the address of alias node is resolved.
+func (c *Cluster) node(name string, weight int) Node {
+	addr := name
+	if c.alias {
+		addr = c.nodeAlias[name]
+	}
+	return Node{Name: name, Addr: addr, Weight: weight}
+}
+
+// BackendConns returns the active backend connections of all nodes.
+func (c *Cluster) BackendConns() int {
+	return c.limiter.Active()
+}
+
+// hashKey returns the bytes of key hashed, the hash tag when extracted from the key requested,
+// else the key on the wire, that is rewritten by rules and prefixed.
+func (c *Cluster) hashKey(key []byte) (realKey []byte, tagged bool) {
 	if len(c.hashTag) == 2 {
 		if b := bytes.IndexByte(key, c.hashTag[0]); b >= 0 {
 			if e := bytes.IndexByte(key[b+1:], c.hashTag[1]); e >= 0 {
@@ -195,11 +999,47 @@ func (c *Cluster) hash(key []byte) (node string, ok bool) {
 			}
 		}
 	}
-	if len(realKey) == 0 {
-		realKey = key
+	if len(realKey) > 0 {
+		return realKey, true
 	}
-	node, ok = c.ring.Hash(realKey)
-	return
+	realKey = memcache.RewriteKey(c.rules, key)
+	if len(c.prefix) > 0 {
+		realKey = append(append(make([]byte, 0, len(c.prefix)+len(realKey)), c.prefix...), realKey...) // NOTE: hash the key on the wire
+	}
+	return realKey, false
+}
+
+// Route is the routing explanation of key.
+// NOTE: no replicas, one key is served by one node only.
+type Route struct {
+	Key     string `json:"key"`
+	HashTag string `json:"hash_tag"` // NOTE: empty when no hash tag extracted
+	HashKey string `json:"hash_key"`
+	Hash    uint   `json:"hash"`
+	Point   uint   `json:"point"` // NOTE: the point of ring hit, the first one not less than hash
+	Node    string `json:"node"`
+	Addr    string `json:"addr"`
+}
+
+// Route returns the routing explanation of key, ok is false when no node or not distributed by ketama.
+func (c *Cluster) Route(key string) (r *Route, ok bool) {
+	ks, ok := c.selector.(*ketamaSelector)
+	if !ok {
+		return nil, false
+	}
+	realKey, tagged := c.hashKey([]byte(key))
+	r = &Route{Key: key, HashKey: string(realKey)}
+	if tagged {
+		r.HashTag = r.HashKey
+	}
+	if r.Node, r.Hash, r.Point, ok = ks.ring.Locate(realKey); !ok {
+		return nil, false
+	}
+	r.Addr = r.Node
+	if c.alias {
+		r.Addr = c.nodeAlias[r.Node]
+	}
+	return r, true
 }
 
 // get returns proto handler by node name.
@@ -211,7 +1051,9 @@ func (c *Cluster) get(node string) (h proto.Handler, err error) {
 	}
 	tmp := p.Get()
 	if h, ok = tmp.(proto.Handler); !ok {
-		err = ErrClusterHashNoNode
+		if err = tmp.Close(); err == nil { // NOTE: the error connection closes with the pool error, like: ErrPoolLimited
+			err = ErrClusterHashNoNode
+		}
 	}
 	return
 }
@@ -226,7 +1068,11 @@ func (c *Cluster) put(node string, h proto.Handler, err error) {
 	if !ok {
 		return
 	}
-	p.Put(conn, err != nil)
+	stale := false
+	if s, ok := h.(proto.Staler); ok && s.Stale() {
+		stale = true // NOTE: recycled rather than idle, like: the server hinted to reconnect
+	}
+	p.Put(conn, err != nil || stale)
 }
 
 // Close closes resources.
@@ -237,15 +1083,24 @@ func (c *Cluster) Close() error {
 		return nil
 	}
 	c.closed = true
+	c.ringLog.stop()
 	for _, p := range c.nodePing {
 		p.ping.Close()
 	}
 	for _, p := range c.nodePool {
 		p.Close()
 	}
+	if c.record != nil {
+		c.record.Close()
+	}
+	if c.tier != nil {
+		c.tier.Close()
+	}
 	return nil
 }
 
+// keepAlive pings the nodes and ejects the failed ones from hashing when auto eject.
+// NOTE: ejection only stops new routing, the in-flight requests finish on their connections.
 func (c *Cluster) keepAlive() {
 	var period = func(p *pinger) {
 		del := false
@@ -255,12 +1110,14 @@ func (c *Cluster) keepAlive() {
 				p.retries = 0
 			} else {
 				p.failure = 0
-				if del {
-					c.ring.AddNode(p.node, p.weight)
+				if w := atomic.LoadInt32(&p.weight); del && w > 0 {
+					c.selector.AddNode(c.node(p.node, int(w)))
+					c.ringLog.changed("readd")
 				}
 			}
 			if c.cc.PingAutoEject && p.failure >= c.cc.PingFailLimit {
-				c.ring.DelNode(p.node)
+				c.selector.RemoveNode(p.node)
+				c.ringLog.changed("eject")
 				del = true
 			}
 			select {
@@ -308,7 +1165,7 @@ func parseServers(svrs []string) (addrs []string, ws []int, ans []string, alias
 		}
 		addrs = append(addrs, net.JoinHostPort(ss[0], ss[1]))
 		w, we := conv.Btoi([]byte(ss[2]))
-		if we != nil || w <= 0 {
+		if we != nil || w < 0 {
 			err = ErrClusterServerFormat
 			return
 		}
@@ -317,14 +1174,64 @@ func parseServers(svrs []string) (addrs []string, ws []int, ans []string, alias
 	return
 }
 
-func newPool(cc *ClusterConfig, addr string) *pool.Pool {
+// parseEncryptKeys parses the keys as 'version:hex key', the last one is current.
+func parseEncryptKeys(keys []string) (kr *memcache.Keyring, err error) {
+	for _, key := range keys {
+		ss := strings.Split(key, ":")
+		if len(ss) != 2 {
+			err = ErrClusterEncryptKey
+			return
+		}
+		v, ve := strconv.ParseUint(ss[0], 10, 8)
+		bs, be := hex.DecodeString(ss[1])
+		if ve != nil || be != nil {
+			err = ErrClusterEncryptKey
+			return
+		}
+		if kr == nil {
+			kr, err = memcache.NewKeyring(byte(v), bs)
+		} else {
+			err = kr.Rotate(byte(v), bs)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// parseKeyRules parses the key rules in order, like: lower, hash:<max>, replace:<old>:<new>.
+func parseKeyRules(rules []string) (krs []memcache.KeyRule, err error) {
+	for _, rule := range rules {
+		ss := strings.SplitN(rule, ":", 3)
+		switch {
+		case ss[0] == "lower" && len(ss) == 1:
+			krs = append(krs, memcache.KeyLower())
+		case ss[0] == "hash" && len(ss) == 2:
+			max, ie := strconv.Atoi(ss[1])
+			if ie != nil || max <= 0 {
+				err = errors.Wrapf(ErrClusterKeyRule, "Cluster key rule(%s)", rule)
+				return
+			}
+			krs = append(krs, memcache.KeyHash(max))
+		case ss[0] == "replace" && len(ss) == 3 && ss[1] != "":
+			krs = append(krs, memcache.KeyReplacePrefix(ss[1], ss[2]))
+		default:
+			err = errors.Wrapf(ErrClusterKeyRule, "Cluster key rule(%s)", rule)
+			return
+		}
+	}
+	return
+}
+
+func newPool(cc *ClusterConfig, addr string, l *pool.Limiter, gate *pool.Gate, dos ...*memcache.DialOption) *pool.Pool {
 	var dial *pool.PoolOption
 	dto := time.Duration(cc.DialTimeout) * time.Millisecond
 	rto := time.Duration(cc.ReadTimeout) * time.Millisecond
 	wto := time.Duration(cc.WriteTimeout) * time.Millisecond
 	switch cc.CacheType {
 	case proto.CacheTypeMemcache:
-		dial = pool.PoolDial(memcache.Dial(cc.Name, addr, dto, rto, wto))
+		dial = pool.PoolDial(memcache.Dial(cc.Name, addr, dto, rto, wto, dos...))
 	case proto.CacheTypeRedis:
 		// TODO(felix): support redis
 	default:
@@ -334,16 +1241,57 @@ func newPool(cc *ClusterConfig, addr string) *pool.Pool {
 	idle := pool.PoolIdle(cc.PoolIdle)
 	idleTo := pool.PoolIdleTimeout(time.Duration(cc.PoolIdleTimeout) * time.Millisecond)
 	wait := pool.PoolWait(cc.PoolGetWait)
-	return pool.NewPool(dial, act, idle, idleTo, wait)
+	ping := pool.PoolIdlePing(time.Duration(cc.PoolIdlePing)*time.Millisecond, func(conn pool.Conn) error {
+		if p, ok := conn.(proto.Pinger); ok {
+			return p.Ping()
+		}
+		return nil
+	})
+	mi := cc.PoolMinIdle
+	if n, ok := cc.ServerMinIdle[addr]; ok {
+		mi = n // NOTE: per server, like: keeps the rarely-accessed one warm
+	}
+	minIdle := pool.PoolMinIdle(mi)
+	borrow := pool.PoolTestOnBorrow(func(conn pool.Conn, _ time.Time) error {
+		if s, ok := conn.(proto.Staler); ok && s.Stale() {
+			return ErrClusterConnStale
+		}
+		if c, ok := conn.(proto.Checker); ok && cc.PoolCheckAlive && !c.Alive() {
+			return ErrClusterConnDead
+		}
+		return nil
+	})
+	if cc.DialConcurrency > 0 || gate != nil {
+		gate = pool.NewGate(cc.DialConcurrency, gate) // NOTE: per server
+	}
+	stat.PoolConns(cc.Name, addr, 0, 0, cc.PoolActive)
+	change := pool.PoolChange(func(active, idle int) {
+		stat.PoolConns(cc.Name, addr, active, idle, cc.PoolActive)
+		if cc.PoolOverflow > 0 {
+			overflow := active - cc.PoolActive
+			if overflow < 0 {
+				overflow = 0
+			}
+			stat.PoolOverflow(cc.Name, addr, active-overflow, overflow)
+		}
+	})
+	slow := pool.PoolSlowStart(time.Duration(cc.PoolSlowStart) * time.Millisecond)
+	overflowTo := time.Duration(cc.PoolOverflowIdle) * time.Millisecond
+	if overflowTo <= 0 {
+		overflowTo = defaultPoolOverflowIdle
+	}
+	overflow := pool.PoolOverflow(cc.PoolOverflow, overflowTo)
+	lifetime := pool.PoolMaxLifetime(time.Duration(cc.PoolMaxLifetime)*time.Millisecond, float64(cc.PoolJitter)/100)
+	return pool.NewPool(dial, act, idle, idleTo, wait, ping, minIdle, borrow, pool.PoolLimiter(l), pool.PoolDialGate(gate), change, slow, overflow, lifetime)
 }
 
-func newPinger(cc *ClusterConfig, addr string) proto.Pinger {
+func newPinger(cc *ClusterConfig, addr string, pos ...*memcache.PingerOption) proto.Pinger {
 	dto := time.Duration(cc.DialTimeout) * time.Millisecond
 	rto := time.Duration(cc.ReadTimeout) * time.Millisecond
 	wto := time.Duration(cc.WriteTimeout) * time.Millisecond
 	switch cc.CacheType {
 	case proto.CacheTypeMemcache:
-		return memcache.NewPinger(addr, dto, rto, wto)
+		return memcache.NewPinger(addr, dto, rto, wto, pos...)
 	case proto.CacheTypeRedis:
 		// TODO(felix): support redis
 	default:
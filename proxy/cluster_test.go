@@ -0,0 +1,1571 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/lib/log"
+	"github.com/felixhao/overlord/lib/pool"
+	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/proto"
+	"github.com/felixhao/overlord/proto/memcache"
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+	"github.com/pkg/errors"
+)
+
+func newTestCluster(t *testing.T, addrs ...string) (*proxy.Cluster, *proxy.ClusterConfig) {
+	cc := *ccs[0]
+	cc.Servers = nil
+	for _, addr := range addrs {
+		cc.Servers = append(cc.Servers, addr+":1")
+	}
+	return proxy.NewCluster(context.Background(), &cc), &cc
+}
+
+func newRequest(t *testing.T, cmd string) *proto.Request {
+	req, err := memcache.NewDecoder(bytes.NewBufferString(cmd)).Decode()
+	if err != nil {
+		t.Fatalf("decode cmd(%q) error:%v", cmd, err)
+	}
+	req.Process()
+	return req
+}
+
+func TestClusterOutstanding(t *testing.T) {
+	block := make(chan struct{})
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			<-block
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	c, _ := newTestCluster(t, addr)
+	defer c.Close()
+	req := newRequest(t, "get a_out\r\n")
+	c.Dispatch(req)
+	for i := 0; c.Outstanding(addr) != 1; i++ {
+		if i > 100 {
+			t.Fatalf("outstanding(%d) want 1", c.Outstanding(addr))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(block)
+	req.Wait()
+	if n := c.Outstanding(addr); n != 0 {
+		t.Errorf("outstanding(%d) want 0 after done", n)
+	}
+}
+
+func TestClusterBackendConnsLimited(t *testing.T) {
+	block := make(chan struct{})
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			<-block
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive, cc.PoolIdle = 4, 4
+	cc.MaxBackendConns = 1
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	wait := func(req *proto.Request) bool {
+		done := make(chan struct{})
+		go func() {
+			req.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+	first := newRequest(t, "get a_first\r\n")
+	c.Dispatch(first)
+	for i := 0; c.Outstanding(addr) != 1; i++ {
+		if i > 100 {
+			t.Fatalf("outstanding(%d) want 1", c.Outstanding(addr))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ { // NOTE: the other workers meet the cap
+		req := newRequest(t, "get a_limited\r\n")
+		c.Dispatch(req)
+		if !wait(req) {
+			t.Fatalf("limited request(%d) hung", i)
+		}
+		if err := req.Resp.Err(); errors.Cause(err) != pool.ErrPoolLimited {
+			t.Errorf("limited request(%d) error(%v) want pool limited", i, err)
+		}
+	}
+	close(block)
+	if !wait(first) || first.Resp.Err() != nil {
+		t.Fatalf("first request not served")
+	}
+	for i := 0; i < 8; i++ { // NOTE: the workers met the cap still serve
+		req := newRequest(t, "get a_after\r\n")
+		c.Dispatch(req)
+		if !wait(req) {
+			t.Fatalf("request(%d) after the cap hung", i)
+		}
+		if err := req.Resp.Err(); err != nil || req.Resp.Status() != "MISS" {
+			t.Errorf("request(%d) after the cap status(%s) error(%v) want served", i, req.Resp.Status(), err)
+		}
+	}
+}
+
+func TestClusterFailOpen(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		bufio.NewReader(conn).ReadSlice('\n')
+		conn.Close() // NOTE: the backend fails every request
+	})
+	defer closer()
+	for _, failOpen := range []bool{false, true} {
+		c, cc := newTestCluster(t, addr)
+		cc.FailOpen = failOpen
+		get := newRequest(t, "get a_fail\r\n")
+		c.Dispatch(get)
+		get.Wait()
+		if failOpen {
+			if err := get.Resp.Err(); err != nil || get.Resp.Status() != "MISS" {
+				t.Errorf("fail open get status(%s) error(%v) want MISS", get.Resp.Status(), err)
+			}
+		} else if get.Resp.Err() == nil {
+			t.Errorf("fail closed get status(%s) want error", get.Resp.Status())
+		}
+		set := newRequest(t, "set a_fail 0 0 1\r\n1\r\n")
+		c.Dispatch(set)
+		set.Wait()
+		if set.Resp.Err() == nil {
+			t.Errorf("fail open(%v) set status(%s) want error", failOpen, set.Resp.Status())
+		}
+		c.Close()
+	}
+}
+
+// testLog captures the logs of all tests, installed before the mock proxy serving.
+var testLog = &captureLog{}
+
+type captureLog struct {
+	lock sync.Mutex
+	msgs []string
+}
+
+func (l *captureLog) Log(lv log.Level, msg string) {
+	l.lock.Lock()
+	l.msgs = append(l.msgs, msg)
+	l.lock.Unlock()
+}
+
+func (l *captureLog) Close() error { return nil }
+
+// ringLogs returns the ring layout logs of cluster.
+func (l *captureLog) ringLogs(cluster string) (msgs []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, msg := range l.msgs {
+		if strings.HasPrefix(msg, "cluster("+cluster+") hash ring changed") {
+			msgs = append(msgs, msg)
+		}
+	}
+	return
+}
+
+func TestClusterRingLog(t *testing.T) {
+	cl := testLog
+	serve := func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte("VERSION 1.5.0\r\n"))
+		}
+	}
+	a, closerA := memcachetest.Backend(t, serve)
+	defer closerA()
+	b, closerB := memcachetest.Backend(t, serve)
+	defer closerB()
+	cc := *ccs[0]
+	cc.Name = "ring-log"
+	cc.Servers = []string{a + ":1", b + ":1"}
+	cc.RingLogInterval = 50
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	waitLogs := func(n int) []string {
+		for i := 0; ; i++ {
+			msgs := cl.ringLogs(cc.Name)
+			if len(msgs) >= n || i > 20 {
+				return msgs
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	msgs := waitLogs(1)
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "event(init) nodes(2) points(510)") {
+		t.Fatalf("init ring logs(%q) want the layout of 2 nodes", msgs)
+	}
+	c.SetWeight(b, 0) // NOTE: within interval, delayed
+	c.SetWeight(a, 1) // NOTE: not changed
+	msgs = waitLogs(2)
+	if len(msgs) != 2 || !strings.Contains(msgs[1], "event(weight,weight) nodes(1) points(255) layout("+a+"=255)") {
+		t.Fatalf("remove node ring logs(%q) want the layout of 1 node", msgs)
+	}
+	c.SetWeight(b, 2)
+	msgs = waitLogs(3)
+	if len(msgs) != 3 || !strings.Contains(msgs[2], "nodes(2) points(765)") || !strings.Contains(msgs[2], b+"=510") {
+		t.Fatalf("add node ring logs(%q) want the layout of 2 nodes", msgs)
+	}
+	c.SetWeight(b, 2)
+	time.Sleep(100 * time.Millisecond)
+	if msgs = cl.ringLogs(cc.Name); len(msgs) != 3 {
+		t.Errorf("unchanged ring logs(%q) want no new log", msgs)
+	}
+}
+
+func TestClusterPartialFailure(t *testing.T) {
+	serve := func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(bs, "get ") {
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+				continue
+			}
+			key := bs[4 : len(bs)-2]
+			conn.Write([]byte("VALUE " + key + " 0 1\r\n1\r\nEND\r\n"))
+		}
+	}
+	a, closerA := memcachetest.Backend(t, serve)
+	defer closerA()
+	b, closerB := memcachetest.Backend(t, serve)
+	defer closerB()
+	bad, closerBad := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(bs, "get ") {
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+				continue
+			}
+			conn.Close() // NOTE: the backend fails every get
+			return
+		}
+	})
+	defer closerBad()
+	c, _ := newTestCluster(t, a, b, bad)
+	defer c.Close()
+	keys := make([]string, 30)
+	for i := range keys {
+		keys[i] = "a_partial_" + strconv.Itoa(i)
+	}
+	req := newRequest(t, "get "+strings.Join(keys, " ")+"\r\n")
+	subs, resp := req.Batch()
+	for i := range subs {
+		subs[i].Process()
+		c.Dispatch(&subs[i])
+	}
+	req.BatchWait()
+	resp.Merge(subs)
+	if err := resp.Err(); err != nil {
+		t.Fatalf("merged response error:%v", err)
+	}
+	pes := resp.Partial()
+	if len(pes) == 0 || len(pes) == len(keys) {
+		t.Fatalf("partial failures(%d) want some of %d keys", len(pes), len(keys))
+	}
+	failed := map[string]bool{}
+	for _, pe := range pes {
+		if pe.Node != bad || pe.Err == nil {
+			t.Errorf("key(%s) failed by node(%s) error(%v) want node(%s)", pe.Key, pe.Node, pe.Err, bad)
+		}
+		failed[string(pe.Key)] = true
+	}
+	var buf bytes.Buffer
+	if err := memcache.NewEncoder(&buf).Encode(resp); err != nil {
+		t.Fatalf("encode merged response error:%v", err)
+	}
+	for _, key := range keys {
+		if hit := strings.Contains(buf.String(), "VALUE "+key+" "); hit == failed[key] {
+			t.Errorf("key(%s) hit(%v) failed(%v), want the keys not failed be hit", key, hit, failed[key])
+		}
+	}
+}
+
+func TestClusterHotKeyShed(t *testing.T) {
+	block := make(chan struct{})
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(bs, "get ") {
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+				continue
+			}
+			<-block
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.HotKeyThreshold = 5
+	cc.HotKeyShed = 1
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	first := newRequest(t, "get a_hot\r\n")
+	c.Dispatch(first)
+	for i := 0; c.Outstanding(addr) < 1; i++ {
+		if i > 100 {
+			t.Fatalf("outstanding(%d) want 1", c.Outstanding(addr))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var reqs []*proto.Request
+	for i := 0; i < 9; i++ {
+		req := newRequest(t, "get a_hot\r\n")
+		c.Dispatch(req)
+		reqs = append(reqs, req)
+	}
+	cold := newRequest(t, "get a_cold\r\n")
+	c.Dispatch(cold)
+	close(block)
+	for i, req := range append([]*proto.Request{first}, reqs...) {
+		req.Wait()
+		shed := errors.Cause(req.Resp.Err()) == proxy.ErrClusterHotKey
+		if want := i+1 >= 5; shed != want {
+			t.Errorf("hot key request(%d) shed(%v) error(%v) want shed(%v)", i+1, shed, req.Resp.Err(), want)
+		}
+	}
+	cold.Wait()
+	if err := cold.Resp.Err(); err != nil {
+		t.Errorf("cold key request error(%v) want served", err)
+	}
+}
+
+func TestClusterPoolCheckAlive(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(bs, "get ") {
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+				continue
+			}
+			conn.Write([]byte("END\r\n"))
+			time.Sleep(10 * time.Millisecond)
+			conn.Close() // NOTE: closed while idle in pool
+			return
+		}
+	})
+	defer closer()
+	for _, check := range []bool{false, true} {
+		cc := *ccs[0]
+		cc.Servers = []string{addr + ":1"}
+		cc.PoolActive = 1
+		cc.PoolCheckAlive = check
+		c := proxy.NewCluster(context.Background(), &cc)
+		for i := 0; i < 2; i++ {
+			req := newRequest(t, "get a_alive\r\n")
+			c.Dispatch(req)
+			req.Wait()
+			if err := req.Resp.Err(); (err == nil) != (i == 0 || check) {
+				t.Errorf("check(%v) request(%d) error(%v)", check, i, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		c.Close()
+	}
+}
+
+func TestClusterEjectInflight(t *testing.T) {
+	var (
+		fail  int32
+		block = make(chan struct{})
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(bs, "get "):
+				<-block
+				conn.Write([]byte("END\r\n"))
+			case strings.HasPrefix(bs, "set ping "):
+				br.ReadString('\n')
+				if atomic.LoadInt32(&fail) == 1 {
+					conn.Write([]byte("SERVER_ERROR out of memory\r\n"))
+				} else {
+					conn.Write([]byte("STORED\r\n"))
+				}
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PingAutoEject = true
+	cc.PingFailLimit = 1
+	cc.ReadTimeout = 5000 // NOTE: in-flight across the ejection
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	var reqs []*proto.Request
+	for i := 0; i < 3; i++ {
+		req := newRequest(t, "get a_eject\r\n")
+		c.Dispatch(req)
+		reqs = append(reqs, req)
+	}
+	for i := 0; c.Outstanding(addr) != 3; i++ {
+		if i > 100 {
+			t.Fatalf("outstanding(%d) want 3", c.Outstanding(addr))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(1500 * time.Millisecond) // NOTE: the next ping after backoff fails, then ejected
+	probe := newRequest(t, "get a_eject\r\n")
+	c.Dispatch(probe)
+	probe.Wait()
+	if errors.Cause(probe.Resp.Err()) != proxy.ErrClusterHashNoNode {
+		t.Fatalf("request after ejected error(%v) want hash no node", probe.Resp.Err())
+	}
+	close(block)
+	for i, req := range reqs {
+		req.Wait()
+		if err := req.Resp.Err(); err != nil || req.Resp.Status() != "MISS" {
+			t.Errorf("in-flight request(%d) status(%s) error(%v) want completed", i, req.Resp.Status(), err)
+		}
+	}
+}
+
+func TestClusterSetWeight(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		keys  = map[string]bool{} // NOTE: keys received by node a
+		hold  = make(chan struct{})
+		held  = make(chan struct{})
+		holdK string
+		open  int32 // NOTE: pool conns, the pinger one is not counted
+	)
+	a, closerA := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for n := 0; ; n++ {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(bs, "get ") {
+				conn.Write([]byte("VERSION 1\r\n"))
+				continue
+			}
+			if n == 0 {
+				atomic.AddInt32(&open, 1)
+				defer atomic.AddInt32(&open, -1)
+			}
+			key := bs[4 : len(bs)-2]
+			lock.Lock()
+			keys[key] = true
+			block := key == holdK
+			lock.Unlock()
+			if block {
+				close(held)
+				<-hold
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closerA()
+	b, closerB := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closerB()
+	cc := *ccs[0]
+	cc.Servers = []string{a + ":1", b + ":1"}
+	cc.PoolActive, cc.PoolIdle = 1, 1 // NOTE: one worker of node, the next request queued behind the in-flight one
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	get := func(key string) *proto.Request {
+		req := newRequest(t, "get "+key+"\r\n")
+		c.Dispatch(req)
+		return req
+	}
+	for i := 0; i < 20; i++ {
+		get("w_" + strconv.Itoa(i)).Wait()
+	}
+	var queuedK string
+	lock.Lock()
+	for k := range keys {
+		if holdK == "" {
+			holdK = k
+		} else {
+			queuedK = k
+		}
+	}
+	lock.Unlock()
+	if queuedK == "" {
+		t.Fatal("less than 2 keys routed to node a")
+	}
+	inflight := get(holdK)
+	<-held
+	queued := get(queuedK)
+	if err := c.SetWeight(a, 0); err != nil {
+		t.Fatalf("set weight error:%v", err)
+	}
+	lock.Lock()
+	keys = map[string]bool{}
+	lock.Unlock()
+	for i := 0; i < 20; i++ {
+		get("w_" + strconv.Itoa(i)).Wait()
+	}
+	lock.Lock()
+	if len(keys) != 0 {
+		t.Errorf("keys(%v) routed to weight 0 node", keys)
+	}
+	lock.Unlock()
+	close(hold)
+	inflight.Wait()
+	if err := inflight.Resp.Err(); err != nil {
+		t.Errorf("in-flight request error:%v", err)
+	}
+	queued.Wait()
+	if err := queued.Resp.Err(); err != nil {
+		t.Errorf("queued request error:%v want served before drained", err)
+	}
+	for i := 0; atomic.LoadInt32(&open) != 0; i++ {
+		if i > 100 {
+			t.Fatalf("node a open conns(%d) want drained", atomic.LoadInt32(&open))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// NOTE: the node of weight restored serves again
+	if err := c.SetWeight(a, 1); err != nil {
+		t.Fatalf("set weight error:%v", err)
+	}
+	lock.Lock()
+	keys = map[string]bool{}
+	lock.Unlock()
+	restored := get(queuedK)
+	done := make(chan struct{})
+	go func() {
+		restored.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request after weight restored hung")
+	}
+	if err := restored.Resp.Err(); err != nil {
+		t.Errorf("request after weight restored error:%v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !keys[queuedK] {
+		t.Errorf("key(%s) want served by node a after weight restored", queuedK)
+	}
+}
+
+func TestClusterBatchWindow(t *testing.T) {
+	var pipelined int32
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if br.Buffered() > 0 {
+				atomic.StoreInt32(&pipelined, 1) // NOTE: more requests arrived with this one
+			}
+			fs := strings.Fields(bs)
+			switch fs[0] {
+			case "set":
+				br.ReadString('\n')
+				conn.Write([]byte("STORED\r\n"))
+			case "get":
+				if strings.HasSuffix(fs[1], "_hit") {
+					conn.Write([]byte("VALUE " + fs[1] + " 0 " + strconv.Itoa(len(fs[1])) + "\r\n" + fs[1] + "\r\nEND\r\n"))
+				} else {
+					conn.Write([]byte("END\r\n"))
+				}
+			case "version":
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+			default:
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	defer closer()
+	c, cc := newTestCluster(t, addr)
+	defer c.Close()
+	cc.BatchWindow = 5000
+	var reqs []*proto.Request
+	var wants []string
+	for i := 0; i < 30; i++ {
+		k := "k" + strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			reqs = append(reqs, newRequest(t, "set "+k+" 0 0 1\r\n1\r\n"))
+			wants = append(wants, "STORED\r\n")
+		case 1:
+			k += "_hit"
+			reqs = append(reqs, newRequest(t, "get "+k+"\r\n"))
+			wants = append(wants, "VALUE "+k+" 0 "+strconv.Itoa(len(k))+"\r\n"+k+"\r\nEND\r\n")
+		default:
+			reqs = append(reqs, newRequest(t, "get "+k+"\r\n"))
+			wants = append(wants, "END\r\n")
+		}
+	}
+	for _, req := range reqs {
+		c.Dispatch(req)
+	}
+	for i, req := range reqs {
+		req.Wait()
+		var b bytes.Buffer
+		memcache.NewEncoder(&b).Encode(req.Resp)
+		if b.String() != wants[i] {
+			t.Errorf("request(%s) reply(%q) want(%q)", req.Key(), b.String(), wants[i])
+		}
+	}
+	if atomic.LoadInt32(&pipelined) != 1 {
+		t.Error("requests within batch window not pipelined")
+	}
+}
+
+func benchmarkClusterSet(b *testing.B, window int) {
+	addr, closer := memcachetest.Backend(b, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		bw := bufio.NewWriter(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			br.ReadSlice('\n')
+			bw.WriteString("STORED\r\n")
+			if br.Buffered() == 0 {
+				bw.Flush()
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PingAutoEject = false
+	cc.PoolActive = 4
+	cc.BatchWindow = window
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, _ := memcache.NewDecoder(bytes.NewBufferString("set a_bench 0 0 5\r\nbench\r\n")).Decode()
+			req.Process()
+			c.Dispatch(req)
+			req.Wait()
+		}
+	})
+}
+
+func BenchmarkClusterSet(b *testing.B) {
+	b.Run("NoBatch", func(b *testing.B) { benchmarkClusterSet(b, 0) })
+	b.Run("BatchWindow200us", func(b *testing.B) { benchmarkClusterSet(b, 200) })
+}
+
+func TestClusterPriority(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		order []string
+		held  = make(chan struct{})
+		hold  = make(chan struct{})
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(bs, "get ") {
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+				continue
+			}
+			key := bs[4 : len(bs)-2]
+			if key == "p_hold" {
+				close(held)
+				<-hold
+			} else {
+				lock.Lock()
+				order = append(order, key)
+				lock.Unlock()
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive = 1 // NOTE: one worker, the others queue behind the held one
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	first := newRequest(t, "get p_hold\r\n")
+	c.Dispatch(first)
+	<-held
+	var reqs []*proto.Request
+	for _, p := range []proto.Priority{proto.PriorityLow, proto.PriorityNormal, proto.PriorityHigh, proto.PriorityLow, proto.PriorityHigh} {
+		req := newRequest(t, "get p_"+p.String()+strconv.Itoa(len(reqs))+"\r\n")
+		req.WithPriority(p)
+		c.Dispatch(req)
+		reqs = append(reqs, req)
+	}
+	close(hold)
+	first.Wait()
+	for _, req := range reqs {
+		req.Wait()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"p_high2", "p_high4", "p_normal1", "p_low0", "p_low3"}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Errorf("served order(%v) want(%v)", order, want)
+	}
+}
+
+func TestClusterTiming(t *testing.T) {
+	const (
+		think = 50 * time.Millisecond
+		read  = 30 * time.Millisecond
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			time.Sleep(think)
+			conn.Write([]byte("VALUE a_timing 0 5\r\n"))
+			time.Sleep(read)
+			conn.Write([]byte("hello\r\nEND\r\n"))
+		}
+	})
+	defer closer()
+	c, _ := newTestCluster(t, addr)
+	defer c.Close()
+	for i, dialed := range []bool{true, false} {
+		req := newRequest(t, "get a_timing\r\n")
+		tm := &proto.Timing{}
+		req.WithTiming(tm)
+		c.Dispatch(req)
+		req.Wait()
+		total := req.Since()
+		if err := req.Resp.Err(); err != nil {
+			t.Fatalf("request(%d) error:%v", i, err)
+		}
+		if (tm.Dial > 0) != dialed || tm.Dial > tm.PoolWait {
+			t.Errorf("request(%d) dial(%v) pool wait(%v) want dialed(%v)", i, tm.Dial, tm.PoolWait, dialed)
+		}
+		if tm.Start.IsZero() || tm.Write <= 0 || tm.Think < think || tm.Read < read {
+			t.Errorf("request(%d) timing(%+v) phases not populated", i, tm)
+		}
+		if sum := tm.PoolWait + tm.Write + tm.Think + tm.Read; sum > total || total-sum > 20*time.Millisecond {
+			t.Errorf("request(%d) phases sum(%v) total(%v) want roughly equal", i, sum, total)
+		}
+	}
+}
+
+func TestClusterAdaptiveLimit(t *testing.T) {
+	var latency int64 // NOTE: atomic, in msec
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			time.Sleep(time.Duration(atomic.LoadInt64(&latency)) * time.Millisecond)
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.AdaptiveLatency = 10
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	get := func() {
+		req := newRequest(t, "get a_adaptive\r\n")
+		c.Dispatch(req)
+		req.Wait()
+		if err := req.Resp.Err(); err != nil {
+			t.Fatalf("request error:%v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		get()
+	}
+	if limit := c.ConcurrencyLimit(addr); limit != cc.PoolActive {
+		t.Fatalf("healthy limit(%d) want(%d)", limit, cc.PoolActive)
+	}
+	last := cc.PoolActive
+	for i := 0; i < 5; i++ {
+		atomic.AddInt64(&latency, 10) // NOTE: rising latency
+		get()
+		if limit := c.ConcurrencyLimit(addr); limit >= last {
+			t.Fatalf("limit(%d) not shrunk from(%d) by latency(%dms)", limit, last, atomic.LoadInt64(&latency))
+		}
+		last = c.ConcurrencyLimit(addr)
+	}
+}
+
+func TestClusterRequestTimeout(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			time.Sleep(60 * time.Millisecond)
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive = 1
+	cc.RequestTimeout = 100
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	start := time.Now()
+	first := newRequest(t, "get a_timeout1\r\n")
+	second := newRequest(t, "get a_timeout2\r\n")
+	c.Dispatch(first)
+	c.Dispatch(second) // NOTE: waits 60ms for the only connection, then reads 60ms
+	first.Wait()
+	if err := first.Resp.Err(); err != nil {
+		t.Fatalf("first request error:%v", err)
+	}
+	second.Wait()
+	took := time.Since(start)
+	if errors.Cause(second.Resp.Err()) != proxy.ErrClusterTimeout {
+		t.Fatalf("second request error:%v want timeout", second.Resp.Err())
+	}
+	if took < 100*time.Millisecond || took > 150*time.Millisecond {
+		t.Fatalf("second request failed after %v want about 100ms", took)
+	}
+	req := newRequest(t, "get a_timeout3\r\n")
+	c.Dispatch(req)
+	req.Wait()
+	if err := req.Resp.Err(); err != nil {
+		t.Fatalf("request after timeout error:%v", err)
+	}
+}
+
+func TestClusterCasRecheck(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		dropped = map[string]bool{}
+		stored  = map[string]int{}
+		tokens  = map[string]string{"a_same": "181", "a_changed": "182"} // NOTE: the cas of client is 181
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fs := strings.Fields(line)
+			switch fs[0] {
+			case "gets":
+				if token, ok := tokens[fs[1]]; ok {
+					conn.Write([]byte("VALUE " + fs[1] + " 0 1 " + token + "\r\nx\r\n"))
+				}
+				conn.Write([]byte("END\r\n"))
+			case "cas":
+				if _, err = br.ReadString('\n'); err != nil {
+					return
+				}
+				lock.Lock()
+				drop := !dropped[fs[1]]
+				dropped[fs[1]] = true
+				if !drop {
+					stored[fs[1]]++
+				}
+				lock.Unlock()
+				if drop {
+					return // NOTE: connection dropped during cas
+				}
+				conn.Write([]byte("STORED\r\n"))
+			}
+		}
+	})
+	defer closer()
+	c, _ := newTestCluster(t, addr)
+	defer c.Close()
+	for key, want := range map[string]string{"a_same": "STORED", "a_changed": "EXISTS", "a_gone": "NOT_FOUND"} {
+		req := newRequest(t, "cas "+key+" 0 0 1 181\r\ny\r\n")
+		c.Dispatch(req)
+		req.Wait()
+		if err := req.Resp.Err(); err != nil {
+			t.Fatalf("cas %s error:%v", key, err)
+		}
+		if status := req.Resp.Status(); status != want {
+			t.Errorf("cas %s reply(%s) want(%s)", key, status, want)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if stored["a_same"] != 1 || stored["a_changed"] != 0 || stored["a_gone"] != 0 {
+		t.Errorf("cas retried(%v) want only the unchanged item once", stored)
+	}
+}
+
+// prefixSelector selects the node by the first byte of key, the removed nodes are skipped.
+type prefixSelector struct {
+	lock    sync.Mutex
+	nodes   []proxy.Node
+	removed map[string]bool
+}
+
+func (s *prefixSelector) Select(req *proto.Request) (proxy.Node, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ns []proxy.Node
+	for _, n := range s.nodes {
+		if !s.removed[n.Name] {
+			ns = append(ns, n)
+		}
+	}
+	if len(ns) == 0 {
+		return proxy.Node{}, proxy.ErrClusterHashNoNode
+	}
+	return ns[int(req.Key()[0])%len(ns)], nil
+}
+
+func (s *prefixSelector) AddNode(n proxy.Node) {
+	s.lock.Lock()
+	delete(s.removed, n.Name)
+	s.lock.Unlock()
+}
+
+func (s *prefixSelector) RemoveNode(name string) {
+	s.lock.Lock()
+	s.removed[name] = true
+	s.lock.Unlock()
+}
+
+func (s *prefixSelector) Update(ns []proxy.Node) {
+	s.lock.Lock()
+	s.nodes = ns
+	s.lock.Unlock()
+}
+
+func TestClusterSelector(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		v := strconv.Itoa(i)
+		addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+			br := bufio.NewReader(conn)
+			for {
+				bs, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				key := strings.TrimSpace(strings.TrimPrefix(bs, "get "))
+				conn.Write([]byte("VALUE " + key + " 0 1\r\n" + v + "\r\nEND\r\n"))
+			}
+		})
+		defer closer()
+		addrs = append(addrs, addr)
+	}
+	sel := &prefixSelector{removed: map[string]bool{}}
+	proxy.RegisterSelector("prefix", func(c *proxy.Cluster) proxy.Selector { return sel })
+	cc := *ccs[0]
+	cc.HashDistribution = "prefix"
+	cc.Servers = []string{addrs[0] + ":1", addrs[1] + ":1"}
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	if len(sel.nodes) != 2 {
+		t.Fatalf("selector nodes(%v) want updated by the cluster", sel.nodes)
+	}
+	get := func(key string) string {
+		req := newRequest(t, "get "+key+"\r\n")
+		c.Dispatch(req)
+		req.Wait()
+		var b bytes.Buffer
+		memcache.NewEncoder(&b).Encode(req.Resp)
+		return b.String()
+	}
+	value := func(n proxy.Node) string {
+		if n.Addr == addrs[0] {
+			return "0"
+		}
+		return "1"
+	}
+	for _, key := range []string{"a_sel", "b_sel"} {
+		want := "VALUE " + key + " 0 1\r\n" + value(sel.nodes[int(key[0])%2]) + "\r\nEND\r\n"
+		if reply := get(key); reply != want {
+			t.Errorf("key(%s) reply(%q) want(%q) by the selector", key, reply, want)
+		}
+	}
+	removed := sel.nodes[0]
+	c.SetWeight(removed.Name, 0)
+	if reply := get("b_sel"); !strings.Contains(reply, "\r\n"+value(sel.nodes[1])+"\r\n") {
+		t.Errorf("reply(%q) want the node left after removed", reply)
+	}
+	c.SetWeight(removed.Name, 1)
+	if sel.removed[removed.Name] {
+		t.Errorf("node(%s) want added back", removed.Name)
+	}
+	cc.HashDistribution = "none"
+	func() {
+		defer func() {
+			if err := recover(); err == nil || errors.Cause(err.(error)) != proxy.ErrClusterSelector {
+				t.Errorf("new cluster recover(%v) want unsupported selector", err)
+			}
+		}()
+		proxy.NewCluster(context.Background(), &cc)
+	}()
+}
+
+func TestClusterCheckPending(t *testing.T) {
+	var conns int32
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		first := atomic.AddInt32(&conns, 1) == 1
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte("END\r\n"))
+			if first { // NOTE: the first connection desynced by a stale reply
+				conn.Write([]byte("VALUE a_stale 0 5\r\nstale\r\nEND\r\n"))
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive, cc.PoolIdle = 1, 1
+	cc.CheckPending = true
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		req := newRequest(t, "get a_pending\r\n")
+		c.Dispatch(req)
+		req.Wait()
+		if err := req.Resp.Err(); err != nil || req.Resp.Status() != "MISS" {
+			t.Fatalf("get(%d) error:%v status(%s) want miss", i, err, req.Resp.Status())
+		}
+		time.Sleep(50 * time.Millisecond) // NOTE: the stale reply arrived
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("conns(%d) want the poisoned one replaced", n)
+	}
+}
+
+func TestClusterCheckPendingBatch(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("END\r\n"))
+			if line == "get a_pending\r\n" { // NOTE: the connection desynced by a stale reply
+				conn.Write([]byte("VALUE a_stale 0 5\r\nstale\r\nEND\r\n"))
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive, cc.PoolIdle = 1, 1
+	cc.CheckPending = true
+	cc.BatchWindow = 5000
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	req := newRequest(t, "get a_pending\r\n")
+	c.Dispatch(req)
+	req.Wait()
+	time.Sleep(50 * time.Millisecond) // NOTE: the stale reply arrived
+	// NOTE: the batch meets the poisoned connection, and is retried by a fresh one
+	reqs := make([]*proto.Request, 3)
+	for i := range reqs {
+		reqs[i] = newRequest(t, "get a_batch_"+strconv.Itoa(i)+"\r\n")
+		c.Dispatch(reqs[i])
+	}
+	for i, req := range reqs {
+		req.Wait()
+		if err := req.Resp.Err(); err != nil || req.Resp.Status() != "MISS" {
+			t.Errorf("batch(%d) error:%v status(%s) want retried", i, err, req.Resp.Status())
+		}
+	}
+}
+
+func TestClusterReconnectErrors(t *testing.T) {
+	var conns int32
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		served := false
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(line, "delete") {
+				conn.Write([]byte("ERROR\r\n")) // NOTE: like the ping, not counted
+				continue
+			}
+			if !served {
+				served = true
+				atomic.AddInt32(&conns, 1)
+			}
+			if line == "delete a_hint\r\n" {
+				conn.Write([]byte("SERVER_ERROR please rebalance\r\n"))
+				continue
+			}
+			conn.Write([]byte("NOT_FOUND\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive, cc.PoolIdle = 1, 1
+	cc.ReconnectErrors = []string{"rebalance"}
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	for _, cmd := range []string{"delete a_keep\r\n", "delete a_keep\r\n", "delete a_hint\r\n", "delete a_next\r\n"} {
+		req := newRequest(t, cmd)
+		c.Dispatch(req)
+		req.Wait()
+		if err := req.Resp.Err(); err != nil {
+			t.Fatalf("cmd(%q) error:%v", cmd, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("conns(%d) want the hinted one recycled", n)
+	}
+}
+
+func TestClusterKeyRules(t *testing.T) {
+	cc := *ccs[0]
+	cc.Name = "rule-cluster"
+	cc.KeyPrefix = "svc:"
+	cc.KeyRules = []string{"replace:legacy_:v2_", "lower", "hash:32"}
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	if r, ok := c.Route("legacy_User"); !ok || r.HashKey != "svc:v2_user" {
+		t.Errorf("route(%+v) want hashing the rewritten key", r)
+	}
+	if r, ok := c.Route("legacy_" + strings.Repeat("K", 60)); !ok || len(r.HashKey) != len("svc:")+40 {
+		t.Errorf("route(%+v) want hashing the long key hashed", r)
+	}
+	for _, rules := range [][]string{{"upper"}, {"hash:x"}, {"replace::v2_"}} {
+		cc.KeyRules = rules
+		func() {
+			defer func() {
+				if err, _ := recover().(error); errors.Cause(err) != proxy.ErrClusterKeyRule {
+					t.Errorf("rules(%v) new error(%v) want ErrClusterKeyRule", rules, err)
+				}
+			}()
+			proxy.NewCluster(context.Background(), &cc).Close()
+		}()
+	}
+}
+
+func TestClusterAuthRotate(t *testing.T) {
+	var (
+		lock           sync.Mutex
+		served, closed []string // NOTE: the tokens of connections served and closed
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "set auth ") {
+			conn.Write([]byte("CLIENT_ERROR unauthenticated\r\n"))
+			conn.Close()
+			return
+		}
+		data, _ := br.ReadString('\n')
+		token := strings.Fields(data)[1]
+		conn.Write([]byte("STORED\r\n"))
+		first := true
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				lock.Lock()
+				if !first {
+					closed = append(closed, token)
+				}
+				lock.Unlock()
+				return
+			}
+			if !strings.HasPrefix(line, "delete") {
+				conn.Write([]byte("ERROR\r\n")) // NOTE: like the ping, not counted
+				continue
+			}
+			if first {
+				first = false
+				lock.Lock()
+				served = append(served, token)
+				lock.Unlock()
+			}
+			conn.Write([]byte("NOT_FOUND\r\n"))
+		}
+	})
+	defer closer()
+	f, err := ioutil.TempFile("", "overlord-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("svc token1\n")
+	f.Close()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive, cc.PoolIdle = 1, 1
+	cc.AuthFile = f.Name()
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	del := func() {
+		req := newRequest(t, "delete a_auth\r\n")
+		c.Dispatch(req)
+		req.Wait()
+		if err := req.Resp.Err(); err != nil {
+			t.Fatalf("delete error:%v", err)
+		}
+	}
+	del()
+	if err = ioutil.WriteFile(f.Name(), []byte("svc token2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(time.Minute) // NOTE: the modification time changed surely
+	os.Chtimes(f.Name(), mod, mod)
+	time.Sleep(1100 * time.Millisecond)
+	del()
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(served) != 2 || served[0] != "token1" || served[1] != "token2" {
+		t.Errorf("served(%v) want the new connection authenticated by the rotated token", served)
+	}
+	if len(closed) != 1 || closed[0] != "token1" {
+		t.Errorf("closed(%v) want the old connection drained", closed)
+	}
+}
+
+func TestClusterServerMinIdle(t *testing.T) {
+	var conns [2]int32
+	var addrs [2]string
+	for i := range addrs {
+		i := i
+		addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+			atomic.AddInt32(&conns[i], 1) // NOTE: the pinger one included
+			br := bufio.NewReader(conn)
+			for {
+				if _, err := br.ReadString('\n'); err != nil {
+					return
+				}
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		})
+		defer closer()
+		addrs[i] = addr
+	}
+	cc := *ccs[0]
+	cc.Servers = []string{addrs[0] + ":1", addrs[1] + ":1"}
+	cc.PoolMinIdle = 0
+	cc.ServerMinIdle = map[string]int{addrs[0]: 3}
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n0, n1 := atomic.LoadInt32(&conns[0]), atomic.LoadInt32(&conns[1]); n0 != n1+3 {
+		t.Errorf("conns(%d, %d) want 3 more idle ones of the first server", n0, n1)
+	}
+}
+
+func TestClusterDialSource(t *testing.T) {
+	sources := make(chan string, 4)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte("NOT_FOUND\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.DialSource = "not-ip"
+	func() {
+		defer func() {
+			if err, _ := recover().(error); errors.Cause(err) != proxy.ErrClusterDialSource {
+				t.Errorf("new error(%v) want ErrClusterDialSource", err)
+			}
+		}()
+		proxy.NewCluster(context.Background(), &cc).Close()
+	}()
+	if l, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("loopback 127.0.0.2 unavailable:%v", err)
+	} else {
+		l.Close()
+	}
+	cc.DialSource = "127.0.0.2"
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	req := newRequest(t, "delete a_source\r\n")
+	c.Dispatch(req)
+	req.Wait()
+	if err := req.Resp.Err(); err != nil {
+		t.Fatalf("delete error:%v", err)
+	}
+	for i := 0; i < 2; i++ { // NOTE: the pinger and the handler
+		if src := <-sources; src != "127.0.0.2" {
+			t.Errorf("source(%s) want dial source", src)
+		}
+	}
+}
+
+func TestClusterPoolMaxRequests(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		served []int // NOTE: the gets of each connection
+		pinged int
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		lock.Lock()
+		i := len(served)
+		served = append(served, 0)
+		lock.Unlock()
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(bs, "version") {
+				lock.Lock()
+				pinged++
+				lock.Unlock()
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+				continue
+			}
+			if strings.HasPrefix(bs, "get ") {
+				lock.Lock()
+				served[i]++
+				lock.Unlock()
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.Servers = []string{addr + ":1"}
+	cc.PoolActive, cc.PoolIdle, cc.PoolMinIdle = 1, 1, 0
+	cc.PoolMaxRequests = 3
+	cc.PoolIdlePing = 20 // NOTE: the pings of the idle connection don't count
+	c := proxy.NewCluster(context.Background(), &cc)
+	defer c.Close()
+	for i := 0; i < 7; i++ {
+		time.Sleep(50 * time.Millisecond)
+		req := newRequest(t, "get a_max\r\n")
+		c.Dispatch(req)
+		req.Wait()
+		if err := req.Resp.Err(); err != nil {
+			t.Fatalf("get %d error:%v", i, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	var gets []int
+	for _, n := range served {
+		if n > 0 {
+			gets = append(gets, n)
+		}
+	}
+	if len(gets) != 3 || gets[0] != 3 || gets[1] != 3 || gets[2] != 1 {
+		t.Errorf("gets of connections(%v) want recycled after exactly 3", gets)
+	}
+	if pinged == 0 {
+		t.Error("idle connections want pinged")
+	}
+}
+
+func TestClusterValueCodecs(t *testing.T) {
+	s, addr, closer := mockTierStore(t)
+	defer closer()
+	cluster := func(compress int, keys []string, reserve bool) *proxy.Cluster {
+		cc := *ccs[0]
+		cc.Servers = []string{addr + ":1"}
+		cc.ValueCompress = compress
+		cc.EncryptKeys = keys
+		cc.ReserveFlags = reserve
+		return proxy.NewCluster(context.Background(), &cc)
+	}
+	compressed := cluster(16, nil, false)
+	defer compressed.Close()
+	encrypted := cluster(0, []string{"1:00112233445566778899aabbccddeeff"}, false)
+	defer encrypted.Close()
+	raw := cluster(0, nil, true)
+	defer raw.Close()
+	plain := cluster(0, nil, false)
+	defer plain.Close()
+	do := func(c *proxy.Cluster, cmd string) string {
+		req := newRequest(t, cmd)
+		c.Dispatch(req)
+		req.Wait()
+		var b bytes.Buffer
+		memcache.NewEncoder(&b).Encode(req.Resp)
+		return b.String()
+	}
+	flags := func(key string) uint32 {
+		item, _ := s.get(key)
+		f, _ := strconv.ParseUint(strings.SplitN(item, " ", 2)[0], 10, 32)
+		return uint32(f)
+	}
+	value := strings.Repeat("overlord", 16)
+	for _, c := range []struct {
+		name string
+		c    *proxy.Cluster
+		key  string
+		flag uint32
+	}{
+		{"compressed", compressed, "a_z", memcache.FlagCompressed},
+		{"encrypted", encrypted, "a_e", memcache.FlagEncrypted},
+	} {
+		if reply := do(c.c, "set "+c.key+" 3 0 128\r\n"+value+"\r\n"); reply != "STORED\r\n" {
+			t.Fatalf("%s set reply(%q)", c.name, reply)
+		}
+		if f := flags(c.key); f != 3|c.flag {
+			t.Errorf("%s item flags(%d) want(%d)", c.name, f, 3|c.flag)
+		}
+		if reply := do(c.c, "get "+c.key+"\r\n"); reply != "VALUE "+c.key+" 3 128\r\n"+value+"\r\nEND\r\n" {
+			t.Errorf("%s get reply(%q) want round-trip", c.name, reply)
+		}
+	}
+	// NOTE: decoded by the flags bits regardless of which codecs of cluster, once reserved
+	if reply := do(raw, "get a_z\r\n"); reply != "VALUE a_z 3 128\r\n"+value+"\r\nEND\r\n" {
+		t.Errorf("raw get compressed reply(%q) want decompressed", reply)
+	}
+	if reply := do(encrypted, "get a_z\r\n"); reply != "VALUE a_z 3 128\r\n"+value+"\r\nEND\r\n" {
+		t.Errorf("encrypted get compressed reply(%q) want decompressed", reply)
+	}
+	if reply := do(raw, "get a_e\r\n"); reply != "SERVER_ERROR value codec not configured\r\n" {
+		t.Errorf("raw get encrypted reply(%q) want codec missing", reply)
+	}
+	// NOTE: the client set reserved bits are cleared by the cluster reserved them
+	if reply := do(compressed, "set a_s 1073741827 0 5\r\nhello\r\n"); reply != "STORED\r\n" {
+		t.Fatalf("compressed set reserved flags reply(%q)", reply)
+	}
+	if f := flags("a_s"); f != 3 {
+		t.Errorf("compressed item flags(%d) want reserved bits cleared", f)
+	}
+	// NOTE: passed through as the client set by the cluster not opted in
+	if reply := do(plain, "set a_h 1073741824 0 5\r\nhello\r\n"); reply != "STORED\r\n" {
+		t.Fatalf("plain set high flags reply(%q)", reply)
+	}
+	if f := flags("a_h"); f != 1<<30 {
+		t.Errorf("plain item flags(%d) want kept", f)
+	}
+	if reply := do(plain, "get a_h\r\n"); reply != "VALUE a_h 1073741824 5\r\nhello\r\nEND\r\n" {
+		t.Errorf("plain get high flags reply(%q) want passed through", reply)
+	}
+	if reply := do(plain, "get a_e\r\n"); !strings.HasPrefix(reply, "VALUE a_e 536870915 ") {
+		t.Errorf("plain get encrypted reply(%q) want passed through", reply)
+	}
+}
+
+func TestClusterRegistry(t *testing.T) {
+	s, addr, closer := mockTierStore(t)
+	defer closer()
+	s.lock.Lock()
+	s.items["a_reg"] = "0 hit"
+	s.lock.Unlock()
+	cluster := func(r *stat.Registry) *proxy.Cluster {
+		cc := *ccs[0]
+		cc.Servers = []string{addr + ":1"}
+		return proxy.NewClusterRegistry(context.Background(), &cc, r)
+	}
+	r1, r2 := stat.NewRegistry(), stat.NewRegistry()
+	c1, c2 := cluster(r1), cluster(r2)
+	defer c1.Close()
+	defer c2.Close()
+	for _, c := range []struct {
+		c   *proxy.Cluster
+		cmd string
+	}{{c1, "get a_reg\r\n"}, {c1, "get a_reg\r\n"}, {c2, "get a_none\r\n"}} {
+		req := newRequest(t, c.cmd)
+		c.c.Dispatch(req)
+		req.Wait()
+	}
+	count := func(r *stat.Registry, name string) (n float64) {
+		mfs, err := r.Gather()
+		if err != nil {
+			t.Fatalf("gather error:%v", err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == name {
+				for _, m := range mf.GetMetric() {
+					n += m.GetCounter().GetValue()
+				}
+			}
+		}
+		return
+	}
+	if h, m := count(r1, "overlord_proxy_hit"), count(r1, "overlord_proxy_miss"); h != 2 || m != 0 {
+		t.Errorf("registry1 hit(%v) miss(%v) want 2 hits", h, m)
+	}
+	if h, m := count(r2, "overlord_proxy_hit"), count(r2, "overlord_proxy_miss"); h != 0 || m != 1 {
+		t.Errorf("registry2 hit(%v) miss(%v) want 1 miss", h, m)
+	}
+}
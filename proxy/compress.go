@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/felixhao/overlord/lib/stat"
+)
+
+// compressCmd is the proxy-local handshake command, like: 'overlord_compress gzip',
+// the responses after its reply are gzip compressed stream.
+const compressCmd = "overlord_compress"
+
+// compressWriter is the client writer can be switched into gzip compression.
+type compressWriter struct {
+	w       io.Writer
+	cluster string
+
+	gz   *gzip.Writer
+	wire int // NOTE: compressed bytes written into w
+	debt int // NOTE: bytes expanded by the tiny responses and gzip header, paid off by the saved ones
+}
+
+func newCompressWriter(w io.Writer, cluster string) *compressWriter {
+	return &compressWriter{w: w, cluster: cluster}
+}
+
+// enable switches into compression, must be called between writes.
+func (c *compressWriter) enable() {
+	if c.gz == nil {
+		c.gz = gzip.NewWriter(writerFunc(c.writeWire))
+	}
+}
+
+// Write writes p and flushes the compressed bytes, so client can decode every response in time.
+func (c *compressWriter) Write(p []byte) (n int, err error) {
+	if c.gz == nil {
+		return c.w.Write(p)
+	}
+	wire := c.wire
+	if n, err = c.gz.Write(p); err != nil {
+		return
+	}
+	err = c.gz.Flush()
+	c.saved(n - (c.wire - wire))
+	return
+}
+
+// saved counts the bytes saved by one write, the expanded ones are owed until paid off,
+// so the counter never decreases.
+func (c *compressWriter) saved(n int) {
+	if c.debt -= n; c.debt < 0 {
+		stat.CompressSaved(c.cluster, -c.debt)
+		c.debt = 0
+	}
+}
+
+func (c *compressWriter) writeWire(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.wire += n
+	return
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
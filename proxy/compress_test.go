@@ -0,0 +1,109 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCompress(t *testing.T) {
+	value := strings.Repeat("overlord", 1024)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			key := strings.TrimSuffix(bs[4:], "\r\n")
+			fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(value), value)
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21219"
+	cc.Servers = []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	br := bufio.NewReader(conn)
+	conn.Write([]byte("overlord_compress gzip\r\n"))
+	if bs, err := br.ReadString('\n'); err != nil || bs != "OK\r\n" {
+		t.Fatalf("handshake reply(%q) error(%v)", bs, err)
+	}
+	// NOTE: multi-get, merged and compressed as one response
+	keys := []string{"a_gz", "b_gz", "c_gz", "d_gz"}
+	conn.Write([]byte("get " + strings.Join(keys, " ") + "\r\n"))
+	var want bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&want, "VALUE %s 0 %d\r\n%s\r\n", k, len(value), value)
+	}
+	want.WriteString("END\r\n")
+	cr := &countReader{r: br}
+	gr, err := gzip.NewReader(cr)
+	if err != nil {
+		t.Fatalf("gzip reader error:%v", err)
+	}
+	got := make([]byte, want.Len())
+	if _, err = io.ReadFull(gr, got); err != nil {
+		t.Fatalf("read decompressed error:%v", err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("decompressed response mismatch, got len(%d) want len(%d)", len(got), want.Len())
+	}
+	if cr.n >= want.Len()/10 {
+		t.Errorf("compressed bytes(%d) not much less than raw(%d)", cr.n, want.Len())
+	}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather error:%v", err)
+	}
+	var saved float64
+	for _, mf := range mfs {
+		if mf.GetName() != "overlord_proxy_compress_saved" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "cluster" && l.GetValue() == cc.Name {
+					saved += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if saved < float64(want.Len()-cr.n-64) { // NOTE: the handshake reply and the gzip header are owed
+		t.Errorf("compress saved counter(%v) want about %d", saved, want.Len()-cr.n)
+	}
+}
+
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += n
+	return
+}
@@ -1,11 +1,16 @@
 package proxy
 
 import (
+	"time"
+
 	"github.com/BurntSushi/toml"
+	"github.com/felixhao/overlord/lib/log"
 	"github.com/felixhao/overlord/proto"
 	"github.com/pkg/errors"
 )
 
+const defaultProbeTimeout = time.Second
+
 // Config proxy config.
 type Config struct {
 	Pprof string
@@ -13,10 +18,19 @@ type Config struct {
 	Log   string
 	LogVL int `toml:"log_vl"`
 	Proxy struct {
-		ReadTimeout    int   `toml:"read_timeout"`
-		WriteTimeout   int   `toml:"write_timeout"`
-		MaxConnections int32 `toml:"max_connections"`
-		UseMetrics     bool  `toml:"use_metrics"`
+		ReadTimeout     int   `toml:"read_timeout"`
+		WriteTimeout    int   `toml:"write_timeout"`
+		MaxConnections  int32 `toml:"max_connections"`
+		MaxInflight     int32 `toml:"max_inflight"`
+		MaxBackendConns int   `toml:"max_backend_conns"`
+		DialConcurrency int   `toml:"dial_concurrency"`
+		UseMetrics      bool  `toml:"use_metrics"`
+		UseAdmin        bool  `toml:"use_admin"`
+
+		MaxResponseBytes int64 `toml:"max_response_bytes"`
+		FreeBuffers      int   `toml:"free_buffers"`
+		AuditSample      int   `toml:"audit_sample"`
+		AuditErrors      bool  `toml:"audit_errors"`
 	}
 }
 
@@ -53,25 +67,106 @@ type ClusterConfig struct {
 	HashMethod       string          `toml:"hash_method"`
 	HashDistribution string          `toml:"hash_distribution"`
 	HashTag          string          `toml:"hash_tag"`
+	KeyPrefix        string          `toml:"key_prefix"`
+	KeyRules         []string        `toml:"key_rules"`
 	CacheType        proto.CacheType `toml:"cache_type"`
 	ListenProto      string          `toml:"listen_proto"`
 	ListenAddr       string          `toml:"listen_addr"`
 	RedisAuth        string          `toml:"redis_auth"`
 	DialTimeout      int             `toml:"dial_timeout"`
+	DNSTTL           int             `toml:"dns_ttl"`
+	DialFallback     int             `toml:"dial_fallback"`
+	DialSource       string          `toml:"dial_source"`
+	DNSTimeout       int             `toml:"dns_timeout"`
 	ReadTimeout      int             `toml:"read_timeout"`
 	WriteTimeout     int             `toml:"write_timeout"`
+	RequestTimeout   int             `toml:"request_timeout"`
 	PoolActive       int             `toml:"pool_active"`
 	PoolIdle         int             `toml:"pool_idle"`
+	PoolMinIdle      int             `toml:"pool_min_idle"`
+	ServerMinIdle    map[string]int  `toml:"server_min_idle"`
 	PoolIdleTimeout  int             `toml:"pool_idle_timeout"`
 	PoolGetWait      bool            `toml:"pool_get_wait"`
+	PoolIdlePing     int             `toml:"pool_idle_ping"`
+	PoolCheckAlive   bool            `toml:"pool_check_alive"`
+	CheckPending     bool            `toml:"check_pending"`
+	DebugAddr        bool            `toml:"debug_addr"`
+	EndGrace         int             `toml:"end_grace"`
+	EndStrict        bool            `toml:"end_strict"`
+	ReconnectErrors  []string        `toml:"reconnect_errors"`
+	AuthFile         string          `toml:"auth_file"`
+	PoolSlowStart    int             `toml:"pool_slow_start"`
+	PoolOverflow     int             `toml:"pool_overflow"`
+	PoolOverflowIdle int             `toml:"pool_overflow_idle_timeout"`
+	PoolMaxLifetime  int             `toml:"pool_max_lifetime"`
+	PoolJitter       int             `toml:"pool_lifetime_jitter"`
+	PoolMaxRequests  int             `toml:"pool_max_requests"`
 	PingFailLimit    int             `toml:"ping_fail_limit"`
 	PingAutoEject    bool            `toml:"ping_auto_eject"`
+	MaxInflight      int32           `toml:"max_inflight"`
+	MaxPipeline      int             `toml:"max_pipeline"`
+	OverloadHint     string          `toml:"overload_hint"`
+	AdaptiveLatency  int             `toml:"adaptive_latency"`
+	BackendQueue     int             `toml:"backend_queue"`
+	MaxMultiKeys     int             `toml:"max_multi_keys"`
+	BadKeyPolicy     string          `toml:"bad_key_policy"`
+	DupKeyPolicy     string          `toml:"dup_key_policy"`
+	MaxBackendConns  int             `toml:"max_backend_conns"`
+	DialConcurrency  int             `toml:"dial_concurrency"`
+	RecordFile       string          `toml:"record_file"`
+	FaultInjection   bool            `toml:"fault_injection"`
+	MicroCacheTTL    int             `toml:"micro_cache_ttl"`
+	ChunkSize        int             `toml:"chunk_size"`
+	MaxTTL           int64           `toml:"max_ttl"`
+	Sticky           bool            `toml:"sticky"`
+	FailOpen         bool            `toml:"fail_open"`
+	BatchWindow      int             `toml:"batch_window"`
+	RingLogInterval  int             `toml:"ring_log_interval"`
+	HotKeyThreshold  int             `toml:"hot_key_threshold"`
+	HotKeyShed       int32           `toml:"hot_key_shed"`
+	Checksum         string          `toml:"checksum"`
+	ChecksumMiss     bool            `toml:"checksum_miss"`
+	ValueCompress    int             `toml:"value_compress"`
+	ReserveFlags     bool            `toml:"reserve_flags"`
+	EncryptKeys      []string        `toml:"encrypt_keys"`
+	ProbeProtocol    bool            `toml:"probe_protocol"`
+	TierServers      []string        `toml:"tier_servers"`
+	TierWrite        string          `toml:"tier_write"`
+	TierPopulateTTL  int64           `toml:"tier_populate_ttl"`
+	TierConcurrency  int             `toml:"tier_concurrency"`
 	Servers          []string
 }
 
 // Validate validate config field value.
 func (cc *ClusterConfig) Validate() error {
 	// TODO(felix): complete validates
+	if cc.ProbeProtocol {
+		return cc.probeProtocol()
+	}
+	return nil
+}
+
+// probeProtocol probes the protocol of every server, fails when any one not speak the cache type.
+// NOTE: the unreachable server is skipped, it may be up later.
+func (cc *ClusterConfig) probeProtocol() error {
+	addrs, _, _, _, err := parseServers(append(append([]string{}, cc.Servers...), cc.TierServers...))
+	if err != nil {
+		return errors.Wrapf(err, "cluster(%s) probe protocol parse servers", cc.Name)
+	}
+	timeout := time.Duration(cc.DialTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	for _, addr := range addrs {
+		ct, err := proto.DetectCacheType(addr, timeout)
+		if err != nil {
+			log.Warnf("cluster(%s) probe protocol of node(%s) skipped error:%v", cc.Name, addr, err)
+			continue
+		}
+		if ct != cc.CacheType {
+			return errors.Wrapf(ErrClusterProtocol, "cluster(%s) node(%s) speaks %s protocol but cache_type is %s", cc.Name, addr, ct, cc.CacheType)
+		}
+	}
 	return nil
 }
 
@@ -115,6 +210,22 @@ read_timeout = 0
 write_timeout = 0
 # proxy accept max connections from client. By default, we no limit.
 max_connections = 0
+# proxy max in-flight requests of all clusters, more are rejected with 'SERVER_ERROR overloaded'. By default, we no limit.
+max_inflight = 0
+# proxy max connections to backends of all clusters, must be not less than the sum of clusters' max_backend_conns. By default, we no limit.
+max_backend_conns = 0
+# proxy max concurrent in-progress dials to backends of all clusters, more dials wait. By default, we no limit.
+dial_concurrency = 0
+# proxy max bytes of the large response buffers in flight of all clusters, more responses wait for the written ones until read_timeout, then fail with 'SERVER_ERROR response memory exhausted'. By default, we no limit.
+max_response_bytes = 0
+# proxy max connection read and write buffers kept of all clusters, the buffers of closed connections are reused by the reconnected ones rather than allocated. By default, we no keep them.
+free_buffers = 0
+# proxy logs the details of one of every audit_sample commands of all clusters, like: command, key, backend, latency and result. By default, we no log them.
+audit_sample = 0
+# proxy logs the details of every failed command, not sampled. By default, we no log them.
+audit_errors = false
 # proxy support prometheus metrics, reuse the pprof port. By default, we use it.
 use_metrics = true
+# proxy support admin API for the operational commands, reuse the pprof port. By default, we no use it.
+use_admin = false
 `
@@ -0,0 +1,63 @@
+package proxy_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+	"github.com/pkg/errors"
+)
+
+func TestClusterConfigProbeProtocol(t *testing.T) {
+	redis, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if bs == "PING\r\n" {
+				conn.Write([]byte("+PONG\r\n"))
+			} else {
+				conn.Write([]byte("-ERR unknown command '" + strings.TrimSpace(bs) + "'\r\n"))
+			}
+		}
+	})
+	defer closer()
+	mc, closer2 := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if bs == "version\r\n" {
+				conn.Write([]byte("VERSION 1.5.10\r\n"))
+			} else {
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	defer closer2()
+	cc := *ccs[0]
+	cc.ProbeProtocol = true
+	cc.Servers = []string{mc + ":1"}
+	if err := cc.Validate(); err != nil {
+		t.Fatalf("memcache node validate error:%v", err)
+	}
+	cc.Servers = []string{mc + ":1", redis + ":1"}
+	err := cc.Validate()
+	if errors.Cause(err) != proxy.ErrClusterProtocol {
+		t.Fatalf("redis node validate error(%v) want protocol mismatch", err)
+	}
+	if !strings.Contains(err.Error(), redis) || !strings.Contains(err.Error(), "speaks redis protocol") {
+		t.Errorf("validate error(%v) not explain the node", err)
+	}
+	cc.ProbeProtocol = false
+	if err := cc.Validate(); err != nil {
+		t.Errorf("no probe validate error:%v", err)
+	}
+}
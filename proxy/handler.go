@@ -20,10 +20,23 @@ const (
 	handlerClosed  = int32(1)
 
 	requestChanBuffer = 1024 // TODO(felix): config???
+
+	defaultMaxMultiKeys = 1000
+
+	badKeyMiss  = "miss"  // NOTE: the invalid keys of multi-get are replied as missing, the valid ones served
+	badKeyError = "error" // NOTE: the multi-get fails when any invalid key
+
+	dupKeyOnce = "once" // NOTE: the value of duplicate keys in multi-get is replied once
+	dupKeyEach = "each" // NOTE: the value is replied for each duplicate key, like memcached
+
+	noopCmd  = "mn"    // NOTE: the meta no-op is replied locally in order, terminates the quiet pipeline
+	statsCmd = "stats" // NOTE: only 'stats proxy', replied by the stats of proxy rather than backend
 )
 
 var (
 	hdlNum = runtime.NumCPU()
+
+	inflight int32 // NOTE: in-flight requests of all clusters
 )
 
 // Handler handle conn.
@@ -35,10 +48,15 @@ type Handler struct {
 	once sync.Once
 
 	conn    net.Conn
+	cw      *compressWriter
 	cluster *Cluster
 	decoder proto.Decoder
 	encoder proto.Encoder
 	reqCh   *proto.RequestChan
+	session *session
+	prio    proto.Priority
+
+	pipeline chan struct{} // NOTE: the slots of requests read but not replied, nil means no limit
 
 	closed int32
 	wg     sync.WaitGroup
@@ -51,17 +69,24 @@ func NewHandler(ctx context.Context, c *Config, conn net.Conn, cluster *Cluster)
 	h.conn = conn
 	h.cluster = cluster
 	h.ctx, h.cancel = context.WithCancel(ctx)
+	h.cw = newCompressWriter(conn, cluster.cc.Name)
 	// cache type
 	switch cluster.cc.CacheType {
 	case proto.CacheTypeMemcache:
 		h.decoder = memcache.NewDecoder(conn)
-		h.encoder = memcache.NewEncoder(conn)
+		h.encoder = memcache.NewEncoder(h.cw)
 	case proto.CacheTypeRedis:
 		// TODO(felix): support redis.
 	default:
 		panic(proto.ErrNoSupportCacheType)
 	}
 	h.reqCh = proto.NewRequestChanBuffer(requestChanBuffer)
+	if cluster.cc.MaxPipeline > 0 {
+		h.pipeline = make(chan struct{}, cluster.cc.MaxPipeline)
+	}
+	if cluster.cc.Sticky {
+		h.session = newSession(cluster)
+	}
 	stat.ConnIncr(cluster.cc.Name)
 	return
 }
@@ -98,6 +123,9 @@ func (h *Handler) handleReader() {
 			return
 		default:
 		}
+		if !h.acquirePipeline() {
+			return
+		}
 		if h.c.Proxy.ReadTimeout > 0 {
 			h.conn.SetReadDeadline(time.Now().Add(time.Duration(h.c.Proxy.ReadTimeout) * time.Millisecond))
 		}
@@ -107,7 +135,9 @@ func (h *Handler) handleReader() {
 				if ne.Temporary() {
 					req = proto.ErrRequest()
 					req.Process()
+					h.admit(h.prio)
 					if h.reqCh.PushBack(req) == 0 {
+						h.release()
 						return
 					}
 					req.DoneWithError(err)
@@ -124,16 +154,103 @@ func (h *Handler) handleReader() {
 			return
 		}
 		req.Process()
+		if auditOn() {
+			req.WithClient(h.conn.RemoteAddr().String())
+		}
+		req.WithPriority(h.prio)
+		admitted := h.admit(req.Priority())
 		if h.reqCh.PushBack(req) == 0 {
+			h.release()
 			return
 		}
+		if !admitted {
+			stat.PriorityShed(h.cluster.cc.Name, req.Priority().String())
+			req.DoneWithError(ErrProxyOverloaded)
+			if log.V(2) {
+				log.Warnf("cluster(%s) addr(%s) remoteAddr(%s) request rejected by max inflight", h.cluster.cc.Name, h.cluster.cc.ListenAddr, h.conn.RemoteAddr())
+			}
+			continue
+		}
+		if req.Cmd() == compressCmd {
+			req.Done(h.localResponse(req))
+			continue
+		}
+		if req.Cmd() == noopCmd {
+			req.Done(h.localResponse(req))
+			continue
+		}
+		if req.Cmd() == statsCmd {
+			req.Done(h.statsResponse(req))
+			continue
+		}
+		if req.Cmd() == priorityCmd {
+			h.prio, _ = proto.ParsePriority(string(req.Key())) // NOTE: the name checked by decoder
+			req.Done(h.localResponse(req))
+			continue
+		}
+		if m := h.cluster.micro; m != nil {
+			if resp, ok := m.get(req); ok {
+				req.Done(resp)
+				continue
+			}
+			m.invalidate(req)
+		}
 		h.dispatchRequest(req)
 	}
 }
 
+// admit counts the request in-flight until it replied, returns false when
+// more than the max in-flight of proxy or cluster, which is less for low priority.
+func (h *Handler) admit(p proto.Priority) bool {
+	n := atomic.AddInt32(&inflight, 1)
+	cn := atomic.AddInt32(&h.cluster.inflight, 1)
+	stat.InflightIncr(h.cluster.cc.Name)
+	if (h.c.Proxy.MaxInflight > 0 && n > priorityLimit(h.c.Proxy.MaxInflight, p)) ||
+		(h.cluster.cc.MaxInflight > 0 && cn > priorityLimit(h.cluster.cc.MaxInflight, p)) {
+		stat.Overload(h.cluster.cc.Name)
+		return false
+	}
+	return true
+}
+
+// release uncounts the request in-flight.
+func (h *Handler) release() {
+	atomic.AddInt32(&inflight, -1)
+	atomic.AddInt32(&h.cluster.inflight, -1)
+	stat.InflightDecr(h.cluster.cc.Name)
+}
+
+// localResponse returns the response of proxy-local request.
+func (h *Handler) localResponse(req *proto.Request) (resp *proto.Response) {
+	switch h.cluster.cc.CacheType {
+	case proto.CacheTypeMemcache:
+		resp = memcache.LocalResponse(req)
+	default:
+		resp = &proto.Response{Type: h.cluster.cc.CacheType}
+		resp.WithError(proto.ErrNoSupportCacheType)
+	}
+	return
+}
+
+// statsResponse returns the response of 'stats proxy' by the stat values of cluster.
+func (h *Handler) statsResponse(req *proto.Request) (resp *proto.Response) {
+	switch h.cluster.cc.CacheType {
+	case proto.CacheTypeMemcache:
+		ss := stat.Samples(h.cluster.cc.Name)
+		if h.cluster.stats != nil {
+			ss = stat.RegistrySamples(h.cluster.stats, h.cluster.cc.Name)
+		}
+		resp = memcache.StatsResponse(req, ss)
+	default:
+		resp = &proto.Response{Type: h.cluster.cc.CacheType}
+		resp.WithError(proto.ErrNoSupportCacheType)
+	}
+	return
+}
+
 func (h *Handler) dispatchRequest(req *proto.Request) {
 	if !req.IsBatch() {
-		h.cluster.Dispatch(req)
+		h.dispatch(req)
 		return
 	}
 	subs, resp := req.Batch()
@@ -144,20 +261,158 @@ func (h *Handler) dispatchRequest(req *proto.Request) {
 		}
 		return
 	}
+	if max := h.cluster.cc.MaxMultiKeys; max >= 0 && len(subs) > maxMultiKeys(max) {
+		req.DoneWithError(ErrProxyTooManyKeys) // NOTE: rejected before fan out
+		if log.V(2) {
+			log.Warnf("cluster(%s) addr(%s) remoteAddr(%s) batch request keys(%d) rejected by max multi keys", h.cluster.cc.Name, h.cluster.cc.ListenAddr, h.conn.RemoteAddr(), len(subs))
+		}
+		return
+	}
+	if h.cluster.cc.BadKeyPolicy == badKeyError && !validKeys(subs) {
+		req.DoneWithError(errors.Wrap(memcache.ErrBadKey, "Handler batch request legal key"))
+		return
+	}
+	firsts := dedupeKeys(subs)
+	if firsts != nil && h.cluster.cc.DupKeyPolicy != dupKeyEach {
+		n := 0
+		for i := range subs {
+			if firsts[i] == i {
+				subs[n] = subs[i]
+				n++
+			}
+		}
+		subs, firsts = subs[:n], nil
+	}
 	subl := len(subs)
 	for i := 0; i < subl; i++ {
+		if firsts != nil && firsts[i] != i {
+			continue // NOTE: fetched once by the first sub of key
+		}
 		subs[i].Process()
-		h.cluster.Dispatch(&subs[i])
+		if !memcache.ValidKey(subs[i].Key()) {
+			subs[i].DoneWithError(errors.Wrap(memcache.ErrBadKey, "Handler batch request legal key")) // NOTE: never sent, the partial failure
+			continue
+		}
+		h.dispatch(&subs[i])
 	}
 	req.BatchWait()
+	for i, j := range firsts {
+		subs[i].Resp = subs[j].Resp
+	}
 	resp.Merge(subs)
+	if pes := resp.Partial(); len(pes) > 0 && log.V(2) {
+		for _, pe := range pes {
+			log.Warnf("cluster(%s) addr(%s) remoteAddr(%s) batch request key(%s) node(%s) failed error:%v", h.cluster.cc.Name, h.cluster.cc.ListenAddr, h.conn.RemoteAddr(), pe.Key, pe.Node, pe.Err)
+		}
+	}
 	req.Done(resp)
 }
 
+// acquirePipeline acquires one slot of the requests read but not replied, the client is not read
+// until the responses drained when max pipeline, returns false when the handler closed.
+func (h *Handler) acquirePipeline() bool {
+	if h.pipeline == nil {
+		return true
+	}
+	select {
+	case h.pipeline <- struct{}{}:
+		return true
+	default:
+	}
+	stat.PipelineThrottle(h.cluster.cc.Name)
+	select {
+	case h.pipeline <- struct{}{}:
+		return true
+	case <-h.ctx.Done():
+		return false
+	}
+}
+
+// releasePipeline releases one slot after the response written.
+func (h *Handler) releasePipeline() {
+	if h.pipeline != nil {
+		<-h.pipeline
+	}
+}
+
+// dedupeKeys returns the index of the first sub of the same key for every sub, nil when no duplicate key.
+func dedupeKeys(subs []proto.Request) (firsts []int) {
+	seen := make(map[string]int, len(subs))
+	for i := range subs {
+		key := string(subs[i].Key())
+		j, ok := seen[key]
+		if !ok {
+			seen[key], j = i, i
+		} else if firsts == nil {
+			firsts = make([]int, len(subs))
+			for k := 0; k < i; k++ {
+				firsts[k] = k // NOTE: all unique before
+			}
+		}
+		if firsts != nil {
+			firsts[i] = j
+		}
+	}
+	return
+}
+
+// validKeys reports whether all keys of subs are legal.
+func validKeys(subs []proto.Request) bool {
+	for i := range subs {
+		if !memcache.ValidKey(subs[i].Key()) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxMultiKeys returns the max keys of one multi-get, zero means the default.
+func maxMultiKeys(max int) int {
+	if max == 0 {
+		return defaultMaxMultiKeys
+	}
+	return max
+}
+
+// dispatch dispatchs request by tiers when tier 2 servers, by session when sticky, else by cluster.
+// The writes are rejected when the cluster is in read-only mode.
+func (h *Handler) dispatch(req *proto.Request) {
+	if h.cluster.ReadOnly() && isWrite(req) {
+		stat.ReadOnlyReject(h.cluster.cc.Name)
+		req.DoneWithError(ErrProxyReadOnly)
+		return
+	}
+	if h.cluster.tier != nil {
+		h.cluster.tier.Dispatch(req)
+		return
+	}
+	if h.session != nil {
+		h.session.Dispatch(req)
+		return
+	}
+	h.cluster.Dispatch(req)
+}
+
+// isWrite returns whether the request modifies the item, the cas included.
+func isWrite(req *proto.Request) bool {
+	return memcache.IsWrite(req) || req.Cmd() == "cas"
+}
+
 func (h *Handler) handleWriter() {
 	var err error
 	defer func() {
 		h.closeWithError(err)
+		for { // NOTE: reqCh closed, release the requests will never be replied
+			req, ok := h.reqCh.PopFront()
+			if !ok {
+				break
+			}
+			h.release()
+			go func() {
+				req.Wait()
+				req.Resp.Release() // NOTE: never written
+			}()
+		}
 	}()
 	for {
 		// NOTE: no check handler closed, ensure that reqCh pop finished.
@@ -188,14 +443,52 @@ func (h *Handler) handleWriter() {
 			return
 		}
 		req.Wait()
+		if m := h.cluster.micro; m != nil {
+			m.put(req, time.Now().Add(-req.Since()))
+		}
 		if h.c.Proxy.WriteTimeout > 0 {
 			h.conn.SetWriteDeadline(time.Now().Add(time.Duration(h.c.Proxy.WriteTimeout) * time.Millisecond))
 		}
+		overloaded := errors.Cause(req.Resp.Err()) == ErrProxyOverloaded
+		h.hintOverload(req.Resp)
 		err = h.encoder.Encode(req.Resp)
+		req.Resp.Release()
+		h.release()
+		h.releasePipeline()
+		if !overloaded {
+			stat.PriorityServed(h.cluster.cc.Name, req.Priority().String())
+		}
+		if err == nil && req.Resp.Err() == nil && req.Cmd() == compressCmd {
+			h.cw.enable() // NOTE: the handshake reply is not compressed
+		}
 		stat.ProxyTime(h.cluster.cc.Name, req.Cmd(), int64(req.Since()/time.Millisecond))
 	}
 }
 
+// hintOverload appends the backoff hint to the overload rejection of response if any,
+// that is rejected by the max in-flight or the adaptive limit of node.
+func (h *Handler) hintOverload(resp *proto.Response) {
+	if h.cluster.cc.OverloadHint == "" {
+		return
+	}
+	switch err := resp.Err(); errors.Cause(err) {
+	case ErrProxyOverloaded, ErrClusterLimited, ErrBackendBusy:
+		resp.WithError(&hintError{err: err, hint: h.cluster.cc.OverloadHint})
+		stat.OverloadHint(h.cluster.cc.Name)
+	}
+}
+
+// hintError is the overload rejection with the backoff hint, like: 'overloaded retry_after=100ms'.
+// NOTE: no Cause, so the hint is replied by encoder.
+type hintError struct {
+	err  error
+	hint string
+}
+
+func (e *hintError) Error() string {
+	return errors.Cause(e.err).Error() + " " + e.hint
+}
+
 // Closed return handler whether or not closed.
 func (h *Handler) Closed() bool {
 	return atomic.LoadInt32(&h.closed) == handlerClosed
@@ -210,6 +503,9 @@ func (h *Handler) closeWithError(err error) {
 		h.cancel()
 		h.reqCh.Close()
 		h.conn.Close()
+		if h.session != nil {
+			h.session.Close()
+		}
 		if log.V(3) {
 			log.Warnf("cluster(%s) addr(%s) remoteAddr(%s) handler end close", h.cluster.cc.Name, h.cluster.cc.ListenAddr, h.conn.RemoteAddr())
 		}
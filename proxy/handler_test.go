@@ -0,0 +1,555 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+)
+
+func TestHandlerMaxInflight(t *testing.T) {
+	block := make(chan struct{})
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			<-block
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21216"
+	cc.Servers = []string{addr + ":1"}
+	cc.MaxInflight = 1
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("get a_inflight\r\nget b_inflight\r\n"))
+	time.Sleep(100 * time.Millisecond) // NOTE: the second one arrived while the first in-flight
+	close(block)
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []string{"END\r\n", "SERVER_ERROR overloaded\r\n"} {
+		bs, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("conn read error:%v", err)
+		}
+		if bs != want {
+			t.Errorf("reply(%q) want(%q)", bs, want)
+		}
+	}
+	conn.Write([]byte("get c_inflight\r\n"))
+	if bs, _ := br.ReadString('\n'); bs != "END\r\n" {
+		t.Errorf("reply(%q) want END after in-flight released", bs)
+	}
+}
+
+func TestHandlerOverloadHint(t *testing.T) {
+	block := make(chan struct{})
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return
+			}
+			<-block
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21234"
+	cc.Servers = []string{addr + ":1"}
+	cc.MaxInflight = 1
+	cc.OverloadHint = "retry_after=100ms"
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("get a_hint\r\nget b_hint\r\n"))
+	time.Sleep(100 * time.Millisecond) // NOTE: the second one arrived while the first in-flight
+	close(block)
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []string{"END\r\n", "SERVER_ERROR overloaded retry_after=100ms\r\n"} {
+		bs, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("conn read error:%v", err)
+		}
+		if bs != want {
+			t.Errorf("reply(%q) want(%q)", bs, want)
+		}
+	}
+}
+
+func TestHandlerPriorityShed(t *testing.T) {
+	block := make(chan struct{})
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(bs, "get ") {
+				<-block
+				conn.Write([]byte("END\r\n"))
+			} else {
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21221"
+	cc.Servers = []string{addr + ":1"}
+	cc.MaxInflight = 4 // NOTE: low priority shed when more than 3
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	request := func(prio, key string) (net.Conn, *bufio.Reader) {
+		conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+		if err != nil {
+			t.Fatalf("net dial error:%v", err)
+		}
+		br := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("overlord_priority " + prio + "\r\n"))
+		if bs, err := br.ReadString('\n'); err != nil || bs != "OK\r\n" {
+			t.Fatalf("priority handshake reply(%q) error(%v)", bs, err)
+		}
+		conn.Write([]byte("get " + key + "\r\n"))
+		time.Sleep(50 * time.Millisecond) // NOTE: the request in-flight
+		return conn, br
+	}
+	var brs []*bufio.Reader
+	for i := 0; i < 3; i++ {
+		conn, br := request("low", "low_"+strconv.Itoa(i))
+		defer conn.Close()
+		brs = append(brs, br)
+	}
+	conn, br := request("low", "low_shed")
+	defer conn.Close()
+	if bs, _ := br.ReadString('\n'); bs != "SERVER_ERROR overloaded\r\n" {
+		t.Errorf("low priority reply(%q) want shed", bs)
+	}
+	conn, br = request("high", "high_0")
+	defer conn.Close()
+	brs = append(brs, br)
+	close(block)
+	for i, br := range brs {
+		if bs, err := br.ReadString('\n'); err != nil || bs != "END\r\n" {
+			t.Errorf("request(%d) reply(%q) error(%v) want served", i, bs, err)
+		}
+	}
+}
+
+func TestHandlerMaxMultiKeys(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(bs, "get ") {
+				conn.Write([]byte("END\r\n"))
+			} else {
+				conn.Write([]byte("VERSION 1.5.0\r\n"))
+			}
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21222"
+	cc.Servers = []string{addr + ":1"}
+	cc.MaxMultiKeys = 3
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, c := range []struct{ cmd, want string }{
+		{"get a_multi b_multi c_multi\r\n", "END\r\n"},
+		{"get a_multi b_multi c_multi d_multi\r\n", "CLIENT_ERROR too many keys\r\n"},
+		{"gat 0 a_multi b_multi c_multi d_multi\r\n", "CLIENT_ERROR too many keys\r\n"},
+		{"get a_multi\r\n", "END\r\n"},
+	} {
+		conn.Write([]byte(c.cmd))
+		if bs, err := br.ReadString('\n'); err != nil || bs != c.want {
+			t.Errorf("cmd(%q) reply(%q) error(%v) want(%q)", c.cmd, bs, err, c.want)
+		}
+	}
+}
+
+func TestHandlerMetaNoop(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond) // NOTE: the no-op replied after, though not dispatched
+			conn.Write([]byte("ME a_mn exp=-1 la=1 cas=2 fetch=no cls=1 size=60\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21232"
+	cc.Servers = []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	conn.Write([]byte("me a_mn\r\nmn\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []string{"ME a_mn exp=-1 la=1 cas=2 fetch=no cls=1 size=60\r\n", "MN\r\n"} {
+		if bs, err := br.ReadString('\n'); err != nil || bs != want {
+			t.Errorf("reply(%q) error(%v) want(%q)", bs, err, want)
+		}
+	}
+}
+
+func TestHandlerStatsProxy(t *testing.T) {
+	defer stat.Reset()
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21233"
+	cc.Servers = []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	if reply := tierCmd(t, br, conn, "get a_stats\r\n"); reply != "END\r\n" {
+		t.Fatalf("get reply(%q) want miss", reply)
+	}
+	conn.Write([]byte("stats proxy\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	stats := map[string]string{}
+	for {
+		bs, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stats read error:%v", err)
+		}
+		if bs == "END\r\n" {
+			break
+		}
+		fs := strings.Fields(bs)
+		if len(fs) != 3 || fs[0] != "STAT" {
+			t.Fatalf("stats line(%q) want 'STAT <name> <value>'", bs)
+		}
+		stats[fs[1]] = fs[2]
+	}
+	for name, want := range map[string]string{
+		"overlord_proxy_miss{node=" + strconv.Quote(addr) + "}":                            "1",
+		"overlord_proxy_handler_timer_count{cmd=\"get\",node=" + strconv.Quote(addr) + "}": "1",
+	} {
+		if v := stats[name]; v != want {
+			t.Errorf("stat(%s) value(%q) want(%q)", name, v, want)
+		}
+	}
+}
+
+func TestHandlerBadKeyPolicy(t *testing.T) {
+	var long int32
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fs := strings.Fields(bs)
+			var b bytes.Buffer
+			for _, key := range fs[1:] {
+				if len(key) > 250 {
+					atomic.AddInt32(&long, 1)
+					b.WriteString("CLIENT_ERROR bad command line format\r\n")
+					continue
+				}
+				b.WriteString("VALUE " + key + " 0 1\r\nv\r\n")
+			}
+			b.WriteString("END\r\n")
+			conn.Write([]byte(b.String()))
+		}
+	})
+	defer closer()
+	miss, fail := *ccs[0], *ccs[0]
+	miss.Name, miss.ListenAddr = "bad-key-miss", "127.0.0.1:21235"
+	fail.Name, fail.ListenAddr, fail.BadKeyPolicy = "bad-key-error", "127.0.0.1:21236", "error"
+	miss.Servers, fail.Servers = []string{addr + ":1"}, []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&miss, &fail})
+	time.Sleep(100 * time.Millisecond)
+
+	cmd := "get a_bad " + strings.Repeat("k", 300) + " b_bad c_bad\r\n"
+	for _, c := range []struct {
+		addr string
+		want string
+	}{
+		{miss.ListenAddr, "VALUE a_bad 0 1\r\nv\r\nVALUE b_bad 0 1\r\nv\r\nVALUE c_bad 0 1\r\nv\r\nEND\r\n"},
+		{fail.ListenAddr, "CLIENT_ERROR key invalid\r\n"},
+	} {
+		conn, err := net.DialTimeout("tcp", c.addr, time.Second)
+		if err != nil {
+			t.Fatalf("net dial error:%v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(cmd))
+		bs := make([]byte, len(c.want))
+		if _, err = io.ReadFull(conn, bs); err != nil || string(bs) != c.want {
+			t.Errorf("addr(%s) reply(%q) error(%v) want(%q)", c.addr, bs, err, c.want)
+		}
+		conn.Close()
+	}
+	if n := atomic.LoadInt32(&long); n != 0 {
+		t.Errorf("long keys(%d) sent to backend", n)
+	}
+}
+
+func TestHandlerMaxPipeline(t *testing.T) {
+	var (
+		received int32
+		block    = make(chan struct{})
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			atomic.AddInt32(&received, 1)
+			<-block
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21237"
+	cc.Servers = []string{addr + ":1"}
+	cc.MaxPipeline = 4
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	const n = 100
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		b.WriteString("get a_pipeline" + strconv.Itoa(i) + "\r\n")
+	}
+	conn.Write(b.Bytes())
+	time.Sleep(200 * time.Millisecond)
+	if r := atomic.LoadInt32(&received); r > int32(cc.MaxPipeline) {
+		t.Errorf("received(%d) want throttled by max pipeline(%d)", r, cc.MaxPipeline)
+	}
+	close(block)
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < n; i++ {
+		if bs, err := br.ReadString('\n'); err != nil || bs != "END\r\n" {
+			t.Fatalf("reply(%d) (%q) error(%v) want all replied after drained", i, bs, err)
+		}
+	}
+}
+
+func TestHandlerDupKeyPolicy(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		fetched = map[string]int{}
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var b bytes.Buffer
+			for _, key := range strings.Fields(bs)[1:] {
+				lock.Lock()
+				fetched[key]++
+				lock.Unlock()
+				b.WriteString("VALUE " + key + " 0 1\r\n" + key[:1] + "\r\n")
+			}
+			b.WriteString("END\r\n")
+			conn.Write(b.Bytes())
+		}
+	})
+	defer closer()
+	once, each := *ccs[0], *ccs[0]
+	once.Name, once.ListenAddr = "dup-key-once", "127.0.0.1:21238"
+	each.Name, each.ListenAddr, each.DupKeyPolicy = "dup-key-each", "127.0.0.1:21239", "each"
+	once.Servers, each.Servers = []string{addr + ":1"}, []string{addr + ":1"}
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&once, &each})
+	time.Sleep(100 * time.Millisecond)
+
+	for _, c := range []struct {
+		addr string
+		want string
+	}{
+		{once.ListenAddr, "VALUE a_dup 0 1\r\na\r\nVALUE b_dup 0 1\r\nb\r\nEND\r\n"},
+		{each.ListenAddr, "VALUE a_dup 0 1\r\na\r\nVALUE b_dup 0 1\r\nb\r\nVALUE a_dup 0 1\r\na\r\nVALUE a_dup 0 1\r\na\r\nEND\r\n"},
+	} {
+		lock.Lock()
+		fetched = map[string]int{}
+		lock.Unlock()
+		conn, err := net.DialTimeout("tcp", c.addr, time.Second)
+		if err != nil {
+			t.Fatalf("net dial error:%v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("get a_dup b_dup a_dup a_dup\r\n"))
+		bs := make([]byte, len(c.want))
+		if _, err = io.ReadFull(conn, bs); err != nil || string(bs) != c.want {
+			t.Errorf("addr(%s) reply(%q) error(%v) want(%q)", c.addr, bs, err, c.want)
+		}
+		conn.Close()
+		lock.Lock()
+		if fetched["a_dup"] != 1 || fetched["b_dup"] != 1 {
+			t.Errorf("addr(%s) fetched(%v) want once per key", c.addr, fetched)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestHandlerMicroCache(t *testing.T) {
+	s, addr, closer := mockTierStore(t)
+	defer closer()
+	s.items["a_mc"] = "0 mc"
+	cc := *ccs[0]
+	cc.Name = "micro-cache-cluster"
+	cc.ListenAddr = "127.0.0.1:21242"
+	cc.Servers = []string{addr + ":1"}
+	cc.MicroCacheTTL = 200
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.DialTimeout("tcp", cc.ListenAddr, time.Second)
+	if err != nil {
+		t.Fatalf("net dial error:%v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	gets := func(want int) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.gets != want {
+			t.Fatalf("backend gets(%d) want(%d)", s.gets, want)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if reply := tierCmd(t, br, conn, "get a_mc\r\n"); reply != "VALUE a_mc 0 2\r\nmc\r\nEND\r\n" {
+			t.Fatalf("get %d reply(%q)", i, reply)
+		}
+	}
+	gets(1)
+	if reply := tierCmd(t, br, conn, "set a_mc 0 0 3\r\nmc2\r\n"); reply != "STORED\r\n" {
+		t.Fatalf("set reply(%q) want STORED", reply)
+	}
+	if reply := tierCmd(t, br, conn, "get a_mc\r\n"); reply != "VALUE a_mc 0 3\r\nmc2\r\nEND\r\n" {
+		t.Fatalf("get reply(%q) want the value written, invalidated by set", reply)
+	}
+	tierCmd(t, br, conn, "get a_mc\r\n")
+	gets(2)
+	time.Sleep(250 * time.Millisecond)
+	tierCmd(t, br, conn, "get a_mc\r\n")
+	gets(3)
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/proto"
+	"github.com/felixhao/overlord/proto/memcache"
+)
+
+// microCache caches the replies of get by the exact command for a sub-second TTL, the identical
+// reads near-simultaneous are replied once fetched, like: the bursty duplicate reads of a hot page.
+// The writes invalidate the replies of their keys when dispatched and again when replied.
+// NOTE: not a local cache of items, the replies are never revalidated and only live for the TTL.
+type microCache struct {
+	cluster string
+	ttl     time.Duration
+
+	lock        sync.Mutex
+	entries     map[string]*microEntry         // NOTE: by the command
+	keys        map[string]map[string]struct{} // NOTE: the commands of key
+	invalidated time.Time                      // NOTE: the last write, the reads started before it are not cached
+	swept       time.Time
+}
+
+type microEntry struct {
+	data   []byte
+	keys   []string
+	expire time.Time
+}
+
+func newMicroCache(cluster string, ttl time.Duration) *microCache {
+	return &microCache{
+		cluster: cluster,
+		ttl:     ttl,
+		entries: map[string]*microEntry{},
+		keys:    map[string]map[string]struct{}{},
+		swept:   time.Now(),
+	}
+}
+
+// get returns the cached response of get request, ok is false when missed.
+func (m *microCache) get(req *proto.Request) (resp *proto.Response, ok bool) {
+	cmd, _, ok := memcache.GetCommand(req)
+	if !ok {
+		return
+	}
+	m.lock.Lock()
+	e, ok := m.entries[cmd]
+	if ok && !time.Now().Before(e.expire) {
+		m.remove(cmd, e)
+		ok = false
+	}
+	m.lock.Unlock()
+	if !ok {
+		return
+	}
+	stat.MicroCacheHit(m.cluster)
+	return memcache.CachedResponse(req, e.data), true
+}
+
+// invalidate removes the replies of the key of write request.
+func (m *microCache) invalidate(req *proto.Request) {
+	if !isWrite(req) {
+		return
+	}
+	key := string(req.Key())
+	m.lock.Lock()
+	m.invalidated = time.Now()
+	for cmd := range m.keys[key] {
+		m.remove(cmd, m.entries[cmd])
+	}
+	m.lock.Unlock()
+}
+
+// put caches the reply of get request started at start, or invalidates the key of replied write request.
+func (m *microCache) put(req *proto.Request, start time.Time) {
+	if isWrite(req) {
+		m.invalidate(req)
+		return
+	}
+	if req.Resp == nil || req.Resp.Cached() {
+		return
+	}
+	cmd, keys, ok := memcache.GetCommand(req)
+	if !ok {
+		return
+	}
+	data, ok := memcache.ReplyBytes(req.Resp)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !start.After(m.invalidated) {
+		return // NOTE: the reply may be older than a write
+	}
+	if now.Sub(m.swept) >= m.ttl {
+		m.sweep(now)
+	}
+	if e, ok := m.entries[cmd]; ok {
+		m.remove(cmd, e)
+	}
+	m.entries[cmd] = &microEntry{data: data, keys: keys, expire: now.Add(m.ttl)}
+	for _, key := range keys {
+		cmds, ok := m.keys[key]
+		if !ok {
+			cmds = map[string]struct{}{}
+			m.keys[key] = cmds
+		}
+		cmds[cmd] = struct{}{}
+	}
+}
+
+// sweep removes the expired replies, at most once per TTL.
+func (m *microCache) sweep(now time.Time) {
+	m.swept = now
+	for cmd, e := range m.entries {
+		if !now.Before(e.expire) {
+			m.remove(cmd, e)
+		}
+	}
+}
+
+func (m *microCache) remove(cmd string, e *microEntry) {
+	delete(m.entries, cmd)
+	for _, key := range e.keys {
+		if cmds, ok := m.keys[key]; ok {
+			delete(cmds, cmd)
+			if len(cmds) == 0 {
+				delete(m.keys, key)
+			}
+		}
+	}
+}
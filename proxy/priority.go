@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/felixhao/overlord/proto"
+)
+
+// priorityCmd is the proxy-local handshake command, like: 'overlord_priority high',
+// the requests after its reply are tagged with the priority.
+const priorityCmd = "overlord_priority"
+
+// priorityLimit returns the max in-flight requests admitted of priority,
+// the low priority ones are shed first when more than 3/4 of max.
+func priorityLimit(max int32, p proto.Priority) int32 {
+	if p == proto.PriorityLow {
+		return max - max/4
+	}
+	return max
+}
+
+// queue is the bounded priority queue of one node worker, the higher priority is popped first.
+type queue struct {
+	chs [3]chan *proto.Request // NOTE: high, normal, low
+}
+
+func newQueue(n int) *queue {
+	q := &queue{}
+	for i := range q.chs {
+		q.chs[i] = make(chan *proto.Request, n)
+	}
+	return q
+}
+
+func (q *queue) push(req *proto.Request) {
+	q.chs[proto.PriorityHigh-req.Priority()] <- req
+}
+
+// pop pops the request of highest priority, blocks until done or timeout.
+// NOTE: the nil timeout never fires.
+func (q *queue) pop(done <-chan struct{}, timeout <-chan time.Time) (req *proto.Request, ok bool) {
+	for _, ch := range q.chs {
+		select {
+		case req = <-ch:
+			return req, true
+		default:
+		}
+	}
+	select {
+	case req = <-q.chs[0]:
+	case req = <-q.chs[1]:
+	case req = <-q.chs[2]:
+	case <-done:
+		return nil, false
+	case <-timeout:
+		return nil, false
+	}
+	return req, true
+}
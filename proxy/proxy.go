@@ -7,6 +7,8 @@ import (
 	"sync/atomic"
 
 	"github.com/felixhao/overlord/lib/log"
+	"github.com/felixhao/overlord/lib/pool"
+	"github.com/felixhao/overlord/lib/stat"
 	"github.com/felixhao/overlord/proto"
 	"github.com/felixhao/overlord/proto/memcache"
 	"github.com/pkg/errors"
@@ -15,6 +17,10 @@ import (
 // proxy errors
 var (
 	ErrProxyMoreMaxConns = errs.New("Proxy accept more than max connextions")
+	ErrProxyOverloaded   = errs.New("overloaded")
+	ErrProxyTooManyKeys  = errs.New("CLIENT_ERROR too many keys")
+	ErrProxyConnsLimit   = errs.New("Proxy clusters max backend conns sum more than max")
+	ErrProxyReadOnly     = errs.New("read-only")
 )
 
 // Proxy is proxy.
@@ -28,7 +34,12 @@ type Proxy struct {
 	clusters map[string]*Cluster
 	once     sync.Once
 
-	conns int32
+	conns   int32
+	limiter *pool.Limiter  // NOTE: backend conns of all clusters
+	gate    *pool.Gate     // NOTE: backend dials of all clusters
+	budget  *pool.Budget   // NOTE: response buffers of all clusters
+	buffers *pool.Buffers  // NOTE: connection buffers of all clusters
+	stats   *stat.Registry // NOTE: stat of all clusters, nil means the package globals
 
 	lock   sync.Mutex
 	closed bool
@@ -42,13 +53,41 @@ func New(c *Config) (p *Proxy, err error) {
 	}
 	p = &Proxy{}
 	p.c = c
+	p.limiter = pool.NewLimiter(c.Proxy.MaxBackendConns, nil, nil)
+	if c.Proxy.DialConcurrency > 0 {
+		p.gate = pool.NewGate(c.Proxy.DialConcurrency, nil)
+	}
+	if c.Proxy.MaxResponseBytes > 0 {
+		p.budget = pool.NewBudget(c.Proxy.MaxResponseBytes, stat.ResponseBytes)
+	}
+	if c.Proxy.FreeBuffers > 0 {
+		p.buffers = pool.NewBuffers(c.Proxy.FreeBuffers)
+	}
+	if c.Proxy.AuditSample > 0 || c.Proxy.AuditErrors {
+		setAuditLog(c.Proxy.AuditSample, c.Proxy.AuditErrors)
+	}
 	p.ctx, p.cancel = context.WithCancel(context.Background())
 	return
 }
 
+// SetRegistry sets the stat registry the clusters count into rather than the package globals,
+// like: the proxies embedded in one process never share the counters. It must be called before Serve.
+func (p *Proxy) SetRegistry(r *stat.Registry) {
+	p.stats = r
+}
+
 // Serve is the main accept() loop of a server.
 func (p *Proxy) Serve(ccs []*ClusterConfig) {
 	p.once.Do(func() {
+		if p.c.Proxy.MaxBackendConns > 0 {
+			sum := 0
+			for _, cc := range ccs {
+				sum += cc.MaxBackendConns
+			}
+			if sum > p.c.Proxy.MaxBackendConns {
+				panic(errors.Wrapf(ErrProxyConnsLimit, "Proxy Serve sum(%d) max(%d)", sum, p.c.Proxy.MaxBackendConns))
+			}
+		}
 		p.ccs = ccs
 		p.clusters = map[string]*Cluster{}
 		for _, cc := range ccs {
@@ -58,7 +97,7 @@ func (p *Proxy) Serve(ccs []*ClusterConfig) {
 }
 
 func (p *Proxy) serve(cc *ClusterConfig) {
-	cluster := NewCluster(p.ctx, cc)
+	cluster := newCluster(p.ctx, cc, p.limiter, p.gate, p.budget, p.buffers, p.stats)
 	p.lock.Lock()
 	p.clusters[cc.Name] = cluster
 	p.lock.Unlock()
@@ -7,6 +7,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/felixhao/overlord/lib/log"
+	"github.com/felixhao/overlord/lib/stat"
 	"github.com/felixhao/overlord/proto"
 	"github.com/felixhao/overlord/proxy"
 )
@@ -66,6 +68,8 @@ var (
 )
 
 func init() {
+	log.Init(testLog)
+	stat.Init() // NOTE: before any proxy served, the stat globals are not guarded
 	mockProxy()
 	time.Sleep(200 * time.Millisecond)
 }
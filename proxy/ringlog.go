@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixhao/overlord/lib/ketama"
+	"github.com/felixhao/overlord/lib/log"
+)
+
+// ringLogger logs the hash ring layout when it changes, at most once per interval.
+// The changes within interval are logged together by the latest layout.
+type ringLogger struct {
+	cluster  string
+	ring     *ketama.HashRing
+	interval time.Duration
+
+	lock   sync.Mutex
+	last   map[string]int
+	logged time.Time
+	timer  *time.Timer
+	events []string
+}
+
+func newRingLogger(cluster string, ring *ketama.HashRing, interval time.Duration) *ringLogger {
+	return &ringLogger{cluster: cluster, ring: ring, interval: interval}
+}
+
+// changed notifies the ring changed by event, like: init|eject|readd|weight.
+// NOTE: nil logger is a no-op.
+func (l *ringLogger) changed(event string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, event)
+	if l.timer != nil {
+		return // NOTE: the pending log will take the latest layout
+	}
+	wait := l.interval - time.Since(l.logged)
+	if wait <= 0 {
+		l.flush()
+		return
+	}
+	l.timer = time.AfterFunc(wait, func() {
+		l.lock.Lock()
+		l.timer = nil
+		l.flush()
+		l.lock.Unlock()
+	})
+}
+
+// flush logs the layout if not same as the last logged one, must be called with lock held.
+func (l *ringLogger) flush() {
+	events := strings.Join(l.events, ",")
+	l.events = nil
+	points, total := l.ring.Layout()
+	if sameLayout(points, l.last) {
+		return
+	}
+	nodes := make([]string, 0, len(points))
+	for node, n := range points {
+		nodes = append(nodes, node+"="+strconv.Itoa(n))
+	}
+	sort.Strings(nodes)
+	log.Infof("cluster(%s) hash ring changed event(%s) nodes(%d) points(%d) layout(%s)", l.cluster, events, len(points), total, strings.Join(nodes, " "))
+	l.last = points
+	l.logged = time.Now()
+}
+
+func (l *ringLogger) stop() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.lock.Unlock()
+}
+
+func sameLayout(a, b map[string]int) bool {
+	if a == nil || b == nil || len(a) != len(b) {
+		return a == nil && b == nil
+	}
+	for node, n := range a {
+		if bn, ok := b[node]; !ok || bn != n {
+			return false
+		}
+	}
+	return true
+}
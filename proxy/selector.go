@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/felixhao/overlord/lib/ketama"
+	"github.com/felixhao/overlord/proto"
+	"github.com/pkg/errors"
+)
+
+const selectorKetama = "ketama"
+
+// Selector selects the node of cluster which serves the request. The nodes of cluster are set by Update
+// when the cluster new, and changed by AddNode|RemoveNode, like: the weight changed or node ejected.
+// NOTE: the methods are called concurrently.
+type Selector interface {
+	Select(req *proto.Request) (Node, error)
+	AddNode(n Node)
+	RemoveNode(name string)
+	Update(ns []Node)
+}
+
+var (
+	selectorLock sync.Mutex
+	selectors    = map[string]func(c *Cluster) Selector{
+		selectorKetama: func(c *Cluster) Selector { return newKetamaSelector(c.hashKey) },
+	}
+)
+
+// RegisterSelector registers the selector by name, which is configured as the hash_distribution of cluster.
+// The new func is called once by the cluster new, it can consult the cluster, like: Outstanding of node.
+// NOTE: must be called before proxy Serve.
+func RegisterSelector(name string, new func(c *Cluster) Selector) {
+	selectorLock.Lock()
+	selectors[name] = new
+	selectorLock.Unlock()
+}
+
+// newSelector new the selector of cluster by name, empty means ketama.
+func newSelector(c *Cluster, name string) (Selector, error) {
+	if name == "" {
+		name = selectorKetama
+	}
+	selectorLock.Lock()
+	new, ok := selectors[name]
+	selectorLock.Unlock()
+	if !ok {
+		return nil, errors.Wrapf(ErrClusterSelector, "Cluster new selector(%s)", name)
+	}
+	return new(c), nil
+}
+
+// ketamaSelector selects node by the consistent hashing of key, the node of weight 0 is not selected.
+type ketamaSelector struct {
+	ring    *ketama.HashRing
+	hashKey func(key []byte) ([]byte, bool)
+
+	lock  sync.RWMutex
+	nodes map[string]Node
+}
+
+func newKetamaSelector(hashKey func(key []byte) ([]byte, bool)) *ketamaSelector {
+	return &ketamaSelector{ring: ketama.NewRing(hashRingSpots), hashKey: hashKey, nodes: map[string]Node{}}
+}
+
+func (s *ketamaSelector) Select(req *proto.Request) (Node, error) {
+	realKey, _ := s.hashKey(req.Key())
+	name, ok := s.ring.Hash(realKey)
+	if !ok {
+		return Node{}, ErrClusterHashNoNode
+	}
+	s.lock.RLock()
+	n := s.nodes[name]
+	s.lock.RUnlock()
+	return n, nil
+}
+
+func (s *ketamaSelector) AddNode(n Node) {
+	s.lock.Lock()
+	s.nodes[n.Name] = n
+	s.lock.Unlock()
+	s.ring.AddNode(n.Name, n.Weight)
+}
+
+func (s *ketamaSelector) RemoveNode(name string) {
+	s.ring.DelNode(name) // NOTE: the node kept, the in-flight selections still resolve it
+}
+
+func (s *ketamaSelector) Update(ns []Node) {
+	names, ws := make([]string, len(ns)), make([]int, len(ns))
+	s.lock.Lock()
+	for i, n := range ns {
+		s.nodes[n.Name] = n
+		names[i], ws[i] = n.Name, n.Weight
+	}
+	s.lock.Unlock()
+	s.ring.Init(names, ws)
+}
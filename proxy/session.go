@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/felixhao/overlord/proto"
+	"github.com/pkg/errors"
+)
+
+// session pins one backend connection per node for the client connection lifetime,
+// the requests of sticky cluster are handled by it in order.
+type session struct {
+	c *Cluster
+
+	lock   sync.Mutex
+	conns  map[string]proto.Handler
+	closed bool
+}
+
+func newSession(c *Cluster) *session {
+	return &session{c: c, conns: map[string]proto.Handler{}}
+}
+
+// Dispatch handles request by the pinned connection of node, the broken one is unpinned.
+// NOTE: the request is admitted by the adaptive limit and expired by request_timeout as the cluster does.
+func (s *session) Dispatch(req *proto.Request) {
+	n, err := s.c.selector.Select(req)
+	if err != nil {
+		s.c.doneWithError("", req, errors.Wrap(err, "Session Dispatch dispatch request select"))
+		return
+	}
+	node := n.Name
+	rc, ok := s.c.nodeCh[node]
+	if !ok {
+		s.c.doneWithError(node, req, errors.Wrap(ErrClusterHashNoNode, "Session Dispatch dispatch request node chan"))
+		return
+	}
+	if s.c.shedHot(node, req) {
+		return
+	}
+	s.c.deadline(node, req)
+	defer req.StopDeadline()
+	reqs := s.c.admit(node, rc, []*proto.Request{req})
+	if len(reqs) == 0 {
+		return
+	}
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hdl, ok := s.conns[node]
+	if !ok {
+		if hdl, err = s.c.get(node); err != nil {
+			s.c.doneWithError(node, req, errors.Wrap(err, "Session Dispatch get handler"))
+			s.c.release(rc, reqs, start, err)
+			return
+		}
+	}
+	var cas *proto.Request
+	if len(unexpired(reqs)) == 0 { // NOTE: expired while waiting for connection
+		s.c.release(rc, reqs, start, ErrClusterTimeout)
+	} else {
+		err = s.c.handle(node, rc, hdl, req)
+		if p, ok := err.(*poisoned); ok {
+			hdl, err = s.c.reconnect(node, rc, hdl, p)
+		}
+		cas, err = handled(err)
+		s.c.release(rc, reqs, start, err)
+	}
+	if err != nil || s.closed {
+		delete(s.conns, node)
+		s.c.put(node, hdl, err)
+		if cas != nil {
+			s.c.casRecheck(node, cas, err)
+		}
+		return
+	}
+	s.conns[node] = hdl
+}
+
+// Close unpins and puts back all connections.
+func (s *session) Close() {
+	s.lock.Lock()
+	s.closed = true
+	for node, hdl := range s.conns {
+		s.c.put(node, hdl, nil)
+	}
+	s.conns = nil
+	s.lock.Unlock()
+}
@@ -0,0 +1,141 @@
+package proxy_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+)
+
+func TestSessionSticky(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		id    int
+		conns = map[string]int{} // NOTE: key => backend conn id
+	)
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		lock.Lock()
+		id++
+		cid := id
+		lock.Unlock()
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns[bs[4:len(bs)-2]] = cid
+			lock.Unlock()
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21218"
+	cc.Servers = []string{addr + ":1"}
+	cc.Sticky = true
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	var clients [2]net.Conn
+	var readers [2]*bufio.Reader
+	for i := range clients {
+		if clients[i], err = net.DialTimeout("tcp", cc.ListenAddr, time.Second); err != nil {
+			t.Fatalf("net dial error:%v", err)
+		}
+		defer clients[i].Close()
+		readers[i] = bufio.NewReader(clients[i])
+	}
+	for _, k := range []string{"a1", "b1", "a2", "b2", "a3"} {
+		i := int(k[0] - 'a')
+		clients[i].Write([]byte("get " + k + "\r\n"))
+		clients[i].SetReadDeadline(time.Now().Add(time.Second))
+		if bs, err := readers[i].ReadString('\n'); err != nil || bs != "END\r\n" {
+			t.Fatalf("get %s reply(%q) error(%v)", k, bs, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if conns["a1"] != conns["a2"] || conns["a1"] != conns["a3"] || conns["b1"] != conns["b2"] {
+		t.Errorf("session commands not sticky:%v", conns)
+	}
+	if conns["a1"] == conns["b1"] {
+		t.Errorf("sessions share one connection:%v", conns)
+	}
+}
+
+func TestSessionRequestTimeout(t *testing.T) {
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			bs, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(bs, "get a_slow") {
+				time.Sleep(300 * time.Millisecond)
+			}
+			conn.Write([]byte("END\r\n"))
+		}
+	})
+	defer closer()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21244"
+	cc.Servers = []string{addr + ":1"}
+	cc.Sticky = true
+	cc.PoolActive = 1 // NOTE: the adaptive limit starts with it
+	cc.AdaptiveLatency = 1000
+	cc.RequestTimeout = 100
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+
+	var clients [2]net.Conn
+	var readers [2]*bufio.Reader
+	for i := range clients {
+		if clients[i], err = net.DialTimeout("tcp", cc.ListenAddr, time.Second); err != nil {
+			t.Fatalf("net dial error:%v", err)
+		}
+		defer clients[i].Close()
+		readers[i] = bufio.NewReader(clients[i])
+	}
+	read := func(i int) string {
+		clients[i].SetReadDeadline(time.Now().Add(time.Second))
+		bs, err := readers[i].ReadString('\n')
+		if err != nil {
+			t.Fatalf("client %d read error:%v", i, err)
+		}
+		return bs
+	}
+	start := time.Now()
+	clients[0].Write([]byte("get a_slow\r\n"))
+	time.Sleep(20 * time.Millisecond)
+	clients[1].Write([]byte("get b_limited\r\n")) // NOTE: over the limit taken by the slow one
+	if bs := read(1); !strings.Contains(bs, proxy.ErrClusterLimited.Error()) {
+		t.Errorf("reply(%q) want concurrency limited", bs)
+	}
+	bs := read(0)
+	if took := time.Since(start); !strings.Contains(bs, proxy.ErrClusterTimeout.Error()) || took > 250*time.Millisecond {
+		t.Errorf("reply(%q) after %v want timeout after about 100ms", bs, took)
+	}
+	time.Sleep(300 * time.Millisecond)
+	clients[1].Write([]byte("get b_after\r\n"))
+	if bs := read(1); bs != "END\r\n" {
+		t.Errorf("reply(%q) after timeout want END", bs)
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/felixhao/overlord/lib/log"
+	"github.com/felixhao/overlord/lib/stat"
+	"github.com/felixhao/overlord/proto"
+	"github.com/felixhao/overlord/proto/memcache"
+	"github.com/pkg/errors"
+)
+
+// tier write policies.
+const (
+	tierWriteAll     = "all"     // NOTE: the write fails when any tier fails
+	tierWritePrimary = "primary" // NOTE: the write fails only when tier 1 fails
+)
+
+const (
+	tierPrimary   = "1"
+	tierSecondary = "2"
+
+	defaultTierConcurrency = 1024
+)
+
+// tier dispatchs the requests of cluster as the tier 1 in front of the tier 2 servers.
+// The writes go to both tiers, and the get|gat missed in tier 1 cascade to tier 2,
+// the hit value populates tier 1 before replied. The others are served by tier 1 only,
+// like: gets|gats|cas, the cas unique is of one server.
+type tier struct {
+	ctx   context.Context
+	c     *Cluster
+	next  *Cluster
+	slots chan struct{} // NOTE: the requests in-progress, bounds the goroutines
+}
+
+// newTier new the tier of cluster, the tier 2 cluster is configured as the cluster but servers,
+// and its backend conns are also limited by the cluster limiter.
+func newTier(ctx context.Context, c *Cluster) *tier {
+	cc := *c.cc
+	cc.Servers = cc.TierServers
+	cc.TierServers = nil
+	cc.RecordFile = ""
+	cc.MicroCacheTTL = 0 // NOTE: cached in front of tiers
+	n := c.cc.TierConcurrency
+	if n <= 0 {
+		n = defaultTierConcurrency
+	}
+	return &tier{
+		ctx:   ctx,
+		c:     c,
+		next:  newCluster(ctx, &cc, c.limiter, nil, c.budget, c.buffers, c.stats),
+		slots: make(chan struct{}, n),
+	}
+}
+
+// Dispatch dispatchs request by tiers, the request is done asynchronously.
+// NOTE: it waits for a slot when the requests in-progress reach tier_concurrency.
+func (t *tier) Dispatch(req *proto.Request) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-t.ctx.Done():
+		req.DoneWithError(errors.Wrap(t.ctx.Err(), "Cluster tier dispatch"))
+		return
+	}
+	go func() {
+		defer func() { <-t.slots }()
+		if memcache.IsWrite(req) {
+			t.write(req)
+		} else {
+			t.read(req)
+		}
+	}()
+}
+
+// read reads tier 1 and cascades to tier 2 when missed.
+func (t *tier) read(req *proto.Request) {
+	resp := t.do(t.c, req)
+	if resp.Err() != nil {
+		stat.Tier(t.c.cc.Name, tierPrimary, "error")
+		req.Done(resp)
+		return
+	}
+	if cmd := req.Cmd(); cmd != "get" && cmd != "gat" {
+		req.Done(resp)
+		return
+	}
+	if resp.Status() != "MISS" {
+		stat.Tier(t.c.cc.Name, tierPrimary, "hit")
+		req.Done(resp)
+		return
+	}
+	stat.Tier(t.c.cc.Name, tierPrimary, "miss")
+	nresp := t.do(t.next, req)
+	if nresp.Err() != nil {
+		stat.Tier(t.c.cc.Name, tierSecondary, "error")
+		req.Done(resp) // NOTE: the miss of tier 1 rather than the error
+		return
+	}
+	if nresp.Status() == "MISS" {
+		stat.Tier(t.c.cc.Name, tierSecondary, "miss")
+		req.Done(nresp)
+		return
+	}
+	stat.Tier(t.c.cc.Name, tierSecondary, "hit")
+	if preq, ok := memcache.PopulateRequest(req, nresp, t.c.cc.TierPopulateTTL); ok {
+		if presp := t.do(t.c, preq); presp.Err() != nil {
+			stat.Tier(t.c.cc.Name, tierPrimary, "populate_error")
+			if log.V(2) {
+				log.Warnf("cluster(%s) addr(%s) request(%s) tier populate error:%v", t.c.cc.Name, t.c.cc.ListenAddr, req.Key(), presp.Err())
+			}
+		} else {
+			stat.Tier(t.c.cc.Name, tierPrimary, "populate")
+		}
+	}
+	req.Done(nresp)
+}
+
+// write writes both tiers concurrently, replies the response of tier 1 unless failed by the write policy.
+func (t *tier) write(req *proto.Request) {
+	r1, r2 := t.request(req), t.request(req)
+	t.c.Dispatch(r1)
+	t.next.Dispatch(r2)
+	r1.Wait()
+	r2.Wait()
+	resp := r1.Resp
+	if resp.Err() != nil {
+		stat.Tier(t.c.cc.Name, tierPrimary, "write_error")
+	} else {
+		stat.Tier(t.c.cc.Name, tierPrimary, "write")
+	}
+	if r2.Resp.Err() != nil {
+		stat.Tier(t.c.cc.Name, tierSecondary, "write_error")
+		if log.V(2) {
+			log.Warnf("cluster(%s) addr(%s) request(%s) tier 2 write error:%v", t.c.cc.Name, t.c.cc.ListenAddr, req.Key(), r2.Resp.Err())
+		}
+		if resp.Err() == nil && t.c.cc.TierWrite != tierWritePrimary {
+			resp = r2.Resp
+		}
+	} else {
+		stat.Tier(t.c.cc.Name, tierSecondary, "write")
+	}
+	req.Done(resp)
+}
+
+// do dispatchs the copy of request into cluster and waits for the response.
+func (t *tier) do(c *Cluster, req *proto.Request) *proto.Response {
+	r := t.request(req)
+	c.Dispatch(r)
+	r.Wait()
+	return r.Resp
+}
+
+// request returns the copy of request, which can be dispatched into one tier.
+func (t *tier) request(req *proto.Request) *proto.Request {
+	r := &proto.Request{Type: req.Type}
+	r.WithProto(req.Proto())
+	r.WithPriority(req.Priority())
+	r.Process()
+	return r
+}
+
+// Close closes the tier 2 cluster.
+func (t *tier) Close() error {
+	return t.next.Close()
+}
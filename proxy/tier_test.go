@@ -0,0 +1,236 @@
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixhao/overlord/proto/memcache/memcachetest"
+	"github.com/felixhao/overlord/proxy"
+)
+
+// tierStore is the mock memcache server of get|set, records the set commands and counts the gets.
+type tierStore struct {
+	lock  sync.Mutex
+	items map[string]string // NOTE: key => 'flags data'
+	sets  []string
+	gets  int
+}
+
+func mockTierStore(t *testing.T) (*tierStore, string, func()) {
+	s := &tierStore{items: map[string]string{}}
+	addr, closer := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fs := strings.Fields(line)
+			switch fs[0] {
+			case "get":
+				s.lock.Lock()
+				item, ok := s.items[fs[1]]
+				s.gets++
+				s.lock.Unlock()
+				if ok {
+					ps := strings.SplitN(item, " ", 2)
+					fmt.Fprintf(conn, "VALUE %s %s %d\r\n%s\r\n", fs[1], ps[0], len(ps[1]), ps[1])
+				}
+				conn.Write([]byte("END\r\n"))
+			case "set":
+				var n int
+				fmt.Sscan(fs[4], &n)
+				data := make([]byte, n+2)
+				if _, err = io.ReadFull(br, data); err != nil {
+					return
+				}
+				s.lock.Lock()
+				s.items[fs[1]] = fs[2] + " " + string(data[:n])
+				s.sets = append(s.sets, strings.TrimSpace(line))
+				s.lock.Unlock()
+				conn.Write([]byte("STORED\r\n"))
+			default:
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}
+	})
+	return s, addr, closer
+}
+
+func (s *tierStore) get(key string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	item, ok := s.items[key]
+	return item, ok
+}
+
+func serveTier(t *testing.T, listen, write string, tier1, tier2 string) (*proxy.Proxy, *bufio.Reader, net.Conn) {
+	cc := *ccs[0]
+	cc.ListenAddr = listen
+	cc.Servers = []string{tier1 + ":1"}
+	cc.TierServers = []string{tier2 + ":1"}
+	cc.TierWrite = write
+	cc.TierPopulateTTL = 60
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.DialTimeout("tcp", listen, time.Second)
+	if err != nil {
+		p.Close()
+		t.Fatalf("net dial error:%v", err)
+	}
+	return p, bufio.NewReader(conn), conn
+}
+
+func tierCmd(t *testing.T, br *bufio.Reader, conn net.Conn, cmd string) string {
+	conn.Write([]byte(cmd))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var reply string
+	for {
+		bs, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("cmd(%q) read error:%v", cmd, err)
+		}
+		reply += bs
+		if !strings.HasPrefix(cmd, "get") || bs == "END\r\n" {
+			return reply
+		}
+	}
+}
+
+func TestTierReadThrough(t *testing.T) {
+	s1, addr1, closer1 := mockTierStore(t)
+	defer closer1()
+	s2, addr2, closer2 := mockTierStore(t)
+	defer closer2()
+	s2.items["a_tier"] = "3 tier2"
+	p, br, conn := serveTier(t, "127.0.0.1:21226", "", addr1, addr2)
+	defer p.Close()
+	defer conn.Close()
+
+	if reply := tierCmd(t, br, conn, "get a_tier\r\n"); reply != "VALUE a_tier 3 5\r\ntier2\r\nEND\r\n" {
+		t.Fatalf("get reply(%q) want the value of tier 2", reply)
+	}
+	if item, ok := s1.get("a_tier"); !ok || item != "3 tier2" {
+		t.Fatalf("tier 1 item(%q) ok(%v) not populated", item, ok)
+	}
+	s1.lock.Lock()
+	set := s1.sets[0]
+	s1.lock.Unlock()
+	if set != "set a_tier 3 60 5" {
+		t.Errorf("populate set(%q) want exptime 60", set)
+	}
+	s2.lock.Lock()
+	s2.items["a_tier"] = "3 stale"
+	s2.lock.Unlock()
+	if reply := tierCmd(t, br, conn, "get a_tier\r\n"); reply != "VALUE a_tier 3 5\r\ntier2\r\nEND\r\n" {
+		t.Errorf("get reply(%q) want the value of tier 1", reply)
+	}
+	if reply := tierCmd(t, br, conn, "get a_none\r\n"); reply != "END\r\n" {
+		t.Errorf("get reply(%q) want miss of both tiers", reply)
+	}
+}
+
+func TestTierWriteThrough(t *testing.T) {
+	s1, addr1, closer1 := mockTierStore(t)
+	defer closer1()
+	s2, addr2, closer2 := mockTierStore(t)
+	p, br, conn := serveTier(t, "127.0.0.1:21227", "", addr1, addr2)
+	defer p.Close()
+	defer conn.Close()
+
+	if reply := tierCmd(t, br, conn, "set a_tier 0 0 4\r\nboth\r\n"); reply != "STORED\r\n" {
+		t.Fatalf("set reply(%q) want STORED", reply)
+	}
+	for _, s := range []*tierStore{s1, s2} {
+		if item, ok := s.get("a_tier"); !ok || item != "0 both" {
+			t.Errorf("tier item(%q) ok(%v) not written", item, ok)
+		}
+	}
+	closer2() // NOTE: tier 2 down, the write fails by policy all
+	ap, abr, aconn := serveTier(t, "127.0.0.1:21228", "all", addr1, addr2)
+	defer ap.Close()
+	defer aconn.Close()
+	if reply := tierCmd(t, abr, aconn, "set a_all 0 0 1\r\n1\r\n"); !strings.HasPrefix(reply, "SERVER_ERROR") {
+		t.Errorf("set reply(%q) want error by policy all", reply)
+	}
+	if _, ok := s1.get("a_all"); !ok {
+		t.Errorf("tier 1 not written by policy all")
+	}
+	pp, pbr, pconn := serveTier(t, "127.0.0.1:21229", "primary", addr1, addr2)
+	defer pp.Close()
+	defer pconn.Close()
+	if reply := tierCmd(t, pbr, pconn, "set a_primary 0 0 1\r\n1\r\n"); reply != "STORED\r\n" {
+		t.Errorf("set reply(%q) want STORED by policy primary", reply)
+	}
+}
+
+func TestTierConcurrency(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		inflight, max int
+	)
+	addr1, closer1 := memcachetest.Backend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			lock.Lock()
+			if inflight++; inflight > max {
+				max = inflight
+			}
+			lock.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			lock.Lock()
+			inflight--
+			lock.Unlock()
+			conn.Write([]byte("VALUE a_tier 0 1\r\n1\r\nEND\r\n"))
+		}
+	})
+	defer closer1()
+	_, addr2, closer2 := mockTierStore(t)
+	defer closer2()
+	cc := *ccs[0]
+	cc.ListenAddr = "127.0.0.1:21243"
+	cc.Servers = []string{addr1 + ":1"}
+	cc.TierServers = []string{addr2 + ":1"}
+	cc.TierConcurrency = 1
+	p, err := proxy.New(proxy.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Serve([]*proxy.ClusterConfig{&cc})
+	time.Sleep(100 * time.Millisecond)
+	conns := make([]net.Conn, 4)
+	for i := range conns {
+		if conns[i], err = net.DialTimeout("tcp", cc.ListenAddr, time.Second); err != nil {
+			t.Fatalf("net dial error:%v", err)
+		}
+		defer conns[i].Close()
+	}
+	for _, conn := range conns {
+		conn.Write([]byte("get a_tier\r\n"))
+	}
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if bs, err := bufio.NewReader(conn).ReadString('\n'); err != nil || bs != "VALUE a_tier 0 1\r\n" {
+			t.Errorf("get reply(%q) error(%v) want the value of tier 1", bs, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if max != 1 {
+		t.Errorf("tier 1 concurrent gets(%d) want bounded by tier_concurrency 1", max)
+	}
+}